@@ -0,0 +1,771 @@
+package buntdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tidwall/btree"
+)
+
+// The binary append-only file starts with a magic header which includes the
+// format version. It's followed by a series of records. Each record is a
+// 4 byte little-endian payload length, a 4 byte CRC-32C checksum of the
+// payload, and the payload. The first byte of the payload is the record type.
+//
+// Files that do not start with the magic header use the legacy text format,
+// which is a series of RESP commands.
+const aofMagic = "buntdb\x00\x01"
+
+// recordHeaderSize is the size of the length and checksum of a record.
+const recordHeaderSize = 8
+
+// maxRecordSize is a sanity limit for the payload of a single record.
+const maxRecordSize = 1 << 31
+
+// Binary record types
+const (
+	recSet     = 's' // set: flags, key, value, [expires]
+	recDel     = 'd' // del: key
+	recFlush   = 'f' // flushdb
+	recMark    = 'o' // log offset mark: offset
+	recExpire  = 'e' // expire: key, expires
+	recPersist = 'p' // persist: key
+	recSpace   = 'k' // keyspace: name, record payload
+	recIndex   = 'i' // index: flags, name, pattern, count, funcs...
+	recDrop    = 'x' // drop index: name
+)
+
+// Binary set record flags
+const (
+	setFlagExpires    = 1 << iota // the record has an expiration
+	setFlagCompressed             // the value is compressed with DEFLATE
+)
+
+// Binary index record flags
+const (
+	indexFlagSpatial         = 1 << iota // the index is an r-tree
+	indexFlagUnique                      // the Unique option
+	indexFlagCaseInsensitive             // the CaseInsensitiveKeyMatching option
+)
+
+// Binary flush record flags
+const (
+	flushFlagAll = 1 << iota // the keyspaces are also flushed
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// beginRecord starts a new binary record of the specified type. The mark is
+// the start of the record and must be passed to endRecord.
+func beginRecord(buf []byte, typ byte) (nbuf []byte, mark int) {
+	mark = len(buf)
+	buf = append(buf, 0, 0, 0, 0, 0, 0, 0, 0, typ)
+	return buf, mark
+}
+
+// endRecord completes the record that was started with beginRecord by
+// filling in the length and checksum.
+func endRecord(buf []byte, mark int) []byte {
+	payload := buf[mark+recordHeaderSize:]
+	binary.LittleEndian.PutUint32(buf[mark:], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(buf[mark+4:],
+		crc32.Checksum(payload, crcTable))
+	return buf
+}
+
+func appendUvarint(buf []byte, x uint64) []byte {
+	var b [binary.MaxVarintLen64]byte
+	return append(buf, b[:binary.PutUvarint(b[:], x)]...)
+}
+
+func appendVarint(buf []byte, x int64) []byte {
+	var b [binary.MaxVarintLen64]byte
+	return append(buf, b[:binary.PutVarint(b[:], x)]...)
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = appendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+// writeSetRecordTo writes an item as a single binary set record. The value is
+// compressed when compress is true, or when it's compressed in memory.
+func (dbi *dbItem) writeSetRecordTo(buf []byte, compress bool) []byte {
+	var flags uint64
+	if dbi.opts != nil && dbi.opts.ex {
+		flags |= setFlagExpires
+	}
+	val, zval := dbi.val, dbi.zval
+	if compress && !zval {
+		val, zval = compressValue(val)
+	}
+	if zval {
+		flags |= setFlagCompressed
+	}
+	buf, mark := beginRecord(buf, recSet)
+	buf = appendUvarint(buf, flags)
+	buf = appendString(buf, dbi.key)
+	buf = appendString(buf, val)
+	if flags&setFlagExpires != 0 {
+		buf = appendVarint(buf, dbi.opts.exat.UnixNano())
+	}
+	return endRecord(buf, mark)
+}
+
+// writeDeleteRecordTo writes an item as a single binary del record.
+func (dbi *dbItem) writeDeleteRecordTo(buf []byte) []byte {
+	buf, mark := beginRecord(buf, recDel)
+	buf = appendString(buf, dbi.key)
+	return endRecord(buf, mark)
+}
+
+// writeExpireRecordTo writes the expiration of an item as a single binary
+// expire record, or as a persist record when the item does not expire.
+func (dbi *dbItem) writeExpireRecordTo(buf []byte) []byte {
+	if dbi.opts == nil || !dbi.opts.ex {
+		buf, mark := beginRecord(buf, recPersist)
+		buf = appendString(buf, dbi.key)
+		return endRecord(buf, mark)
+	}
+	buf, mark := beginRecord(buf, recExpire)
+	buf = appendString(buf, dbi.key)
+	buf = appendVarint(buf, dbi.opts.exat.UnixNano())
+	return endRecord(buf, mark)
+}
+
+// writeSetTo writes an item as a single set command using the format of the
+// database file.
+func (db *DB) writeSetTo(buf []byte, dbi *dbItem) []byte {
+	if db.textaof {
+		return dbi.writeSetTo(buf)
+	}
+	return dbi.writeSetRecordTo(buf, db.opts.Compression)
+}
+
+// writeDeleteTo writes an item as a single del command using the format of the
+// database file.
+func (db *DB) writeDeleteTo(buf []byte, dbi *dbItem) []byte {
+	if db.textaof {
+		return dbi.writeDeleteTo(buf)
+	}
+	return dbi.writeDeleteRecordTo(buf)
+}
+
+// writeExpireTo writes the expiration of an item using the format of the
+// database file. The legacy text format has no expire command, so the item is
+// written as a set command.
+func (db *DB) writeExpireTo(buf []byte, dbi *dbItem) []byte {
+	if db.textaof {
+		return dbi.writeSetTo(buf)
+	}
+	return dbi.writeExpireRecordTo(buf)
+}
+
+// writeFlushTo writes a flushdb command using the format of the database file.
+func (db *DB) writeFlushTo(buf []byte) []byte {
+	if db.textaof {
+		return append(buf, "*1\r\n$7\r\nflushdb\r\n"...)
+	}
+	return writeFlushRecordTo(buf, false)
+}
+
+// writeFlushRecordTo writes a binary flush record. The keyspaces are flushed
+// too when all is true.
+func writeFlushRecordTo(buf []byte, all bool) []byte {
+	buf, mark := beginRecord(buf, recFlush)
+	if all {
+		buf = appendUvarint(buf, flushFlagAll)
+	}
+	return endRecord(buf, mark)
+}
+
+// wrapKeyspace wraps the binary record that starts at mark in a keyspace
+// record, which applies the record to the keyspace. The default keyspace has
+// no wrapper.
+func wrapKeyspace(buf []byte, mark int, space string) []byte {
+	if space == "" || len(buf) == mark {
+		return buf
+	}
+	payload := append([]byte(nil), buf[mark+recordHeaderSize:]...)
+	buf, mark = beginRecord(buf[:mark], recSpace)
+	buf = appendString(buf, space)
+	buf = append(buf, payload...)
+	return endRecord(buf, mark)
+}
+
+// writeMarkRecordTo writes a log offset mark. The offset is the log offset
+// of the record that follows the mark.
+func writeMarkRecordTo(buf []byte, off int64) []byte {
+	buf, mark := beginRecord(buf, recMark)
+	buf = appendUvarint(buf, uint64(off))
+	return endRecord(buf, mark)
+}
+
+// aofCommand is a single command that was read from an append-only file.
+type aofCommand struct {
+	typ  byte      // one of the record types
+	key  string    // the key for set, del, expire, and persist
+	val  string    // the value for set
+	ex   bool      // the set or expire has an expiration
+	exat time.Time // when the set or expire expires
+	z    bool      // the value of the set is compressed
+	off  int64     // the log offset for mark
+	all  bool      // the flush is for all of the keyspaces
+	ks   string    // the keyspace, empty for the default keyspace
+	idx  indexDef  // the definition of an index
+}
+
+// aofReader reads commands from a reader that is in the binary or the legacy
+// text format.
+type aofReader struct {
+	r       *bufio.Reader
+	text    bool       // the reader is in the text format
+	n       int64      // number of bytes of the complete commands
+	modTime time.Time  // the modified time of the reader, for text format
+	data    []byte     // read buffer
+	parts   []string   // text command parts
+	cipher  *aofCipher // decrypts an encrypted reader, nil for no key
+	hdr     bool       // the binary header has been read
+	enc     bool       // the reader is encrypted
+	plain   []byte     // decrypted payload buffer
+}
+
+// newAOFReader returns a reader for the append-only file. The format of the
+// file is detected by reading the magic header.
+func newAOFReader(rd io.Reader, modTime time.Time) *aofReader {
+	ar := &aofReader{
+		r:       bufio.NewReader(rd),
+		modTime: modTime,
+		data:    make([]byte, 4096),
+	}
+	hdr, _ := ar.r.Peek(len(aofMagic))
+	if len(hdr) > 0 && !strings.HasPrefix(aofMagic, string(hdr)) &&
+		!strings.HasPrefix(aofEncMagic, string(hdr)) {
+		ar.text = true
+	}
+	return ar
+}
+
+// next reads the next command. Returns io.EOF when there are no more
+// commands. The binary format returns io.ErrUnexpectedEOF for truncated
+// records and ErrCorrupted for records that fail the checksum.
+func (ar *aofReader) next(cmd *aofCommand) error {
+	if ar.text {
+		return ar.nextText(cmd)
+	}
+	return ar.nextBinary(cmd)
+}
+
+// nextBinary reads the next command from a binary formatted reader.
+func (ar *aofReader) nextBinary(cmd *aofCommand) error {
+	if !ar.hdr {
+		if err := ar.readHeader(); err != nil {
+			return err
+		}
+	}
+	payload, err := ar.readRecord()
+	if err != nil {
+		return err
+	}
+	if ar.enc {
+		if payload, err = ar.cipher.open(ar.plain[:0], payload); err != nil {
+			return err
+		}
+		ar.plain = payload
+	}
+	*cmd = aofCommand{typ: payload[0]}
+	p := payload[1:]
+	if cmd.typ == recSpace {
+		// The payload of the keyspace record is the name of the keyspace
+		// followed by the payload of another record.
+		if cmd.ks, p, err = readString(p); err != nil {
+			return err
+		}
+		if cmd.ks == "" || len(p) == 0 || p[0] == recMark {
+			return ErrInvalid
+		}
+		cmd.typ, p = p[0], p[1:]
+	}
+	switch cmd.typ {
+	case recSet:
+		var flags uint64
+		if flags, p, err = readUvarint(p); err != nil {
+			return err
+		}
+		if cmd.key, p, err = readString(p); err != nil {
+			return err
+		}
+		if cmd.val, p, err = readString(p); err != nil {
+			return err
+		}
+		if flags&setFlagExpires != 0 {
+			var exat int64
+			if exat, p, err = readVarint(p); err != nil {
+				return err
+			}
+			cmd.ex, cmd.exat = true, time.Unix(0, exat)
+		}
+		cmd.z = flags&setFlagCompressed != 0
+	case recDel, recPersist, recDrop:
+		if cmd.key, p, err = readString(p); err != nil {
+			return err
+		}
+	case recIndex:
+		if p, err = cmd.idx.read(p); err != nil {
+			return err
+		}
+	case recExpire:
+		if cmd.key, p, err = readString(p); err != nil {
+			return err
+		}
+		var exat int64
+		if exat, p, err = readVarint(p); err != nil {
+			return err
+		}
+		cmd.ex, cmd.exat = true, time.Unix(0, exat)
+	case recFlush:
+		if len(p) > 0 {
+			var flags uint64
+			if flags, p, err = readUvarint(p); err != nil {
+				return err
+			}
+			cmd.all = flags&flushFlagAll != 0
+		}
+	case recMark:
+		var off uint64
+		if off, p, err = readUvarint(p); err != nil {
+			return err
+		}
+		cmd.off = int64(off)
+	default:
+		return ErrInvalid
+	}
+	if len(p) != 0 {
+		return ErrInvalid
+	}
+	return nil
+}
+
+// readHeader reads the magic header of a binary formatted reader. Returns
+// ErrInvalidKey when the reader is encrypted with another key, or when there
+// is no key.
+func (ar *aofReader) readHeader() error {
+	hdr, err := ar.r.Peek(len(aofMagic))
+	if err != nil {
+		if len(hdr) == 0 && err == io.EOF {
+			return io.EOF
+		}
+		return unexpectedEOF(err)
+	}
+	switch string(hdr) {
+	case aofMagic:
+	case aofEncMagic:
+		if ar.cipher == nil {
+			return ErrInvalidKey
+		}
+		if hdr, err = ar.r.Peek(encHeaderSize); err != nil {
+			return unexpectedEOF(err)
+		}
+		if err := ar.cipher.checkHeader(hdr); err != nil {
+			return err
+		}
+		ar.enc = true
+	default:
+		return ErrInvalid
+	}
+	ar.r.Discard(len(hdr))
+	ar.n = int64(len(hdr))
+	ar.hdr = true
+	return nil
+}
+
+// readRecord reads the payload of the next binary record and verifies the
+// checksum.
+func (ar *aofReader) readRecord() ([]byte, error) {
+	var hdr [recordHeaderSize]byte
+	if n, err := io.ReadFull(ar.r, hdr[:]); err != nil {
+		if n == 0 && err == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, unexpectedEOF(err)
+	}
+	size := binary.LittleEndian.Uint32(hdr[:])
+	if size == 0 || size >= maxRecordSize {
+		// A zero sized payload is never written, which makes it likely that
+		// this is a zero filled tail.
+		return nil, ErrCorrupted
+	}
+	// The payload is read in chunks to avoid a large allocation when the
+	// length has been damaged.
+	payload := ar.data[:0]
+	for len(payload) < int(size) {
+		n := int(size) - len(payload)
+		if n > 1024*1024 {
+			n = 1024 * 1024
+		}
+		if cap(payload)-len(payload) < n {
+			npayload := make([]byte, len(payload), cap(payload)*2+n)
+			copy(npayload, payload)
+			payload = npayload
+		}
+		chunk := payload[len(payload) : len(payload)+n]
+		if _, err := io.ReadFull(ar.r, chunk); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		payload = payload[:len(payload)+n]
+	}
+	ar.data = payload
+	if crc32.Checksum(payload, crcTable) !=
+		binary.LittleEndian.Uint32(hdr[4:]) {
+		return nil, ErrCorrupted
+	}
+	ar.n += recordHeaderSize + int64(size)
+	return payload, nil
+}
+
+// unexpectedEOF converts an EOF in the middle of a record to
+// io.ErrUnexpectedEOF. Other read errors are returned as is.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func readUvarint(p []byte) (uint64, []byte, error) {
+	x, n := binary.Uvarint(p)
+	if n <= 0 {
+		return 0, nil, ErrInvalid
+	}
+	return x, p[n:], nil
+}
+
+func readVarint(p []byte) (int64, []byte, error) {
+	x, n := binary.Varint(p)
+	if n <= 0 {
+		return 0, nil, ErrInvalid
+	}
+	return x, p[n:], nil
+}
+
+func readString(p []byte) (string, []byte, error) {
+	n, p, err := readUvarint(p)
+	if err != nil {
+		return "", nil, err
+	}
+	if uint64(len(p)) < n {
+		return "", nil, ErrInvalid
+	}
+	return string(p[:n]), p[n:], nil
+}
+
+// readCount reads a RESP line that starts with the prefix character and is
+// followed by a number, such as "*3\r\n" or "$5\r\n".
+func (ar *aofReader) readCount(prefix byte) (int, error) {
+	line, err := ar.r.ReadBytes('\n')
+	if err != nil {
+		if len(line) > 0 {
+			// got an eof but also data. this should be an unexpected eof.
+			return 0, io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+	ar.n += int64(len(line))
+	if line[0] != prefix {
+		return 0, ErrInvalid
+	}
+	// convert the string number to and int
+	var n int
+	if len(line) == 4 && line[len(line)-2] == '\r' {
+		if line[1] < '0' || line[1] > '9' {
+			return 0, ErrInvalid
+		}
+		n = int(line[1] - '0')
+	} else {
+		if len(line) < 5 || line[len(line)-2] != '\r' {
+			return 0, ErrInvalid
+		}
+		for i := 1; i < len(line)-2; i++ {
+			if line[i] < '0' || line[i] > '9' {
+				return 0, ErrInvalid
+			}
+			n = n*10 + int(line[i]-'0')
+		}
+	}
+	return n, nil
+}
+
+// nextText reads the next command from a text formatted reader. Returns
+// io.ErrUnexpectedEOF for a truncated command, in which case the count of
+// complete bytes stops at the start of the command.
+func (ar *aofReader) nextText(cmd *aofCommand) (err error) {
+	start := ar.n
+	defer func() {
+		if err == io.ErrUnexpectedEOF {
+			ar.n = start
+		}
+	}()
+	for {
+		start = ar.n
+		// read a single command.
+		// first we should read the number of parts that the of the command
+		n, err := ar.readCount('*')
+		if err != nil {
+			return err
+		}
+		// read each part of the command.
+		parts := ar.parts[:0]
+		for i := 0; i < n; i++ {
+			// read the number of bytes of the part.
+			n, err := ar.readCount('$')
+			if err != nil {
+				if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				return err
+			}
+			// resize the read buffer
+			if len(ar.data) < n+2 {
+				dataln := len(ar.data)
+				for dataln < n+2 {
+					dataln *= 2
+				}
+				ar.data = make([]byte, dataln)
+			}
+			if _, err = io.ReadFull(ar.r, ar.data[:n+2]); err != nil {
+				if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				return err
+			}
+			ar.n += int64(n + 2)
+			if ar.data[n] != '\r' || ar.data[n+1] != '\n' {
+				return ErrInvalid
+			}
+			// copy string
+			parts = append(parts, string(ar.data[:n]))
+		}
+		ar.parts = parts
+		// finished reading the command
+
+		if len(parts) == 0 {
+			continue
+		}
+		return parseTextCommand(cmd, parts, ar.modTime)
+	}
+}
+
+// parseTextCommand converts the parts of a text command to a command.
+func parseTextCommand(cmd *aofCommand, parts []string,
+	modTime time.Time) error {
+	*cmd = aofCommand{}
+	if (parts[0][0] == 's' || parts[0][0] == 'S') &&
+		(parts[0][1] == 'e' || parts[0][1] == 'E') &&
+		(parts[0][2] == 't' || parts[0][2] == 'T') {
+		// SET
+		if len(parts) < 3 || len(parts) == 4 || len(parts) > 5 {
+			return ErrInvalid
+		}
+		cmd.typ, cmd.key, cmd.val = recSet, parts[1], parts[2]
+		if len(parts) == 5 {
+			if strings.ToLower(parts[3]) != "ex" {
+				return ErrInvalid
+			}
+			ex, err := strconv.ParseInt(parts[4], 10, 64)
+			if err != nil {
+				return err
+			}
+			now := time.Now()
+			dur := (time.Duration(ex) * time.Second) - now.Sub(modTime)
+			cmd.ex, cmd.exat = true, now.Add(dur)
+		}
+	} else if (parts[0][0] == 'd' || parts[0][0] == 'D') &&
+		(parts[0][1] == 'e' || parts[0][1] == 'E') &&
+		(parts[0][2] == 'l' || parts[0][2] == 'L') {
+		// DEL
+		if len(parts) != 2 {
+			return ErrInvalid
+		}
+		cmd.typ, cmd.key = recDel, parts[1]
+	} else if (parts[0][0] == 'f' || parts[0][0] == 'F') &&
+		strings.ToLower(parts[0]) == "flushdb" {
+		cmd.typ = recFlush
+	} else {
+		return ErrInvalid
+	}
+	return nil
+}
+
+// writeRecordTo writes the command as a binary record.
+func (cmd *aofCommand) writeRecordTo(buf []byte) []byte {
+	mark := len(buf)
+	return wrapKeyspace(cmd.writePayloadTo(buf), mark, cmd.ks)
+}
+
+// writePayloadTo writes the command as a binary record, without the keyspace.
+func (cmd *aofCommand) writePayloadTo(buf []byte) []byte {
+	switch cmd.typ {
+	case recSet:
+		// A compressed value is written as is, which keeps the record the
+		// same size.
+		dbi := &dbItem{key: cmd.key, val: cmd.val, zval: cmd.z}
+		if cmd.ex {
+			dbi.opts = &dbItemOpts{ex: true, exat: cmd.exat}
+		}
+		return dbi.writeSetRecordTo(buf, false)
+	case recDel:
+		return (&dbItem{key: cmd.key}).writeDeleteRecordTo(buf)
+	case recExpire, recPersist:
+		dbi := &dbItem{key: cmd.key}
+		if cmd.ex {
+			dbi.opts = &dbItemOpts{ex: true, exat: cmd.exat}
+		}
+		return dbi.writeExpireRecordTo(buf)
+	case recMark:
+		return writeMarkRecordTo(buf, cmd.off)
+	case recIndex:
+		return cmd.idx.writeRecordTo(buf)
+	case recDrop:
+		return writeDropRecordTo(buf, cmd.key)
+	}
+	return writeFlushRecordTo(buf, cmd.all)
+}
+
+// applyCommand applies a command that was read from an append-only file to
+// the database.
+func (db *DB) applyCommand(cmd *aofCommand) error {
+	if cmd.ks != "" {
+		db = db.keyspace(cmd.ks)
+	}
+	switch cmd.typ {
+	case recSet:
+		if cmd.ex && !time.Now().Before(cmd.exat) {
+			break
+		}
+		dbi := &dbItem{key: cmd.key, val: cmd.val, zval: cmd.z}
+		if err := db.encodeItem(dbi); err != nil {
+			return err
+		}
+		if cmd.ex {
+			dbi.opts = &dbItemOpts{ex: true, exat: cmd.exat}
+		}
+		db.insertIntoDatabase(dbi)
+	case recDel:
+		db.deleteFromDatabase(&dbItem{key: cmd.key})
+	case recExpire, recPersist:
+		prev := db.get(cmd.key)
+		if prev == nil {
+			break
+		}
+		if cmd.ex && !time.Now().Before(cmd.exat) {
+			db.deleteFromDatabase(prev)
+			break
+		}
+		// The items are never changed in place.
+		dbi := &dbItem{key: prev.key, val: prev.val, zval: prev.zval,
+			access: prev.access}
+		if cmd.ex {
+			dbi.opts = &dbItemOpts{ex: true, exat: cmd.exat}
+		}
+		db.insertIntoDatabase(dbi)
+	case recFlush:
+		// Keep the index definitions, but with an empty dataset.
+		db.keys = btree.New(btreeDegrees, nil)
+		db.exps = btree.New(btreeDegrees, &exctx{db})
+		db.memsize = 0
+		idxs := db.idxs
+		db.idxs = make(map[string]*index)
+		for name, idx := range idxs {
+			db.idxs[name] = idx.clearCopy()
+		}
+		if cmd.all {
+			for _, kdb := range db.spaces {
+				kdb.applyCommand(&aofCommand{typ: recFlush})
+			}
+		}
+	case recIndex:
+		// The index replaces an index with the same name. The definition is
+		// copied, because the command is reused by the reader.
+		def := cmd.idx
+		idx, err := def.newIndex()
+		if err != nil {
+			return err
+		}
+		idx.db = db
+		idx.rebuild()
+		db.idxs[idx.name] = idx
+	case recDrop:
+		delete(db.idxs, cmd.key)
+	}
+	return nil
+}
+
+// readAOF reads all commands from the reader and loads them into the database.
+func (db *DB) readAOF(ar *aofReader) error {
+	var cmd aofCommand
+	for {
+		if err := ar.next(&cmd); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if cmd.typ == recMark && db.persist {
+			// The records that follow the mark start at its log offset.
+			db.logstart, db.logpos = cmd.off, ar.n
+		}
+		if err := db.applyCommand(&cmd); err != nil {
+			return err
+		}
+	}
+}
+
+// maxTailRecord is the largest payload of a record that is looked for after a
+// damaged record.
+const maxTailRecord = 1024 * 1024
+
+// damagedTail reports whether no valid record follows the damaged record at
+// the position of the named file, which makes the damage the tail of the file
+// that was being written during a crash. A valid record that follows means
+// that the file was damaged in the middle.
+func (db *DB) damagedTail(name string, pos int64) (bool, error) {
+	rd, err := db.fs.ReadAll(name)
+	if err != nil {
+		return false, err
+	}
+	defer rd.Close()
+	// A record may start at any byte after the damaged one.
+	if err := skipRead(rd, pos+1); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return true, nil
+		}
+		return false, err
+	}
+	br := bufio.NewReaderSize(rd, recordHeaderSize+maxTailRecord)
+	for {
+		hdr, err := br.Peek(recordHeaderSize)
+		if err != nil {
+			if err == io.EOF {
+				return true, nil
+			}
+			return false, err
+		}
+		size := binary.LittleEndian.Uint32(hdr)
+		if size > 0 && size <= maxTailRecord {
+			rec, err := br.Peek(recordHeaderSize + int(size))
+			if err != nil && err != io.EOF {
+				return false, err
+			}
+			if err == nil && crc32.Checksum(rec[recordHeaderSize:], crcTable) ==
+				binary.LittleEndian.Uint32(rec[4:]) {
+				return false, nil
+			}
+		}
+		br.Discard(1)
+	}
+}
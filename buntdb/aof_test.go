@@ -0,0 +1,307 @@
+package buntdb
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testFillAOF(t *testing.T, db *DB, n int) {
+	for i := 0; i < n; i++ {
+		if err := db.Update(func(tx *Tx) error {
+			_, _, err := tx.Set(fmt.Sprintf("key:%d", i), fmt.Sprintf("val:%d", i),
+				nil)
+			return err
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func testCountItems(t *testing.T, db *DB) int {
+	var n int
+	if err := db.View(func(tx *Tx) error {
+		var err error
+		n, err = tx.Len()
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestBinaryFormat(t *testing.T) {
+	db := testOpen(t)
+	defer testClose(db)
+	testFillAOF(t, db, 10)
+	if err := db.Update(func(tx *Tx) error {
+		if _, err := tx.Delete("key:0"); err != nil {
+			return err
+		}
+		_, _, err := tx.Set("exp", "val", &SetOptions{Expires: true, TTL: time.Hour})
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile("data.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), aofMagic) {
+		t.Fatal("expected the binary header")
+	}
+	db = testReOpen(t, db)
+	defer testClose(db)
+	if n := testCountItems(t, db); n != 10 {
+		t.Fatalf("expected '%v', got '%v'", 10, n)
+	}
+	if err := db.View(func(tx *Tx) error {
+		ttl, err := tx.TTL("exp")
+		if err != nil {
+			return err
+		}
+		if ttl < time.Hour-time.Minute || ttl > time.Hour {
+			t.Fatalf("invalid ttl: %v", ttl)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBinaryFormatTornTail(t *testing.T) {
+	db := testOpen(t)
+	defer testClose(db)
+	testFillAOF(t, db, 10)
+	db.Close()
+	fi, err := os.Stat("data.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := fi.Size()
+	// truncate in the middle of the last record
+	if err := os.Truncate("data.db", size-3); err != nil {
+		t.Fatal(err)
+	}
+	db, err = OpenWithOptions("data.db", &Options{StrictLoad: true})
+	if err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected '%v', got '%v'", io.ErrUnexpectedEOF, err)
+	}
+	db = testReOpen(t, nil)
+	if n := testCountItems(t, db); n != 9 {
+		t.Fatalf("expected '%v', got '%v'", 9, n)
+	}
+	// the damaged tail must have been cut off, so new writes are readable.
+	testFillAOF(t, db, 10)
+	db = testReOpen(t, db)
+	defer testClose(db)
+	if n := testCountItems(t, db); n != 10 {
+		t.Fatalf("expected '%v', got '%v'", 10, n)
+	}
+}
+
+func TestBinaryFormatCorruptTail(t *testing.T) {
+	db := testOpen(t)
+	defer testClose(db)
+	testFillAOF(t, db, 10)
+	db.Close()
+	data, err := ioutil.ReadFile("data.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// damage the last record and add a zero filled tail
+	data[len(data)-1]++
+	data = append(data, make([]byte, 64)...)
+	if err := ioutil.WriteFile("data.db", data, 0666); err != nil {
+		t.Fatal(err)
+	}
+	db, err = OpenWithOptions("data.db", &Options{StrictLoad: true})
+	if err != ErrCorrupted {
+		t.Fatalf("expected '%v', got '%v'", ErrCorrupted, err)
+	}
+	db = testReOpen(t, nil)
+	defer testClose(db)
+	if n := testCountItems(t, db); n != 9 {
+		t.Fatalf("expected '%v', got '%v'", 9, n)
+	}
+	// a torn header leaves an empty database
+	db.Close()
+	if err := ioutil.WriteFile("data.db", []byte(aofMagic[:3]), 0666); err != nil {
+		t.Fatal(err)
+	}
+	db = testReOpen(t, nil)
+	if n := testCountItems(t, db); n != 0 {
+		t.Fatalf("expected '%v', got '%v'", 0, n)
+	}
+	testFillAOF(t, db, 2)
+	db = testReOpen(t, db)
+	if n := testCountItems(t, db); n != 2 {
+		t.Fatalf("expected '%v', got '%v'", 2, n)
+	}
+}
+
+func TestBinaryFormatCorruptMiddle(t *testing.T) {
+	db := testOpen(t)
+	defer testClose(db)
+	testFillAOF(t, db, 5)
+	fi, err := os.Stat("data.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pos := fi.Size()
+	testFillAOF(t, db, 10)
+	db.Close()
+	data, err := ioutil.ReadFile("data.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// damage the payload of a record that is followed by valid records
+	data[pos+recordHeaderSize+2]++
+	if err := ioutil.WriteFile("data.db", data, 0666); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open("data.db")
+	if err != ErrCorrupted {
+		t.Fatalf("expected '%v', got '%v'", ErrCorrupted, err)
+	}
+	// the records that follow are not cut off.
+	res, err := ioutil.ReadFile("data.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(res, data) {
+		t.Fatal("expected the file to be unchanged")
+	}
+	// a damaged length is found in the same way.
+	data[pos+recordHeaderSize+2]--
+	data[pos+3] = 0x7f
+	if err := ioutil.WriteFile("data.db", data, 0666); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open("data.db")
+	if err != ErrCorrupted {
+		t.Fatalf("expected '%v', got '%v'", ErrCorrupted, err)
+	}
+}
+
+func TestTextFormatMigration(t *testing.T) {
+	resp := strings.Join([]string{
+		"*3\r\n$3\r\nset\r\n$4\r\nvar1\r\n$4\r\n1234\r\n",
+		"*3\r\n$3\r\nset\r\n$4\r\nvar2\r\n$4\r\n1234\r\n",
+		"*2\r\n$3\r\ndel\r\n$4\r\nvar1\r\n",
+		"*5\r\n$3\r\nset\r\n$3\r\nvar\r\n$3\r\nval\r\n$2\r\nex\r\n$2\r\n10\r\n",
+	}, "")
+	if err := os.RemoveAll("data.db"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile("data.db", []byte(resp), 0666); err != nil {
+		t.Fatal(err)
+	}
+	db := testReOpen(t, nil)
+	defer testClose(db)
+	testFillAOF(t, db, 3)
+	// new writes continue to use the text format.
+	data, err := ioutil.ReadFile("data.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), resp+"*3\r\n$3\r\nset\r\n") {
+		t.Fatal("expected the text format")
+	}
+	if err := db.Shrink(); err != nil {
+		t.Fatal(err)
+	}
+	data, err = ioutil.ReadFile("data.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), aofMagic) {
+		t.Fatal("expected the binary header")
+	}
+	testFillAOF(t, db, 4)
+	db = testReOpen(t, db)
+	defer testClose(db)
+	if n := testCountItems(t, db); n != 6 {
+		t.Fatalf("expected '%v', got '%v'", 6, n)
+	}
+	if err := db.View(func(tx *Tx) error {
+		ttl, err := tx.TTL("var")
+		if err != nil {
+			return err
+		}
+		if ttl <= 0 || ttl > time.Second*10 {
+			t.Fatalf("invalid ttl: %v", ttl)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTextFormatTornTail(t *testing.T) {
+	resp := strings.Join([]string{
+		"*3\r\n$3\r\nset\r\n$4\r\nvar1\r\n$4\r\n1234\r\n",
+		"*3\r\n$3\r\nset\r\n$4\r\nvar2\r\n$4\r\n1234\r\n",
+	}, "")
+	for _, tail := range []string{
+		"*3\r",
+		"*3\r\n$3\r\nset\r\n$4\r\nvar3\r\n",
+		"*3\r\n$3\r\nset\r\n$4\r\nvar3\r\n$4\r\n12",
+	} {
+		if err := os.RemoveAll("data.db"); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile("data.db", []byte(resp+tail), 0666); err != nil {
+			t.Fatal(err)
+		}
+		_, err := OpenWithOptions("data.db", &Options{StrictLoad: true})
+		if err != io.ErrUnexpectedEOF {
+			t.Fatalf("expected '%v', got '%v'", io.ErrUnexpectedEOF, err)
+		}
+		db := testReOpen(t, nil)
+		if n := testCountItems(t, db); n != 2 {
+			t.Fatalf("expected '%v', got '%v'", 2, n)
+		}
+		// the partial command must have been cut off, so new writes are
+		// readable.
+		testFillAOF(t, db, 1)
+		data, err := ioutil.ReadFile("data.db")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(string(data), resp+"*3\r\n$3\r\nset\r\n") {
+			t.Fatal("expected the text format")
+		}
+		db = testReOpen(t, db)
+		if n := testCountItems(t, db); n != 3 {
+			t.Fatalf("expected '%v', got '%v'", 3, n)
+		}
+		testClose(db)
+	}
+}
+
+func TestBinarySaveLoad(t *testing.T) {
+	db, _ := Open(":memory:")
+	defer db.Close()
+	testFillAOF(t, db, 20)
+	var buf bytes.Buffer
+	if err := db.Save(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(buf.String(), aofMagic) {
+		t.Fatal("expected the binary header")
+	}
+	db2, _ := Open(":memory:")
+	defer db2.Close()
+	if err := db2.Load(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if n := testCountItems(t, db2); n != 20 {
+		t.Fatalf("expected '%v', got '%v'", 20, n)
+	}
+}
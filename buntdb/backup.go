@@ -0,0 +1,132 @@
+package buntdb
+
+import (
+	"io"
+)
+
+// Backup writes a backup of the database to a writer and returns the log
+// offset of the end of the backup. This operation does not block the
+// database.
+//
+// A sinceOffset of zero writes a full backup, which is a copy of all of the
+// items. Otherwise an incremental backup is written, which only contains the
+// records that were committed since the offset that was returned by a
+// previous backup. When those records are no longer in the database file,
+// such as when they were removed by a shrink, a full backup is written
+// instead.
+//
+// The database must persist to disk using the binary format, otherwise
+// ErrInvalidOperation is returned. Use Save for in-memory databases. The
+// backup of an encrypted database file is encrypted with the same key.
+func (db *DB) Backup(w io.Writer, sinceOffset int64) (int64, error) {
+	db.mu.Lock()
+	if db.closed {
+		db.mu.Unlock()
+		return 0, ErrDatabaseClosed
+	}
+	if !db.persist || db.textaof {
+		db.mu.Unlock()
+		return 0, ErrInvalidOperation
+	}
+	var sdb *DB
+	offset, end := sinceOffset, db.logOffset()
+	crypt := db.aofcrypt
+	var f io.ReadCloser
+	var err error
+	if offset > 0 && offset <= end {
+		// The opened files keep their contents when they're replaced or
+		// removed by a shrink.
+		f, err = db.readLog(offset, end, crypt)
+	}
+	if err == nil && f == nil {
+		// A full backup, or the records are not all in the database file.
+		sdb = db.detach()
+		offset = end
+		f, err = db.readLog(offset, end, crypt)
+	}
+	db.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	buf := crypt.appendHeader(nil)
+	if sdb != nil {
+		if buf, err = sdb.writeCopyTo(w, buf, crypt); err != nil {
+			return 0, err
+		}
+	}
+	// The mark is used by Restore to verify that the backups are continuous.
+	mark := len(buf)
+	buf = writeMarkRecordTo(buf, offset)
+	buf = crypt.seal(buf, mark)
+	if _, err := w.Write(buf); err != nil {
+		return 0, err
+	}
+	if _, err := io.Copy(w, f); err != nil {
+		return 0, err
+	}
+	return end, nil
+}
+
+// Restore replaces the contents of the database using a full backup followed
+// by a chain of incremental backups, which were written by Backup. This
+// operation blocks all reads and writes.
+//
+// Each incremental backup must continue at the log offset where the previous
+// backup ended, otherwise ErrBackupChain is returned. An incremental backup
+// can also be restored on its own, when the database is at the log offset of
+// the previous backup. On error, the database contains the records that were
+// restored prior to the error.
+//
+// The restored records are appended to the database file, and the database
+// has the log offset of the last backup. The backups must be encrypted when
+// the database file is encrypted, and not encrypted otherwise, or else
+// ErrInvalidOperation is returned.
+func (db *DB) Restore(backups ...io.Reader) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	// The records of the pending group commits go before the backups.
+	db.waitGroups()
+	if db.closed {
+		return ErrDatabaseClosed
+	}
+	if db.follower {
+		return ErrFollower
+	}
+	if db.persist && db.textaof {
+		return ErrInvalidOperation
+	}
+	var cmd aofCommand
+	for _, rd := range backups {
+		ar, err := db.newLogReader(rd, db.aofcrypt)
+		if err != nil {
+			if err == io.EOF {
+				// A backup always has records.
+				return ErrInvalid
+			}
+			return err
+		}
+		for first := true; ; first = false {
+			if err := ar.next(&cmd); err != nil {
+				if err == io.EOF {
+					if first {
+						// A backup always has records.
+						return ErrInvalid
+					}
+					break
+				}
+				return err
+			}
+			// A full backup starts with a flush, and an incremental backup
+			// starts with the mark of its offset.
+			if first && cmd.typ != recFlush &&
+				(cmd.typ != recMark || cmd.off != db.logOffset()) {
+				return ErrBackupChain
+			}
+			if err := db.appendCommand(&cmd); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package buntdb
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestBackup(t *testing.T) {
+	db := testOpen(t)
+	defer testClose(db)
+	testFillAOF(t, db, 10)
+	var full, inc1, inc2 bytes.Buffer
+	off1, err := db.Backup(&full, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Update(func(tx *Tx) error {
+		tx.Delete("key:1")
+		_, _, err := tx.Set("exp", "val", &SetOptions{Expires: true, TTL: time.Hour})
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	off2, err := db.Backup(&inc1, off1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inc1.Len() >= full.Len() {
+		t.Fatalf("expected a smaller incremental backup, got %d bytes", inc1.Len())
+	}
+	testFillAOF(t, db, 20)
+	off3, err := db.Backup(&inc2, off2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp, err := db.LogOffset(); err != nil || off3 != exp {
+		t.Fatalf("expected '%v', got '%v'", exp, off3)
+	}
+
+	// restore the chain into an in-memory database.
+	mdb, _ := Open(":memory:")
+	defer mdb.Close()
+	if err := mdb.Restore(bytes.NewReader(full.Bytes()),
+		bytes.NewReader(inc1.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if n := testCountItems(t, mdb); n != 10 {
+		t.Fatalf("expected '%v', got '%v'", 10, n)
+	}
+	// the next backup of the chain continues at the same offset.
+	if err := mdb.Restore(bytes.NewReader(inc2.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if exp, res := testDump(t, db), testDump(t, mdb); exp != res {
+		t.Fatalf("expected '%v', got '%v'", exp, res)
+	}
+	if off, err := mdb.LogOffset(); err != nil || off != off3 {
+		t.Fatalf("expected '%v', got '%v'", off3, off)
+	}
+
+	// restore into a database that persists to disk.
+	if err := os.RemoveAll("restore.db"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll("restore.db")
+	rdb, err := Open("restore.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rdb.Restore(bytes.NewReader(full.Bytes()),
+		bytes.NewReader(inc1.Bytes()), bytes.NewReader(inc2.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	rdb.Close()
+	rdb, err = Open("restore.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rdb.Close()
+	if exp, res := testDump(t, db), testDump(t, rdb); exp != res {
+		t.Fatalf("expected '%v', got '%v'", exp, res)
+	}
+	if off, err := rdb.LogOffset(); err != nil || off != off3 {
+		t.Fatalf("expected '%v', got '%v'", off3, off)
+	}
+}
+
+func TestBackupChain(t *testing.T) {
+	db := testOpen(t)
+	defer testClose(db)
+	testFillAOF(t, db, 10)
+	var full, inc1, inc2 bytes.Buffer
+	off1, err := db.Backup(&full, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testFillAOF(t, db, 11)
+	off2, err := db.Backup(&inc1, off1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testFillAOF(t, db, 12)
+	if _, err := db.Backup(&inc2, off2); err != nil {
+		t.Fatal(err)
+	}
+	// a missing incremental backup breaks the chain.
+	mdb, _ := Open(":memory:")
+	defer mdb.Close()
+	err = mdb.Restore(bytes.NewReader(full.Bytes()), bytes.NewReader(inc2.Bytes()))
+	if err != ErrBackupChain {
+		t.Fatalf("expected '%v', got '%v'", ErrBackupChain, err)
+	}
+	if err := mdb.Restore(bytes.NewReader(inc1.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if err := mdb.Restore(bytes.NewReader(inc2.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if n := testCountItems(t, mdb); n != 12 {
+		t.Fatalf("expected '%v', got '%v'", 12, n)
+	}
+	// a shrink removes the offset, so a full backup is written instead.
+	testFillAOF(t, db, 13)
+	if err := db.Shrink(); err != nil {
+		t.Fatal(err)
+	}
+	off, err := mdb.LogOffset()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var inc3 bytes.Buffer
+	if _, err := db.Backup(&inc3, off); err != nil {
+		t.Fatal(err)
+	}
+	if err := mdb.Restore(bytes.NewReader(inc3.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if exp, res := testDump(t, db), testDump(t, mdb); exp != res {
+		t.Fatalf("expected '%v', got '%v'", exp, res)
+	}
+	// Save does not write a backup.
+	var save bytes.Buffer
+	if err := mdb.Save(&save); err != nil {
+		t.Fatal(err)
+	}
+	if err := mdb.Restore(&save); err != ErrBackupChain {
+		t.Fatalf("expected '%v', got '%v'", ErrBackupChain, err)
+	}
+	if _, err := mdb.Backup(&save, 0); err != ErrInvalidOperation {
+		t.Fatalf("expected '%v', got '%v'", ErrInvalidOperation, err)
+	}
+}
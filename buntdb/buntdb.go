@@ -5,7 +5,6 @@
 package buntdb
 
 import (
-	"bufio"
 	"errors"
 	"io"
 	"os"
@@ -58,13 +57,75 @@ var (
 
 	// ErrTxIterating is returned when Set or Delete are called while iterating.
 	ErrTxIterating = errors.New("tx is iterating")
+
+	// ErrCorrupted is returned when a record in the database file fails the
+	// checksum.
+	ErrCorrupted = errors.New("database file is corrupted")
+
+	// ErrFollower is returned when opening a read/write transaction on a
+	// database that follows a leader.
+	ErrFollower = errors.New("database is a follower")
+
+	// ErrBackupChain is returned when restoring an incremental backup that
+	// does not continue from the previous backup.
+	ErrBackupChain = errors.New("backup chain is not continuous")
+
+	// ErrUniqueViolation is returned when an item has the same value as an
+	// item with another key in a unique index.
+	ErrUniqueViolation = errors.New("unique index violation")
+
+	// ErrMaxMemory is returned when a Set would go over the MaxMemory limit,
+	// and the eviction policy is unable to make room.
+	ErrMaxMemory = errors.New("max memory reached")
+
+	// ErrInvalidEvictionPolicy is returned for an invalid EvictionPolicy
+	// value.
+	ErrInvalidEvictionPolicy = errors.New("invalid eviction policy")
+
+	// ErrInvalidKey is returned when the encryption key has an invalid size,
+	// or when it does not match the key of an encrypted database file.
+	ErrInvalidKey = errors.New("invalid encryption key")
+
+	// ErrInvalidQuery is returned when a query has invalid syntax.
+	ErrInvalidQuery = errors.New("invalid query")
+
+	// ErrConflict is returned when committing an optimistic transaction
+	// that read an item which was changed by another transaction.
+	ErrConflict = errors.New("transaction conflict")
+
+	// ErrInvalidValue is returned when the value of an item cannot be changed
+	// by an operation, such as incrementing a value that is not a number.
+	ErrInvalidValue = errors.New("invalid value")
+
+	// ErrInvalidToken is returned when resuming an iterator from a token
+	// that is not valid.
+	ErrInvalidToken = errors.New("invalid token")
+
+	// ErrInvalidPolygon is returned when the polygon of WithinPolygon has
+	// fewer than three points, or a point with fewer than two coordinates.
+	ErrInvalidPolygon = errors.New("invalid polygon")
+
+	// ErrNotRegistered is returned when a persistent index uses a less or
+	// rect function name that is not registered. The error that is returned
+	// by Open includes the name, and is matched using errors.Is.
+	ErrNotRegistered = errors.New("index function not registered")
+
+	// ErrSyncFailed is returned when a group commit fails to sync the
+	// database file. The changes of the group are visible, and they may or
+	// may not be on disk, so all writes fail until the database is reopened.
+	// The error includes the sync error, and is matched using errors.Is.
+	ErrSyncFailed = errors.New("sync failed")
 )
 
 // DB represents a collection of key-value pairs that persist on disk.
 // Transactions are used for all forms of data access to the DB.
 type DB struct {
 	mu        sync.RWMutex      // the gatekeeper for all fields
-	file      *os.File          // the underlying file
+	file      StorageFile       // the underlying file
+	path      string            // the path of the database file
+	fs        Storage           // the storage of the database file
+	segs      []segment         // the segments, nil when not segmented
+	segseq    int               // the sequence number of the next segment
 	buf       []byte            // a buffer to write to
 	keys      *btree.BTree      // a tree of all item ordered by key
 	exps      *btree.BTree      // a tree of items ordered by expiration
@@ -76,6 +137,34 @@ type DB struct {
 	persist   bool              // do we write to disk
 	shrinking bool              // when an aof shrink is in-process.
 	lastaofsz int               // the size of the last shrink aof size
+	shrinkat  time.Time         // the time of the last shrink
+	stats     dbStats           // the counts of the transactions
+	watchers  []*watcher        // subscribers for change events
+	watchq    *watchQueue       // pending change events
+	snapshot  bool              // a detached point-in-time copy
+	opts      Options           // the options used to open the database
+	textaof   bool              // the aof uses the legacy text format
+	aofhdr    bool              // the binary aof header has been written
+	crypt     *aofCipher        // the cipher of the encryption key option
+	aofcrypt  *aofCipher        // encrypts the aof, nil when not encrypted
+	aofsize   int64             // the size of the aof file
+	aofgen    int               // incremented when the aof file is replaced
+	logstart  int64             // the log offset at logpos
+	logpos    int64             // the aof file position of logstart
+	logcond   *sync.Cond        // signaled when the log changes
+	follower  bool              // the database follows a leader
+	memsize   int64             // the approximate memory used by the items
+	evictkey  string            // the eviction sampling cursor
+	group     *commitGroup      // the group commit that is being filled
+	lastgroup *commitGroup      // the newest group commit that is not done
+	syncgroup *commitGroup      // the group commit that is being synced
+	batchmu   sync.Mutex        // protects batch
+	clonemu   sync.Mutex        // serializes the clones of detachShared
+	syncerr   error             // a group commit failed to sync
+	batch     *batch            // the calls of Batch that are being collected
+	space     string            // the name of the keyspace, "" for the default
+	spaces    map[string]*DB    // the keyspaces, by name
+	root      *DB               // the database of a keyspace
 }
 
 // SyncPolicy represents how often data is synced to disk.
@@ -119,7 +208,7 @@ type Config struct {
 	AutoShrinkDisabled bool
 
 	// OnExpired is used to custom handle the deletion option when a key
-	// has been expired.
+	// has been expired. It can't be used with keyspaces.
 	OnExpired func(keys []string)
 
 	// OnExpiredSync will be called inside the same transaction that is performing
@@ -127,6 +216,30 @@ type Config struct {
 	// will not be called. If this callback is present, then the deletion of the
 	// timeed-out item is the explicit responsibility of this callback.
 	OnExpiredSync func(key, value string, tx *Tx) error
+
+	// MaxMemory is the approximate number of bytes that the keys and values
+	// may use. When a Set would go over the limit, items are evicted using
+	// the EvictionPolicy. The items of all of the keyspaces count toward
+	// the limit. Zero means no limit.
+	MaxMemory int
+
+	// EvictionPolicy chooses the items that are evicted when the MaxMemory
+	// limit is reached. This value can be NoEviction, AllKeysLRU,
+	// AllKeysLFU, or VolatileTTL. The default is NoEviction.
+	EvictionPolicy EvictionPolicy
+
+	// OnEvicted is called with the keys that were evicted after the
+	// transaction that evicted them has been committed. It can't be used
+	// with keyspaces.
+	OnEvicted func(keys []string)
+
+	// MaxBatchSize is the maximum number of calls that Batch runs in a
+	// single transaction. Zero or less disables batching.
+	MaxBatchSize int
+
+	// MaxBatchDelay is the maximum time that Batch waits for more calls
+	// before running a transaction. Zero or less disables batching.
+	MaxBatchDelay time.Duration
 }
 
 // exctx is a simple b-tree context for ordering by expiration.
@@ -137,33 +250,103 @@ type exctx struct {
 // Default number of btree degrees
 const btreeDegrees = 64
 
+// Options are used to change the behavior of a database when it's opened.
+type Options struct {
+	// StrictLoad prevents the database from opening when the end of the
+	// append-only file is truncated or fails the checksum. By default the
+	// damaged records at the end of the file, which are usually the result
+	// of a crash in the middle of a write, are cut off. A damaged record that
+	// is followed by valid records always returns ErrCorrupted.
+	StrictLoad bool
+	// EncryptionKey encrypts the records of the append-only file with
+	// AES-GCM. The key must be 16, 24, or 32 bytes, which selects AES-128,
+	// AES-192, or AES-256. A database file that was encrypted with another
+	// key, or a database file that is encrypted when there's no key, returns
+	// ErrInvalidKey. A database file that is not encrypted is encrypted by
+	// the next Shrink. Save writes the same format as the database file.
+	EncryptionKey []byte
+	// Compression compresses the values of the set records in the
+	// append-only file with DEFLATE. Values that are small, or that do not
+	// get smaller, are not compressed. The records that were written before
+	// are compressed by the next Shrink. The legacy text format is not
+	// compressed.
+	Compression bool
+	// CompressMemory keeps the values compressed in memory, and they are
+	// decompressed on every access, such as by Get or an iterator. Index
+	// less functions and the other index functions still see the plain
+	// values, but an index on compressed values is slower, because the
+	// values are decompressed for every comparison. The compressed values
+	// are also compressed in the append-only file.
+	CompressMemory bool
+	// SegmentSize splits the append-only file into segments of about this
+	// many bytes. A segment that is full is sealed and not changed again,
+	// and Shrink compacts the sealed segments in the background without
+	// blocking writes. An existing database file becomes the first segment.
+	// A database file that has segments keeps them when it's opened without
+	// this option, and uses segments of 64 MB. The legacy text format must
+	// be shrunk before it can have segments. Zero is a single file.
+	SegmentSize int
+	// Storage is where the database file is kept. The default is the files
+	// of the operating system. The Storage is not used by a database that
+	// is opened with ":memory:".
+	Storage Storage
+}
+
 // Open opens a database at the provided path.
 // If the file does not exist then it will be created automatically.
 func Open(path string) (*DB, error) {
+	return OpenWithOptions(path, nil)
+}
+
+// OpenWithOptions is the same as Open except that it allows for additional
+// options.
+func OpenWithOptions(path string, opts *Options) (*DB, error) {
 	db := &DB{}
+	if opts != nil {
+		db.opts = *opts
+	}
+	if len(db.opts.EncryptionKey) > 0 {
+		var err error
+		if db.crypt, err = newAOFCipher(db.opts.EncryptionKey); err != nil {
+			return nil, err
+		}
+		// An in-memory database is saved in the encrypted format.
+		db.aofcrypt = db.crypt
+	}
 	// initialize trees and indexes
 	db.keys = btree.New(btreeDegrees, nil)
 	db.exps = btree.New(btreeDegrees, &exctx{db})
 	db.idxs = make(map[string]*index)
+	db.logcond = sync.NewCond(&db.mu)
 	// initialize default configuration
 	db.config = Config{
 		SyncPolicy:           EverySecond,
 		AutoShrinkPercentage: 100,
 		AutoShrinkMinSize:    32 * 1024 * 1024,
+		MaxBatchSize:         1000,
+		MaxBatchDelay:        10 * time.Millisecond,
 	}
 	// turn off persistence for pure in-memory
 	db.persist = path != ":memory:"
 	if db.persist {
-		var err error
-		// hardcoding 0666 as the default mode.
-		db.file, err = os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0666)
-		if err != nil {
-			return nil, err
+		db.path, db.fs = path, db.opts.Storage
+		if db.fs == nil {
+			db.fs = osStorage{}
+		}
+		segs, next, err := db.readManifest()
+		if err == nil {
+			if segs != nil || db.opts.SegmentSize > 0 {
+				err = db.openSegments(segs, next)
+			} else if db.file, err = db.fs.OpenFile(path); err == nil {
+				// load the database from disk
+				err = db.load()
+			}
 		}
-		// load the database from disk
-		if err := db.load(); err != nil {
+		if err != nil {
 			// close on error, ignore close error
-			_ = db.file.Close()
+			if db.file != nil {
+				_ = db.file.Close()
+			}
 			return nil, err
 		}
 	}
@@ -180,7 +363,17 @@ func (db *DB) Close() error {
 	if db.closed {
 		return ErrDatabaseClosed
 	}
+	// The group commit that is being synced uses the file.
+	db.waitSync()
+	if db.closed {
+		return ErrDatabaseClosed
+	}
 	db.closed = true
+	if db.watchq != nil {
+		db.watchq.close()
+	}
+	// wake up the streams
+	db.logcond.Broadcast()
 	if db.persist {
 		db.file.Sync() // do a sync but ignore the error
 		if err := db.file.Close(); err != nil {
@@ -190,6 +383,7 @@ func (db *DB) Close() error {
 	// Let's release all references to nil. This will help both with debugging
 	// late usage panics and it provides a hint to the garbage collector
 	db.keys, db.exps, db.idxs, db.file = nil, nil, nil, nil
+	db.spaces = nil
 	return nil
 }
 
@@ -203,22 +397,35 @@ func (db *DB) Save(wr io.Writer) error {
 	defer db.mu.RUnlock()
 	// use a buffered writer and flush every 4MB
 	var buf []byte
+	if !db.textaof {
+		buf = db.aofcrypt.appendHeader(buf)
+	}
 	// iterated through every item in the database and write to the buffer
-	db.keys.Ascend(func(item btree.Item) bool {
-		dbi := item.(*dbItem)
-		buf = dbi.writeSetTo(buf)
-		if len(buf) > 1024*1024*4 {
-			// flush when buffer is over 4MB
-			_, err = wr.Write(buf)
-			if err != nil {
-				return false
+	for _, kdb := range db.spaceDBs() {
+		if !db.textaof {
+			mark := len(buf)
+			buf = kdb.writeIndexesTo(buf)
+			buf = db.aofcrypt.seal(buf, mark)
+		}
+		kdb.keys.Ascend(func(item btree.Item) bool {
+			dbi := item.(*dbItem)
+			mark := len(buf)
+			buf = db.writeSetTo(buf, dbi)
+			buf = wrapKeyspace(buf, mark, kdb.space)
+			buf = db.aofcrypt.seal(buf, mark)
+			if len(buf) > 1024*1024*4 {
+				// flush when buffer is over 4MB
+				_, err = wr.Write(buf)
+				if err != nil {
+					return false
+				}
+				buf = buf[:0]
 			}
-			buf = buf[:0]
+			return true
+		})
+		if err != nil {
+			return err
 		}
-		return true
-	})
-	if err != nil {
-		return err
 	}
 	// one final flush
 	if len(buf) > 0 {
@@ -254,6 +461,11 @@ type index struct {
 	rect    func(item string) (min, max []float64) // rect from string function
 	db      *DB                                    // the origin database
 	opts    IndexOptions                           // index options
+	fields  []IndexField                           // compound index fields
+	extract func(value string) string              // text from value function
+	txt     *textIndex                             // contains the terms
+	def     *indexDef                              // the persistent definition
+	lazy    bool                                   // filled when first used
 }
 
 // match matches the pattern to the key
@@ -272,6 +484,59 @@ func (idx *index) match(key string) bool {
 	return match.Match(key, idx.pattern)
 }
 
+// include returns true when the item belongs in the index.
+func (idx *index) include(dbi *dbItem) bool {
+	if !idx.match(dbi.key) {
+		return false
+	}
+	return idx.opts.Filter == nil || idx.opts.Filter(dbi.key, dbi.value())
+}
+
+// duplicate returns true when a unique index has a live item with the same
+// value as the item, but with another key.
+func (idx *index) duplicate(item *dbItem) bool {
+	var dup bool
+	val := item.value()
+	idx.btr.AscendGreaterOrEqual(&dbItem{val: val},
+		func(bi btree.Item) bool {
+			dbi := bi.(*dbItem)
+			if idx.less(val, dbi.value()) {
+				// past the items with the same value
+				return false
+			}
+			if dbi.key != item.key && !dbi.expired() {
+				dup = true
+				return false
+			}
+			return true
+		},
+	)
+	return dup
+}
+
+// checkUnique returns ErrUniqueViolation when the index is unique and it has
+// items with the same value.
+func (idx *index) checkUnique() error {
+	if !idx.opts.Unique || idx.btr == nil {
+		return nil
+	}
+	var prev *dbItem
+	var err error
+	idx.btr.Ascend(func(bi btree.Item) bool {
+		dbi := bi.(*dbItem)
+		if dbi.expired() {
+			return true
+		}
+		if prev != nil && !idx.less(prev.value(), dbi.value()) {
+			err = ErrUniqueViolation
+			return false
+		}
+		prev = dbi
+		return true
+	})
+	return err
+}
+
 // clearCopy creates a copy of the index, but with an empty dataset.
 func (idx *index) clearCopy() *index {
 	// copy the index meta information
@@ -282,6 +547,9 @@ func (idx *index) clearCopy() *index {
 		less:    idx.less,
 		rect:    idx.rect,
 		opts:    idx.opts,
+		fields:  idx.fields,
+		extract: idx.extract,
+		def:     idx.def,
 	}
 	// initialize with empty trees
 	if nidx.less != nil {
@@ -290,6 +558,9 @@ func (idx *index) clearCopy() *index {
 	if nidx.rect != nil {
 		nidx.rtr = rtree.New(nidx)
 	}
+	if nidx.extract != nil {
+		nidx.txt = newTextIndex()
+	}
 	return nidx
 }
 
@@ -302,11 +573,14 @@ func (idx *index) rebuild() {
 	if idx.rect != nil {
 		idx.rtr = rtree.New(idx)
 	}
+	if idx.extract != nil {
+		idx.txt = newTextIndex()
+	}
 	// iterate through all keys and fill the index
 	idx.db.keys.Ascend(func(item btree.Item) bool {
 		dbi := item.(*dbItem)
-		if !idx.match(dbi.key) {
-			// does not match the pattern, conintue
+		if !idx.include(dbi) {
+			// does not match the pattern or filter, conintue
 			return true
 		}
 		if idx.less != nil {
@@ -315,6 +589,9 @@ func (idx *index) rebuild() {
 		if idx.rect != nil {
 			idx.rtr.Insert(dbi)
 		}
+		if idx.extract != nil {
+			idx.txt.insert(dbi.key, idx.extract(dbi.value()))
+		}
 		return true
 	})
 }
@@ -447,7 +724,9 @@ func (db *DB) ReadConfig(config *Config) error {
 	return nil
 }
 
-// SetConfig updates the database configuration.
+// SetConfig updates the database configuration. Returns ErrInvalidOperation
+// when the OnExpired or OnEvicted callback is set for a database that has
+// keyspaces.
 func (db *DB) SetConfig(config Config) error {
 	db.mu.Lock()
 	defer db.mu.Unlock()
@@ -459,7 +738,20 @@ func (db *DB) SetConfig(config Config) error {
 		return ErrInvalidSyncPolicy
 	case Never, EverySecond, Always:
 	}
+	switch config.EvictionPolicy {
+	default:
+		return ErrInvalidEvictionPolicy
+	case NoEviction, AllKeysLRU, AllKeysLFU, VolatileTTL:
+	}
+	if len(db.spaces) > 0 &&
+		(config.OnExpired != nil || config.OnEvicted != nil) {
+		// The callbacks are not told the keyspaces of the keys.
+		return ErrInvalidOperation
+	}
 	db.config = config
+	for _, kdb := range db.spaces {
+		kdb.config = config
+	}
 	return nil
 }
 
@@ -469,10 +761,12 @@ func (db *DB) SetConfig(config Config) error {
 func (db *DB) insertIntoDatabase(item *dbItem) *dbItem {
 	var pdbi *dbItem
 	prev := db.keys.ReplaceOrInsert(item)
+	db.memsize += item.size()
 	if prev != nil {
 		// A previous item was removed from the keys tree. Let's
 		// fully delete this item from all indexes.
 		pdbi = prev.(*dbItem)
+		db.memsize -= pdbi.size()
 		if pdbi.opts != nil && pdbi.opts.ex {
 			// Remove it from the exipres tree.
 			db.exps.Delete(pdbi)
@@ -486,6 +780,10 @@ func (db *DB) insertIntoDatabase(item *dbItem) *dbItem {
 				// Remove it from the rtree index.
 				idx.rtr.Remove(pdbi)
 			}
+			if idx.txt != nil {
+				// Remove it from the text index.
+				idx.txt.remove(pdbi.key, idx.extract(pdbi.value()))
+			}
 		}
 	}
 	if item.opts != nil && item.opts.ex {
@@ -494,7 +792,7 @@ func (db *DB) insertIntoDatabase(item *dbItem) *dbItem {
 		db.exps.ReplaceOrInsert(item)
 	}
 	for _, idx := range db.idxs {
-		if !idx.match(item.key) {
+		if !idx.include(item) {
 			continue
 		}
 		if idx.btr != nil {
@@ -505,11 +803,27 @@ func (db *DB) insertIntoDatabase(item *dbItem) *dbItem {
 			// Add new item to rtree index.
 			idx.rtr.Insert(item)
 		}
+		if idx.txt != nil {
+			// Add new item to text index.
+			idx.txt.insert(item.key, idx.extract(item.value()))
+		}
 	}
 	// we must return the previous item to the caller.
 	return pdbi
 }
 
+// checkUnique returns ErrUniqueViolation when the item cannot be inserted
+// because a unique index has an item with the same value.
+func (db *DB) checkUnique(item *dbItem) error {
+	for _, idx := range db.idxs {
+		if idx.opts.Unique && idx.btr != nil && idx.include(item) &&
+			idx.duplicate(item) {
+			return ErrUniqueViolation
+		}
+	}
+	return nil
+}
+
 // deleteFromDatabase removes and item from the database and indexes. The input
 // item must only have the key field specified thus "&dbItem{key: key}" is all
 // that is needed to fully remove the item with the matching key. If an item
@@ -521,6 +835,7 @@ func (db *DB) deleteFromDatabase(item *dbItem) *dbItem {
 	prev := db.keys.Delete(item)
 	if prev != nil {
 		pdbi = prev.(*dbItem)
+		db.memsize -= pdbi.size()
 		if pdbi.opts != nil && pdbi.opts.ex {
 			// Remove it from the exipres tree.
 			db.exps.Delete(pdbi)
@@ -534,6 +849,10 @@ func (db *DB) deleteFromDatabase(item *dbItem) *dbItem {
 				// Remove it from the rtree index.
 				idx.rtr.Remove(pdbi)
 			}
+			if idx.txt != nil {
+				// Remove it from the text index.
+				idx.txt.remove(pdbi.key, idx.extract(pdbi.value()))
+			}
 		}
 	}
 	return pdbi
@@ -552,45 +871,62 @@ func (db *DB) backgroundManager() {
 		var onExpired func([]string)
 		var expired []*dbItem
 		var onExpiredSync func(key, value string, tx *Tx) error
-		err := db.Update(func(tx *Tx) error {
+		err := db.managed(true, true, func(tx *Tx) error {
+			if db.persist && !db.config.AutoShrinkDisabled {
+				aofsz := int(db.fileSize())
+				if aofsz > db.config.AutoShrinkMinSize {
+					prc := float64(db.config.AutoShrinkPercentage) / 100.0
+					shrink = aofsz > db.lastaofsz+int(float64(db.lastaofsz)*prc)
+				}
+			}
+			if db.follower {
+				// The leader sends the deletes for the expired items.
+				return nil
+			}
 			onExpired = db.config.OnExpired
 			if onExpired == nil {
 				onExpiredSync = db.config.OnExpiredSync
 			}
-			if db.persist && !db.config.AutoShrinkDisabled {
-				pos, err := db.file.Seek(0, 1)
+			for _, name := range append([]string{""}, db.spaceNames()...) {
+				ktx, err := tx.Keyspace(name)
 				if err != nil {
 					return err
 				}
-				aofsz := int(pos)
-				if aofsz > db.config.AutoShrinkMinSize {
-					prc := float64(db.config.AutoShrinkPercentage) / 100.0
-					shrink = aofsz > db.lastaofsz+int(float64(db.lastaofsz)*prc)
-				}
-			}
-			// produce a list of expired items that need removing
-			db.exps.AscendLessThan(&dbItem{
-				opts: &dbItemOpts{ex: true, exat: time.Now()},
-			}, func(item btree.Item) bool {
-				expired = append(expired, item.(*dbItem))
-				return true
-			})
-			if onExpired == nil && onExpiredSync == nil {
-				for _, itm := range expired {
-					if _, err := tx.Delete(itm.key); err != nil {
-						// it's ok to get a "not found" because the
-						// 'Delete' method reports "not found" for
-						// expired items.
-						if err != ErrNotFound {
+				// produce a list of expired items that need removing
+				var kexpired []*dbItem
+				ktx.db.exps.AscendLessThan(&dbItem{
+					opts: &dbItemOpts{ex: true, exat: time.Now()},
+				}, func(item btree.Item) bool {
+					kexpired = append(kexpired, item.(*dbItem))
+					return true
+				})
+				if onExpired != nil {
+					// There are no keyspaces when OnExpired is set.
+					expired = kexpired
+				} else if onExpiredSync == nil {
+					for _, itm := range kexpired {
+						if _, err := ktx.Delete(itm.key); err != nil {
+							// it's ok to get a "not found" because the
+							// 'Delete' method reports "not found" for
+							// expired items.
+							if err != ErrNotFound {
+								return err
+							}
+						}
+					}
+				} else {
+					for _, itm := range kexpired {
+						if err := onExpiredSync(itm.key, itm.value(), ktx); err != nil {
 							return err
 						}
 					}
 				}
-			} else if onExpiredSync != nil {
-				for _, itm := range expired {
-					if err := onExpiredSync(itm.key, itm.val, tx); err != nil {
-						return err
-					}
+			}
+			// evict items when the max memory was lowered.
+			if db.config.MaxMemory > 0 &&
+				db.config.EvictionPolicy != NoEviction {
+				if err := tx.evict("", 0); err != nil && err != ErrMaxMemory {
+					return err
 				}
 			}
 			return nil
@@ -653,29 +989,42 @@ func (db *DB) Shrink() error {
 		db.shrinking = false
 		db.mu.Unlock()
 	}()
-	fname := db.file.Name()
+	if db.segs != nil {
+		return db.compactSegments()
+	}
+	fname := db.path
 	tmpname := fname + ".tmp"
+	textaof := db.textaof
+	// The new file is encrypted when there's a key, which is how a file that
+	// is not encrypted is migrated.
+	oldcrypt, newcrypt := db.aofcrypt, db.crypt
 	// the endpos is used to return to the end of the file when we are
 	// finished writing all of the current items.
-	endpos, err := db.file.Seek(0, 2)
-	if err != nil {
-		return err
-	}
+	endpos := db.aofsize
+	// the log offset of the endpos, which is where the new commands start.
+	endoff := db.logOffset()
+	cur := db.newItemCursor()
 	db.mu.Unlock()
 	time.Sleep(time.Second / 4) // wait just a bit before starting
-	f, err := os.Create(tmpname)
+	// Start with an empty file, in case that a previous shrink failed.
+	if err := db.fs.Remove(tmpname); err != nil {
+		return err
+	}
+	f, err := db.fs.OpenFile(tmpname)
 	if err != nil {
 		return err
 	}
 	defer func() {
 		_ = f.Close()
-		_ = os.RemoveAll(tmpname)
+		_ = db.fs.Remove(tmpname)
 	}()
+	// The new file is always written in the binary format. This is how a
+	// file in the legacy text format is migrated.
+	w := &aofWriter{w: f, crypt: newcrypt}
 
 	// we are going to read items in as chunks as to not hold up the database
 	// for too long.
 	var buf []byte
-	pivot := ""
 	done := false
 	for !done {
 		err := func() error {
@@ -684,24 +1033,12 @@ func (db *DB) Shrink() error {
 			if db.closed {
 				return ErrDatabaseClosed
 			}
-			done = true
-			var n int
-			db.keys.AscendGreaterOrEqual(&dbItem{key: pivot},
-				func(item btree.Item) bool {
-					dbi := item.(*dbItem)
-					// 1000 items or 64MB buffer
-					if n > 1000 || len(buf) > 64*1024*1024 {
-						pivot = dbi.key
-						done = false
-						return false
-					}
-					buf = dbi.writeSetTo(buf)
-					n++
-					return true
-				},
-			)
+			var more bool
+			buf, more = cur.next(db, buf, db.opts.Compression)
+			done = !more
+			buf = newcrypt.seal(buf, 0)
 			if len(buf) > 0 {
-				if _, err := f.Write(buf); err != nil {
+				if _, err := w.Write(buf); err != nil {
 					return err
 				}
 				buf = buf[:0]
@@ -712,6 +1049,19 @@ func (db *DB) Shrink() error {
 			return err
 		}
 	}
+	// Mark the log offset of the new commands, which allows for the log to be
+	// streamed beyond a shrink. An empty log needs no mark.
+	if endoff != 0 {
+		buf = writeMarkRecordTo(buf[:0], endoff)
+		buf = newcrypt.seal(buf, 0)
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+	}
+	logpos := w.n
+	if logpos < int64(newcrypt.headerSize()) {
+		logpos = int64(newcrypt.headerSize())
+	}
 	// We reached this far so all of the items have been written to a new tmp
 	// There's some more work to do by appending the new line from the aof
 	// to the tmp file and finally swap the files out.
@@ -720,25 +1070,52 @@ func (db *DB) Shrink() error {
 		// lock/unlock.
 		db.mu.Lock()
 		defer db.mu.Unlock()
+		// The group commit that is being synced uses the file.
+		db.waitSync()
 		if db.closed {
 			return ErrDatabaseClosed
 		}
 		// We are going to open a new version of the aof file so that we do
 		// not change the seek position of the previous. This may cause a
 		// problem in the future if we choose to use syscall file locking.
-		aof, err := os.Open(fname)
+		aof, err := db.fs.ReadAll(fname)
 		if err != nil {
 			return err
 		}
 		defer func() { _ = aof.Close() }()
-		if _, err := aof.Seek(endpos, 0); err != nil {
-			return err
+		if !textaof && endpos == 0 && db.aofsize > 0 {
+			// The file was empty. Skip the header of the new commands.
+			endpos = int64(oldcrypt.headerSize())
 		}
-		// Just copy all of the new commands that have occurred since we
-		// started the shrink process.
-		if _, err := io.Copy(f, aof); err != nil {
+		if err := skipRead(aof, endpos); err != nil {
 			return err
 		}
+		if textaof || oldcrypt != newcrypt {
+			// Convert all of the new commands that have occurred since we
+			// started the shrink process.
+			ar := newAOFReader(aof, time.Now())
+			ar.text = textaof
+			ar.hdr, ar.enc, ar.cipher = true, oldcrypt != nil, oldcrypt
+			var cmd aofCommand
+			for {
+				if err := ar.next(&cmd); err != nil {
+					if err == io.EOF {
+						break
+					}
+					return err
+				}
+				buf = newcrypt.seal(cmd.writeRecordTo(buf[:0]), 0)
+				if _, err := w.Write(buf); err != nil {
+					return err
+				}
+			}
+		} else {
+			// Just copy all of the new commands that have occurred since we
+			// started the shrink process.
+			if _, err := io.Copy(w, aof); err != nil {
+				return err
+			}
+		}
 		// Close all files
 		if err := aof.Close(); err != nil {
 			return err
@@ -750,193 +1127,132 @@ func (db *DB) Shrink() error {
 			return err
 		}
 		// Any failures below here is really bad. So just panic.
-		if err := os.Rename(tmpname, fname); err != nil {
+		if err := db.fs.Rename(tmpname, fname); err != nil {
 			panic(err)
 		}
-		db.file, err = os.OpenFile(fname, os.O_CREATE|os.O_RDWR, 0666)
+		db.file, err = db.fs.OpenFile(fname)
 		if err != nil {
 			panic(err)
 		}
-		pos, err := db.file.Seek(0, 2)
+		pos, err := db.file.Size()
 		if err != nil {
 			return err
 		}
 		db.lastaofsz = int(pos)
+		db.shrinkat = time.Now()
+		db.textaof = false
+		db.aofcrypt = newcrypt
+		db.aofhdr = w.hdr
+		db.aofsize = pos
+		db.logstart, db.logpos = endoff, logpos
+		db.aofgen++
+		db.logcond.Broadcast()
 		return nil
 	}()
 }
 
-var errValidEOF = errors.New("valid eof")
+// aofWriter writes the binary header prior to the first write.
+type aofWriter struct {
+	w     io.Writer
+	hdr   bool
+	n     int64      // number of bytes written, including the header
+	crypt *aofCipher // the cipher of the header, nil for no encryption
+}
+
+func (w *aofWriter) Write(p []byte) (int, error) {
+	if !w.hdr && len(p) > 0 {
+		hdr := w.crypt.appendHeader(nil)
+		if _, err := w.w.Write(hdr); err != nil {
+			return 0, err
+		}
+		w.hdr = true
+		w.n += int64(len(hdr))
+	}
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
 
 // readLoad reads from the reader and loads commands into the database.
 // modTime is the modified time of the reader, should be no greater than
 // the current time.Now().
 func (db *DB) readLoad(rd io.Reader, modTime time.Time) error {
-	data := make([]byte, 4096)
-	parts := make([]string, 0, 8)
-	r := bufio.NewReader(rd)
-	for {
-		// read a single command.
-		// first we should read the number of parts that the of the command
-		line, err := r.ReadBytes('\n')
+	ar := newAOFReader(rd, modTime)
+	ar.cipher = db.crypt
+	return db.readAOF(ar)
+}
+
+// load reads entries from the append only database file and fills the database.
+// The file is either in the binary format or in the legacy text format, which
+// is the Redis append only file format. For more information on the binary
+// format please see aof.go.
+//
+// A binary file that ends with a truncated or damaged record, or a text file
+// that ends with a truncated command, will be cut off at the last good record,
+// unless the StrictLoad option is used. A damaged record that is followed by
+// valid records is not cut off, and ErrCorrupted is returned. An encrypted
+// file is decrypted with the EncryptionKey option.
+func (db *DB) load() error {
+	rd, err := db.fs.ReadAll(db.path)
+	if err != nil {
+		return err
+	}
+	defer rd.Close()
+	// The expirations of the legacy text format are relative to the modified
+	// time of the file.
+	modTime := time.Now()
+	if f, ok := rd.(*os.File); ok {
+		fi, err := f.Stat()
 		if err != nil {
-			if len(line) > 0 {
-				// got an eof but also data. this should be an unexpected eof.
-				return io.ErrUnexpectedEOF
-			}
-			if err == io.EOF {
-				break
-			}
 			return err
 		}
-		if line[0] != '*' {
-			return ErrInvalid
-		}
-		// convert the string number to and int
-		var n int
-		if len(line) == 4 && line[len(line)-2] == '\r' {
-			if line[1] < '0' || line[1] > '9' {
-				return ErrInvalid
-			}
-			n = int(line[1] - '0')
-		} else {
-			if len(line) < 5 || line[len(line)-2] != '\r' {
-				return ErrInvalid
-			}
-			for i := 1; i < len(line)-2; i++ {
-				if line[i] < '0' || line[i] > '9' {
-					return ErrInvalid
-				}
-				n = n*10 + int(line[i]-'0')
-			}
+		modTime = fi.ModTime()
+	}
+	ar := newAOFReader(rd, modTime)
+	ar.cipher = db.crypt
+	db.textaof = ar.text
+	if err := db.readAOF(ar); err != nil {
+		if db.opts.StrictLoad || (err != io.ErrUnexpectedEOF &&
+			(ar.text || err != ErrCorrupted)) {
+			return err
 		}
-		// read each part of the command.
-		parts = parts[:0]
-		for i := 0; i < n; i++ {
-			// read the number of bytes of the part.
-			line, err := r.ReadBytes('\n')
+		if !ar.text {
+			tail, err := db.damagedTail(db.path, ar.n)
 			if err != nil {
 				return err
 			}
-			if line[0] != '$' {
-				return ErrInvalid
-			}
-			// convert the string number to and int
-			var n int
-			if len(line) == 4 && line[len(line)-2] == '\r' {
-				if line[1] < '0' || line[1] > '9' {
-					return ErrInvalid
-				}
-				n = int(line[1] - '0')
-			} else {
-				if len(line) < 5 || line[len(line)-2] != '\r' {
-					return ErrInvalid
-				}
-				for i := 1; i < len(line)-2; i++ {
-					if line[i] < '0' || line[i] > '9' {
-						return ErrInvalid
-					}
-					n = n*10 + int(line[i]-'0')
-				}
-			}
-			// resize the read buffer
-			if len(data) < n+2 {
-				dataln := len(data)
-				for dataln < n+2 {
-					dataln *= 2
-				}
-				data = make([]byte, dataln)
-			}
-			if _, err = io.ReadFull(r, data[:n+2]); err != nil {
-				return err
-			}
-			if data[n] != '\r' || data[n+1] != '\n' {
-				return ErrInvalid
+			if !tail {
+				return ErrCorrupted
 			}
-			// copy string
-			parts = append(parts, string(data[:n]))
 		}
-		// finished reading the command
-
-		if len(parts) == 0 {
-			continue
-		}
-		if (parts[0][0] == 's' || parts[0][1] == 'S') &&
-			(parts[0][1] == 'e' || parts[0][1] == 'E') &&
-			(parts[0][2] == 't' || parts[0][2] == 'T') {
-			// SET
-			if len(parts) < 3 || len(parts) == 4 || len(parts) > 5 {
-				return ErrInvalid
-			}
-			if len(parts) == 5 {
-				if strings.ToLower(parts[3]) != "ex" {
-					return ErrInvalid
-				}
-				ex, err := strconv.ParseInt(parts[4], 10, 64)
-				if err != nil {
-					return err
-				}
-				now := time.Now()
-				dur := (time.Duration(ex) * time.Second) - now.Sub(modTime)
-				if dur > 0 {
-					db.insertIntoDatabase(&dbItem{
-						key: parts[1],
-						val: parts[2],
-						opts: &dbItemOpts{
-							ex:   true,
-							exat: now.Add(dur),
-						},
-					})
-				}
-			} else {
-				db.insertIntoDatabase(&dbItem{key: parts[1], val: parts[2]})
-			}
-		} else if (parts[0][0] == 'd' || parts[0][1] == 'D') &&
-			(parts[0][1] == 'e' || parts[0][1] == 'E') &&
-			(parts[0][2] == 'l' || parts[0][2] == 'L') {
-			// DEL
-			if len(parts) != 2 {
-				return ErrInvalid
-			}
-			db.deleteFromDatabase(&dbItem{key: parts[1]})
-		} else if (parts[0][0] == 'f' || parts[0][1] == 'F') &&
-			strings.ToLower(parts[0]) == "flushdb" {
-			db.keys = btree.New(btreeDegrees, nil)
-			db.exps = btree.New(btreeDegrees, &exctx{db})
-			db.idxs = make(map[string]*index)
-		} else {
-			return ErrInvalid
+		if err := db.file.Truncate(ar.n); err != nil {
+			return err
 		}
 	}
-	return nil
-}
-
-// load reads entries from the append only database file and fills the database.
-// The file format uses the Redis append only file format, which is and a series
-// of RESP commands. For more information on RESP please read
-// http://redis.io/topics/protocol. The only supported RESP commands are DEL and
-// SET.
-func (db *DB) load() error {
-	fi, err := db.file.Stat()
-	if err != nil {
-		return err
+	db.aofhdr = ar.n > 0
+	if ar.text || (db.aofhdr && !ar.enc) {
+		// A file that is not encrypted stays that way until it's shrunk.
+		db.aofcrypt = nil
 	}
-	if err := db.readLoad(db.file, fi.ModTime()); err != nil {
-		return err
+	if !ar.text && db.logpos == 0 {
+		// There was no mark. The records start after the header.
+		db.logpos = int64(db.aofcrypt.headerSize())
 	}
-	pos, err := db.file.Seek(0, 2)
+	pos, err := db.file.Size()
 	if err != nil {
 		return err
 	}
+	db.aofsize = pos
 	db.lastaofsz = int(pos)
 	return nil
 }
 
 // managed calls a block of code that is fully contained in a transaction.
 // This method is intended to be wrapped by Update and View
-func (db *DB) managed(writable bool, fn func(tx *Tx) error) (err error) {
+func (db *DB) managed(writable, internal bool, fn func(tx *Tx) error) (
+	err error) {
 	var tx *Tx
-	tx, err = db.Begin(writable)
+	tx, err = db.begin(writable, internal)
 	if err != nil {
 		return
 	}
@@ -969,7 +1285,7 @@ func (db *DB) managed(writable bool, fn func(tx *Tx) error) (err error) {
 // Executing a manual commit or rollback from inside the function will result
 // in a panic.
 func (db *DB) View(fn func(tx *Tx) error) error {
-	return db.managed(false, fn)
+	return db.managed(false, false, fn)
 }
 
 // Update executes a function within a managed read/write transaction.
@@ -981,7 +1297,7 @@ func (db *DB) View(fn func(tx *Tx) error) error {
 // Executing a manual commit or rollback from inside the function will result
 // in a panic.
 func (db *DB) Update(fn func(tx *Tx) error) error {
-	return db.managed(true, fn)
+	return db.managed(true, false, fn)
 }
 
 // get return an item or nil if not found.
@@ -1004,6 +1320,9 @@ type Tx struct {
 	writable bool            // when false mutable operations fail.
 	funcd    bool            // when true Commit and Rollback panic.
 	wc       *txWriteContext // context for writable transactions.
+	oc       *txOptContext   // context for optimistic transactions.
+	parent   *Tx             // the transaction that a keyspace is part of.
+	spaces   map[string]*Tx  // the transactions of the keyspaces.
 }
 
 type txWriteContext struct {
@@ -1014,8 +1333,13 @@ type txWriteContext struct {
 
 	rollbackItems   map[string]*dbItem // details for rolling back tx.
 	commitItems     map[string]*dbItem // details for committing tx.
+	commitExpires   map[string]bool    // keys with only a new expiration.
+	commitIndexes   map[string]*index  // persistent indexes, nil for drops.
 	itercount       int                // stack of iterators
 	rollbackIndexes map[string]*index  // details for dropped indexes.
+	rbmemsize       int64              // memory size prior to deleteAll.
+	evicted         []string           // keys evicted by the tx.
+	created         bool               // the keyspace was created by the tx.
 }
 
 // DeleteAll deletes all items from the database.
@@ -1034,10 +1358,12 @@ func (tx *Tx) DeleteAll() error {
 		tx.wc.rbkeys = tx.db.keys
 		tx.wc.rbexps = tx.db.exps
 		tx.wc.rbidxs = tx.db.idxs
+		tx.wc.rbmemsize = tx.db.memsize
 	}
 
 	// now reset the live database trees
 	tx.db.keys = btree.New(btreeDegrees, nil)
+	tx.db.memsize = 0
 	tx.db.exps = btree.New(btreeDegrees, &exctx{tx.db})
 	tx.db.idxs = make(map[string]*index)
 
@@ -1047,7 +1373,10 @@ func (tx *Tx) DeleteAll() error {
 	}
 
 	// always clear out the commits
-	tx.wc.commitItems = make(map[string]*dbItem)
+	if tx.wc.commitItems != nil {
+		tx.wc.commitItems = make(map[string]*dbItem)
+		tx.wc.commitExpires = make(map[string]bool)
+	}
 
 	return nil
 }
@@ -1060,6 +1389,12 @@ func (tx *Tx) DeleteAll() error {
 //
 // All transactions must be closed by calling Commit() or Rollback() when done.
 func (db *DB) Begin(writable bool) (*Tx, error) {
+	return db.begin(writable, false)
+}
+
+// begin opens a new transaction. Internal transactions, such as the ones
+// used by the background manager, are allowed to write to a follower.
+func (db *DB) begin(writable, internal bool) (*Tx, error) {
 	tx := &Tx{
 		db:       db,
 		writable: writable,
@@ -1069,6 +1404,14 @@ func (db *DB) Begin(writable bool) (*Tx, error) {
 		tx.unlock()
 		return nil, ErrDatabaseClosed
 	}
+	if writable && db.follower && !internal {
+		tx.unlock()
+		return nil, ErrFollower
+	}
+	if writable && db.syncerr != nil {
+		tx.unlock()
+		return nil, db.syncerr
+	}
 	if writable {
 		// writable transactions have a writeContext object that
 		// contains information about changes to the database.
@@ -1077,13 +1420,18 @@ func (db *DB) Begin(writable bool) (*Tx, error) {
 		tx.wc.rollbackIndexes = make(map[string]*index)
 		if db.persist {
 			tx.wc.commitItems = make(map[string]*dbItem)
+			tx.wc.commitExpires = make(map[string]bool)
 		}
 	}
 	return tx, nil
 }
 
 // lock locks the database based on the transaction type.
+// Snapshots are never shared and do not require locking.
 func (tx *Tx) lock() {
+	if tx.db.snapshot {
+		return
+	}
 	if tx.writable {
 		tx.db.mu.Lock()
 	} else {
@@ -1093,6 +1441,9 @@ func (tx *Tx) lock() {
 
 // unlock unlocks the database based on the transaction type.
 func (tx *Tx) unlock() {
+	if tx.db.snapshot {
+		return
+	}
 	if tx.writable {
 		tx.db.mu.Unlock()
 	} else {
@@ -1108,6 +1459,7 @@ func (tx *Tx) rollbackInner() {
 		tx.db.keys = tx.wc.rbkeys
 		tx.db.idxs = tx.wc.rbidxs
 		tx.db.exps = tx.wc.rbexps
+		tx.db.memsize = tx.wc.rbmemsize
 	}
 	for key, item := range tx.wc.rollbackItems {
 		tx.db.deleteFromDatabase(&dbItem{key: key})
@@ -1127,12 +1479,24 @@ func (tx *Tx) rollbackInner() {
 			idx.rebuild()
 		}
 	}
+	for name, ktx := range tx.spaces {
+		if ktx.writable {
+			ktx.rollbackInner()
+			if ktx.wc.created {
+				delete(tx.db.spaces, name)
+			}
+		}
+	}
 }
 
 // Commit writes all changes to disk.
 // An error is returned when a write error occurs, or when a Commit() is called
 // from a read-only transaction.
 func (tx *Tx) Commit() error {
+	if tx.parent != nil {
+		// A keyspace is committed with the transaction it's part of.
+		return tx.parent.Commit()
+	}
 	if tx.funcd {
 		panic("managed tx commit not allowed")
 	}
@@ -1141,59 +1505,159 @@ func (tx *Tx) Commit() error {
 	} else if !tx.writable {
 		return ErrTxNotWritable
 	}
+	if tx.oc != nil {
+		// The changes are committed by another transaction, which is
+		// counted in the stats.
+		return tx.commitOptimistic()
+	}
+	db, start := tx.db, time.Now()
+	err := tx.commit()
+	db.stats.commit(start, err)
+	return err
+}
+
+// commit writes the changes of a read/write transaction.
+func (tx *Tx) commit() error {
 	var err error
-	if tx.db.persist && (len(tx.wc.commitItems) > 0 || tx.wc.rbkeys != nil) {
+	if tx.db.persist && tx.dirty() {
+		if tx.db.config.SyncPolicy == Always || tx.db.lastgroup != nil {
+			// The changes are written and synced together with the
+			// changes of the transactions that commit at the same time.
+			return tx.commitGrouped()
+		}
 		tx.db.buf = tx.db.buf[:0]
-		// write a flushdb if a deleteAll was called.
-		if tx.wc.rbkeys != nil {
-			tx.db.buf = append(tx.db.buf, "*1\r\n$7\r\nflushdb\r\n"...)
-		}
-		// Each committed record is written to disk
-		for key, item := range tx.wc.commitItems {
-			if item == nil {
-				tx.db.buf = (&dbItem{key: key}).writeDeleteTo(tx.db.buf)
-			} else {
-				tx.db.buf = item.writeSetTo(tx.db.buf)
-			}
+		if !tx.db.textaof && !tx.db.aofhdr {
+			// The first write to an empty file includes the header.
+			tx.db.buf = tx.db.aofcrypt.appendHeader(tx.db.buf)
 		}
+		mark := len(tx.db.buf)
+		tx.db.buf = tx.writeRecordsTo(tx.db.buf)
+		tx.db.buf = tx.db.aofcrypt.seal(tx.db.buf, mark)
 		// Flushing the buffer only once per transaction.
 		// If this operation fails then the write did failed and we must
 		// rollback.
-		if _, err = tx.db.file.Write(tx.db.buf); err != nil {
+		var n int
+		if n, err = tx.db.file.Write(tx.db.buf); err != nil {
 			tx.rollbackInner()
-		}
-		if tx.db.config.SyncPolicy == Always {
-			_ = tx.db.file.Sync()
+			if n > 0 {
+				// Cut off the partial write, otherwise the records that
+				// follow will not be readable.
+				_ = tx.db.file.Truncate(tx.db.aofsize)
+			}
+		} else {
+			tx.db.aofsize += int64(n)
+			tx.db.aofhdr = true
+			tx.db.logcond.Broadcast()
+			tx.db.rotateSegment()
 		}
 		// Increment the number of flushes. The background syncing uses this.
 		tx.db.flushes++
 	}
+	var onEvicted func(keys []string)
+	if err == nil && len(tx.wc.evicted) > 0 {
+		onEvicted = tx.db.config.OnEvicted
+	}
+	if err == nil && len(tx.db.watchers) > 0 {
+		// Queue the change events prior to unlocking, which guarantees that
+		// the watchers see the events in commit order.
+		if events := tx.changeEvents(); len(events) > 0 {
+			tx.db.watchq.push(events)
+		}
+	}
 	// Unlock the database and allow for another writable transaction.
 	tx.unlock()
+	if onEvicted != nil {
+		onEvicted(tx.wc.evicted)
+	}
 	// Clear the db field to disable this transaction from future use.
-	tx.db = nil
+	tx.release()
 	return err
 }
 
+// dirty returns true when the transaction, or one of its keyspaces, has
+// changes to write.
+func (tx *Tx) dirty() bool {
+	if len(tx.wc.commitItems) > 0 || len(tx.wc.commitIndexes) > 0 ||
+		tx.wc.rbkeys != nil {
+		return true
+	}
+	for _, ktx := range tx.spaces {
+		if ktx.dirty() {
+			return true
+		}
+	}
+	return false
+}
+
+// writeRecordsTo appends the records of the changes to the buffer, followed
+// by the records of the keyspaces.
+func (tx *Tx) writeRecordsTo(buf []byte) []byte {
+	// write a flushdb if a deleteAll was called.
+	if tx.wc.rbkeys != nil {
+		mark := len(buf)
+		buf = tx.db.writeFlushTo(buf)
+		buf = wrapKeyspace(buf, mark, tx.db.space)
+	}
+	// The persistent indexes are written prior to the items.
+	for name, idx := range tx.wc.commitIndexes {
+		mark := len(buf)
+		if idx == nil {
+			buf = writeDropRecordTo(buf, name)
+		} else {
+			buf = idx.def.writeRecordTo(buf)
+		}
+		buf = wrapKeyspace(buf, mark, tx.db.space)
+	}
+	// Each committed record is written to disk
+	for key, item := range tx.wc.commitItems {
+		mark := len(buf)
+		if item == nil {
+			buf = tx.db.writeDeleteTo(buf, &dbItem{key: key})
+		} else if tx.wc.commitExpires[key] {
+			buf = tx.db.writeExpireTo(buf, item)
+		} else {
+			buf = tx.db.writeSetTo(buf, item)
+		}
+		buf = wrapKeyspace(buf, mark, tx.db.space)
+	}
+	for _, ktx := range tx.spaces {
+		buf = ktx.writeRecordsTo(buf)
+	}
+	return buf
+}
+
 // Rollback closes the transaction and reverts all mutable operations that
 // were performed on the transaction such as Set() and Delete().
 //
 // Read-only transactions can only be rolled back, not committed.
 func (tx *Tx) Rollback() error {
+	if tx.parent != nil {
+		// A keyspace is rolled back with the transaction it's part of.
+		return tx.parent.Rollback()
+	}
 	if tx.funcd {
 		panic("managed tx rollback not allowed")
 	}
 	if tx.db == nil {
 		return ErrTxClosed
 	}
-	// The rollback func does the heavy lifting.
-	if tx.writable {
+	db, start := tx.db, time.Now()
+	if tx.oc != nil {
+		// The transaction has a private copy of the database.
+		db = tx.oc.db
+	}
+	// The rollback func does the heavy lifting. The changes of an optimistic
+	// transaction are only in its private copy of the database.
+	if tx.writable && tx.oc == nil {
 		tx.rollbackInner()
 	}
 	// unlock the database for more transactions.
 	tx.unlock()
 	// Clear the db field to disable this transaction from future use.
-	tx.db = nil
+	tx.release()
+	if tx.writable {
+		db.stats.rollback(start)
+	}
 	return nil
 }
 
@@ -1204,8 +1668,10 @@ type dbItemOpts struct {
 }
 type dbItem struct {
 	key, val string      // the binary key and value
+	zval     bool        // the val is compressed
 	opts     *dbItemOpts // optional meta information
 	keyless  bool        // keyless item for scanning
+	access   uint32      // access time or frequency for eviction
 }
 
 func appendArray(buf []byte, count int) []byte {
@@ -1231,14 +1697,14 @@ func (dbi *dbItem) writeSetTo(buf []byte) []byte {
 		buf = appendArray(buf, 5)
 		buf = appendBulkString(buf, "set")
 		buf = appendBulkString(buf, dbi.key)
-		buf = appendBulkString(buf, dbi.val)
+		buf = appendBulkString(buf, dbi.value())
 		buf = appendBulkString(buf, "ex")
 		buf = appendBulkString(buf, strconv.FormatUint(uint64(ex), 10))
 	} else {
 		buf = appendArray(buf, 3)
 		buf = appendBulkString(buf, "set")
 		buf = appendBulkString(buf, dbi.key)
-		buf = appendBulkString(buf, dbi.val)
+		buf = appendBulkString(buf, dbi.value())
 	}
 	return buf
 }
@@ -1290,10 +1756,11 @@ func (dbi *dbItem) Less(item btree.Item, ctx interface{}) bool {
 	case *index:
 		if ctx.less != nil {
 			// Using an index
-			if ctx.less(dbi.val, dbi2.val) {
+			val, val2 := dbi.value(), dbi2.value()
+			if ctx.less(val, val2) {
 				return true
 			}
-			if ctx.less(dbi2.val, dbi.val) {
+			if ctx.less(val2, val) {
 				return false
 			}
 		}
@@ -1312,7 +1779,7 @@ func (dbi *dbItem) Less(item btree.Item, ctx interface{}) bool {
 func (dbi *dbItem) Rect(ctx interface{}) (min, max []float64) {
 	switch ctx := ctx.(type) {
 	case *index:
-		return ctx.rect(dbi.val)
+		return ctx.rect(dbi.value())
 	}
 	return nil, nil
 }
@@ -1325,6 +1792,10 @@ type SetOptions struct {
 	// before being evicted. The Expires field must also be set to true.
 	// TTL stands for Time-To-Live.
 	TTL time.Duration
+	// ExpiresAt is the time when the key-value expires. It's used instead
+	// of the TTL when it's not the zero time, and then the Expires field is
+	// not needed.
+	ExpiresAt time.Time
 }
 
 // GetLess returns the less function for an index. This is handy for
@@ -1379,13 +1850,34 @@ func (tx *Tx) Set(key, value string, opts *SetOptions) (previousValue string,
 		return "", false, ErrTxIterating
 	}
 	item := &dbItem{key: key, val: value}
+	if err := tx.db.encodeItem(item); err != nil {
+		return "", false, err
+	}
 	if opts != nil {
-		if opts.Expires {
+		if !opts.ExpiresAt.IsZero() {
+			item.opts = &dbItemOpts{ex: true, exat: opts.ExpiresAt}
+		} else if opts.Expires {
 			// The caller is requesting that this item expires. Convert the
 			// TTL to an absolute time and bind it to the item.
 			item.opts = &dbItemOpts{ex: true, exat: time.Now().Add(opts.TTL)}
 		}
 	}
+	// The previous value is returned, so the item is read.
+	tx.trackRead(key)
+	return tx.set(item)
+}
+
+// set inserts an item into the database.
+func (tx *Tx) set(item *dbItem) (previousValue string, replaced bool,
+	err error) {
+	key := item.key
+	if err := tx.db.checkUnique(item); err != nil {
+		return "", false, err
+	}
+	if err := tx.makeRoom(item); err != nil {
+		return "", false, err
+	}
+	tx.db.initAccess(item)
 	// Insert the item into the keys tree.
 	prev := tx.db.insertIntoDatabase(item)
 
@@ -1396,7 +1888,11 @@ func (tx *Tx) Set(key, value string, opts *SetOptions) (previousValue string,
 			// create a rollback entry with a nil value. A nil value indicates
 			// that the entry should be deleted on rollback. When the value is
 			// *not* nil, that means the entry should be reverted.
-			tx.wc.rollbackItems[key] = nil
+			// An existing entry is kept because the key may have been deleted
+			// earlier in the transaction.
+			if _, ok := tx.wc.rollbackItems[key]; !ok {
+				tx.wc.rollbackItems[key] = nil
+			}
 		} else {
 			// A previous item already exists in the database. Let's create a
 			// rollback entry with the item as the value. We need to check the
@@ -1406,14 +1902,15 @@ func (tx *Tx) Set(key, value string, opts *SetOptions) (previousValue string,
 				tx.wc.rollbackItems[key] = prev
 			}
 			if !prev.expired() {
-				previousValue, replaced = prev.val, true
+				previousValue, replaced = prev.value(), true
 			}
 		}
 	}
 	// For commits we simply assign the item to the map. We use this map to
 	// write the entry to disk.
-	if tx.db.persist {
+	if tx.wc.commitItems != nil {
 		tx.wc.commitItems[key] = item
+		delete(tx.wc.commitExpires, key)
 	}
 	return previousValue, replaced, nil
 }
@@ -1429,13 +1926,15 @@ func (tx *Tx) Get(key string, ignoreExpired ...bool) (val string, err error) {
 	if len(ignoreExpired) != 0 {
 		ignore = ignoreExpired[0]
 	}
+	tx.trackRead(key)
 	item := tx.db.get(key)
 	if item == nil || (item.expired() && !ignore) {
 		// The item does not exists or has expired. Let's assume that
 		// the caller is only interested in items that have not expired.
 		return "", ErrNotFound
 	}
-	return item.val, nil
+	tx.db.touch(item)
+	return item.value(), nil
 }
 
 // Delete removes an item from the database based on the item's key. If the item
@@ -1451,6 +1950,7 @@ func (tx *Tx) Delete(key string) (val string, err error) {
 	} else if tx.wc.itercount > 0 {
 		return "", ErrTxIterating
 	}
+	tx.trackRead(key)
 	item := tx.db.deleteFromDatabase(&dbItem{key: key})
 	if item == nil {
 		return "", ErrNotFound
@@ -1461,8 +1961,9 @@ func (tx *Tx) Delete(key string) (val string, err error) {
 			tx.wc.rollbackItems[key] = item
 		}
 	}
-	if tx.db.persist {
+	if tx.wc.commitItems != nil {
 		tx.wc.commitItems[key] = nil
+		delete(tx.wc.commitExpires, key)
 	}
 	// Even though the item has been deleted, we still want to check
 	// if it has expired. An expired item should not be returned.
@@ -1471,7 +1972,7 @@ func (tx *Tx) Delete(key string) (val string, err error) {
 		// the caller is only interested in items that have not expired.
 		return "", ErrNotFound
 	}
-	return item.val, nil
+	return item.value(), nil
 }
 
 // TTL returns the remaining time-to-live for an item.
@@ -1481,6 +1982,7 @@ func (tx *Tx) TTL(key string) (time.Duration, error) {
 	if tx.db == nil {
 		return 0, ErrTxClosed
 	}
+	tx.trackRead(key)
 	item := tx.db.get(key)
 	if item == nil {
 		return 0, ErrNotFound
@@ -1494,6 +1996,66 @@ func (tx *Tx) TTL(key string) (time.Duration, error) {
 	return dur, nil
 }
 
+// Expire sets the time-to-live of an item, which expires the item after the
+// duration from now. Returns ErrNotFound when the item does not exist or
+// has expired.
+//
+// Only a writable transaction can be used for this operation.
+// This operation is not allowed during iterations such as Ascend* & Descend*.
+func (tx *Tx) Expire(key string, ttl time.Duration) error {
+	return tx.expire(key, &dbItemOpts{ex: true, exat: time.Now().Add(ttl)})
+}
+
+// ExpireAt sets the time when an item expires. Returns ErrNotFound when the
+// item does not exist or has expired.
+//
+// Only a writable transaction can be used for this operation.
+// This operation is not allowed during iterations such as Ascend* & Descend*.
+func (tx *Tx) ExpireAt(key string, t time.Time) error {
+	return tx.expire(key, &dbItemOpts{ex: true, exat: t})
+}
+
+// Persist removes the expiration of an item, so it does not expire. Returns
+// ErrNotFound when the item does not exist or has expired.
+//
+// Only a writable transaction can be used for this operation.
+// This operation is not allowed during iterations such as Ascend* & Descend*.
+func (tx *Tx) Persist(key string) error {
+	return tx.expire(key, nil)
+}
+
+// expire replaces the expiration of an item. Only the expiration is written
+// to the database file, unless the item was set by the transaction.
+func (tx *Tx) expire(key string, opts *dbItemOpts) error {
+	if tx.db == nil {
+		return ErrTxClosed
+	} else if !tx.writable {
+		return ErrTxNotWritable
+	} else if tx.wc.itercount > 0 {
+		return ErrTxIterating
+	}
+	tx.trackRead(key)
+	prev := tx.db.get(key)
+	if prev == nil || prev.expired() {
+		return ErrNotFound
+	}
+	if opts == nil && (prev.opts == nil || !prev.opts.ex) {
+		// The item does not expire.
+		return nil
+	}
+	// An item that was set by the transaction is written as a whole.
+	_, set := tx.wc.commitItems[key]
+	set = set && !tx.wc.commitExpires[key]
+	item := &dbItem{key: key, val: prev.val, zval: prev.zval, opts: opts}
+	if _, _, err := tx.set(item); err != nil {
+		return err
+	}
+	if tx.wc.commitItems != nil && !set {
+		tx.wc.commitExpires[key] = true
+	}
+	return nil
+}
+
 // scan iterates through a specified index and calls user-defined iterator
 // function for each item encountered.
 // The desc param indicates that the iterator should descend.
@@ -1512,7 +2074,7 @@ func (tx *Tx) scan(desc, gt, lt bool, index, start, stop string,
 	// wrap a btree specific iterator around the user-defined iterator.
 	iter := func(item btree.Item) bool {
 		dbi := item.(*dbItem)
-		return iterator(dbi.key, dbi.val)
+		return iterator(dbi.key, dbi.value())
 	}
 	var tr *btree.BTree
 	if index == "" {
@@ -1828,13 +2390,14 @@ func (tx *Tx) Nearby(index, bounds string,
 	// // wrap a rtree specific iterator around the user-defined iterator.
 	iter := func(item rtree.Item, dist float64) bool {
 		dbi := item.(*dbItem)
-		return iterator(dbi.key, dbi.val, dist)
+		return iterator(dbi.key, dbi.value(), dist)
 	}
 	idx := tx.db.idxs[index]
 	if idx == nil {
 		// index was not found. return error
 		return ErrNotFound
 	}
+	idx.fill()
 	if idx.rtr == nil {
 		// not an r-tree index. just return nil
 		return nil
@@ -1866,13 +2429,14 @@ func (tx *Tx) Intersects(index, bounds string,
 	// wrap a rtree specific iterator around the user-defined iterator.
 	iter := func(item rtree.Item) bool {
 		dbi := item.(*dbItem)
-		return iterator(dbi.key, dbi.val)
+		return iterator(dbi.key, dbi.value())
 	}
 	idx := tx.db.idxs[index]
 	if idx == nil {
 		// index was not found. return error
 		return ErrNotFound
 	}
+	idx.fill()
 	if idx.rtr == nil {
 		// not an r-tree index. just return nil
 		return nil
@@ -1900,6 +2464,18 @@ type IndexOptions struct {
 	// CaseInsensitiveKeyMatching allow for case-insensitive
 	// matching on keys when setting key/values.
 	CaseInsensitiveKeyMatching bool
+
+	// Unique prevents two items with different keys from having the same
+	// value in the index. A Set that would add the same value returns
+	// ErrUniqueViolation, and so does creating the index when the existing
+	// items have the same values. Values are the same when neither is less
+	// than the other. Only for b-tree indexes.
+	Unique bool
+
+	// Filter is called for every item that matches the pattern, and the
+	// index only holds the items where it returns true. The filter must only
+	// depend on the key and value.
+	Filter func(key, value string) bool
 }
 
 // CreateIndex builds a new index and populates it with items.
@@ -1954,7 +2530,7 @@ func (tx *Tx) CreateSpatialIndex(name, pattern string,
 func (tx *Tx) CreateSpatialIndexOptions(name, pattern string,
 	opts *IndexOptions,
 	rect func(item string) (min, max []float64)) error {
-	return tx.createIndex(name, pattern, nil, rect, nil)
+	return tx.createIndex(name, pattern, nil, rect, opts)
 }
 
 // createIndex is called by CreateIndex() and CreateSpatialIndex()
@@ -1963,13 +2539,51 @@ func (tx *Tx) createIndex(name string, pattern string,
 	rect func(item string) (min, max []float64),
 	opts *IndexOptions,
 ) error {
+	// intialize new index
+	return tx.addIndex(&index{
+		name:    name,
+		pattern: pattern,
+		less:    joinLess(lessers),
+		rect:    rect,
+	}, opts)
+}
+
+// joinLess returns a less function for the less functions.
+func joinLess(lessers []func(a, b string) bool) func(a, b string) bool {
+	switch len(lessers) {
+	case 0:
+		// no less function
+		return nil
+	case 1:
+		return lessers[0]
+	}
+	// multiple less functions specified.
+	// create a compound less function.
+	return func(a, b string) bool {
+		for i := 0; i < len(lessers)-1; i++ {
+			if lessers[i](a, b) {
+				return true
+			}
+			if lessers[i](b, a) {
+				return false
+			}
+		}
+		return lessers[len(lessers)-1](a, b)
+	}
+}
+
+// addIndex populates a new index and adds it to the database.
+func (tx *Tx) addIndex(idx *index, opts *IndexOptions) error {
 	if tx.db == nil {
 		return ErrTxClosed
 	} else if !tx.writable {
 		return ErrTxNotWritable
 	} else if tx.wc.itercount > 0 {
 		return ErrTxIterating
+	} else if tx.oc != nil {
+		return ErrInvalidOperation
 	}
+	name := idx.name
 	if name == "" {
 		// cannot create an index without a name.
 		// an empty name index is designated for the main "keys" tree.
@@ -1980,45 +2594,17 @@ func (tx *Tx) createIndex(name string, pattern string,
 		// index with name already exists. error.
 		return ErrIndexExists
 	}
-	// genreate a less function
-	var less func(a, b string) bool
-	switch len(lessers) {
-	default:
-		// multiple less functions specified.
-		// create a compound less function.
-		less = func(a, b string) bool {
-			for i := 0; i < len(lessers)-1; i++ {
-				if lessers[i](a, b) {
-					return true
-				}
-				if lessers[i](b, a) {
-					return false
-				}
-			}
-			return lessers[len(lessers)-1](a, b)
-		}
-	case 0:
-		// no less function
-	case 1:
-		less = lessers[0]
-	}
-	var sopts IndexOptions
 	if opts != nil {
-		sopts = *opts
-	}
-	if sopts.CaseInsensitiveKeyMatching {
-		pattern = strings.ToLower(pattern)
+		idx.opts = *opts
 	}
-	// intialize new index
-	idx := &index{
-		name:    name,
-		pattern: pattern,
-		less:    less,
-		rect:    rect,
-		db:      tx.db,
-		opts:    sopts,
+	if idx.opts.CaseInsensitiveKeyMatching {
+		idx.pattern = strings.ToLower(idx.pattern)
 	}
+	idx.db = tx.db
 	idx.rebuild()
+	if err := idx.checkUnique(); err != nil {
+		return err
+	}
 	// save the index
 	tx.db.idxs[name] = idx
 	if tx.wc.rbkeys == nil {
@@ -2039,6 +2625,8 @@ func (tx *Tx) DropIndex(name string) error {
 		return ErrTxNotWritable
 	} else if tx.wc.itercount > 0 {
 		return ErrTxIterating
+	} else if tx.oc != nil {
+		return ErrInvalidOperation
 	}
 	if name == "" {
 		// cannot drop the default "keys" index
@@ -2051,6 +2639,13 @@ func (tx *Tx) DropIndex(name string) error {
 	// delete from the map.
 	// this is all that is needed to delete an index.
 	delete(tx.db.idxs, name)
+	if idx.def != nil && tx.wc.commitItems != nil {
+		// the drop of a persistent index is written to disk.
+		if tx.wc.commitIndexes == nil {
+			tx.wc.commitIndexes = make(map[string]*index)
+		}
+		tx.wc.commitIndexes[name] = nil
+	}
 	if tx.wc.rbkeys == nil {
 		// store the index in the rollback map.
 		if _, ok := tx.wc.rollbackIndexes[name]; !ok {
@@ -12,6 +12,9 @@ import (
 	"sync"
 	"testing"
 	"time"
+
+	"github.com/tidwall/btree"
+	"github.com/tidwall/gjson"
 )
 
 func testOpen(t testing.TB) *DB {
@@ -784,13 +787,10 @@ func TestVariousTx(t *testing.T) {
 	}); err == nil {
 		t.Fatal("should not be able to commit when the file is closed")
 	}
-	db.file, err = os.OpenFile("data.db", os.O_CREATE|os.O_RDWR, 0666)
+	db.file, err = db.fs.OpenFile("data.db")
 	if err != nil {
 		t.Fatal(err)
 	}
-	if _, err := db.file.Seek(0, 2); err != nil {
-		t.Fatal(err)
-	}
 	db.buf = nil
 	if err := db.CreateIndex("blank", "*", nil); err != nil {
 		t.Fatal(err)
@@ -1368,7 +1368,8 @@ func TestDatabaseFormat(t *testing.T) {
 		if err := ioutil.WriteFile("data.db", []byte(resp), 0666); err != nil {
 			t.Fatal(err)
 		}
-		db, err := Open("data.db")
+		// a truncated command at the end is only an error with StrictLoad.
+		db, err := OpenWithOptions("data.db", &Options{StrictLoad: true})
 		if err == nil {
 			if err := db.Close(); err != nil {
 				t.Fatal(err)
@@ -2125,6 +2126,175 @@ func TestTTL(t *testing.T) {
 	}
 }
 
+func TestExpire(t *testing.T) {
+	db := testOpen(t)
+	defer testClose(db)
+	at := time.Now().Add(time.Hour).Round(0)
+	if err := db.Update(func(tx *Tx) error {
+		if _, _, err := tx.Set("key1", "val1", &SetOptions{ExpiresAt: at}); err != nil {
+			return err
+		}
+		if _, _, err := tx.Set("key2", "val2", nil); err != nil {
+			return err
+		}
+		if _, _, err := tx.Set("key3", "val3", &SetOptions{Expires: true, TTL: time.Hour}); err != nil {
+			return err
+		}
+		if err := tx.Expire("key2", time.Minute); err != nil {
+			return err
+		}
+		if err := tx.Persist("key3"); err != nil {
+			return err
+		}
+		if err := tx.Expire("key4", time.Minute); err != ErrNotFound {
+			t.Fatalf("expected '%v', got '%v'", ErrNotFound, err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	check := func(db *DB, exps string) {
+		if err := db.View(func(tx *Tx) error {
+			for _, test := range []struct {
+				key      string
+				min, max time.Duration
+			}{
+				{"key1", time.Hour - time.Minute, time.Hour},
+				{"key2", 0, time.Minute},
+				{"key3", -1, -1},
+			} {
+				dur, err := tx.TTL(test.key)
+				if err != nil {
+					return err
+				}
+				if dur < test.min || dur > test.max {
+					t.Fatalf("%v: expected between '%v' and '%v', got '%v'",
+						test.key, test.min, test.max, dur)
+				}
+			}
+			// the expirations are ordered in the exps tree.
+			var keys []string
+			tx.db.exps.Ascend(func(item btree.Item) bool {
+				keys = append(keys, item.(*dbItem).key)
+				return true
+			})
+			if res := strings.Join(keys, ","); res != exps {
+				t.Fatalf("expected '%v', got '%v'", exps, res)
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check(db, "key2,key1")
+	// only the expiration is written to the file.
+	fi, err := os.Stat("data.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	val := strings.Repeat("x", 1000)
+	if err := db.Update(func(tx *Tx) error {
+		if _, _, err := tx.Set("key5", val, nil); err != nil {
+			return err
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	fi, _ = os.Stat("data.db")
+	size := fi.Size()
+	if err := db.Update(func(tx *Tx) error {
+		if err := tx.ExpireAt("key5", at); err != nil {
+			return err
+		}
+		return tx.Persist("key5")
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if fi, _ = os.Stat("data.db"); fi.Size()-size > 100 {
+		t.Fatalf("expected a small record, got %d bytes", fi.Size()-size)
+	}
+	if err := db.Update(func(tx *Tx) error {
+		return tx.ExpireAt("key5", at)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	db = testReOpen(t, db)
+	defer testClose(db)
+	check(db, "key2,key1,key5")
+	if err := db.View(func(tx *Tx) error {
+		if res, err := tx.Get("key5"); err != nil || res != val {
+			t.Fatalf("expected '%v', got '%v'", val, res)
+		}
+		dur, err := tx.TTL("key5")
+		if err != nil || dur < time.Hour-time.Minute {
+			t.Fatalf("expected about '%v', got '%v'", time.Hour, dur)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// an expiration in the past expires the item.
+	if err := db.Update(func(tx *Tx) error {
+		if err := tx.ExpireAt("key5", time.Now().Add(-time.Second)); err != nil {
+			return err
+		}
+		if err := tx.Persist("key5"); err != ErrNotFound {
+			t.Fatalf("expected '%v', got '%v'", ErrNotFound, err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	db = testReOpen(t, db)
+	defer testClose(db)
+	if err := db.View(func(tx *Tx) error {
+		if _, err := tx.Get("key5", true); err != ErrNotFound {
+			t.Fatalf("expected '%v', got '%v'", ErrNotFound, err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExpireRollback(t *testing.T) {
+	db := testOpen(t)
+	defer testClose(db)
+	if err := db.Update(func(tx *Tx) error {
+		_, _, err := tx.Set("key1", "val1", nil)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	errRollback := errors.New("rollback")
+	if err := db.Update(func(tx *Tx) error {
+		if err := tx.Expire("key1", time.Minute); err != nil {
+			return err
+		}
+		return errRollback
+	}); err != errRollback {
+		t.Fatalf("expected '%v', got '%v'", errRollback, err)
+	}
+	// an optimistic transaction changes only the expiration.
+	if err := db.UpdateOptimistic(func(tx *Tx) error {
+		return tx.Expire("key1", time.Hour)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	db = testReOpen(t, db)
+	defer testClose(db)
+	if err := db.View(func(tx *Tx) error {
+		dur, err := tx.TTL("key1")
+		if err != nil || dur < time.Hour-time.Minute {
+			t.Fatalf("expected about '%v', got '%v'", time.Hour, dur)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestConfig(t *testing.T) {
 	db := testOpen(t)
 	defer testClose(db)
@@ -2646,3 +2816,156 @@ OUTER1:
 		t.Fail()
 	}
 }
+
+func TestUniqueIndex(t *testing.T) {
+	db := testOpen(t)
+	defer testClose(db)
+	if err := db.Update(func(tx *Tx) error {
+		tx.Set("user:1", `{"email":"a@example.com"}`, nil)
+		tx.Set("user:2", `{"email":"B@example.com"}`, nil)
+		tx.Set("user:3", `{"email":"b@example.com"}`, nil)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// the existing items are checked.
+	err := db.Update(func(tx *Tx) error {
+		return tx.CreateIndexOptions("email", "user:*",
+			&IndexOptions{Unique: true}, IndexJSON("email"))
+	})
+	if err != ErrUniqueViolation {
+		t.Fatalf("expected '%v', got '%v'", ErrUniqueViolation, err)
+	}
+	if err := db.Update(func(tx *Tx) error {
+		if _, err := tx.Delete("user:3"); err != nil {
+			return err
+		}
+		return tx.CreateIndexOptions("email", "user:*",
+			&IndexOptions{Unique: true}, IndexJSON("email"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(tx *Tx) error {
+		_, _, err := tx.Set("user:4", `{"email":"A@example.com"}`, nil)
+		return err
+	})
+	if err != ErrUniqueViolation {
+		t.Fatalf("expected '%v', got '%v'", ErrUniqueViolation, err)
+	}
+	if err := db.Update(func(tx *Tx) error {
+		// replacing the same key is allowed.
+		if _, _, err := tx.Set("user:1", `{"email":"a@example.com","x":1}`,
+			nil); err != nil {
+			return err
+		}
+		// keys that do not match the pattern are not checked.
+		if _, _, err := tx.Set("admin:1", `{"email":"a@example.com"}`,
+			nil); err != nil {
+			return err
+		}
+		// a value that was moved off of another key is free.
+		if _, _, err := tx.Set("user:2", `{"email":"c@example.com"}`,
+			nil); err != nil {
+			return err
+		}
+		_, _, err := tx.Set("user:5", `{"email":"b@example.com"}`, nil)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// expired items do not count.
+	if err := db.Update(func(tx *Tx) error {
+		_, _, err := tx.Set("user:6", `{"email":"d@example.com"}`,
+			&SetOptions{Expires: true, TTL: time.Millisecond})
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 10)
+	if err := db.Update(func(tx *Tx) error {
+		_, _, err := tx.Set("user:7", `{"email":"d@example.com"}`, nil)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFilteredIndex(t *testing.T) {
+	db := testOpen(t)
+	defer testClose(db)
+	active := func(key, value string) bool {
+		return gjson.Get(value, "active").Bool()
+	}
+	if err := db.Update(func(tx *Tx) error {
+		tx.Set("user:1", `{"name":"Tom","active":true}`, nil)
+		tx.Set("user:2", `{"name":"Jane","active":false}`, nil)
+		tx.Set("user:3", `{"name":"Andy","active":true}`, nil)
+		if err := tx.CreateIndexOptions("active", "user:*",
+			&IndexOptions{Filter: active}, IndexJSON("name")); err != nil {
+			return err
+		}
+		return tx.CreateSpatialIndexOptions("pos", "*",
+			&IndexOptions{Filter: func(key, value string) bool {
+				return key != "pos:2"
+			}}, IndexRect)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	keys := func() string {
+		var keys []string
+		if err := db.View(func(tx *Tx) error {
+			return tx.Ascend("active", func(key, value string) bool {
+				keys = append(keys, key)
+				return true
+			})
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return strings.Join(keys, ",")
+	}
+	if res := keys(); res != "user:3,user:1" {
+		t.Fatalf("expected '%v', got '%v'", "user:3,user:1", res)
+	}
+	if err := db.Update(func(tx *Tx) error {
+		tx.Set("user:1", `{"name":"Tom","active":false}`, nil)
+		tx.Set("user:2", `{"name":"Jane","active":true}`, nil)
+		tx.Set("pos:1", "[1 1]", nil)
+		tx.Set("pos:2", "[2 2]", nil)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if res := keys(); res != "user:3,user:2" {
+		t.Fatalf("expected '%v', got '%v'", "user:3,user:2", res)
+	}
+	var n int
+	if err := db.View(func(tx *Tx) error {
+		return tx.Intersects("pos", "[0 0],[3 3]", func(key, val string) bool {
+			n++
+			return true
+		})
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("expected '%v', got '%v'", 1, n)
+	}
+	// only the filtered items must be unique.
+	if err := db.Update(func(tx *Tx) error {
+		if err := tx.DropIndex("active"); err != nil {
+			return err
+		}
+		tx.Set("user:4", `{"name":"Andy","active":false}`, nil)
+		return tx.CreateIndexOptions("active", "user:*",
+			&IndexOptions{Filter: active, Unique: true}, IndexJSON("name"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	err := db.Update(func(tx *Tx) error {
+		_, _, err := tx.Set("user:4", `{"name":"Andy","active":true}`, nil)
+		return err
+	})
+	if err != ErrUniqueViolation {
+		t.Fatalf("expected '%v', got '%v'", ErrUniqueViolation, err)
+	}
+}
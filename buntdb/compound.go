@@ -0,0 +1,208 @@
+package buntdb
+
+import (
+	"encoding/json"
+
+	"github.com/tidwall/gjson"
+)
+
+// IndexField is a single field of a compound index.
+type IndexField struct {
+	// Path is the JSON path of the field, such as "user.age".
+	Path string
+	// Less is the type of the field, which is one of the helper functions
+	// such as IndexString, IndexInt, IndexUint, IndexFloat, or IndexBinary.
+	// The field is compared like IndexJSON when Less is nil.
+	Less func(a, b string) bool
+	// Desc orders the field in descending order.
+	Desc bool
+}
+
+// CreateCompoundIndex builds a new index on one or more JSON fields of the
+// values. The items are ordered by the first field, then by the second field,
+// and so on. For example, to order by the "user.age" as an int, and then by
+// the "name" as a string in descending order:
+//
+//	tx.CreateCompoundIndex("age_name", "user:*",
+//	    IndexField{Path: "user.age", Less: IndexInt},
+//	    IndexField{Path: "name", Less: IndexString, Desc: true},
+//	)
+//
+// Items that are missing a field are ordered before the items that have the
+// field, regardless of the Desc option.
+//
+// Use AscendPrefix to iterate over the items that have equal values for the
+// first fields. The index can also be used by the Ascend* and Descend*
+// methods, where the pivots are JSON documents.
+func (tx *Tx) CreateCompoundIndex(name, pattern string,
+	fields ...IndexField) error {
+	return tx.CreateCompoundIndexOptions(name, pattern, nil, fields...)
+}
+
+// CreateCompoundIndexOptions is the same as CreateCompoundIndex except that
+// it allows for additional options.
+func (tx *Tx) CreateCompoundIndexOptions(name, pattern string,
+	opts *IndexOptions, fields ...IndexField) error {
+	if len(fields) == 0 {
+		return ErrInvalidOperation
+	}
+	fields = append([]IndexField(nil), fields...)
+	err := tx.createIndex(name, pattern,
+		[]func(a, b string) bool{fieldsLess(fields)}, nil, opts)
+	if err != nil {
+		return err
+	}
+	tx.db.idxs[name].fields = fields
+	return nil
+}
+
+// AscendPrefix calls the iterator for every item in a compound index that
+// has values that are equal to the prefix, until iterator returns false. The
+// prefix holds the values of the first fields of the index, in the same order
+// as the fields. The results are ordered by the remaining fields.
+//
+// For example, all of the items with an age of 30, which are then ordered by
+// the name:
+//
+//	tx.AscendPrefix("age_name", []string{"30"}, iterator)
+//
+// When a field has no Less function, a prefix value that is valid JSON, such
+// as 30 or true, is compared as that JSON type. All other values are compared
+// as strings.
+//
+// An error is returned when the index is not a compound index, or when the
+// prefix has more values than the index has fields.
+func (tx *Tx) AscendPrefix(index string, prefix []string,
+	iterator func(key, value string) bool) error {
+	if tx.db == nil {
+		return ErrTxClosed
+	}
+	idx := tx.db.idxs[index]
+	if idx == nil {
+		return ErrNotFound
+	}
+	if idx.fields == nil || len(prefix) > len(idx.fields) {
+		return ErrInvalidOperation
+	}
+	fields := idx.fields[:len(prefix)]
+	pivot := fieldsPivot(fields, prefix)
+	less := fieldsLess(fields)
+	// The pivot is missing the remaining fields, so it's ordered before all
+	// of the items that have the prefix.
+	return tx.AscendGreaterOrEqual(index, pivot, func(key, value string) bool {
+		if less(pivot, value) {
+			return false
+		}
+		return iterator(key, value)
+	})
+}
+
+// fieldsLess returns a less function that compares the fields in order.
+func fieldsLess(fields []IndexField) func(a, b string) bool {
+	return func(a, b string) bool {
+		for _, f := range fields {
+			ra, rb := gjson.Get(a, f.Path), gjson.Get(b, f.Path)
+			if !ra.Exists() || !rb.Exists() {
+				// A missing field is ordered first.
+				if ra.Exists() != rb.Exists() {
+					return !ra.Exists()
+				}
+				continue
+			}
+			if f.Desc {
+				ra, rb = rb, ra
+			}
+			if fieldLess(f, ra, rb) {
+				return true
+			}
+			if fieldLess(f, rb, ra) {
+				return false
+			}
+		}
+		return false
+	}
+}
+
+// fieldLess compares two values of a field.
+func fieldLess(f IndexField, a, b gjson.Result) bool {
+	if f.Less == nil {
+		return a.Less(b, false)
+	}
+	return f.Less(a.String(), b.String())
+}
+
+// fieldsPivot returns a JSON document with the values at the paths of the
+// fields. Only simple paths, which are keys that are separated by dots, are
+// supported.
+func fieldsPivot(fields []IndexField, values []string) string {
+	root := &pivotNode{}
+	for i, f := range fields {
+		node := root
+		for _, name := range splitPath(f.Path) {
+			node = node.child(name)
+		}
+		if gjson.Valid(values[i]) {
+			node.raw = values[i]
+		} else {
+			b, _ := json.Marshal(values[i])
+			node.raw = string(b)
+		}
+	}
+	return string(root.appendJSON(nil))
+}
+
+// splitPath splits a path into keys. The dot and wildcard characters may be
+// escaped with a backslash.
+func splitPath(path string) []string {
+	var names []string
+	var name []byte
+	for i := 0; i < len(path); i++ {
+		switch {
+		case path[i] == '\\' && i+1 < len(path):
+			i++
+			name = append(name, path[i])
+		case path[i] == '.':
+			names = append(names, string(name))
+			name = name[:0]
+		default:
+			name = append(name, path[i])
+		}
+	}
+	return append(names, string(name))
+}
+
+// pivotNode is an object or a value of a pivot document.
+type pivotNode struct {
+	raw   string       // the raw JSON value
+	names []string     // the names of the object members, in order
+	nodes []*pivotNode // the object members
+}
+
+func (n *pivotNode) child(name string) *pivotNode {
+	for i := range n.names {
+		if n.names[i] == name {
+			return n.nodes[i]
+		}
+	}
+	c := &pivotNode{}
+	n.names = append(n.names, name)
+	n.nodes = append(n.nodes, c)
+	return c
+}
+
+func (n *pivotNode) appendJSON(buf []byte) []byte {
+	if n.raw != "" {
+		return append(buf, n.raw...)
+	}
+	buf = append(buf, '{')
+	for i, name := range n.names {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+		b, _ := json.Marshal(name)
+		buf = append(buf, b...)
+		buf = append(buf, ':')
+		buf = n.nodes[i].appendJSON(buf)
+	}
+	return append(buf, '}')
+}
@@ -0,0 +1,134 @@
+package buntdb
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCompoundIndex(t *testing.T) {
+	db := testOpen(t)
+	defer testClose(db)
+	if err := db.Update(func(tx *Tx) error {
+		tx.Set("user:1", `{"user":{"age":30},"name":"Tom"}`, nil)
+		tx.Set("user:2", `{"user":{"age":30},"name":"andy"}`, nil)
+		tx.Set("user:3", `{"user":{"age":4},"name":"Zed"}`, nil)
+		tx.Set("user:4", `{"user":{"age":30},"name":"Carol"}`, nil)
+		tx.Set("user:5", `{"user":{"age":100},"name":"Bob"}`, nil)
+		tx.Set("user:6", `{"user":{"age":30}}`, nil)
+		tx.Set("user:7", `{"name":"Alice"}`, nil)
+		return tx.CreateCompoundIndex("age_name", "user:*",
+			IndexField{Path: "user.age", Less: IndexInt},
+			IndexField{Path: "name", Less: IndexString, Desc: true},
+		)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	ascend := func(tx *Tx, prefix ...string) string {
+		var keys []string
+		var err error
+		fn := func(key, value string) bool {
+			keys = append(keys, key)
+			return true
+		}
+		if prefix == nil {
+			err = tx.Ascend("age_name", fn)
+		} else {
+			err = tx.AscendPrefix("age_name", prefix, fn)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.Join(keys, ",")
+	}
+	if err := db.View(func(tx *Tx) error {
+		// missing fields first, then age as an int, then name descending.
+		res := ascend(tx)
+		exp := "user:7,user:3,user:6,user:1,user:4,user:2,user:5"
+		if res != exp {
+			t.Fatalf("expected '%v', got '%v'", exp, res)
+		}
+		res = ascend(tx, "30")
+		exp = "user:6,user:1,user:4,user:2"
+		if res != exp {
+			t.Fatalf("expected '%v', got '%v'", exp, res)
+		}
+		res = ascend(tx, "30", "carol")
+		if res != "user:4" {
+			t.Fatalf("expected '%v', got '%v'", "user:4", res)
+		}
+		if res = ascend(tx, "31"); res != "" {
+			t.Fatalf("expected '%v', got '%v'", "", res)
+		}
+		err := tx.AscendPrefix("age_name", []string{"1", "2", "3"},
+			func(key, value string) bool { return true })
+		if err != ErrInvalidOperation {
+			t.Fatalf("expected '%v', got '%v'", ErrInvalidOperation, err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// the fields are kept when the index is rebuilt.
+	if err := db.Update(func(tx *Tx) error {
+		if err := tx.DeleteAll(); err != nil {
+			return err
+		}
+		_, _, err := tx.Set("user:8", `{"user":{"age":30},"name":"Dan"}`, nil)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.View(func(tx *Tx) error {
+		if res := ascend(tx, "30"); res != "user:8" {
+			t.Fatalf("expected '%v', got '%v'", "user:8", res)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCompoundIndexJSON(t *testing.T) {
+	db := testOpen(t)
+	defer testClose(db)
+	if err := db.Update(func(tx *Tx) error {
+		tx.Set("1", `{"a.b":true,"c":"x"}`, nil)
+		tx.Set("2", `{"a.b":false,"c":"y"}`, nil)
+		tx.Set("3", `{"a.b":true,"c":"z"}`, nil)
+		tx.Set("4", `{"a.b":"true","c":"w"}`, nil)
+		if err := tx.CreateIndex("plain", "*", IndexString); err != nil {
+			return err
+		}
+		if err := tx.CreateCompoundIndex("ab_c", "*",
+			IndexField{Path: `a\.b`}, IndexField{Path: "c"}); err != nil {
+			return err
+		}
+		if err := tx.CreateCompoundIndex("none", "*"); err != ErrInvalidOperation {
+			t.Fatalf("expected '%v', got '%v'", ErrInvalidOperation, err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.View(func(tx *Tx) error {
+		var keys []string
+		if err := tx.AscendPrefix("ab_c", []string{"true"},
+			func(key, value string) bool {
+				keys = append(keys, key)
+				return true
+			}); err != nil {
+			return err
+		}
+		if res := strings.Join(keys, ","); res != "1,3" {
+			t.Fatalf("expected '%v', got '%v'", "1,3", res)
+		}
+		err := tx.AscendPrefix("plain", nil,
+			func(key, value string) bool { return true })
+		if err != ErrInvalidOperation {
+			t.Fatalf("expected '%v', got '%v'", ErrInvalidOperation, err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,98 @@
+package buntdb
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+)
+
+// minCompressSize is the smallest value that is compressed. Smaller values
+// rarely get smaller.
+const minCompressSize = 64
+
+var flateWriters = sync.Pool{
+	New: func() interface{} {
+		w, _ := flate.NewWriter(nil, flate.BestSpeed)
+		return w
+	},
+}
+
+var flateReaders = sync.Pool{
+	New: func() interface{} {
+		return flate.NewReader(nil)
+	},
+}
+
+// compressValue returns the value compressed with DEFLATE. Returns false when
+// the value is too small, or when it does not get smaller.
+func compressValue(val string) (string, bool) {
+	if len(val) < minCompressSize {
+		return val, false
+	}
+	var buf bytes.Buffer
+	buf.Grow(len(val) / 2)
+	w := flateWriters.Get().(*flate.Writer)
+	defer flateWriters.Put(w)
+	w.Reset(&buf)
+	if _, err := io.WriteString(w, val); err != nil {
+		return val, false
+	}
+	if err := w.Close(); err != nil || buf.Len() >= len(val) {
+		return val, false
+	}
+	return buf.String(), true
+}
+
+// decompressValue returns the value that was compressed by compressValue.
+func decompressValue(val string) (string, error) {
+	r := flateReaders.Get().(io.ReadCloser)
+	defer flateReaders.Put(r)
+	if err := r.(flate.Resetter).Reset(strings.NewReader(val), nil); err != nil {
+		return "", err
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// value returns the plain value of the item. A value that is compressed in
+// memory is decompressed on each call.
+func (dbi *dbItem) value() string {
+	if !dbi.zval {
+		return dbi.val
+	}
+	val, err := decompressValue(dbi.val)
+	if err != nil {
+		// Not reachable, because the compressed values that are loaded are
+		// checked by encodeItem, and the others are compressed by this
+		// process. An empty value is better than a panic in a reader.
+		return ""
+	}
+	return val
+}
+
+// encodeItem compresses or decompresses the value of an item, as it's kept in
+// memory by the database. A value that is already compressed, such as one
+// that is loaded from the append-only file, is decompressed once to check
+// it. Returns ErrInvalid when it cannot be decompressed.
+func (db *DB) encodeItem(dbi *dbItem) error {
+	if db.opts.CompressMemory {
+		if !dbi.zval {
+			dbi.val, dbi.zval = compressValue(dbi.val)
+		} else if _, err := decompressValue(dbi.val); err != nil {
+			return ErrInvalid
+		}
+	} else if dbi.zval {
+		val, err := decompressValue(dbi.val)
+		if err != nil {
+			return ErrInvalid
+		}
+		dbi.val, dbi.zval = val, false
+	}
+	return nil
+}
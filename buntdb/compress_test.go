@@ -0,0 +1,176 @@
+package buntdb
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+// testFillJSON sets n items with large JSON values that compress well.
+func testFillJSON(t *testing.T, db *DB, n int) {
+	if err := db.Update(func(tx *Tx) error {
+		for i := 0; i < n; i++ {
+			val := fmt.Sprintf(`{"age":%d,"bio":"%s"}`, n-i,
+				strings.Repeat("lorem ipsum ", 50))
+			if _, _, err := tx.Set(fmt.Sprintf("user:%d", i), val, nil); err != nil {
+				return err
+			}
+		}
+		_, _, err := tx.Set("small", "val", nil)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testFileSize(t *testing.T, path string) int64 {
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fi.Size()
+}
+
+func TestCompression(t *testing.T) {
+	db := testOpen(t)
+	defer testClose(db)
+	testFillJSON(t, db, 20)
+	exp := testDump(t, db)
+	plain := testFileSize(t, "data.db")
+	db.Close()
+	// the records that were written before are compressed by a shrink.
+	db, err := OpenWithOptions("data.db", &Options{Compression: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Shrink(); err != nil {
+		t.Fatal(err)
+	}
+	if size := testFileSize(t, "data.db"); size > plain/4 {
+		t.Fatalf("expected a compressed file, got %d of %d bytes", size, plain)
+	}
+	testFillJSON(t, db, 30)
+	exp = testDump(t, db)
+	// the file can be opened without the option.
+	db = testReOpen(t, db)
+	defer testClose(db)
+	if res := testDump(t, db); res != exp {
+		t.Fatalf("expected '%v', got '%v'", exp, res)
+	}
+}
+
+func TestCompressMemory(t *testing.T) {
+	if err := os.RemoveAll("data.db"); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenWithOptions("data.db", &Options{CompressMemory: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testClose(db)
+	if err := db.Update(func(tx *Tx) error {
+		return tx.CreateIndex("age", "user:*", IndexJSON("age"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	testFillJSON(t, db, 20)
+	if db.memsize > 20*200 {
+		t.Fatalf("expected compressed values, got %d bytes", db.memsize)
+	}
+	check := func(db *DB) {
+		if err := db.View(func(tx *Tx) error {
+			val, err := tx.Get("user:3")
+			if err != nil {
+				return err
+			}
+			if !strings.HasPrefix(val, `{"age":17,"bio":"lorem ipsum`) {
+				t.Fatalf("expected a plain value, got '%v'", val)
+			}
+			// the index sees the plain values.
+			var keys []string
+			tx.Ascend("age", func(key, value string) bool {
+				keys = append(keys, key)
+				return len(keys) < 3
+			})
+			if res := strings.Join(keys, ","); res != "user:19,user:18,user:17" {
+				t.Fatalf("expected '%v', got '%v'", "user:19,user:18,user:17", res)
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check(db)
+	if res := testFileSize(t, "data.db"); res > 20*200 {
+		t.Fatalf("expected a compressed file, got %d bytes", res)
+	}
+	exp := testDump(t, db)
+	// the compressed values are decompressed when loaded without the option.
+	db = testReOpen(t, db)
+	defer testClose(db)
+	if res := testDump(t, db); res != exp {
+		t.Fatalf("expected '%v', got '%v'", exp, res)
+	}
+	db.Close()
+	db, err = OpenWithOptions("data.db", &Options{CompressMemory: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testClose(db)
+	if err := db.Update(func(tx *Tx) error {
+		return tx.CreateIndex("age", "user:*", IndexJSON("age"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	check(db)
+	if res := testDump(t, db); res != exp {
+		t.Fatalf("expected '%v', got '%v'", exp, res)
+	}
+}
+
+func TestCompressionReplication(t *testing.T) {
+	if err := os.RemoveAll("data.db"); err != nil {
+		t.Fatal(err)
+	}
+	leader, err := OpenWithOptions("data.db", &Options{Compression: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testClose(leader)
+	testFillJSON(t, leader, 10)
+	follower, _ := Open(":memory:")
+	defer follower.Close()
+	pr, pw := io.Pipe()
+	go func() { leader.Stream(pw, 0) }()
+	go func() { follower.Follow(pr) }()
+	testWaitFollower(t, leader, follower)
+	// the compressed records keep their size, and so the log offset.
+	testFillJSON(t, leader, 20)
+	testWaitFollower(t, leader, follower)
+	leader.Close()
+	pr.Close()
+}
+
+func TestCompressCorrupted(t *testing.T) {
+	// a compressed value that cannot be decompressed, in a record with a
+	// valid checksum.
+	var crypt *aofCipher
+	buf := crypt.appendHeader(nil)
+	dbi := &dbItem{key: "key", val: "\xff\xff\xff\xff", zval: true}
+	buf = dbi.writeSetRecordTo(buf, false)
+	for _, opts := range []*Options{{}, {CompressMemory: true}} {
+		if err := os.WriteFile("data.db", buf, 0666); err != nil {
+			t.Fatal(err)
+		}
+		db, err := OpenWithOptions("data.db", opts)
+		if err != ErrInvalid {
+			if err == nil {
+				db.Close()
+			}
+			t.Fatalf("expected '%v', got '%v'", ErrInvalid, err)
+		}
+	}
+	os.RemoveAll("data.db")
+}
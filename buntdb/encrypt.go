@@ -0,0 +1,129 @@
+package buntdb
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"hash/crc32"
+)
+
+// An encrypted append-only file starts with its own magic header, which is
+// the binary header with the high bit of the format version set. The header
+// is followed by a key check, which is a nonce and the AES-GCM tag of the
+// magic header, and a CRC-32C checksum of the key check. The records use the
+// binary format, where the payload is a 12 byte nonce followed by the AES-GCM
+// sealed payload of the plain record. The checksum of a record is of the
+// sealed payload, which allows for a damaged tail to be detected without the
+// key.
+const aofEncMagic = "buntdb\x00\x81"
+
+const (
+	nonceSize = 12 // the AES-GCM nonce size
+	tagSize   = 16 // the AES-GCM tag size
+)
+
+// encHeaderSize is the size of the header of an encrypted file.
+const encHeaderSize = len(aofEncMagic) + nonceSize + tagSize + 4
+
+// aofCipher encrypts and decrypts the records of an append-only file. A nil
+// cipher is used for files that are not encrypted.
+type aofCipher struct {
+	aead cipher.AEAD
+}
+
+// newAOFCipher returns a cipher for an AES-128, AES-192, or AES-256 key.
+func newAOFCipher(key []byte) (*aofCipher, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, ErrInvalidKey
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, ErrInvalidKey
+	}
+	return &aofCipher{aead: aead}, nil
+}
+
+// newNonce returns a random nonce. A random nonce is safe for about four
+// billion records per key.
+func newNonce() [nonceSize]byte {
+	var nonce [nonceSize]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		panic(err)
+	}
+	return nonce
+}
+
+// headerSize returns the size of the file header.
+func (c *aofCipher) headerSize() int {
+	if c == nil {
+		return len(aofMagic)
+	}
+	return encHeaderSize
+}
+
+// appendHeader appends the file header to the buffer.
+func (c *aofCipher) appendHeader(buf []byte) []byte {
+	if c == nil {
+		return append(buf, aofMagic...)
+	}
+	buf = append(buf, aofEncMagic...)
+	mark := len(buf)
+	nonce := newNonce()
+	buf = append(buf, nonce[:]...)
+	buf = c.aead.Seal(buf, nonce[:], nil, []byte(aofEncMagic))
+	var crc [4]byte
+	binary.LittleEndian.PutUint32(crc[:], crc32.Checksum(buf[mark:], crcTable))
+	return append(buf, crc[:]...)
+}
+
+// checkHeader verifies that the header of an encrypted file was written with
+// the same key. Returns ErrInvalidKey when the key is different.
+func (c *aofCipher) checkHeader(hdr []byte) error {
+	check := hdr[len(aofEncMagic) : encHeaderSize-4]
+	if crc32.Checksum(check, crcTable) !=
+		binary.LittleEndian.Uint32(hdr[encHeaderSize-4:]) {
+		return ErrInvalid
+	}
+	_, err := c.aead.Open(nil, check[:nonceSize], check[nonceSize:],
+		[]byte(aofEncMagic))
+	if err != nil {
+		return ErrInvalidKey
+	}
+	return nil
+}
+
+// seal encrypts the plain records in the buffer that start at the position.
+// The buffer is unchanged when the cipher is nil.
+func (c *aofCipher) seal(buf []byte, start int) []byte {
+	if c == nil || len(buf) == start {
+		return buf
+	}
+	plain := append([]byte(nil), buf[start:]...)
+	buf = buf[:start]
+	for len(plain) > 0 {
+		end := recordHeaderSize + int(binary.LittleEndian.Uint32(plain))
+		payload := plain[recordHeaderSize:end]
+		plain = plain[end:]
+		mark := len(buf)
+		nonce := newNonce()
+		buf = append(buf, 0, 0, 0, 0, 0, 0, 0, 0)
+		buf = append(buf, nonce[:]...)
+		buf = c.aead.Seal(buf, nonce[:], payload, nil)
+		buf = endRecord(buf, mark)
+	}
+	return buf
+}
+
+// open decrypts the sealed payload of a record into the buffer.
+func (c *aofCipher) open(buf, payload []byte) ([]byte, error) {
+	if len(payload) < nonceSize+tagSize+1 {
+		return nil, ErrInvalid
+	}
+	plain, err := c.aead.Open(buf, payload[:nonceSize], payload[nonceSize:], nil)
+	if err != nil {
+		return nil, ErrInvalid
+	}
+	return plain, nil
+}
@@ -0,0 +1,262 @@
+package buntdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+var testKey = []byte("0123456789abcdef0123456789abcdef")
+
+func testOpenKey(t *testing.T, key []byte) *DB {
+	db, err := OpenWithOptions("data.db", &Options{EncryptionKey: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestEncryption(t *testing.T) {
+	if err := os.RemoveAll("data.db"); err != nil {
+		t.Fatal(err)
+	}
+	db := testOpenKey(t, testKey)
+	defer testClose(db)
+	testFillAOF(t, db, 10)
+	if err := db.Update(func(tx *Tx) error {
+		_, err := tx.Delete("key:3")
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	exp := testDump(t, db)
+	db.Close()
+	data, err := ioutil.ReadFile("data.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), aofEncMagic) {
+		t.Fatal("expected the encrypted header")
+	}
+	if bytes.Contains(data, []byte("key:")) || bytes.Contains(data, []byte("val:")) {
+		t.Fatal("expected no plain text")
+	}
+	// the wrong key, and no key, are refused.
+	wrong := append([]byte(nil), testKey...)
+	wrong[0]++
+	for _, opts := range []*Options{{EncryptionKey: wrong}, nil} {
+		if _, err := OpenWithOptions("data.db", opts); err != ErrInvalidKey {
+			t.Fatalf("expected '%v', got '%v'", ErrInvalidKey, err)
+		}
+	}
+	if _, err := OpenWithOptions("data.db", &Options{EncryptionKey: []byte("short")}); err != ErrInvalidKey {
+		t.Fatalf("expected '%v', got '%v'", ErrInvalidKey, err)
+	}
+	// the file was not changed by the failed opens.
+	if data2, _ := ioutil.ReadFile("data.db"); !bytes.Equal(data, data2) {
+		t.Fatal("expected an unchanged file")
+	}
+	db = testOpenKey(t, testKey)
+	defer testClose(db)
+	if res := testDump(t, db); res != exp {
+		t.Fatalf("expected '%v', got '%v'", exp, res)
+	}
+	// shrinking keeps the file encrypted.
+	if err := db.Shrink(); err != nil {
+		t.Fatal(err)
+	}
+	testFillAOF(t, db, 12)
+	exp = testDump(t, db)
+	db.Close()
+	data, err = ioutil.ReadFile("data.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), aofEncMagic) || bytes.Contains(data, []byte("val:")) {
+		t.Fatal("expected an encrypted file")
+	}
+	db = testOpenKey(t, testKey)
+	defer testClose(db)
+	if res := testDump(t, db); res != exp {
+		t.Fatalf("expected '%v', got '%v'", exp, res)
+	}
+}
+
+func TestEncryptionTornTail(t *testing.T) {
+	if err := os.RemoveAll("data.db"); err != nil {
+		t.Fatal(err)
+	}
+	db := testOpenKey(t, testKey)
+	defer testClose(db)
+	testFillAOF(t, db, 10)
+	db.Close()
+	fi, err := os.Stat("data.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate("data.db", fi.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+	db = testOpenKey(t, testKey)
+	if n := testCountItems(t, db); n != 9 {
+		t.Fatalf("expected '%v', got '%v'", 9, n)
+	}
+	testFillAOF(t, db, 10)
+	db.Close()
+	// a record that fails to decrypt is not cut off.
+	data, err := ioutil.ReadFile("data.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pos := encHeaderSize
+	for pos+recordHeaderSize+int(binary.LittleEndian.Uint32(data[pos:])) < len(data) {
+		pos += recordHeaderSize + int(binary.LittleEndian.Uint32(data[pos:]))
+	}
+	data[len(data)-1]++
+	endRecord(data, pos)
+	if err := ioutil.WriteFile("data.db", data, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenWithOptions("data.db", &Options{EncryptionKey: testKey}); err != ErrInvalid {
+		t.Fatalf("expected '%v', got '%v'", ErrInvalid, err)
+	}
+}
+
+func TestEncryptionMigration(t *testing.T) {
+	db := testOpen(t)
+	defer testClose(db)
+	testFillAOF(t, db, 5)
+	db.Close()
+	// the file stays the same until it's shrunk.
+	db = testOpenKey(t, testKey)
+	defer testClose(db)
+	testFillAOF(t, db, 7)
+	data, err := ioutil.ReadFile("data.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), aofMagic) {
+		t.Fatal("expected the binary header")
+	}
+	if err := db.Shrink(); err != nil {
+		t.Fatal(err)
+	}
+	testFillAOF(t, db, 8)
+	db.Close()
+	data, err = ioutil.ReadFile("data.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), aofEncMagic) || bytes.Contains(data, []byte("val:")) {
+		t.Fatal("expected an encrypted file")
+	}
+	if _, err := Open("data.db"); err != ErrInvalidKey {
+		t.Fatalf("expected '%v', got '%v'", ErrInvalidKey, err)
+	}
+	db = testOpenKey(t, testKey)
+	defer testClose(db)
+	if n := testCountItems(t, db); n != 8 {
+		t.Fatalf("expected '%v', got '%v'", 8, n)
+	}
+}
+
+func TestEncryptionSaveLoad(t *testing.T) {
+	opts := &Options{EncryptionKey: testKey}
+	db, _ := OpenWithOptions(":memory:", opts)
+	defer db.Close()
+	testFillAOF(t, db, 20)
+	var buf bytes.Buffer
+	if err := db.Save(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(buf.String(), aofEncMagic) || strings.Contains(buf.String(), "val:") {
+		t.Fatal("expected an encrypted file")
+	}
+	db2, _ := Open(":memory:")
+	defer db2.Close()
+	if err := db2.Load(bytes.NewReader(buf.Bytes())); err != ErrInvalidKey {
+		t.Fatalf("expected '%v', got '%v'", ErrInvalidKey, err)
+	}
+	db3, _ := OpenWithOptions(":memory:", opts)
+	defer db3.Close()
+	if err := db3.Load(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if exp, res := testDump(t, db), testDump(t, db3); res != exp {
+		t.Fatalf("expected '%v', got '%v'", exp, res)
+	}
+}
+
+func TestEncryptionBackup(t *testing.T) {
+	if err := os.RemoveAll("data.db"); err != nil {
+		t.Fatal(err)
+	}
+	db := testOpenKey(t, testKey)
+	defer testClose(db)
+	testFillAOF(t, db, 10)
+	var full, inc bytes.Buffer
+	off, err := db.Backup(&full, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testFillAOF(t, db, 15)
+	if _, err := db.Backup(&inc, off); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(full.String()+inc.String(), "val:") {
+		t.Fatal("expected an encrypted backup")
+	}
+	// a database that is not encrypted cannot restore the backups.
+	mdb, _ := Open(":memory:")
+	defer mdb.Close()
+	if err := mdb.Restore(bytes.NewReader(full.Bytes())); err != ErrInvalidKey {
+		t.Fatalf("expected '%v', got '%v'", ErrInvalidKey, err)
+	}
+	edb, _ := OpenWithOptions(":memory:", &Options{EncryptionKey: testKey})
+	defer edb.Close()
+	if err := edb.Restore(&full, &inc); err != nil {
+		t.Fatal(err)
+	}
+	if exp, res := testDump(t, db), testDump(t, edb); exp != res {
+		t.Fatalf("expected '%v', got '%v'", exp, res)
+	}
+	exp, _ := db.LogOffset()
+	if res, _ := edb.LogOffset(); res != exp {
+		t.Fatalf("expected '%v', got '%v'", exp, res)
+	}
+}
+
+func TestEncryptionReplication(t *testing.T) {
+	if err := os.RemoveAll("data.db"); err != nil {
+		t.Fatal(err)
+	}
+	leader := testOpenKey(t, testKey)
+	defer testClose(leader)
+	testFillAOF(t, leader, 10)
+	follower, _ := OpenWithOptions(":memory:", &Options{EncryptionKey: testKey})
+	defer follower.Close()
+	pr, pw := io.Pipe()
+	serrc := make(chan error, 1)
+	go func() { serrc <- leader.Stream(pw, 0) }()
+	go func() { follower.Follow(pr) }()
+	testWaitFollower(t, leader, follower)
+	testFillAOF(t, leader, 20)
+	testWaitFollower(t, leader, follower)
+	// a follower that is not encrypted cannot follow.
+	plain, _ := Open(":memory:")
+	defer plain.Close()
+	pr2, pw2 := io.Pipe()
+	go func() { leader.Stream(pw2, 0) }()
+	if err := plain.Follow(pr2); err != ErrInvalidKey {
+		t.Fatalf("expected '%v', got '%v'", ErrInvalidKey, err)
+	}
+	pr2.Close()
+	leader.Close()
+	if err := <-serrc; err != ErrDatabaseClosed {
+		t.Fatalf("expected '%v', got '%v'", ErrDatabaseClosed, err)
+	}
+}
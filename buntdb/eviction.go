@@ -0,0 +1,238 @@
+package buntdb
+
+import (
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	"github.com/tidwall/btree"
+)
+
+// EvictionPolicy is how items are chosen for eviction when the database
+// reaches the Config.MaxMemory limit.
+type EvictionPolicy int
+
+const (
+	// NoEviction does not evict items. A Set that would go over the limit
+	// returns ErrMaxMemory. This is the default.
+	NoEviction EvictionPolicy = iota
+	// AllKeysLRU evicts the least recently used items.
+	AllKeysLRU
+	// AllKeysLFU evicts the least frequently used items.
+	AllKeysLFU
+	// VolatileTTL evicts the items with an expiration, starting with the
+	// items that expire first. A Set returns ErrMaxMemory when there are no
+	// items with an expiration.
+	VolatileTTL
+)
+
+// dbItemOverhead is the approximate memory used by an item, excluding the
+// key and value.
+const dbItemOverhead = 64
+
+// evictionSamples is the number of items that are sampled for choosing an
+// item to evict by the LRU and LFU policies.
+const evictionSamples = 16
+
+// The LFU counter is a logarithmic counter in the low 8 bits of the access
+// field, and the high 16 bits hold the last decrement time in minutes.
+const (
+	lfuInitVal   = 5  // the counter of a new item
+	lfuLogFactor = 10 // higher values make the counter grow slower
+)
+
+// clockStart is the start of the access clocks.
+var clockStart = time.Now()
+
+// lruClock returns the current LRU time in milliseconds.
+func lruClock() uint32 {
+	return uint32(time.Since(clockStart) / time.Millisecond)
+}
+
+// lfuClock returns the current LFU time in minutes.
+func lfuClock() uint16 {
+	return uint16(time.Since(clockStart) / time.Minute)
+}
+
+// size returns the approximate memory used by the item.
+func (dbi *dbItem) size() int64 {
+	return int64(len(dbi.key) + len(dbi.val) + dbItemOverhead)
+}
+
+// lfuCounter returns the LFU counter of the item, which is decremented by
+// one for every minute since the last decrement.
+func (dbi *dbItem) lfuCounter() uint32 {
+	access := atomic.LoadUint32(&dbi.access)
+	counter := access & 0xFF
+	elapsed := uint32(lfuClock() - uint16(access>>8))
+	if elapsed >= counter {
+		return 0
+	}
+	return counter - elapsed
+}
+
+// initAccess sets the access field of a new item.
+func (db *DB) initAccess(dbi *dbItem) {
+	switch db.config.EvictionPolicy {
+	case AllKeysLRU:
+		dbi.access = lruClock()
+	case AllKeysLFU:
+		dbi.access = uint32(lfuClock())<<8 | lfuInitVal
+	}
+}
+
+// touch records an access of the item for the LRU and LFU policies. It's
+// safe to call while holding a read lock.
+func (db *DB) touch(dbi *dbItem) {
+	if db.config.MaxMemory <= 0 {
+		return
+	}
+	switch db.config.EvictionPolicy {
+	case AllKeysLRU:
+		atomic.StoreUint32(&dbi.access, lruClock())
+	case AllKeysLFU:
+		counter := dbi.lfuCounter()
+		if counter < 255 {
+			p := 1.0 / float64((int(counter)-lfuInitVal)*lfuLogFactor+1)
+			if counter < lfuInitVal || rand.Float64() < p {
+				counter++
+			}
+		}
+		atomic.StoreUint32(&dbi.access, uint32(lfuClock())<<8|counter)
+	}
+}
+
+// evictionScore returns how much an item is preferred for eviction.
+func (db *DB) evictionScore(dbi *dbItem) uint32 {
+	if db.config.EvictionPolicy == AllKeysLFU {
+		return 255 - dbi.lfuCounter()
+	}
+	// the idle time, which is correct for up to 49 days.
+	return lruClock() - atomic.LoadUint32(&dbi.access)
+}
+
+// evictionVictim returns an item to evict, other than the item with the
+// keep key. Returns nil when there is nothing to evict.
+func (db *DB) evictionVictim(keep string) *dbItem {
+	var victim *dbItem
+	switch db.config.EvictionPolicy {
+	case VolatileTTL:
+		db.exps.Ascend(func(item btree.Item) bool {
+			dbi := item.(*dbItem)
+			if dbi.key == keep {
+				return true
+			}
+			victim = dbi
+			return false
+		})
+	case AllKeysLRU, AllKeysLFU:
+		// Like Redis, the victim is the best of a small sample of items.
+		// The samples are taken from a cursor that moves through the keys.
+		var best uint32
+		var n int
+		start := db.evictkey
+		sample := func(item btree.Item) bool {
+			dbi := item.(*dbItem)
+			db.evictkey = dbi.key + "\x00"
+			n++
+			if dbi.key != keep {
+				if score := db.evictionScore(dbi); victim == nil || score > best {
+					victim, best = dbi, score
+				}
+			}
+			return n < evictionSamples
+		}
+		db.keys.AscendGreaterOrEqual(&dbItem{key: start}, sample)
+		if n < evictionSamples {
+			// wrap around to the first key
+			db.keys.AscendLessThan(&dbItem{key: start}, sample)
+		}
+	}
+	return victim
+}
+
+// evict deletes items of any keyspace until the database uses no more than
+// the max memory plus the extra bytes. The item with the keep key, in the
+// keyspace of the transaction, is not evicted.
+func (tx *Tx) evict(keep string, extra int64) error {
+	root := tx
+	if tx.parent != nil {
+		root = tx.parent
+	}
+	max := int64(tx.db.config.MaxMemory)
+	for root.db.memory()+extra > max {
+		// The victim is the best of the victims of the keyspaces.
+		var vtx *Tx
+		var victim *dbItem
+		for _, name := range append([]string{""}, root.db.spaceNames()...) {
+			ktx, err := root.Keyspace(name)
+			if err != nil {
+				return err
+			}
+			kkeep := ""
+			if ktx == tx {
+				kkeep = keep
+			}
+			item := ktx.db.evictionVictim(kkeep)
+			if item != nil &&
+				(victim == nil || tx.db.evictsBefore(item, victim)) {
+				vtx, victim = ktx, item
+			}
+		}
+		if victim == nil {
+			return ErrMaxMemory
+		}
+		// Evictions use the same delete as expirations, which keeps the
+		// indexes and the append-only file in sync.
+		if _, err := vtx.Delete(victim.key); err != nil && err != ErrNotFound {
+			return err
+		}
+		if vtx == root {
+			// OnEvicted is not used with keyspaces.
+			root.wc.evicted = append(root.wc.evicted, victim.key)
+		}
+	}
+	return nil
+}
+
+// evictsBefore returns true when the item a is evicted before the item b.
+func (db *DB) evictsBefore(a, b *dbItem) bool {
+	if db.config.EvictionPolicy == VolatileTTL {
+		return a.opts.exat.Before(b.opts.exat)
+	}
+	return db.evictionScore(a) > db.evictionScore(b)
+}
+
+// memory returns the approximate memory used by the items of the database,
+// including the items of all of its keyspaces.
+func (db *DB) memory() int64 {
+	if db.root != nil {
+		db = db.root
+	}
+	size := db.memsize
+	for _, kdb := range db.spaces {
+		size += kdb.memsize
+	}
+	return size
+}
+
+// makeRoom evicts items to make room for the item that is being set.
+// Returns ErrMaxMemory when there is not enough room.
+func (tx *Tx) makeRoom(item *dbItem) error {
+	max := int64(tx.db.config.MaxMemory)
+	if max <= 0 {
+		return nil
+	}
+	size := item.size()
+	if size > max {
+		return ErrMaxMemory
+	}
+	if prev := tx.db.get(item.key); prev != nil {
+		size -= prev.size()
+	}
+	if size <= 0 {
+		// the item is not larger than the item that it replaces
+		return nil
+	}
+	return tx.evict(item.key, size)
+}
@@ -0,0 +1,216 @@
+package buntdb
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testEvictionDB opens a database that has room for ten of the items that are
+// created by testFillAOF.
+func testEvictionDB(t *testing.T, policy EvictionPolicy) (*DB,
+	func() string) {
+	db := testOpen(t)
+	var mu sync.Mutex
+	var evicted []string
+	var config Config
+	if err := db.ReadConfig(&config); err != nil {
+		t.Fatal(err)
+	}
+	config.MaxMemory = 10*(len("key:0")+len("val:0")+dbItemOverhead) + 10
+	config.EvictionPolicy = policy
+	config.OnEvicted = func(keys []string) {
+		mu.Lock()
+		evicted = append(evicted, keys...)
+		mu.Unlock()
+	}
+	if err := db.SetConfig(config); err != nil {
+		t.Fatal(err)
+	}
+	return db, func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		return strings.Join(evicted, ",")
+	}
+}
+
+func testGet(t *testing.T, db *DB, key string) {
+	if err := db.View(func(tx *Tx) error {
+		_, err := tx.Get(key)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEvictionNoEviction(t *testing.T) {
+	db, _ := testEvictionDB(t, NoEviction)
+	defer testClose(db)
+	testFillAOF(t, db, 10)
+	err := db.Update(func(tx *Tx) error {
+		_, _, err := tx.Set("key:10", "val:10", nil)
+		return err
+	})
+	if err != ErrMaxMemory {
+		t.Fatalf("expected '%v', got '%v'", ErrMaxMemory, err)
+	}
+	if err := db.Update(func(tx *Tx) error {
+		// replacing with a value of the same size is allowed.
+		if _, _, err := tx.Set("key:1", "VAL:1", nil); err != nil {
+			return err
+		}
+		if _, err := tx.Delete("key:2"); err != nil {
+			return err
+		}
+		_, _, err := tx.Set("key:10", "val:1", nil)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if n := testCountItems(t, db); n != 10 {
+		t.Fatalf("expected '%v', got '%v'", 10, n)
+	}
+	// a rolled back delete all restores the memory size.
+	if err := db.Update(func(tx *Tx) error {
+		tx.DeleteAll()
+		return errors.New("rollback")
+	}); err == nil {
+		t.Fatal("expected an error")
+	}
+	err = db.Update(func(tx *Tx) error {
+		_, _, err := tx.Set("key:11", "val:11", nil)
+		return err
+	})
+	if err != ErrMaxMemory {
+		t.Fatalf("expected '%v', got '%v'", ErrMaxMemory, err)
+	}
+}
+
+func TestEvictionLRU(t *testing.T) {
+	db, evicted := testEvictionDB(t, AllKeysLRU)
+	defer testClose(db)
+	for i := 0; i < 10; i++ {
+		if err := db.Update(func(tx *Tx) error {
+			_, _, err := tx.Set(fmt.Sprintf("key:%d", i), "val:0", nil)
+			return err
+		}); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond * 2)
+	}
+	testGet(t, db, "key:0")
+	testGet(t, db, "key:1")
+	if err := db.Update(func(tx *Tx) error {
+		if _, _, err := tx.Set("key:10", "val:0", nil); err != nil {
+			return err
+		}
+		_, _, err := tx.Set("key:11", "val:0", nil)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if res := evicted(); res != "key:2,key:3" {
+		t.Fatalf("expected '%v', got '%v'", "key:2,key:3", res)
+	}
+	// the evictions are written to the file.
+	db = testReOpen(t, db)
+	defer testClose(db)
+	if n := testCountItems(t, db); n != 10 {
+		t.Fatalf("expected '%v', got '%v'", 10, n)
+	}
+	if err := db.View(func(tx *Tx) error {
+		_, err := tx.Get("key:2")
+		return err
+	}); err != ErrNotFound {
+		t.Fatalf("expected '%v', got '%v'", ErrNotFound, err)
+	}
+}
+
+func TestEvictionLFU(t *testing.T) {
+	db, evicted := testEvictionDB(t, AllKeysLFU)
+	defer testClose(db)
+	testFillAOF(t, db, 10)
+	for i := 0; i < 10; i++ {
+		if i != 5 {
+			testGet(t, db, fmt.Sprintf("key:%d", i))
+		}
+	}
+	if err := db.Update(func(tx *Tx) error {
+		_, _, err := tx.Set("key:10", "val:0", nil)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if res := evicted(); res != "key:5" {
+		t.Fatalf("expected '%v', got '%v'", "key:5", res)
+	}
+}
+
+func TestEvictionVolatileTTL(t *testing.T) {
+	db, evicted := testEvictionDB(t, VolatileTTL)
+	defer testClose(db)
+	testFillAOF(t, db, 8)
+	if err := db.Update(func(tx *Tx) error {
+		if _, _, err := tx.Set("key:8", "val:8",
+			&SetOptions{Expires: true, TTL: time.Hour * 2}); err != nil {
+			return err
+		}
+		_, _, err := tx.Set("key:9", "val:9",
+			&SetOptions{Expires: true, TTL: time.Hour})
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 10; i < 12; i++ {
+		if err := db.Update(func(tx *Tx) error {
+			_, _, err := tx.Set(fmt.Sprintf("key:%d", i), "val:0", nil)
+			return err
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if res := evicted(); res != "key:9,key:8" {
+		t.Fatalf("expected '%v', got '%v'", "key:9,key:8", res)
+	}
+	// nothing left to evict.
+	err := db.Update(func(tx *Tx) error {
+		_, _, err := tx.Set("key:12", "val:0", nil)
+		return err
+	})
+	if err != ErrMaxMemory {
+		t.Fatalf("expected '%v', got '%v'", ErrMaxMemory, err)
+	}
+}
+
+func TestEvictionLowered(t *testing.T) {
+	db, evicted := testEvictionDB(t, AllKeysLRU)
+	defer testClose(db)
+	testFillAOF(t, db, 10)
+	var config Config
+	if err := db.ReadConfig(&config); err != nil {
+		t.Fatal(err)
+	}
+	config.MaxMemory /= 2
+	if err := db.SetConfig(config); err != nil {
+		t.Fatal(err)
+	}
+	// the background manager evicts the items.
+	start := time.Now()
+	for testCountItems(t, db) != 5 {
+		if time.Since(start) > time.Second*5 {
+			t.Fatal("expected evictions")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	time.Sleep(time.Millisecond * 10)
+	if n := len(strings.Split(evicted(), ",")); n != 5 {
+		t.Fatalf("expected '%v', got '%v'", 5, n)
+	}
+	config.EvictionPolicy = 100
+	if err := db.SetConfig(config); err != ErrInvalidEvictionPolicy {
+		t.Fatalf("expected '%v', got '%v'", ErrInvalidEvictionPolicy, err)
+	}
+}
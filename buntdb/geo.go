@@ -0,0 +1,302 @@
+package buntdb
+
+import (
+	"container/heap"
+	"math"
+
+	"github.com/tidwall/rtree"
+)
+
+// earthRadius is the mean radius of the earth in meters.
+const earthRadius = 6371008.8
+
+// WithinRadius calls the iterator for every item of a spatial index that is
+// within the distance in meters of the lat/lon point, in order of nearest to
+// farthest. The items of the index are [lon lat] points or rectangles, like
+// for Nearby, and dist is the great-circle distance in meters from the point
+// to the nearest point of the item.
+func (tx *Tx) WithinRadius(index string, lat, lon, meters float64,
+	iterator func(key, value string, dist float64) bool) error {
+	return tx.nearbyMeters(index, lat, lon, meters, iterator)
+}
+
+// NearbyMeters calls the iterator for every item of a spatial index in order
+// of nearest to farthest from the lat/lon point, until iterator returns
+// false. Unlike Nearby, the dist is the great-circle distance in meters from
+// the point to the nearest point of the item.
+func (tx *Tx) NearbyMeters(index string, lat, lon float64,
+	iterator func(key, value string, dist float64) bool) error {
+	return tx.nearbyMeters(index, lat, lon, math.Inf(+1), iterator)
+}
+
+// WithinPolygon calls the iterator for every item of a spatial index that is
+// within the polygon, until iterator returns false. The ring of the polygon
+// is a list of [lon lat] points, which may be closed by repeating the first
+// point. The items are checked with the exact polygon, and not only with its
+// bounding rectangle. Returns ErrInvalidPolygon when the ring has fewer than
+// three points, or when a point has fewer than two coordinates.
+func (tx *Tx) WithinPolygon(index string, ring [][]float64,
+	iterator func(key, value string) bool) error {
+	if tx.db == nil {
+		return ErrTxClosed
+	}
+	for _, p := range ring {
+		if len(p) < 2 {
+			return ErrInvalidPolygon
+		}
+	}
+	if len(ring) > 1 && ring[0][0] == ring[len(ring)-1][0] &&
+		ring[0][1] == ring[len(ring)-1][1] {
+		ring = ring[:len(ring)-1]
+	}
+	if len(ring) < 3 {
+		return ErrInvalidPolygon
+	}
+	idx, err := tx.spatialIndex(index)
+	if idx == nil {
+		return err
+	}
+	min := []float64{ring[0][0], ring[0][1]}
+	max := []float64{ring[0][0], ring[0][1]}
+	for _, p := range ring[1:] {
+		min[0], min[1] = math.Min(min[0], p[0]), math.Min(min[1], p[1])
+		max[0], max[1] = math.Max(max[0], p[0]), math.Max(max[1], p[1])
+	}
+	idx.rtr.Search(&rect{min, max}, func(item rtree.Item) bool {
+		dbi := item.(*dbItem)
+		min, max := dbi.Rect(idx)
+		if len(min) < 2 || !rectInRing(ring, min, max) {
+			return true
+		}
+		return iterator(dbi.key, dbi.value())
+	})
+	return nil
+}
+
+// spatialIndex returns the spatial index, or nil when there is nothing to
+// search.
+func (tx *Tx) spatialIndex(index string) (*index, error) {
+	if index == "" {
+		// cannot search on keys tree. just return nil.
+		return nil, nil
+	}
+	idx := tx.db.idxs[index]
+	if idx == nil {
+		// index was not found. return error
+		return nil, ErrNotFound
+	}
+	idx.fill()
+	if idx.rtr == nil {
+		// not an r-tree index. just return nil
+		return nil, nil
+	}
+	return idx, nil
+}
+
+// nearbyMeters calls the iterator for the items that are within the
+// distance in meters, in order of nearest to farthest.
+//
+// The items come from the KNN of the r-tree, which is ordered by the
+// distance in degrees, and are held until the distance in degrees shows that
+// there are no nearer items left. An item within a distance in meters is
+// always within the bounding box of the circle around the point, so the
+// items that are farther in degrees than the box are also farther in meters.
+func (tx *Tx) nearbyMeters(index string, lat, lon, meters float64,
+	iterator func(key, value string, dist float64) bool) error {
+	if tx.db == nil {
+		return ErrTxClosed
+	}
+	idx, err := tx.spatialIndex(index)
+	if idx == nil {
+		return err
+	}
+	var q geoQueue
+	var stopped bool
+	limit := geoSpan(lat, lon, meters)
+	point := []float64{lon, lat}
+	idx.rtr.KNN(&rect{point, point}, false, func(item rtree.Item,
+		boxdist float64) bool {
+		for len(q) > 0 && geoSpan(lat, lon, q[0].dist) < boxdist {
+			gi := heap.Pop(&q).(geoItem)
+			if !iterator(gi.dbi.key, gi.dbi.value(), gi.dist) {
+				stopped = true
+				return false
+			}
+		}
+		if limit < boxdist {
+			// There are no more items within the distance.
+			return false
+		}
+		dbi := item.(*dbItem)
+		min, max := dbi.Rect(idx)
+		if len(min) < 2 {
+			return true
+		}
+		dist := geoRectDist(lat, lon, min, max)
+		if dist <= meters {
+			heap.Push(&q, geoItem{dbi, dist})
+		}
+		return true
+	})
+	for !stopped && len(q) > 0 {
+		gi := heap.Pop(&q).(geoItem)
+		stopped = !iterator(gi.dbi.key, gi.dbi.value(), gi.dist)
+	}
+	return nil
+}
+
+// geoItem is an item and its distance in meters.
+type geoItem struct {
+	dbi  *dbItem
+	dist float64
+}
+
+// geoQueue is a min-heap of items ordered by distance.
+type geoQueue []geoItem
+
+func (q geoQueue) Len() int            { return len(q) }
+func (q geoQueue) Less(i, j int) bool  { return q[i].dist < q[j].dist }
+func (q geoQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *geoQueue) Push(x interface{}) { *q = append(*q, x.(geoItem)) }
+func (q *geoQueue) Pop() interface{} {
+	old := *q
+	x := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return x
+}
+
+// geoSpan returns the squared distance in degrees from the lat/lon point to
+// the farthest corner of the bounding box of the circle with the radius in
+// meters, which is the box distance that the KNN of the r-tree uses. The box
+// wraps around at the antimeridian and widens to all longitudes at a pole.
+func geoSpan(lat, lon, meters float64) float64 {
+	ang := meters / earthRadius
+	if ang >= math.Pi || math.IsNaN(ang) {
+		return math.Inf(+1)
+	}
+	dlat := ang * 180 / math.Pi
+	var dlon float64
+	sin := math.Sin(ang) / math.Cos(lat*math.Pi/180)
+	if lat+dlat >= 90 || lat-dlat <= -90 || sin >= 1 {
+		dlon = 180 + math.Abs(lon)
+	} else {
+		dlon = math.Asin(sin) * 180 / math.Pi
+		if lon+dlon > 180 {
+			dlon = math.Max(dlon, lon+180)
+		}
+		if lon-dlon < -180 {
+			dlon = math.Max(dlon, 180-lon)
+		}
+	}
+	return dlat*dlat + dlon*dlon
+}
+
+// haversine returns the great-circle distance in meters between two lat/lon
+// points.
+func haversine(lat1, lon1, lat2, lon2 float64) float64 {
+	rlat1, rlat2 := lat1*math.Pi/180, lat2*math.Pi/180
+	dlat, dlon := rlat2-rlat1, (lon2-lon1)*math.Pi/180
+	a := math.Sin(dlat/2)*math.Sin(dlat/2) +
+		math.Cos(rlat1)*math.Cos(rlat2)*math.Sin(dlon/2)*math.Sin(dlon/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(math.Min(a, 1)))
+}
+
+// geoRectDist returns the great-circle distance in meters from the lat/lon
+// point to the nearest point of the [lon lat] rectangle. The nearest point is
+// on the meridian of the point when it's within the longitudes of the
+// rectangle, and otherwise on one of the meridian edges, because the distance
+// along a parallel grows with the difference in longitude.
+func geoRectDist(lat, lon float64, min, max []float64) float64 {
+	lons := []float64{min[0], max[0]}
+	if lon >= min[0] && lon <= max[0] {
+		if lat >= min[1] && lat <= max[1] {
+			return 0
+		}
+		lons = []float64{lon}
+	}
+	rlat := lat * math.Pi / 180
+	dist := math.Inf(+1)
+	for _, l := range lons {
+		// The nearest latitude on the meridian.
+		dlon := (l - lon) * math.Pi / 180
+		nlat := math.Atan2(math.Sin(rlat), math.Cos(rlat)*math.Cos(dlon)) *
+			180 / math.Pi
+		nlat = math.Max(min[1], math.Min(max[1], nlat))
+		dist = math.Min(dist, haversine(lat, lon, nlat, l))
+	}
+	return dist
+}
+
+// pointInRing returns true when the point is inside the ring, or on its
+// boundary. The ring is not closed.
+func pointInRing(ring [][]float64, x, y float64) bool {
+	in := false
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		a, b := ring[j], ring[i]
+		if onSegment(a, b, x, y) {
+			return true
+		}
+		if (a[1] > y) != (b[1] > y) &&
+			x < (b[0]-a[0])*(y-a[1])/(b[1]-a[1])+a[0] {
+			in = !in
+		}
+	}
+	return in
+}
+
+// onSegment returns true when the point is on the segment from a to b.
+func onSegment(a, b []float64, x, y float64) bool {
+	return orient(a[0], a[1], b[0], b[1], x, y) == 0 &&
+		x >= math.Min(a[0], b[0]) && x <= math.Max(a[0], b[0]) &&
+		y >= math.Min(a[1], b[1]) && y <= math.Max(a[1], b[1])
+}
+
+// orient returns the sign of the turn from a to b to c.
+func orient(ax, ay, bx, by, cx, cy float64) int {
+	v := (bx-ax)*(cy-ay) - (by-ay)*(cx-ax)
+	switch {
+	case v > 0:
+		return 1
+	case v < 0:
+		return -1
+	}
+	return 0
+}
+
+// segmentsCross returns true when the segments cross at a single point that
+// is not an end of either segment.
+func segmentsCross(a, b, c, d []float64) bool {
+	return orient(a[0], a[1], b[0], b[1], c[0], c[1])*
+		orient(a[0], a[1], b[0], b[1], d[0], d[1]) < 0 &&
+		orient(c[0], c[1], d[0], d[1], a[0], a[1])*
+			orient(c[0], c[1], d[0], d[1], b[0], b[1]) < 0
+}
+
+// rectInRing returns true when the rectangle is inside the ring. The corners
+// of the rectangle must be inside the ring, and the ring must not cross the
+// edges of the rectangle, or have a point inside of it.
+func rectInRing(ring [][]float64, min, max []float64) bool {
+	corners := [][]float64{
+		{min[0], min[1]}, {max[0], min[1]}, {max[0], max[1]}, {min[0], max[1]},
+	}
+	for _, c := range corners {
+		if !pointInRing(ring, c[0], c[1]) {
+			return false
+		}
+	}
+	if min[0] == max[0] && min[1] == max[1] {
+		return true
+	}
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		p := ring[i]
+		if p[0] > min[0] && p[0] < max[0] && p[1] > min[1] && p[1] < max[1] {
+			return false
+		}
+		for k := range corners {
+			if segmentsCross(ring[j], p, corners[k], corners[(k+1)%4]) {
+				return false
+			}
+		}
+	}
+	return true
+}
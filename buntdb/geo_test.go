@@ -0,0 +1,195 @@
+package buntdb
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestNearbyMeters(t *testing.T) {
+	db := testOpen(t)
+	defer testClose(db)
+	type point struct {
+		key      string
+		lat, lon float64
+	}
+	var points []point
+	rng := rand.New(rand.NewSource(1))
+	if err := db.Update(func(tx *Tx) error {
+		if err := tx.CreateSpatialIndex("pos", "pos:*", IndexRect); err != nil {
+			return err
+		}
+		for i := 0; i < 1000; i++ {
+			p := point{fmt.Sprintf("pos:%d", i), rng.Float64()*180 - 90, rng.Float64()*360 - 180}
+			if i%4 == 0 {
+				// more points near the poles and the antimeridian.
+				p.lat = math.Copysign(85+rng.Float64()*5, p.lat)
+			} else if i%4 == 1 {
+				p.lon = math.Copysign(175+rng.Float64()*5, p.lon)
+			}
+			points = append(points, p)
+			if _, _, err := tx.Set(p.key, fmt.Sprintf("[%v %v]", p.lon, p.lat), nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	centers := [][2]float64{{0, 0}, {33.5, -112.2}, {88, 40}, {-89.9, 0}, {10, 179.9}, {-60, -179.5}}
+	for _, c := range centers {
+		sort.Slice(points, func(i, j int) bool {
+			return haversine(c[0], c[1], points[i].lat, points[i].lon) <
+				haversine(c[0], c[1], points[j].lat, points[j].lon)
+		})
+		var exp, expr []string
+		radius := 2000e3
+		for _, p := range points {
+			dist := haversine(c[0], c[1], p.lat, p.lon)
+			exp = append(exp, fmt.Sprintf("%s:%.3f", p.key, dist))
+			if dist <= radius {
+				expr = append(expr, exp[len(exp)-1])
+			}
+		}
+		var res, resr []string
+		if err := db.View(func(tx *Tx) error {
+			if err := tx.NearbyMeters("pos", c[0], c[1], func(key, _ string, dist float64) bool {
+				res = append(res, fmt.Sprintf("%s:%.3f", key, dist))
+				return true
+			}); err != nil {
+				return err
+			}
+			return tx.WithinRadius("pos", c[0], c[1], radius, func(key, _ string, dist float64) bool {
+				resr = append(resr, fmt.Sprintf("%s:%.3f", key, dist))
+				return true
+			})
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(res, ",") != strings.Join(exp, ",") {
+			t.Fatalf("%v: expected '%v', got '%v'", c, exp[:10], res[:10])
+		}
+		if strings.Join(resr, ",") != strings.Join(expr, ",") {
+			t.Fatalf("%v: expected '%v', got '%v'", c, expr, resr)
+		}
+	}
+}
+
+func TestNearbyMetersRect(t *testing.T) {
+	db := testOpen(t)
+	defer testClose(db)
+	if err := db.Update(func(tx *Tx) error {
+		if err := tx.CreateSpatialIndex("pos", "pos:*", IndexRect); err != nil {
+			return err
+		}
+		tx.Set("pos:london", "[-0.1278 51.5074]", nil)
+		tx.Set("pos:paris", "[2.3522 48.8566]", nil)
+		// a rectangle around Paris.
+		tx.Set("pos:box", "[2 48],[3 49]", nil)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	dists := make(map[string]float64)
+	var keys []string
+	if err := db.View(func(tx *Tx) error {
+		return tx.NearbyMeters("pos", 48.8566, 2.3522, func(key, _ string, dist float64) bool {
+			keys = append(keys, key)
+			dists[key] = dist
+			return true
+		})
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if dists["pos:box"] != 0 || dists["pos:paris"] != 0 {
+		t.Fatalf("expected '%v', got '%v'", 0, dists)
+	}
+	if math.Abs(dists["pos:london"]-343.5e3) > 1e3 {
+		t.Fatalf("expected about '%v', got '%v'", 343.5e3, dists["pos:london"])
+	}
+	if keys[2] != "pos:london" {
+		t.Fatalf("expected '%v', got '%v'", "pos:london", keys[2])
+	}
+	// the nearest point of the rectangle is on its edge.
+	var res float64
+	if err := db.View(func(tx *Tx) error {
+		return tx.WithinRadius("pos", 50, 2.5, 200e3, func(key, _ string, dist float64) bool {
+			if key == "pos:box" {
+				res = dist
+			}
+			return true
+		})
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if exp := haversine(50, 2.5, 49, 2.5); math.Abs(res-exp) > 1e-6 {
+		t.Fatalf("expected '%v', got '%v'", exp, res)
+	}
+	if err := db.View(func(tx *Tx) error {
+		return tx.NearbyMeters("missing", 0, 0, nil)
+	}); err != ErrNotFound {
+		t.Fatalf("expected '%v', got '%v'", ErrNotFound, err)
+	}
+}
+
+func TestWithinPolygon(t *testing.T) {
+	db := testOpen(t)
+	defer testClose(db)
+	if err := db.Update(func(tx *Tx) error {
+		if err := tx.CreateSpatialIndex("pos", "pos:*", IndexRect); err != nil {
+			return err
+		}
+		for x := 0; x < 10; x++ {
+			for y := 0; y < 10; y++ {
+				key := fmt.Sprintf("pos:%d:%d", x, y)
+				if _, _, err := tx.Set(key, fmt.Sprintf("[%d %d]", x, y), nil); err != nil {
+					return err
+				}
+			}
+		}
+		tx.Set("pos:rect:in", "[0.5 0.5],[1.5 5.5]", nil)
+		tx.Set("pos:rect:notch", "[0.5 0.5],[5.5 5.5]", nil)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// a U shape, with the notch between x=2 and x=4 above y=2.
+	ring := [][]float64{{0, 0}, {6, 0}, {6, 6}, {4, 6}, {4, 2}, {2, 2}, {2, 6}, {0, 6}, {0, 0}}
+	var keys []string
+	if err := db.View(func(tx *Tx) error {
+		return tx.WithinPolygon("pos", ring, func(key, _ string) bool {
+			keys = append(keys, key)
+			return true
+		})
+	}); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(keys)
+	var exp []string
+	for x := 0; x < 10; x++ {
+		for y := 0; y < 10; y++ {
+			if x <= 6 && y <= 6 && (x <= 2 || x >= 4 || y <= 2) {
+				exp = append(exp, fmt.Sprintf("pos:%d:%d", x, y))
+			}
+		}
+	}
+	exp = append(exp, "pos:rect:in")
+	sort.Strings(exp)
+	if strings.Join(keys, ",") != strings.Join(exp, ",") {
+		t.Fatalf("expected '%v', got '%v'", exp, keys)
+	}
+	for _, ring := range [][][]float64{
+		ring[:2],
+		{{0, 0}, {10}, {10, 10}},
+		{{0, 0}, {10, 0}, {}},
+	} {
+		if err := db.View(func(tx *Tx) error {
+			return tx.WithinPolygon("pos", ring, nil)
+		}); err != ErrInvalidPolygon {
+			t.Fatalf("expected '%v', got '%v'", ErrInvalidPolygon, err)
+		}
+	}
+}
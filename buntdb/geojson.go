@@ -0,0 +1,487 @@
+package buntdb
+
+import (
+	"math"
+	"sort"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/rtree"
+)
+
+// IndexGeoJSON provides for the ability to create a spatial index on a
+// GeoJSON object in a JSON value. The object at the path may be a Point,
+// MultiPoint, LineString, MultiLineString, Polygon, MultiPolygon,
+// GeometryCollection, Feature, or FeatureCollection, and its bounding box
+// is indexed. An empty path uses the whole value. Values that do not have a
+// valid object are not indexed.
+//
+// The IntersectsGeoJSON and WithinGeoJSON methods search a persistent index
+// with the exact shapes of the objects, and not only with their bounding
+// boxes. The index is created with the name of the function and the path,
+// which keeps the path with the index:
+//
+//	tx.CreatePersistentSpatialIndex("geo", "*", nil, "IndexGeoJSON:geom")
+func IndexGeoJSON(path string) func(s string) (min, max []float64) {
+	return func(s string) (min, max []float64) {
+		shape := parseGeoJSON(geoJSONObject(s, path))
+		if shape == nil {
+			return nil, nil
+		}
+		return shape.bounds()
+	}
+}
+
+// IntersectsGeoJSON calls the iterator for every item of a persistent spatial
+// index with an IndexGeoJSON function, whose object intersects the GeoJSON
+// object, until iterator returns false. The items are first searched by the
+// bounding box of the object, and then checked with the exact shapes.
+// Returns ErrInvalidQuery when the object is not valid GeoJSON, and
+// ErrInvalidOperation when the index was not created with the name of
+// IndexGeoJSON, such as "IndexGeoJSON:geom".
+func (tx *Tx) IntersectsGeoJSON(index, object string,
+	iterator func(key, value string) bool) error {
+	return tx.searchGeoJSON(index, object, func(item, query *geoShape) bool {
+		return item.intersects(query)
+	}, iterator)
+}
+
+// WithinGeoJSON calls the iterator for every item of a persistent spatial
+// index with an IndexGeoJSON function, whose object is within the polygons of
+// the GeoJSON object, until iterator returns false. The items are first
+// searched by the bounding box of the object, and then checked with the exact
+// shapes. Returns the same errors as IntersectsGeoJSON.
+func (tx *Tx) WithinGeoJSON(index, object string,
+	iterator func(key, value string) bool) error {
+	return tx.searchGeoJSON(index, object, func(item, query *geoShape) bool {
+		return item.within(query)
+	}, iterator)
+}
+
+// searchGeoJSON calls the iterator for the items within the bounding box of
+// the object that match it.
+func (tx *Tx) searchGeoJSON(index, object string,
+	match func(item, query *geoShape) bool,
+	iterator func(key, value string) bool) error {
+	if tx.db == nil {
+		return ErrTxClosed
+	}
+	query := parseGeoJSON(gjson.Parse(object))
+	if query == nil {
+		return ErrInvalidQuery
+	}
+	idx, err := tx.spatialIndex(index)
+	if idx == nil {
+		return err
+	}
+	path, ok := idx.geoJSONPath()
+	if !ok {
+		return ErrInvalidOperation
+	}
+	min, max := query.bounds()
+	idx.rtr.Search(&rect{min, max}, func(item rtree.Item) bool {
+		dbi := item.(*dbItem)
+		value := dbi.value()
+		shape := parseGeoJSON(geoJSONObject(value, path))
+		if shape == nil || !match(shape, query) {
+			return true
+		}
+		return iterator(dbi.key, value)
+	})
+	return nil
+}
+
+// geoJSONObject returns the object at the path, or the whole value when the
+// path is empty.
+func geoJSONObject(s, path string) gjson.Result {
+	if path == "" {
+		return gjson.Parse(s)
+	}
+	return gjson.Get(s, path)
+}
+
+// geoShape is the points, lines and polygons of a GeoJSON object. The rings
+// of a polygon are not closed, and the first ring is the exterior.
+type geoShape struct {
+	points [][]float64
+	lines  [][][]float64
+	polys  [][][][]float64
+}
+
+// parseGeoJSON returns the shape of the GeoJSON object, or nil when the
+// object is not valid.
+func parseGeoJSON(obj gjson.Result) *geoShape {
+	shape := &geoShape{}
+	if !shape.add(obj) || len(shape.points)+len(shape.lines)+len(shape.polys) == 0 {
+		return nil
+	}
+	return shape
+}
+
+// add adds the GeoJSON object to the shape.
+func (shape *geoShape) add(obj gjson.Result) bool {
+	coords := obj.Get("coordinates")
+	switch obj.Get("type").String() {
+	case "Point":
+		point := geoPoint(coords)
+		shape.points = append(shape.points, point)
+		return point != nil
+	case "MultiPoint":
+		points := geoPoints(coords, 1)
+		shape.points = append(shape.points, points...)
+		return points != nil
+	case "LineString":
+		line := geoPoints(coords, 2)
+		shape.lines = append(shape.lines, line)
+		return line != nil
+	case "MultiLineString":
+		for _, coords := range coords.Array() {
+			line := geoPoints(coords, 2)
+			if line == nil {
+				return false
+			}
+			shape.lines = append(shape.lines, line)
+		}
+		return coords.IsArray()
+	case "Polygon":
+		poly := geoPolygon(coords)
+		shape.polys = append(shape.polys, poly)
+		return poly != nil
+	case "MultiPolygon":
+		for _, coords := range coords.Array() {
+			poly := geoPolygon(coords)
+			if poly == nil {
+				return false
+			}
+			shape.polys = append(shape.polys, poly)
+		}
+		return coords.IsArray()
+	case "GeometryCollection":
+		return shape.addAll(obj.Get("geometries"))
+	case "Feature":
+		return shape.add(obj.Get("geometry"))
+	case "FeatureCollection":
+		return shape.addAll(obj.Get("features"))
+	}
+	return false
+}
+
+// addAll adds the GeoJSON objects in the array to the shape.
+func (shape *geoShape) addAll(objs gjson.Result) bool {
+	if !objs.IsArray() {
+		return false
+	}
+	for _, obj := range objs.Array() {
+		if !shape.add(obj) {
+			return false
+		}
+	}
+	return true
+}
+
+// geoPoint returns the [x y] point of a position, or nil when the position
+// is not valid.
+func geoPoint(coords gjson.Result) []float64 {
+	pos := coords.Array()
+	if len(pos) < 2 || pos[0].Type != gjson.Number || pos[1].Type != gjson.Number {
+		return nil
+	}
+	return []float64{pos[0].Float(), pos[1].Float()}
+}
+
+// geoPoints returns the points of an array of positions, or nil when there
+// are fewer than n, or a position is not valid.
+func geoPoints(coords gjson.Result, n int) [][]float64 {
+	var points [][]float64
+	for _, coords := range coords.Array() {
+		point := geoPoint(coords)
+		if point == nil {
+			return nil
+		}
+		points = append(points, point)
+	}
+	if len(points) < n {
+		return nil
+	}
+	return points
+}
+
+// geoPolygon returns the rings of a polygon, which are not closed, or nil
+// when a ring has fewer than three points.
+func geoPolygon(coords gjson.Result) [][][]float64 {
+	var rings [][][]float64
+	for _, coords := range coords.Array() {
+		ring := geoPoints(coords, 3)
+		if n := len(ring); n > 1 && ring[0][0] == ring[n-1][0] &&
+			ring[0][1] == ring[n-1][1] {
+			ring = ring[:n-1]
+		}
+		if len(ring) < 3 {
+			return nil
+		}
+		rings = append(rings, ring)
+	}
+	return rings
+}
+
+// bounds returns the bounding box of the shape.
+func (shape *geoShape) bounds() (min, max []float64) {
+	min = []float64{math.Inf(+1), math.Inf(+1)}
+	max = []float64{math.Inf(-1), math.Inf(-1)}
+	extend := func(points [][]float64) {
+		for _, p := range points {
+			min[0], min[1] = math.Min(min[0], p[0]), math.Min(min[1], p[1])
+			max[0], max[1] = math.Max(max[0], p[0]), math.Max(max[1], p[1])
+		}
+	}
+	extend(shape.points)
+	for _, line := range shape.lines {
+		extend(line)
+	}
+	for _, poly := range shape.polys {
+		extend(poly[0])
+	}
+	return min, max
+}
+
+// containsPoint returns true when the point is on the shape.
+func (shape *geoShape) containsPoint(p []float64) bool {
+	for _, q := range shape.points {
+		if p[0] == q[0] && p[1] == q[1] {
+			return true
+		}
+	}
+	for _, line := range shape.lines {
+		for i := 1; i < len(line); i++ {
+			if onSegment(line[i-1], line[i], p[0], p[1]) {
+				return true
+			}
+		}
+	}
+	for _, poly := range shape.polys {
+		if pointInPolygon(poly, p[0], p[1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// intersects returns true when the shapes have a point in common.
+func (shape *geoShape) intersects(other *geoShape) bool {
+	for _, p := range shape.points {
+		if other.containsPoint(p) {
+			return true
+		}
+	}
+	for _, p := range other.points {
+		if shape.containsPoint(p) {
+			return true
+		}
+	}
+	// The lines and polygons have a point in common when a point of one is
+	// in the other, or their segments intersect.
+	a, b := shape.paths(), other.paths()
+	for _, pa := range a {
+		for _, pb := range b {
+			if pathsIntersect(pa, pb) {
+				return true
+			}
+		}
+	}
+	for _, line := range shape.lines {
+		if other.containsPoint(line[0]) {
+			return true
+		}
+	}
+	for _, line := range other.lines {
+		if shape.containsPoint(line[0]) {
+			return true
+		}
+	}
+	for _, poly := range shape.polys {
+		if other.containsPoint(poly[0][0]) {
+			return true
+		}
+	}
+	for _, poly := range other.polys {
+		if shape.containsPoint(poly[0][0]) {
+			return true
+		}
+	}
+	return false
+}
+
+// within returns true when the shape is within the polygons of the other
+// shape.
+func (shape *geoShape) within(other *geoShape) bool {
+	for _, p := range shape.points {
+		if !other.pointInPolygons(p) {
+			return false
+		}
+	}
+	for _, line := range shape.lines {
+		for i := 1; i < len(line); i++ {
+			if !other.segmentInPolygons(line[i-1], line[i]) {
+				return false
+			}
+		}
+	}
+	for _, poly := range shape.polys {
+		if !other.polygonInPolygons(poly) {
+			return false
+		}
+	}
+	return true
+}
+
+// pointInPolygons returns true when the point is in a polygon of the shape.
+func (shape *geoShape) pointInPolygons(p []float64) bool {
+	for _, poly := range shape.polys {
+		if pointInPolygon(poly, p[0], p[1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// segmentInPolygons returns true when the segment is in a polygon of the
+// shape.
+func (shape *geoShape) segmentInPolygons(a, b []float64) bool {
+	for _, poly := range shape.polys {
+		if segmentInPolygon(poly, a, b) {
+			return true
+		}
+	}
+	return false
+}
+
+// polygonInPolygons returns true when the polygon is in a polygon of the
+// shape. The exterior ring must be in the polygon, and the holes of the
+// polygon must not be inside of it.
+func (shape *geoShape) polygonInPolygons(inner [][][]float64) bool {
+	ext := inner[0]
+next:
+	for _, poly := range shape.polys {
+		for i, j := 0, len(ext)-1; i < len(ext); j, i = i, i+1 {
+			if !segmentInPolygon(poly, ext[j], ext[i]) {
+				continue next
+			}
+		}
+		for _, hole := range poly[1:] {
+			for _, p := range hole {
+				if pointInPolygon(inner, p[0], p[1]) && !onRing(inner[0], p[0], p[1]) {
+					continue next
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// paths returns the lines, and the rings of the polygons, which are closed.
+func (shape *geoShape) paths() [][][]float64 {
+	paths := append([][][]float64(nil), shape.lines...)
+	for _, poly := range shape.polys {
+		for _, ring := range poly {
+			paths = append(paths, append(ring[:len(ring):len(ring)], ring[0]))
+		}
+	}
+	return paths
+}
+
+// pathsIntersect returns true when a segment of one path intersects a
+// segment of the other.
+func pathsIntersect(a, b [][]float64) bool {
+	for i := 1; i < len(a); i++ {
+		for j := 1; j < len(b); j++ {
+			if segmentsIntersect(a[i-1], a[i], b[j-1], b[j]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// segmentsIntersect returns true when the segments have a point in common.
+func segmentsIntersect(a, b, c, d []float64) bool {
+	o1 := orient(a[0], a[1], b[0], b[1], c[0], c[1])
+	o2 := orient(a[0], a[1], b[0], b[1], d[0], d[1])
+	o3 := orient(c[0], c[1], d[0], d[1], a[0], a[1])
+	o4 := orient(c[0], c[1], d[0], d[1], b[0], b[1])
+	if o1*o2 < 0 && o3*o4 < 0 {
+		return true
+	}
+	return onSegment(a, b, c[0], c[1]) || onSegment(a, b, d[0], d[1]) ||
+		onSegment(c, d, a[0], a[1]) || onSegment(c, d, b[0], b[1])
+}
+
+// onRing returns true when the point is on the boundary of the ring.
+func onRing(ring [][]float64, x, y float64) bool {
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		if onSegment(ring[j], ring[i], x, y) {
+			return true
+		}
+	}
+	return false
+}
+
+// pointInPolygon returns true when the point is inside the polygon, or on
+// its boundary. A point inside of a hole is not in the polygon, unless it's
+// on the boundary of the hole.
+func pointInPolygon(poly [][][]float64, x, y float64) bool {
+	if !pointInRing(poly[0], x, y) {
+		return false
+	}
+	for _, hole := range poly[1:] {
+		if pointInRing(hole, x, y) && !onRing(hole, x, y) {
+			return false
+		}
+	}
+	return true
+}
+
+// segmentInPolygon returns true when the segment from a to b is in the
+// polygon. The segment is split where it meets the rings, and every part
+// must be in the polygon.
+func segmentInPolygon(poly [][][]float64, a, b []float64) bool {
+	if !pointInPolygon(poly, a[0], a[1]) || !pointInPolygon(poly, b[0], b[1]) {
+		return false
+	}
+	dx, dy := b[0]-a[0], b[1]-a[1]
+	// param returns the position of a point on the line of the segment.
+	param := func(p []float64) float64 {
+		if dx == 0 && dy == 0 {
+			return 0
+		}
+		return ((p[0]-a[0])*dx + (p[1]-a[1])*dy) / (dx*dx + dy*dy)
+	}
+	ts := []float64{0, 1}
+	for _, ring := range poly {
+		for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+			c, d := ring[j], ring[i]
+			if !segmentsIntersect(a, b, c, d) {
+				continue
+			}
+			ex, ey := d[0]-c[0], d[1]-c[1]
+			den := dx*ey - dy*ex
+			if den == 0 {
+				// The segments are on the same line.
+				ts = append(ts, param(c), param(d))
+			} else {
+				ts = append(ts, ((c[0]-a[0])*ey-(c[1]-a[1])*ex)/den)
+			}
+		}
+	}
+	sort.Float64s(ts)
+	for i := 1; i < len(ts); i++ {
+		t0, t1 := math.Max(ts[i-1], 0), math.Min(ts[i], 1)
+		if t0 >= t1 {
+			continue
+		}
+		t := (t0 + t1) / 2
+		if !pointInPolygon(poly, a[0]+dx*t, a[1]+dy*t) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,162 @@
+package buntdb
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestIndexGeoJSON(t *testing.T) {
+	tests := []struct {
+		value    string
+		min, max string
+	}{
+		{`{"geom":{"type":"Point","coordinates":[1,2]}}`, "[1 2]", "[1 2]"},
+		{`{"geom":{"type":"LineString","coordinates":[[1,2],[-3,4]]}}`, "[-3 2]", "[1 4]"},
+		{`{"geom":{"type":"Polygon","coordinates":[[[0,0],[5,0],[5,5],[0,0]],[[1,1],[2,1],[2,2],[1,1]]]}}`, "[0 0]", "[5 5]"},
+		{`{"geom":{"type":"Feature","properties":{},"geometry":{"type":"MultiPoint","coordinates":[[1,1],[3,-1]]}}}`, "[1 -1]", "[3 1]"},
+		{`{"geom":{"type":"FeatureCollection","features":[{"type":"Feature","geometry":{"type":"Point","coordinates":[1,1]}},{"type":"Feature","geometry":{"type":"Point","coordinates":[9,9]}}]}}`, "[1 1]", "[9 9]"},
+		{`{"geom":{"type":"Point","coordinates":[1]}}`, "[]", "[]"},
+		{`{"geom":{"type":"Polygon","coordinates":[[[0,0],[5,0],[0,0]]]}}`, "[]", "[]"},
+		{`{"geom":{"type":"Circle","coordinates":[1,2]}}`, "[]", "[]"},
+		{`{"name":"none"}`, "[]", "[]"},
+	}
+	rect := IndexGeoJSON("geom")
+	for i, tt := range tests {
+		min, max := rect(tt.value)
+		if res := fmt.Sprint(min); res != tt.min {
+			t.Fatalf("%d: expected '%v', got '%v'", i, tt.min, res)
+		}
+		if res := fmt.Sprint(max); res != tt.max {
+			t.Fatalf("%d: expected '%v', got '%v'", i, tt.max, res)
+		}
+	}
+	min, max := IndexGeoJSON("")(`{"type":"Point","coordinates":[1,2]}`)
+	if res := fmt.Sprint(min, max); res != "[1 2] [1 2]" {
+		t.Fatalf("expected '%v', got '%v'", "[1 2] [1 2]", res)
+	}
+}
+
+func TestGeoJSONQueries(t *testing.T) {
+	db := testOpen(t)
+	defer testClose(db)
+	items := map[string]string{
+		"arm":        `{"type":"Point","coordinates":[1,4]}`,
+		"notch":      `{"type":"Point","coordinates":[3,4]}`,
+		"edge":       `{"type":"Point","coordinates":[2,4]}`,
+		"outside":    `{"type":"Point","coordinates":[8,8]}`,
+		"bridge":     `{"type":"LineString","coordinates":[[1,5],[5,5]]}`,
+		"base":       `{"type":"LineString","coordinates":[[1,1],[5,1]]}`,
+		"crossing":   `{"type":"LineString","coordinates":[[3,1],[3,5]]}`,
+		"inotch":     `{"type":"LineString","coordinates":[[3,3],[3,5]]}`,
+		"square":     `{"type":"Polygon","coordinates":[[[0.5,0.5],[1.5,0.5],[1.5,1.5],[0.5,1.5],[0.5,0.5]]]}`,
+		"covering":   `{"type":"Polygon","coordinates":[[[2.5,1.5],[3.5,1.5],[3.5,2.5],[2.5,2.5],[2.5,1.5]]]}`,
+		"pnotch":     `{"type":"Polygon","coordinates":[[[2.5,2.5],[3.5,2.5],[3.5,3.5],[2.5,3.5],[2.5,2.5]]]}`,
+		"around":     `{"type":"Polygon","coordinates":[[[-1,-1],[7,-1],[7,7],[-1,7],[-1,-1]]]}`,
+		"feature":    `{"type":"Feature","properties":{"name":"x"},"geometry":{"type":"Point","coordinates":[5,3]}}`,
+		"collection": `{"type":"GeometryCollection","geometries":[{"type":"Point","coordinates":[1,1]},{"type":"Point","coordinates":[3,5]}]}`,
+		"invalid":    `{"type":"Point"}`,
+	}
+	if err := db.Update(func(tx *Tx) error {
+		if err := tx.CreatePersistentSpatialIndex("geo", "obj:*", nil,
+			"IndexGeoJSON:geom"); err != nil {
+			return err
+		}
+		if err := tx.CreateSpatialIndex("rect", "obj:*",
+			IndexGeoJSON("geom")); err != nil {
+			return err
+		}
+		for name, obj := range items {
+			val := fmt.Sprintf(`{"name":"%s","geom":%s}`, name, obj)
+			if _, _, err := tx.Set("obj:"+name, val, nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// a U shape, with the notch between x=2 and x=4 above y=2, so that its
+	// bounding box has all of the items except for outside.
+	query := `{"type":"Feature","geometry":{"type":"Polygon","coordinates":[
+		[[0,0],[6,0],[6,6],[4,6],[4,2],[2,2],[2,6],[0,6],[0,0]]]}}`
+	search := func(within bool) string {
+		var names []string
+		if err := db.View(func(tx *Tx) error {
+			fn := tx.IntersectsGeoJSON
+			if within {
+				fn = tx.WithinGeoJSON
+			}
+			return fn("geo", query, func(key, value string) bool {
+				names = append(names, strings.TrimPrefix(key, "obj:"))
+				return true
+			})
+		}); err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(names)
+		return strings.Join(names, ",")
+	}
+	exp := "arm,around,base,bridge,collection,covering,crossing,edge,feature,square"
+	if res := search(false); res != exp {
+		t.Fatalf("expected '%v', got '%v'", exp, res)
+	}
+	exp = "arm,base,edge,feature,square"
+	if res := search(true); res != exp {
+		t.Fatalf("expected '%v', got '%v'", exp, res)
+	}
+	if err := db.View(func(tx *Tx) error {
+		return tx.IntersectsGeoJSON("geo", `{"type":"Point"}`, nil)
+	}); err != ErrInvalidQuery {
+		t.Fatalf("expected '%v', got '%v'", ErrInvalidQuery, err)
+	}
+	// the path of an index is only known when it's created by name.
+	if err := db.View(func(tx *Tx) error {
+		return tx.IntersectsGeoJSON("rect", query, nil)
+	}); err != ErrInvalidOperation {
+		t.Fatalf("expected '%v', got '%v'", ErrInvalidOperation, err)
+	}
+	// the path is kept when the database is opened again.
+	db = testReOpen(t, db)
+	defer testClose(db)
+	if res := search(true); res != exp {
+		t.Fatalf("expected '%v', got '%v'", exp, res)
+	}
+}
+
+func TestGeoJSONHoles(t *testing.T) {
+	// a square with a square hole.
+	poly := parseGeoJSON(geoJSONObject(`{"type":"Polygon","coordinates":[
+		[[0,0],[10,0],[10,10],[0,10],[0,0]],
+		[[4,4],[6,4],[6,6],[4,6],[4,4]]]}`, ""))
+	tests := []struct {
+		obj                string
+		intersects, within bool
+	}{
+		{`{"type":"Point","coordinates":[5,5]}`, false, false},
+		{`{"type":"Point","coordinates":[4,5]}`, true, true},
+		{`{"type":"Point","coordinates":[2,2]}`, true, true},
+		{`{"type":"LineString","coordinates":[[1,5],[9,5]]}`, true, false},
+		{`{"type":"LineString","coordinates":[[1,1],[9,1]]}`, true, true},
+		{`{"type":"Polygon","coordinates":[[[4.5,4.5],[5.5,4.5],[5.5,5.5],[4.5,4.5]]]}`, false, false},
+		{`{"type":"Polygon","coordinates":[[[1,1],[3,1],[3,3],[1,1]]]}`, true, true},
+		// the hole is inside of the polygon, unless it's inside of the hole of
+		// the polygon.
+		{`{"type":"Polygon","coordinates":[[[3,3],[7,3],[7,7],[3,7],[3,3]]]}`, true, false},
+		{`{"type":"Polygon","coordinates":[[[3,3],[7,3],[7,7],[3,7],[3,3]],[[3.5,3.5],[6.5,3.5],[6.5,6.5],[3.5,6.5],[3.5,3.5]]]}`, true, true},
+		{`{"type":"Polygon","coordinates":[[[-1,-1],[11,-1],[11,11],[-1,-1]]]}`, true, false},
+	}
+	for i, tt := range tests {
+		shape := parseGeoJSON(geoJSONObject(tt.obj, ""))
+		if res := shape.intersects(poly); res != tt.intersects {
+			t.Fatalf("%d: expected '%v', got '%v'", i, tt.intersects, res)
+		}
+		if res := poly.intersects(shape); res != tt.intersects {
+			t.Fatalf("%d: expected '%v', got '%v'", i, tt.intersects, res)
+		}
+		if res := shape.within(poly); res != tt.within {
+			t.Fatalf("%d: expected '%v', got '%v'", i, tt.within, res)
+		}
+	}
+}
@@ -0,0 +1,274 @@
+package buntdb
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// commitGroup is a group of transactions that are written to the append-only
+// file with a single write, and synced to disk with a single fsync.
+//
+// With the Always sync policy, a committed transaction joins the group that
+// is being filled, or it starts a new group and becomes its leader. The
+// leader waits for the previous group to be synced, which is when the other
+// transactions join the group, and then writes and syncs the group. The
+// database lock is not held during the fsync, so the next group is filled in
+// the meantime.
+type commitGroup struct {
+	txs    []*Tx         // the transactions, in commit order
+	events []watchEvent  // the change events of the transactions
+	prev   *commitGroup  // the previous group, which is written first
+	done   chan struct{} // closed when the group is synced or has failed
+	err    error         // the write or sync error
+}
+
+// commitGrouped commits a transaction as part of a group commit, and returns
+// after the changes have been synced to disk. Must be called while holding
+// the write lock.
+func (tx *Tx) commitGrouped() error {
+	db := tx.db
+	g := db.group
+	leader := g == nil
+	if leader {
+		g = &commitGroup{prev: db.lastgroup, done: make(chan struct{})}
+		db.group, db.lastgroup = g, g
+	}
+	g.txs = append(g.txs, tx)
+	if len(db.watchers) > 0 {
+		// The events are queued once the group is durable, which keeps the
+		// watchers from seeing changes that are rolled back.
+		g.events = append(g.events, tx.changeEvents()...)
+	}
+	var onEvicted func(keys []string)
+	if len(tx.wc.evicted) > 0 {
+		onEvicted = db.config.OnEvicted
+	}
+	// Unlock the database and allow for another writable transaction, which
+	// may join the group.
+	tx.unlock()
+	if leader {
+		db.writeGroup(g)
+	}
+	<-g.done
+	if g.err == nil && onEvicted != nil {
+		onEvicted(tx.wc.evicted)
+	}
+	// Clear the db field to disable this transaction from future use.
+	tx.release()
+	return g.err
+}
+
+// writeGroup writes the records of the group to the file and syncs the file.
+// When the write fails the transactions of the group are rolled back. When
+// the sync fails, the changes of the group cannot be rolled back, because
+// the next group has been applied on top of them, so the database rejects
+// all writes from then on.
+func (db *DB) writeGroup(g *commitGroup) {
+	if g.prev != nil {
+		<-g.prev.done
+		g.prev = nil
+	}
+	db.mu.Lock()
+	// No more transactions can join the group.
+	db.group = nil
+	var err error
+	if db.closed {
+		err = ErrDatabaseClosed
+	} else if db.syncerr != nil {
+		// The previous group failed to sync. Every change since then
+		// belongs to this group.
+		err = db.syncerr
+		for i := len(g.txs) - 1; i >= 0; i-- {
+			g.txs[i].rollbackInner()
+		}
+	} else {
+		db.buf = db.buf[:0]
+		if !db.textaof && !db.aofhdr {
+			// The first write to an empty file includes the header.
+			db.buf = db.aofcrypt.appendHeader(db.buf)
+		}
+		mark := len(db.buf)
+		for _, tx := range g.txs {
+			db.buf = tx.writeRecordsTo(db.buf)
+		}
+		db.buf = db.aofcrypt.seal(db.buf, mark)
+		var n int
+		if n, err = db.file.Write(db.buf); err != nil {
+			// Every change since the previous group belongs to this group,
+			// so they are rolled back in reverse order.
+			for i := len(g.txs) - 1; i >= 0; i-- {
+				g.txs[i].rollbackInner()
+			}
+			if n > 0 {
+				// Cut off the partial write, otherwise the records that
+				// follow will not be readable.
+				_ = db.file.Truncate(db.aofsize)
+			}
+		} else {
+			db.aofsize += int64(n)
+			db.aofhdr = true
+			db.logcond.Broadcast()
+			db.rotateSegment()
+		}
+		db.flushes++
+	}
+	if err == nil {
+		db.syncgroup = g
+		file := db.file
+		db.mu.Unlock()
+		err = file.Sync()
+		db.mu.Lock()
+		db.syncgroup = nil
+		if err != nil {
+			// The changes are visible, and they may or may not be on disk.
+			err = fmt.Errorf("%w: %v", ErrSyncFailed, err)
+			db.syncerr = err
+		}
+	}
+	if err == nil && len(g.events) > 0 && db.watchq != nil {
+		db.watchq.push(g.events)
+	}
+	if db.lastgroup == g {
+		db.lastgroup = nil
+	}
+	g.err = err
+	db.mu.Unlock()
+	close(g.done)
+}
+
+// waitSync waits for the group commit that is being synced. Must be called
+// while holding the write lock, which is released while waiting.
+func (db *DB) waitSync() {
+	for db.syncgroup != nil {
+		g := db.syncgroup
+		db.mu.Unlock()
+		<-g.done
+		db.mu.Lock()
+	}
+}
+
+// waitGroups waits for all of the group commits. Must be called while
+// holding the write lock, which is released while waiting.
+func (db *DB) waitGroups() {
+	for db.lastgroup != nil {
+		g := db.lastgroup
+		db.mu.Unlock()
+		<-g.done
+		db.mu.Lock()
+	}
+}
+
+// errBatchCall is returned to the transaction of a batch when one of its
+// calls fails.
+var errBatchCall = errors.New("batch call failed")
+
+// batch is a group of Batch calls that are run in a single transaction. The
+// first call of the batch runs it, once the batch is full or after the delay.
+type batch struct {
+	calls []*batchCall
+	full  chan struct{} // closed when the batch is full
+}
+
+// batchCall is a single call of Batch.
+type batchCall struct {
+	fn   func(tx *Tx) error
+	solo bool          // the call failed, and is run on its own
+	err  error         // the commit error of the batch
+	done chan struct{} // closed when the call is done
+}
+
+// Batch calls a function as part of a read/write transaction that is shared
+// with other goroutines that are calling Batch at the same time. The
+// transaction is committed once Config.MaxBatchSize calls have been collected,
+// or after Config.MaxBatchDelay, which allows for many small updates to be
+// written and synced together.
+//
+// When a function returns an error or panics, the transaction is rolled back
+// and run again without that function, and then the function is run in a
+// transaction of its own, which returns its error, or panics, to the caller
+// of Batch. This means that the function may be called more than once, so it
+// should not have side effects outside of the transaction.
+//
+// Batch is only useful when it's called by many goroutines at once.
+func (db *DB) Batch(fn func(tx *Tx) error) error {
+	db.mu.RLock()
+	maxSize, maxDelay := db.config.MaxBatchSize, db.config.MaxBatchDelay
+	db.mu.RUnlock()
+	if maxSize <= 0 || maxDelay <= 0 {
+		return db.Update(fn)
+	}
+	c := &batchCall{fn: fn, done: make(chan struct{})}
+	db.batchmu.Lock()
+	b := db.batch
+	first := b == nil
+	if first {
+		b = &batch{full: make(chan struct{})}
+		db.batch = b
+	}
+	b.calls = append(b.calls, c)
+	if len(b.calls) >= maxSize {
+		// No more calls can join the batch.
+		db.batch = nil
+		close(b.full)
+	}
+	db.batchmu.Unlock()
+	if first {
+		timer := time.NewTimer(maxDelay)
+		select {
+		case <-b.full:
+		case <-timer.C:
+		}
+		timer.Stop()
+		db.batchmu.Lock()
+		if db.batch == b {
+			db.batch = nil
+		}
+		calls := b.calls
+		db.batchmu.Unlock()
+		db.runBatch(calls)
+	}
+	<-c.done
+	if c.solo {
+		return db.Update(fn)
+	}
+	return c.err
+}
+
+// runBatch runs the calls in a single transaction. A call that fails is taken
+// out, and the transaction is run again with the calls that are left.
+func (db *DB) runBatch(calls []*batchCall) {
+	for len(calls) > 0 {
+		failed := -1
+		err := db.Update(func(tx *Tx) error {
+			for i, c := range calls {
+				if !c.try(tx) {
+					failed = i
+					return errBatchCall
+				}
+			}
+			return nil
+		})
+		if failed < 0 {
+			for _, c := range calls {
+				c.err = err
+				close(c.done)
+			}
+			return
+		}
+		calls[failed].solo = true
+		close(calls[failed].done)
+		calls = append(calls[:failed:failed], calls[failed+1:]...)
+	}
+}
+
+// try calls the function of a batch call, and returns false when it returns
+// an error or panics.
+func (c *batchCall) try(tx *Tx) (ok bool) {
+	defer func() {
+		if recover() != nil {
+			ok = false
+		}
+	}()
+	return c.fn(tx) == nil
+}
@@ -0,0 +1,335 @@
+package buntdb
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testOpenAlways opens a database with the Always sync policy.
+func testOpenAlways(t *testing.T) *DB {
+	db := testOpen(t)
+	var config Config
+	if err := db.ReadConfig(&config); err != nil {
+		t.Fatal(err)
+	}
+	config.SyncPolicy = Always
+	if err := db.SetConfig(config); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// testHoldGroup makes the next group commit wait until the returned function
+// is called.
+func testHoldGroup(db *DB) func() {
+	held := &commitGroup{done: make(chan struct{})}
+	db.mu.Lock()
+	db.lastgroup = held
+	db.mu.Unlock()
+	return func() {
+		db.mu.Lock()
+		if db.lastgroup == held {
+			db.lastgroup = nil
+		}
+		db.mu.Unlock()
+		close(held.done)
+	}
+}
+
+// testWaitGroup waits for a group commit with n transactions.
+func testWaitGroup(t *testing.T, db *DB, n int) {
+	start := time.Now()
+	for {
+		db.mu.RLock()
+		g := db.group
+		ok := g != nil && len(g.txs) == n
+		db.mu.RUnlock()
+		if ok {
+			return
+		}
+		if time.Since(start) > time.Second*5 {
+			t.Fatal("expected a group commit")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func testUpdates(db *DB, n int) []chan error {
+	errcs := make([]chan error, n)
+	for i := 0; i < n; i++ {
+		errcs[i] = make(chan error, 1)
+		go func(i int) {
+			errcs[i] <- db.Update(func(tx *Tx) error {
+				_, _, err := tx.Set(fmt.Sprintf("key:%d", i),
+					fmt.Sprintf("val:%d", i), nil)
+				return err
+			})
+		}(i)
+	}
+	return errcs
+}
+
+func TestGroupCommit(t *testing.T) {
+	db := testOpenAlways(t)
+	defer testClose(db)
+	var events []string
+	var mu sync.Mutex
+	if _, err := db.Watch("*", func(ev ChangeEvent) {
+		mu.Lock()
+		events = append(events, ev.Key)
+		mu.Unlock()
+	}); err != nil {
+		t.Fatal(err)
+	}
+	release := testHoldGroup(db)
+	errcs := testUpdates(db, 10)
+	testWaitGroup(t, db, 10)
+	// the changes are not durable, and the transactions have not returned.
+	select {
+	case err := <-errcs[0]:
+		t.Fatalf("expected a waiting transaction, got '%v'", err)
+	default:
+	}
+	db.mu.RLock()
+	flushes := db.flushes
+	db.mu.RUnlock()
+	release()
+	for _, errc := range errcs {
+		if err := <-errc; err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the ten transactions were written at once.
+	db.mu.RLock()
+	n := db.flushes - flushes
+	db.mu.RUnlock()
+	if n != 1 {
+		t.Fatalf("expected '%v', got '%v'", 1, n)
+	}
+	start := time.Now()
+	for {
+		mu.Lock()
+		n := len(events)
+		mu.Unlock()
+		if n == 10 {
+			break
+		}
+		if time.Since(start) > time.Second*5 {
+			t.Fatalf("expected '%v', got '%v'", 10, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	exp := testDump(t, db)
+	db = testReOpen(t, db)
+	defer testClose(db)
+	if res := testDump(t, db); res != exp || testCountItems(t, db) != 10 {
+		t.Fatalf("expected '%v', got '%v'", exp, res)
+	}
+	// a transaction that is alone is also a group.
+	testFillAOF(t, db, 11)
+	if n := testCountItems(t, db); n != 11 {
+		t.Fatalf("expected '%v', got '%v'", 11, n)
+	}
+}
+
+func TestGroupCommitWriteError(t *testing.T) {
+	db := testOpenAlways(t)
+	defer testClose(db)
+	testFillAOF(t, db, 2)
+	release := testHoldGroup(db)
+	errcs := testUpdates(db, 5)
+	testWaitGroup(t, db, 5)
+	// a file that is opened for reading only cannot be written to.
+	rdonly, err := os.Open(db.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.mu.Lock()
+	file := db.file
+	db.file = osFile{rdonly}
+	db.mu.Unlock()
+	release()
+	for _, errc := range errcs {
+		if err := <-errc; err == nil {
+			t.Fatal("expected an error")
+		}
+	}
+	db.mu.Lock()
+	db.file = file
+	db.mu.Unlock()
+	rdonly.Close()
+	// all of the transactions of the group were rolled back.
+	if res := testDump(t, db); res != "key:0=val:0,key:1=val:1" {
+		t.Fatalf("expected '%v', got '%v'", "key:0=val:0,key:1=val:1", res)
+	}
+	testFillAOF(t, db, 3)
+	db = testReOpen(t, db)
+	defer testClose(db)
+	exp := "key:0=val:0,key:1=val:1,key:2=val:2"
+	if res := testDump(t, db); res != exp {
+		t.Fatalf("expected '%v', got '%v'", exp, res)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	db := testOpen(t)
+	defer testClose(db)
+	var config Config
+	if err := db.ReadConfig(&config); err != nil {
+		t.Fatal(err)
+	}
+	config.MaxBatchSize = 10
+	config.MaxBatchDelay = time.Minute
+	if err := db.SetConfig(config); err != nil {
+		t.Fatal(err)
+	}
+	errFailed := errors.New("failed")
+	var mu sync.Mutex
+	calls := make(map[int]int)
+	errcs := make([]chan error, 10)
+	for i := 0; i < 10; i++ {
+		errcs[i] = make(chan error, 1)
+		go func(i int) {
+			errcs[i] <- db.Batch(func(tx *Tx) error {
+				mu.Lock()
+				calls[i]++
+				mu.Unlock()
+				if i == 3 {
+					return errFailed
+				}
+				_, _, err := tx.Set(fmt.Sprintf("key:%d", i), "val", nil)
+				return err
+			})
+		}(i)
+	}
+	for i, errc := range errcs {
+		if err := <-errc; i == 3 && err != errFailed {
+			t.Fatalf("expected '%v', got '%v'", errFailed, err)
+		} else if i != 3 && err != nil {
+			t.Fatal(err)
+		}
+	}
+	var keys []string
+	db.View(func(tx *Tx) error {
+		return tx.AscendKeys("*", func(key, value string) bool {
+			keys = append(keys, key)
+			return true
+		})
+	})
+	exp := "key:0,key:1,key:2,key:4,key:5,key:6,key:7,key:8,key:9"
+	if res := strings.Join(keys, ","); res != exp {
+		t.Fatalf("expected '%v', got '%v'", exp, res)
+	}
+	// the failed calls are run again in a transaction of their own.
+	if calls[3] != 2 {
+		t.Fatalf("expected '%v', got '%v'", 2, calls[3])
+	}
+	// batching can be turned off.
+	config.MaxBatchSize = 0
+	if err := db.SetConfig(config); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Batch(func(tx *Tx) error {
+		_, _, err := tx.Set("key:10", "val", nil)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if n := testCountItems(t, db); n != 10 {
+		t.Fatalf("expected '%v', got '%v'", 10, n)
+	}
+}
+
+// testSyncErrFile is a file that fails to sync.
+type testSyncErrFile struct {
+	StorageFile
+}
+
+func (f testSyncErrFile) Sync() error {
+	return errors.New("sync error")
+}
+
+func TestGroupCommitSyncError(t *testing.T) {
+	db := testOpenAlways(t)
+	defer testClose(db)
+	db.mu.Lock()
+	file := db.file
+	db.file = testSyncErrFile{file}
+	db.mu.Unlock()
+	err := db.Update(func(tx *Tx) error {
+		_, _, err := tx.Set("key:0", "val:0", nil)
+		return err
+	})
+	if !errors.Is(err, ErrSyncFailed) || !strings.Contains(err.Error(), "sync error") {
+		t.Fatalf("expected '%v', got '%v'", ErrSyncFailed, err)
+	}
+	db.mu.Lock()
+	db.file = file
+	db.mu.Unlock()
+	// the changes are visible, but the database rejects all writes.
+	if res := testDump(t, db); res != "key:0=val:0" {
+		t.Fatalf("expected '%v', got '%v'", "key:0=val:0", res)
+	}
+	err = db.Update(func(tx *Tx) error {
+		_, _, err := tx.Set("key:1", "val:1", nil)
+		return err
+	})
+	if !errors.Is(err, ErrSyncFailed) {
+		t.Fatalf("expected '%v', got '%v'", ErrSyncFailed, err)
+	}
+	db = testReOpen(t, db)
+	defer testClose(db)
+	if err := db.Update(func(tx *Tx) error {
+		_, _, err := tx.Set("key:1", "val:1", nil)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if res := testDump(t, db); res != "key:0=val:0,key:1=val:1" {
+		t.Fatalf("expected '%v', got '%v'", "key:0=val:0,key:1=val:1", res)
+	}
+}
+
+func TestBatchPanic(t *testing.T) {
+	db := testOpen(t)
+	defer testClose(db)
+	var config Config
+	if err := db.ReadConfig(&config); err != nil {
+		t.Fatal(err)
+	}
+	config.MaxBatchSize = 2
+	config.MaxBatchDelay = time.Minute
+	if err := db.SetConfig(config); err != nil {
+		t.Fatal(err)
+	}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- db.Batch(func(tx *Tx) error {
+			_, _, err := tx.Set("key", "val", nil)
+			return err
+		})
+	}()
+	// the panic is returned to the caller, when the function is run on its
+	// own, and the other calls of the batch are committed.
+	func() {
+		defer func() {
+			if res := recover(); res != "failed" {
+				t.Fatalf("expected '%v', got '%v'", "failed", res)
+			}
+		}()
+		db.Batch(func(tx *Tx) error {
+			panic("failed")
+		})
+	}()
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if res := testDump(t, db); res != "key=val" {
+		t.Fatalf("expected '%v', got '%v'", "key=val", res)
+	}
+}
@@ -0,0 +1,311 @@
+package buntdb
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// A persistent index has its definition written to the database file, and it
+// is created again when the database is opened. The less and rect functions
+// of a persistent index are given by their names, which are the names of the
+// built-in functions, or the names that were registered with RegisterLess
+// and RegisterRect prior to opening the database.
+//
+// The built-in less functions are IndexString, IndexBinary, IndexInt,
+// IndexUint, and IndexFloat, and the JSON functions with a path, such as
+// "IndexJSON:age" and "IndexJSONCaseSensitive:name.last". A name that
+// starts with "Desc:" is the descending order of the name that follows, such
+// as "Desc:IndexInt". The built-in rect functions are IndexRect, and
+// IndexGeoJSON with a path, such as "IndexGeoJSON:geom".
+
+// registry holds the registered functions.
+var registry struct {
+	mu   sync.RWMutex
+	less map[string]func(a, b string) bool
+	rect map[string]func(item string) (min, max []float64)
+}
+
+// RegisterLess registers a less function by name, which allows for it to be
+// used by a persistent index. It panics when the name is empty, or when it's
+// already registered or the name of a built-in function.
+func RegisterLess(name string, less func(a, b string) bool) {
+	if name == "" || less == nil || lookupLess(name) != nil {
+		panic("buntdb: invalid or duplicate less function name: " + name)
+	}
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	if registry.less == nil {
+		registry.less = make(map[string]func(a, b string) bool)
+	}
+	registry.less[name] = less
+}
+
+// RegisterRect registers a rect function by name, which allows for it to be
+// used by a persistent spatial index. It panics when the name is empty, or
+// when it's already registered or the name of a built-in function.
+func RegisterRect(name string, rect func(item string) (min, max []float64)) {
+	if name == "" || rect == nil || lookupRect(name) != nil {
+		panic("buntdb: invalid or duplicate rect function name: " + name)
+	}
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	if registry.rect == nil {
+		registry.rect = make(map[string]func(item string) (min, max []float64))
+	}
+	registry.rect[name] = rect
+}
+
+// lookupLess returns the less function with the name, or nil when there is
+// no such function.
+func lookupLess(name string) func(a, b string) bool {
+	registry.mu.RLock()
+	less := registry.less[name]
+	registry.mu.RUnlock()
+	if less != nil {
+		return less
+	}
+	switch {
+	case name == "IndexString":
+		return IndexString
+	case name == "IndexBinary":
+		return IndexBinary
+	case name == "IndexInt":
+		return IndexInt
+	case name == "IndexUint":
+		return IndexUint
+	case name == "IndexFloat":
+		return IndexFloat
+	case strings.HasPrefix(name, "IndexJSON:"):
+		return IndexJSON(name[len("IndexJSON:"):])
+	case strings.HasPrefix(name, "IndexJSONCaseSensitive:"):
+		return IndexJSONCaseSensitive(name[len("IndexJSONCaseSensitive:"):])
+	case strings.HasPrefix(name, "Desc:"):
+		if less := lookupLess(name[len("Desc:"):]); less != nil {
+			return Desc(less)
+		}
+	}
+	return nil
+}
+
+// lookupRect returns the rect function with the name, or nil when there is
+// no such function.
+func lookupRect(name string) func(item string) (min, max []float64) {
+	registry.mu.RLock()
+	rect := registry.rect[name]
+	registry.mu.RUnlock()
+	if rect != nil {
+		return rect
+	}
+	switch {
+	case name == "IndexRect":
+		return IndexRect
+	case strings.HasPrefix(name, "IndexGeoJSON:"):
+		return IndexGeoJSON(name[len("IndexGeoJSON:"):])
+	}
+	return nil
+}
+
+// notRegistered returns ErrNotRegistered for the function name.
+func notRegistered(name string) error {
+	return fmt.Errorf("%w: %s", ErrNotRegistered, name)
+}
+
+// indexDef is the definition of a persistent index.
+type indexDef struct {
+	flags   uint64   // the index record flags
+	name    string   // name of the index
+	pattern string   // a required key pattern
+	funcs   []string // the names of the less functions, or the rect function
+}
+
+// newIndex returns an empty index for the definition. Returns
+// ErrNotRegistered when a function is not registered.
+func (def *indexDef) newIndex() (*index, error) {
+	idx := &index{name: def.name, pattern: def.pattern, def: def}
+	idx.opts.Unique = def.flags&indexFlagUnique != 0
+	idx.opts.CaseInsensitiveKeyMatching =
+		def.flags&indexFlagCaseInsensitive != 0
+	if idx.opts.CaseInsensitiveKeyMatching {
+		idx.pattern = strings.ToLower(idx.pattern)
+	}
+	if def.flags&indexFlagSpatial != 0 {
+		if len(def.funcs) != 1 {
+			return nil, ErrInvalid
+		}
+		if idx.rect = lookupRect(def.funcs[0]); idx.rect == nil {
+			return nil, notRegistered(def.funcs[0])
+		}
+		return idx, nil
+	}
+	lessers := make([]func(a, b string) bool, len(def.funcs))
+	for i, name := range def.funcs {
+		if lessers[i] = lookupLess(name); lessers[i] == nil {
+			return nil, notRegistered(name)
+		}
+	}
+	idx.less = joinLess(lessers)
+	return idx, nil
+}
+
+// jsonFields returns the JSON fields that order the items of the index, as
+// they were recorded when the index was created. Those are the fields of a
+// compound index, or the paths of a persistent index that only has IndexJSON
+// functions, such as "IndexJSON:age". Returns nil when the fields are not
+// known.
+func (idx *index) jsonFields() []IndexField {
+	if idx.fields != nil {
+		return idx.fields
+	}
+	if idx.def == nil || idx.def.flags&indexFlagSpatial != 0 {
+		return nil
+	}
+	fields := make([]IndexField, len(idx.def.funcs))
+	for i, name := range idx.def.funcs {
+		if !strings.HasPrefix(name, "IndexJSON:") {
+			return nil
+		}
+		fields[i].Path = name[len("IndexJSON:"):]
+	}
+	return fields
+}
+
+// geoJSONPath returns the path of a spatial index with an IndexGeoJSON
+// function, as it was recorded when the index was created, such as by
+// "IndexGeoJSON:geom". Returns false when the path is not known.
+func (idx *index) geoJSONPath() (string, bool) {
+	if idx.def == nil || idx.def.flags&indexFlagSpatial == 0 ||
+		!strings.HasPrefix(idx.def.funcs[0], "IndexGeoJSON:") {
+		return "", false
+	}
+	return idx.def.funcs[0][len("IndexGeoJSON:"):], true
+}
+
+// writeRecordTo writes the definition as a single binary index record.
+func (def *indexDef) writeRecordTo(buf []byte) []byte {
+	buf, mark := beginRecord(buf, recIndex)
+	buf = appendUvarint(buf, def.flags)
+	buf = appendString(buf, def.name)
+	buf = appendString(buf, def.pattern)
+	buf = appendUvarint(buf, uint64(len(def.funcs)))
+	for _, name := range def.funcs {
+		buf = appendString(buf, name)
+	}
+	return endRecord(buf, mark)
+}
+
+// read reads the definition from the payload of a binary index record.
+func (def *indexDef) read(p []byte) ([]byte, error) {
+	var err error
+	if def.flags, p, err = readUvarint(p); err != nil {
+		return nil, err
+	}
+	if def.name, p, err = readString(p); err != nil {
+		return nil, err
+	}
+	if def.pattern, p, err = readString(p); err != nil {
+		return nil, err
+	}
+	var n uint64
+	if n, p, err = readUvarint(p); err != nil {
+		return nil, err
+	}
+	if def.name == "" || n > uint64(len(p)) {
+		return nil, ErrInvalid
+	}
+	def.funcs = make([]string, n)
+	for i := range def.funcs {
+		if def.funcs[i], p, err = readString(p); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// writeDropRecordTo writes a single binary drop index record.
+func writeDropRecordTo(buf []byte, name string) []byte {
+	buf, mark := beginRecord(buf, recDrop)
+	buf = appendString(buf, name)
+	return endRecord(buf, mark)
+}
+
+// writeIndexesTo writes the definitions of the persistent indexes, in the
+// order of their names.
+func (db *DB) writeIndexesTo(buf []byte) []byte {
+	var names []string
+	for name, idx := range db.idxs {
+		if idx.def != nil {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		mark := len(buf)
+		buf = db.idxs[name].def.writeRecordTo(buf)
+		buf = wrapKeyspace(buf, mark, db.space)
+	}
+	return buf
+}
+
+// CreatePersistentIndex is the same as CreateIndexOptions, except that the
+// less functions are given by their names, and the index is written to the
+// database file. The index is created again when the database is opened,
+// which requires for the custom less functions to be registered by then.
+//
+// Returns ErrNotRegistered when a less function is not registered, and
+// ErrInvalidOperation when the options have a Filter, or when the database
+// file uses the legacy text format, which must be shrunk before it can have
+// persistent indexes.
+func (tx *Tx) CreatePersistentIndex(name, pattern string, opts *IndexOptions,
+	less ...string) error {
+	def := &indexDef{name: name, pattern: pattern, funcs: less}
+	return tx.createPersistentIndex(def, opts)
+}
+
+// CreatePersistentSpatialIndex is the same as CreateSpatialIndexOptions,
+// except that the rect function is given by its name, and the index is
+// written to the database file, like CreatePersistentIndex.
+func (tx *Tx) CreatePersistentSpatialIndex(name, pattern string,
+	opts *IndexOptions, rect string) error {
+	def := &indexDef{flags: indexFlagSpatial, name: name, pattern: pattern,
+		funcs: []string{rect}}
+	return tx.createPersistentIndex(def, opts)
+}
+
+// createPersistentIndex is called by CreatePersistentIndex() and
+// CreatePersistentSpatialIndex()
+func (tx *Tx) createPersistentIndex(def *indexDef, opts *IndexOptions) error {
+	if tx.db == nil {
+		return ErrTxClosed
+	}
+	if opts != nil {
+		if opts.Filter != nil {
+			// functions cannot be written to the database file.
+			return ErrInvalidOperation
+		}
+		if opts.Unique {
+			def.flags |= indexFlagUnique
+		}
+		if opts.CaseInsensitiveKeyMatching {
+			def.flags |= indexFlagCaseInsensitive
+		}
+	}
+	if tx.db.persist && tx.db.textaof {
+		return ErrInvalidOperation
+	}
+	idx, err := def.newIndex()
+	if err != nil {
+		return err
+	}
+	if err := tx.addIndex(idx, nil); err != nil {
+		return err
+	}
+	if tx.wc.commitItems != nil {
+		if tx.wc.commitIndexes == nil {
+			tx.wc.commitIndexes = make(map[string]*index)
+		}
+		tx.wc.commitIndexes[def.name] = idx
+	}
+	return nil
+}
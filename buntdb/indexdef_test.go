@@ -0,0 +1,162 @@
+package buntdb
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestPersistentIndex(t *testing.T) {
+	RegisterLess("testLenLess", func(a, b string) bool {
+		return len(a) < len(b)
+	})
+	db := testOpen(t)
+	defer testClose(db)
+	if err := db.Update(func(tx *Tx) error {
+		if err := tx.CreatePersistentIndex("age", "user:*", nil,
+			"IndexJSON:age"); err != nil {
+			return err
+		}
+		if err := tx.CreatePersistentIndex("name", "USER:*",
+			&IndexOptions{Unique: true, CaseInsensitiveKeyMatching: true},
+			"testLenLess", "Desc:IndexJSON:name"); err != nil {
+			return err
+		}
+		if err := tx.CreatePersistentSpatialIndex("pos", "pos:*", nil,
+			"IndexRect"); err != nil {
+			return err
+		}
+		if err := tx.CreateIndex("memory", "*", IndexString); err != nil {
+			return err
+		}
+		tx.Set("user:1", `{"name":"Tom","age":38}`, nil)
+		tx.Set("user:2", `{"name":"Janet","age":25}`, nil)
+		tx.Set("user:3", `{"name":"Carol","age":52}`, nil)
+		tx.Set("pos:1", "[10 10]", nil)
+		_, _, err := tx.Set("pos:2", "[20 20]", nil)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Keyspace("users").Update(func(tx *Tx) error {
+		if err := tx.CreatePersistentIndex("age", "*", nil,
+			"Desc:IndexInt"); err != nil {
+			return err
+		}
+		tx.Set("1", "30", nil)
+		_, _, err := tx.Set("2", "40", nil)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	check := func(db *DB) {
+		t.Helper()
+		res := testScan(t, db, func(tx *Tx, iter func(key, value string) bool) error {
+			names, err := tx.Indexes()
+			if err != nil {
+				return err
+			}
+			iter(strings.Join(names, ","), "")
+			if err := tx.Ascend("age", iter); err != nil {
+				return err
+			}
+			if err := tx.Ascend("name", iter); err != nil {
+				return err
+			}
+			if err := tx.Intersects("pos", "[15 15],[25 25]", iter); err != nil {
+				return err
+			}
+			ktx, err := tx.Keyspace("users")
+			if err != nil {
+				return err
+			}
+			return ktx.Ascend("age", iter)
+		})
+		exp := "age,name,pos,user:2,user:1,user:3,user:1,user:2,user:3,pos:2,2,1"
+		if res != exp {
+			t.Fatalf("expected '%v', got '%v'", exp, res)
+		}
+		if err := db.Update(func(tx *Tx) error {
+			_, _, err := tx.Set("user:4", `{"name":"Carol","age":99}`, nil)
+			return err
+		}); err != ErrUniqueViolation {
+			t.Fatalf("expected '%v', got '%v'", ErrUniqueViolation, err)
+		}
+	}
+	// the persistent indexes are created again when the database is opened,
+	// and they are kept by a shrink.
+	db = testReOpen(t, db)
+	check(db)
+	if err := db.Shrink(); err != nil {
+		t.Fatal(err)
+	}
+	db = testReOpen(t, db)
+	check(db)
+	if err := db.Update(func(tx *Tx) error {
+		if err := tx.DropIndex("age"); err != nil {
+			return err
+		}
+		return tx.DropIndex("pos")
+	}); err != nil {
+		t.Fatal(err)
+	}
+	db = testReOpen(t, db)
+	names, err := db.Indexes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := strings.Join(names, ","); res != "name" {
+		t.Fatalf("expected '%v', got '%v'", "name", res)
+	}
+}
+
+func TestPersistentIndexErrors(t *testing.T) {
+	db := testOpen(t)
+	defer testClose(db)
+	if err := db.Update(func(tx *Tx) error {
+		return tx.CreatePersistentIndex("idx", "*", nil, "IndexMissing")
+	}); !errors.Is(err, ErrNotRegistered) {
+		t.Fatalf("expected '%v', got '%v'", ErrNotRegistered, err)
+	}
+	if err := db.Update(func(tx *Tx) error {
+		return tx.CreatePersistentIndex("idx", "*", &IndexOptions{
+			Filter: func(key, value string) bool { return true },
+		}, "IndexString")
+	}); err != ErrInvalidOperation {
+		t.Fatalf("expected '%v', got '%v'", ErrInvalidOperation, err)
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("expected a panic")
+			}
+		}()
+		RegisterLess("IndexJSON:name", IndexString)
+	}()
+	// the database cannot be opened when a function is not registered.
+	RegisterRect("testRect", IndexRect)
+	if err := db.Update(func(tx *Tx) error {
+		return tx.CreatePersistentSpatialIndex("pos", "*", nil, "testRect")
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	registry.mu.Lock()
+	delete(registry.rect, "testRect")
+	registry.mu.Unlock()
+	_, err := Open("data.db")
+	if !errors.Is(err, ErrNotRegistered) || !strings.Contains(err.Error(), "testRect") {
+		t.Fatalf("expected '%v', got '%v'", ErrNotRegistered, err)
+	}
+	RegisterRect("testRect", IndexRect)
+	if db, err = Open("data.db"); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if res := fmt.Sprint(db.Indexes()); res != "[pos] <nil>" {
+		t.Fatalf("expected '%v', got '%v'", "[pos] <nil>", res)
+	}
+}
@@ -0,0 +1,253 @@
+package buntdb
+
+import (
+	"encoding/base64"
+
+	"github.com/tidwall/btree"
+	"github.com/tidwall/gjson"
+)
+
+// Iterator is a pull-style iterator over the items of an index. Unlike the
+// Ascend* and Descend* methods, the caller moves the iterator with Next.
+//
+// Set, Delete, and the other write operations of the transaction are not
+// allowed until the iterator is closed, like during the Ascend* and Descend*
+// methods. The iterator is done when the transaction is closed.
+type Iterator struct {
+	tx      *Tx
+	index   string
+	desc    bool
+	ctx     interface{}   // the context of the tree
+	cur     *btree.Cursor // nil when the index has no items to iterate
+	first   btree.Item    // the item that the first Next returns
+	started bool          // Next was called
+	item    *dbItem       // the item that Next returned
+	closed  bool
+}
+
+// Iterate returns an iterator over the items of an index, in ascending order,
+// or descending order when desc is true. When an index is provided, the items
+// are ordered by the item values as specified by the less() function of the
+// defined index. When an index is not provided, the items are ordered by the
+// item key. An invalid index will return an error.
+//
+// The iterator must be closed by calling Close() when done.
+func (tx *Tx) Iterate(index string, desc bool) (*Iterator, error) {
+	return tx.iterate(index, desc, nil, false)
+}
+
+// IterateFrom is like Iterate, but the iterator starts at the pivot. In
+// ascending order, the items are in the range [pivot, last], and in
+// descending order, the items are in the range [pivot, first].
+//
+// The iterator must be closed by calling Close() when done.
+func (tx *Tx) IterateFrom(index, pivot string, desc bool) (*Iterator, error) {
+	item := &dbItem{key: pivot}
+	if index != "" {
+		item = &dbItem{val: pivot, keyless: desc}
+	}
+	return tx.iterate(index, desc, item, false)
+}
+
+// Resume returns an iterator that continues after the item of a token, which
+// was returned by the Token method of an iterator. The token keeps the index,
+// the order, and the position of the item, so it can be resumed by another
+// transaction, after the database is opened again, or by another database
+// with the same index. When the item was changed or deleted in the meantime,
+// the iterator continues after where the item was. Returns ErrInvalidToken
+// when the token is not valid for the index, and ErrNotFound when the index
+// does not exist.
+//
+// The iterator must be closed by calling Close() when done.
+func (tx *Tx) Resume(token string) (*Iterator, error) {
+	if tx.db == nil {
+		return nil, ErrTxClosed
+	}
+	p, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(p) == 0 || p[0] > 1 {
+		return nil, ErrInvalidToken
+	}
+	desc := p[0] == 1
+	var index, key, pivot string
+	p = p[1:]
+	if index, p, err = readString(p); err != nil {
+		return nil, ErrInvalidToken
+	}
+	if key, p, err = readString(p); err != nil {
+		return nil, ErrInvalidToken
+	}
+	if pivot, p, err = readString(p); err != nil || len(p) != 0 {
+		return nil, ErrInvalidToken
+	}
+	if index == "" {
+		// The keys are ordered by the key alone.
+		if pivot != "" {
+			return nil, ErrInvalidToken
+		}
+	} else if idx := tx.db.idxs[index]; idx == nil {
+		return nil, ErrNotFound
+	} else if idx.less == nil ||
+		(idx.jsonFields() != nil && !gjson.Valid(pivot)) {
+		return nil, ErrInvalidToken
+	}
+	return tx.iterate(index, desc, &dbItem{key: key, val: pivot}, true)
+}
+
+// iterate returns an iterator that starts at the pivot, or at the first item
+// when the pivot is nil. The item that equals the pivot is skipped when after
+// is true.
+func (tx *Tx) iterate(index string, desc bool, pivot *dbItem,
+	after bool) (*Iterator, error) {
+	if tx.db == nil {
+		return nil, ErrTxClosed
+	}
+	it := &Iterator{tx: tx, index: index, desc: desc}
+	var tr *btree.BTree
+	if index == "" {
+		// empty index means we will use the keys tree.
+		tr = tx.db.keys
+	} else {
+		idx := tx.db.idxs[index]
+		if idx == nil {
+			// index was not found. return error
+			return nil, ErrNotFound
+		}
+		tr, it.ctx = idx.btr, idx
+	}
+	if tx.wc != nil {
+		tx.wc.itercount++
+	}
+	if tr == nil {
+		return it, nil
+	}
+	it.cur = tr.Cursor()
+	switch {
+	case pivot == nil && desc:
+		it.first = it.cur.Last()
+	case pivot == nil:
+		it.first = it.cur.First()
+	case desc:
+		// The cursor moves to the first item that is not less than the
+		// pivot, which is the item before it in descending order.
+		it.first = it.cur.Seek(pivot)
+		if it.first == nil {
+			it.first = it.cur.Last()
+		} else if after || pivot.Less(it.first, it.ctx) {
+			it.first = it.cur.Prev()
+		}
+	default:
+		it.first = it.cur.Seek(pivot)
+		if after && it.first != nil && !pivot.Less(it.first, it.ctx) {
+			it.first = it.cur.Next()
+		}
+	}
+	return it, nil
+}
+
+// Next moves the iterator to the next item. Returns false when there are no
+// more items, or the iterator or its transaction is closed.
+func (it *Iterator) Next() bool {
+	if it.closed || it.tx.db == nil || it.cur == nil {
+		return false
+	}
+	var item btree.Item
+	if !it.started {
+		item, it.started = it.first, true
+	} else if it.item == nil {
+		// There were no more items.
+		return false
+	} else if it.desc {
+		item = it.cur.Prev()
+	} else {
+		item = it.cur.Next()
+	}
+	if item == nil {
+		it.item = nil
+		return false
+	}
+	it.item = item.(*dbItem)
+	return true
+}
+
+// Key returns the key of the item that Next moved to.
+func (it *Iterator) Key() string {
+	if it.item == nil {
+		return ""
+	}
+	return it.item.key
+}
+
+// Value returns the value of the item that Next moved to.
+func (it *Iterator) Value() string {
+	if it.item == nil {
+		return ""
+	}
+	return it.item.value()
+}
+
+// Token returns an opaque token for resuming the iteration after the item
+// that Next moved to, with the Resume method of a later transaction. Returns
+// an empty string when Next has not moved to an item, or when there are no
+// more items.
+//
+// The token has the key of the item, and the fields that the index orders the
+// item by, when the index has JSON fields, such as a compound index, or the
+// whole value otherwise. The token is not encrypted or signed, so it should
+// not be given to those that cannot see the item.
+func (it *Iterator) Token() string {
+	if it.item == nil {
+		return ""
+	}
+	var buf []byte
+	if it.desc {
+		buf = append(buf, 1)
+	} else {
+		buf = append(buf, 0)
+	}
+	buf = appendString(buf, it.index)
+	buf = appendString(buf, it.item.key)
+	var pivot string
+	if idx, ok := it.ctx.(*index); ok && idx.less != nil {
+		pivot = idx.sortPivot(it.item.value())
+	}
+	buf = appendString(buf, pivot)
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+// sortPivot returns a value that the index orders the same as the value.
+// That's a JSON document with the values of the fields that the index
+// recorded when it was created, and otherwise it's the value.
+func (idx *index) sortPivot(value string) string {
+	fields := idx.jsonFields()
+	if fields == nil {
+		return value
+	}
+	var pfields []IndexField
+	var values []string
+	for _, f := range fields {
+		if res := gjson.Get(value, f.Path); res.Exists() {
+			pfields = append(pfields, f)
+			values = append(values, res.Raw)
+		}
+	}
+	pivot := fieldsPivot(pfields, values)
+	if idx.less(pivot, value) || idx.less(value, pivot) {
+		// The path of a field is not a simple path.
+		return value
+	}
+	return pivot
+}
+
+// Close closes the iterator, which allows for the write operations of the
+// transaction.
+func (it *Iterator) Close() error {
+	if it.closed {
+		return nil
+	}
+	it.closed = true
+	it.item = nil
+	if it.tx.db != nil && it.tx.wc != nil {
+		it.tx.wc.itercount--
+	}
+	return nil
+}
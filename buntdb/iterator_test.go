@@ -0,0 +1,316 @@
+package buntdb
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// testPages iterates over an index in pages of n items, with one transaction
+// for each page.
+func testPages(t *testing.T, db *DB, index string, desc bool, n int) string {
+	var keys []string
+	var token string
+	for {
+		if err := db.View(func(tx *Tx) error {
+			var it *Iterator
+			var err error
+			if token == "" {
+				it, err = tx.Iterate(index, desc)
+			} else {
+				it, err = tx.Resume(token)
+			}
+			if err != nil {
+				return err
+			}
+			defer it.Close()
+			for i := 0; i < n && it.Next(); i++ {
+				keys = append(keys, it.Key())
+			}
+			token = it.Token()
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if token == "" {
+			return strings.Join(keys, ",")
+		}
+	}
+}
+
+// testScan returns the keys of a scan.
+func testScan(t *testing.T, db *DB, scan func(tx *Tx, iter func(key, value string) bool) error) string {
+	var keys []string
+	if err := db.View(func(tx *Tx) error {
+		return scan(tx, func(key, value string) bool {
+			keys = append(keys, key)
+			return true
+		})
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return strings.Join(keys, ",")
+}
+
+func TestIterator(t *testing.T) {
+	db := testOpen(t)
+	defer testClose(db)
+	if err := db.Update(func(tx *Tx) error {
+		if err := tx.CreateIndex("num", "*", IndexInt); err != nil {
+			return err
+		}
+		for i := 0; i < 100; i++ {
+			// the values are not unique.
+			val := fmt.Sprint((i * 7) % 30)
+			if _, _, err := tx.Set(fmt.Sprintf("key:%d", i), val, nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []int{1, 7, 100, 1000} {
+		for _, index := range []string{"", "num"} {
+			exp := testScan(t, db, func(tx *Tx, iter func(key, value string) bool) error {
+				return tx.Ascend(index, iter)
+			})
+			if res := testPages(t, db, index, false, n); res != exp {
+				t.Fatalf("expected '%v', got '%v'", exp, res)
+			}
+			exp = testScan(t, db, func(tx *Tx, iter func(key, value string) bool) error {
+				return tx.Descend(index, iter)
+			})
+			if res := testPages(t, db, index, true, n); res != exp {
+				t.Fatalf("expected '%v', got '%v'", exp, res)
+			}
+		}
+	}
+	// the pivots are the same as AscendGreaterOrEqual and DescendLessOrEqual.
+	for _, pivot := range []string{"", "-1", "0", "14", "15", "29", "30"} {
+		for _, index := range []string{"", "num"} {
+			pivot := pivot
+			if index == "" && pivot != "" {
+				pivot = "key:" + pivot
+			}
+			for _, desc := range []bool{false, true} {
+				exp := testScan(t, db, func(tx *Tx, iter func(key, value string) bool) error {
+					if desc {
+						return tx.DescendLessOrEqual(index, pivot, iter)
+					}
+					return tx.AscendGreaterOrEqual(index, pivot, iter)
+				})
+				res := testScan(t, db, func(tx *Tx, iter func(key, value string) bool) error {
+					it, err := tx.IterateFrom(index, pivot, desc)
+					if err != nil {
+						return err
+					}
+					defer it.Close()
+					for it.Next() {
+						iter(it.Key(), it.Value())
+					}
+					return nil
+				})
+				if res != exp {
+					t.Fatalf("%s %s %v: expected '%v', got '%v'", index, pivot, desc, exp, res)
+				}
+			}
+		}
+	}
+}
+
+func TestIteratorResume(t *testing.T) {
+	db := testOpen(t)
+	defer testClose(db)
+	if err := db.Update(func(tx *Tx) error {
+		if err := tx.CreateIndex("num", "*", IndexInt); err != nil {
+			return err
+		}
+		for i := 0; i < 10; i++ {
+			if _, _, err := tx.Set(fmt.Sprintf("key:%d", i), fmt.Sprint(i%5), nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// the item of the token is deleted, and items are added, before the
+	// iteration is resumed.
+	var token string
+	if err := db.View(func(tx *Tx) error {
+		it, err := tx.Iterate("num", false)
+		if err != nil {
+			return err
+		}
+		defer it.Close()
+		for i := 0; i < 4; i++ {
+			it.Next()
+		}
+		if it.Key() != "key:6" || it.Value() != "1" {
+			t.Fatalf("expected '%v', got '%v'", "key:6=1", it.Key()+"="+it.Value())
+		}
+		token = it.Token()
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Update(func(tx *Tx) error {
+		tx.Delete("key:6")
+		tx.Set("key:0", "9", nil)
+		tx.Set("key:7", "1", nil)
+		_, _, err := tx.Set("key:5", "1", nil)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	res := testScan(t, db, func(tx *Tx, iter func(key, value string) bool) error {
+		it, err := tx.Resume(token)
+		if err != nil {
+			return err
+		}
+		defer it.Close()
+		for it.Next() {
+			iter(it.Key(), it.Value())
+		}
+		return nil
+	})
+	if exp := "key:7,key:2,key:3,key:8,key:4,key:9,key:0"; res != exp {
+		t.Fatalf("expected '%v', got '%v'", exp, res)
+	}
+	// the writes are allowed after the iterator is closed.
+	if err := db.Update(func(tx *Tx) error {
+		it, err := tx.Iterate("", false)
+		if err != nil {
+			return err
+		}
+		if _, _, err := tx.Set("key:1", "val", nil); err != ErrTxIterating {
+			t.Fatalf("expected '%v', got '%v'", ErrTxIterating, err)
+		}
+		it.Close()
+		it.Close()
+		if it.Next() {
+			t.Fatal("expected a closed iterator")
+		}
+		_, _, err = tx.Set("key:1", "val", nil)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.View(func(tx *Tx) error {
+		if _, err := tx.Resume("invalid"); err != ErrInvalidToken {
+			t.Fatalf("expected '%v', got '%v'", ErrInvalidToken, err)
+		}
+		if _, err := tx.Resume(token[:len(token)-2]); err != ErrInvalidToken {
+			t.Fatalf("expected '%v', got '%v'", ErrInvalidToken, err)
+		}
+		if _, err := tx.Iterate("missing", false); err != ErrNotFound {
+			t.Fatalf("expected '%v', got '%v'", ErrNotFound, err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// a token of a dropped index.
+	if err := db.Update(func(tx *Tx) error {
+		return tx.DropIndex("num")
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.View(func(tx *Tx) error {
+		_, err := tx.Resume(token)
+		return err
+	}); err != ErrNotFound {
+		t.Fatalf("expected '%v', got '%v'", ErrNotFound, err)
+	}
+}
+
+func TestIteratorToken(t *testing.T) {
+	db := testOpen(t)
+	defer testClose(db)
+	if err := db.Update(func(tx *Tx) error {
+		if err := tx.CreatePersistentIndex("age", "*", nil,
+			"IndexJSON:user.age"); err != nil {
+			return err
+		}
+		for i := 0; i < 10; i++ {
+			if _, _, err := tx.Set(fmt.Sprintf("key:%d", i), fmt.Sprintf(
+				`{"secret":"%s","user":{"name":"user%d","age":%d}}`,
+				strings.Repeat("x", 1000), i, i%5), nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if res := testPages(t, db, "age", false, 3); res != "key:0,key:5,key:1,"+
+		"key:6,key:2,key:7,key:3,key:8,key:4,key:9" {
+		t.Fatalf("unexpected order '%v'", res)
+	}
+	// the token has the field of the index, but not the rest of the value.
+	var token string
+	if err := db.View(func(tx *Tx) error {
+		it, err := tx.Iterate("age", true)
+		if err != nil {
+			return err
+		}
+		defer it.Close()
+		it.Next()
+		token = it.Token()
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	p, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p) > 100 || !strings.Contains(string(p), `{"user":{"age":4}}`) ||
+		strings.Contains(string(p), "secret") {
+		t.Fatalf("unexpected token '%q'", p)
+	}
+	// the token is resumed after the database is opened again.
+	db = testReOpen(t, db)
+	defer testClose(db)
+	if err := db.View(func(tx *Tx) error {
+		it, err := tx.Resume(token)
+		if err != nil {
+			return err
+		}
+		defer it.Close()
+		if !it.Next() || it.Key() != "key:4" {
+			t.Fatalf("expected '%v', got '%v'", "key:4", it.Key())
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// the contents of a token are validated.
+	enc := base64.RawURLEncoding.EncodeToString
+	tokens := []string{
+		"!",
+		"",
+		enc([]byte{2}),
+		enc(append(p, 0)),
+		enc(p[:len(p)-1]),
+		enc(appendString(appendString(appendString([]byte{0}, "age"), "k"), "x")),
+		enc(appendString(appendString(appendString([]byte{0}, ""), "k"), "x")),
+	}
+	if err := db.View(func(tx *Tx) error {
+		for _, token := range tokens {
+			if _, err := tx.Resume(token); err != ErrInvalidToken {
+				t.Fatalf("%q: expected '%v', got '%v'", token, ErrInvalidToken, err)
+			}
+		}
+		missing := enc(appendString(appendString(appendString([]byte{0},
+			"missing"), "k"), ""))
+		if _, err := tx.Resume(missing); err != ErrNotFound {
+			t.Fatalf("expected '%v', got '%v'", ErrNotFound, err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
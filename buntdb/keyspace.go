@@ -0,0 +1,286 @@
+package buntdb
+
+import (
+	"sort"
+
+	"github.com/tidwall/btree"
+)
+
+// A keyspace is a separate collection of items in the same database. Each
+// keyspace has its own keys, indexes, and expirations, so the same key may
+// be in many keyspaces, and the indexes of a keyspace only have the items of
+// that keyspace. The keyspaces share the database file, the sync policy, and
+// the background manager of the database.
+//
+// The items that are not in a named keyspace are in the default keyspace,
+// which is the one that is used by the transactions of the database. The
+// changes of a keyspace are written to the database file as records that are
+// wrapped with the name of the keyspace.
+
+// Keyspace is a named keyspace of a database.
+type Keyspace struct {
+	db   *DB
+	name string
+}
+
+// Keyspace returns the keyspace with the name. A keyspace is created by the
+// first read/write transaction that uses it, and the empty name is the
+// default keyspace.
+//
+// The items of all of the keyspaces count toward the MaxMemory limit, and
+// the items of any keyspace may be evicted. The expired items of a keyspace
+// are passed to OnExpiredSync with a transaction of their keyspace. Use the
+// Watch and Stats methods of the keyspace for its changes and statistics.
+//
+// The OnExpired and OnEvicted callbacks are not told the keyspaces of the
+// keys, so they can't be used together with keyspaces, and optimistic
+// transactions cannot use keyspaces.
+func (db *DB) Keyspace(name string) *Keyspace {
+	return &Keyspace{db: db, name: name}
+}
+
+// Name returns the name of the keyspace.
+func (ks *Keyspace) Name() string {
+	return ks.name
+}
+
+// Watch registers a function that is called for every committed change to a
+// key of the keyspace matching the specified pattern, like DB.Watch.
+func (ks *Keyspace) Watch(pattern string, fn func(ev ChangeEvent)) (
+	unwatch func(), err error) {
+	return ks.db.watch(ks.name, pattern, fn)
+}
+
+// Stats returns the statistics of the keyspace, like DB.Stats. The Keys,
+// Indexes, and Expiring counts are of the keyspace, and the other statistics
+// are of the database.
+func (ks *Keyspace) Stats() (Stats, error) {
+	return ks.db.spaceStats(ks.name)
+}
+
+// Begin opens a new transaction on the keyspace, like DB.Begin. The
+// transaction may open the other keyspaces using Tx.Keyspace.
+//
+// All transactions must be closed by calling Commit() or Rollback() when done.
+func (ks *Keyspace) Begin(writable bool) (*Tx, error) {
+	tx, err := ks.db.Begin(writable)
+	if err != nil {
+		return nil, err
+	}
+	ktx, err := tx.Keyspace(ks.name)
+	if err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+	return ktx, nil
+}
+
+// View executes a function within a managed read-only transaction on the
+// keyspace, like DB.View.
+func (ks *Keyspace) View(fn func(tx *Tx) error) error {
+	return ks.db.View(func(tx *Tx) error {
+		ktx, err := tx.Keyspace(ks.name)
+		if err != nil {
+			return err
+		}
+		return fn(ktx)
+	})
+}
+
+// Update executes a function within a managed read/write transaction on the
+// keyspace, like DB.Update.
+func (ks *Keyspace) Update(fn func(tx *Tx) error) error {
+	return ks.db.Update(func(tx *Tx) error {
+		ktx, err := tx.Keyspace(ks.name)
+		if err != nil {
+			return err
+		}
+		return fn(ktx)
+	})
+}
+
+// Keyspaces returns the names of the keyspaces that have items, not including
+// the default keyspace. A keyspace without items is not in the database file.
+func (db *DB) Keyspaces() ([]string, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return nil, ErrDatabaseClosed
+	}
+	var names []string
+	for _, name := range db.spaceNames() {
+		if db.spaces[name].keys.Len() > 0 {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// Keyspace returns a transaction on the keyspace with the name, which is part
+// of the transaction. The changes of all of the keyspaces are committed or
+// rolled back together, and committing or rolling back the returned
+// transaction is the same as doing it with the transaction that it's part
+// of. The empty name is the default keyspace.
+//
+// Returns ErrInvalidOperation for an optimistic transaction, when the
+// OnExpired or OnEvicted callback is set, or when a read/write transaction
+// creates a keyspace in a database file that uses the legacy text format,
+// which must be shrunk before it can have keyspaces.
+func (tx *Tx) Keyspace(name string) (*Tx, error) {
+	if tx.db == nil {
+		return nil, ErrTxClosed
+	}
+	if tx.parent != nil {
+		return tx.parent.Keyspace(name)
+	}
+	if name == "" {
+		return tx, nil
+	}
+	if ktx, ok := tx.spaces[name]; ok {
+		return ktx, nil
+	}
+	if tx.oc != nil || tx.db.config.OnExpired != nil ||
+		tx.db.config.OnEvicted != nil {
+		return nil, ErrInvalidOperation
+	}
+	ktx := &Tx{db: tx.db.spaces[name], writable: tx.writable, parent: tx}
+	if tx.writable {
+		ktx.wc = &txWriteContext{}
+		ktx.wc.rollbackItems = make(map[string]*dbItem)
+		ktx.wc.rollbackIndexes = make(map[string]*index)
+		if tx.wc.commitItems != nil {
+			ktx.wc.commitItems = make(map[string]*dbItem)
+			ktx.wc.commitExpires = make(map[string]bool)
+		}
+	}
+	if ktx.db == nil {
+		if !tx.writable {
+			// A read-only transaction sees an empty keyspace.
+			ktx.db = tx.db.newKeyspace(name)
+		} else if tx.db.persist && tx.db.textaof {
+			return nil, ErrInvalidOperation
+		} else {
+			ktx.db = tx.db.keyspace(name)
+			ktx.wc.created = true
+		}
+	}
+	if tx.spaces == nil {
+		tx.spaces = make(map[string]*Tx)
+	}
+	tx.spaces[name] = ktx
+	return ktx, nil
+}
+
+// newKeyspace returns an empty keyspace of the database.
+func (db *DB) newKeyspace(name string) *DB {
+	kdb := &DB{space: name, config: db.config, opts: db.opts,
+		snapshot: db.snapshot, root: db}
+	kdb.keys = btree.New(btreeDegrees, nil)
+	kdb.exps = btree.New(btreeDegrees, &exctx{kdb})
+	kdb.idxs = make(map[string]*index)
+	return kdb
+}
+
+// keyspace returns the keyspace with the name, which is created when it does
+// not exist. Must be called while holding the write lock.
+func (db *DB) keyspace(name string) *DB {
+	if name == "" {
+		return db
+	}
+	kdb := db.spaces[name]
+	if kdb == nil {
+		kdb = db.newKeyspace(name)
+		if db.spaces == nil {
+			db.spaces = make(map[string]*DB)
+		}
+		db.spaces[name] = kdb
+	}
+	return kdb
+}
+
+// spaceNames returns the sorted names of the keyspaces. Must be called while
+// holding a lock.
+func (db *DB) spaceNames() []string {
+	names := make([]string, 0, len(db.spaces))
+	for name := range db.spaces {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// spaceDBs returns the default keyspace followed by the keyspaces, in the
+// order of their names. Must be called while holding a lock.
+func (db *DB) spaceDBs() []*DB {
+	dbs := []*DB{db}
+	for _, name := range db.spaceNames() {
+		dbs = append(dbs, db.spaces[name])
+	}
+	return dbs
+}
+
+// release clears the db fields of the transaction and of its keyspaces, which
+// disables them from future use.
+func (tx *Tx) release() {
+	for _, ktx := range tx.spaces {
+		ktx.db = nil
+	}
+	tx.db = nil
+}
+
+// itemCursor reads the items of all of the keyspaces in chunks, which allows
+// for a shrink to write the items without holding the lock for too long.
+type itemCursor struct {
+	spaces  []string // the keyspaces that are left, "" for the default
+	pivot   string   // the key of the next item
+	indexes bool     // the indexes of the keyspace have been written
+}
+
+// newItemCursor returns a cursor at the first item of the default keyspace.
+// Must be called while holding a lock.
+func (db *DB) newItemCursor() *itemCursor {
+	return &itemCursor{spaces: append([]string{""}, db.spaceNames()...)}
+}
+
+// next appends the set records of the next chunk of items to the buffer. The
+// items of a keyspace follow its persistent indexes. Returns false when there
+// are no more items. Must be called while holding a lock.
+func (c *itemCursor) next(db *DB, buf []byte, compress bool) ([]byte, bool) {
+	var n int
+	for ; len(c.spaces) > 0; c.spaces = c.spaces[1:] {
+		kdb := db
+		if c.spaces[0] != "" {
+			if kdb = db.spaces[c.spaces[0]]; kdb == nil {
+				// The keyspace was removed by a rollback.
+				c.pivot, c.indexes = "", false
+				continue
+			}
+		}
+		if !c.indexes {
+			buf = kdb.writeIndexesTo(buf)
+			c.indexes = true
+		}
+		more := false
+		kdb.keys.AscendGreaterOrEqual(&dbItem{key: c.pivot},
+			func(item btree.Item) bool {
+				dbi := item.(*dbItem)
+				// 1000 items or 64MB buffer
+				if n > 1000 || len(buf) > 64*1024*1024 {
+					c.pivot = dbi.key
+					more = true
+					return false
+				}
+				mark := len(buf)
+				buf = dbi.writeSetRecordTo(buf, compress)
+				buf = wrapKeyspace(buf, mark, kdb.space)
+				n++
+				return true
+			},
+		)
+		if more {
+			return buf, true
+		}
+		c.pivot, c.indexes = "", false
+	}
+	return buf, false
+}
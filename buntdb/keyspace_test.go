@@ -0,0 +1,414 @@
+package buntdb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testDumpSpaces returns the items of all of the keyspaces.
+func testDumpSpaces(t *testing.T, db *DB) string {
+	names, err := db.Keyspaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var items []string
+	for _, name := range append([]string{""}, names...) {
+		if err := db.Keyspace(name).View(func(tx *Tx) error {
+			return tx.Ascend("", func(key, value string) bool {
+				items = append(items, name+"/"+key+"="+value)
+				return true
+			})
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return strings.Join(items, ",")
+}
+
+func TestKeyspaces(t *testing.T) {
+	db := testOpen(t)
+	defer testClose(db)
+	users := db.Keyspace("users")
+	if err := users.Update(func(tx *Tx) error {
+		if err := tx.CreateIndex("age", "*", IndexInt); err != nil {
+			return err
+		}
+		tx.Set("1", "30", nil)
+		tx.Set("2", "20", nil)
+		_, _, err := tx.Set("3", "40", nil)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Update(func(tx *Tx) error {
+		// the same key in the default keyspace.
+		_, _, err := tx.Set("1", "default", nil)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// the indexes of a keyspace only have the items of the keyspace.
+	res := testScan(t, db, func(tx *Tx, iter func(key, value string) bool) error {
+		ktx, err := tx.Keyspace("users")
+		if err != nil {
+			return err
+		}
+		return ktx.Ascend("age", iter)
+	})
+	if exp := "2,1,3"; res != exp {
+		t.Fatalf("expected '%v', got '%v'", exp, res)
+	}
+	if err := db.View(func(tx *Tx) error {
+		return tx.Ascend("age", nil)
+	}); err != ErrNotFound {
+		t.Fatalf("expected '%v', got '%v'", ErrNotFound, err)
+	}
+	// a transaction that spans keyspaces is rolled back as a whole.
+	errAbort := errors.New("abort")
+	if err := db.Update(func(tx *Tx) error {
+		ktx, err := tx.Keyspace("orders")
+		if err != nil {
+			return err
+		}
+		ktx.Set("1", "order", nil)
+		if ktx, err = ktx.Keyspace("users"); err != nil {
+			return err
+		}
+		ktx.Delete("2")
+		tx.Set("2", "default", nil)
+		return errAbort
+	}); err != errAbort {
+		t.Fatalf("expected '%v', got '%v'", errAbort, err)
+	}
+	exp := "/1=default,users/1=30,users/2=20,users/3=40"
+	if res := testDumpSpaces(t, db); res != exp {
+		t.Fatalf("expected '%v', got '%v'", exp, res)
+	}
+	if err := db.Update(func(tx *Tx) error {
+		ktx, err := tx.Keyspace("orders")
+		if err != nil {
+			return err
+		}
+		ktx.Set("1", "order", nil)
+		if ktx, err = ktx.Keyspace("users"); err != nil {
+			return err
+		}
+		ktx.Delete("2")
+		_, _, err = tx.Set("2", "default", nil)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	exp = "/1=default,/2=default,orders/1=order,users/1=30,users/3=40"
+	if res := testDumpSpaces(t, db); res != exp {
+		t.Fatalf("expected '%v', got '%v'", exp, res)
+	}
+	// the keyspaces are loaded from the file, before and after a shrink.
+	db = testReOpen(t, db)
+	if res := testDumpSpaces(t, db); res != exp {
+		t.Fatalf("expected '%v', got '%v'", exp, res)
+	}
+	if err := db.Keyspace("orders").Update(func(tx *Tx) error {
+		return tx.DeleteAll()
+	}); err != nil {
+		t.Fatal(err)
+	}
+	exp = "/1=default,/2=default,users/1=30,users/3=40"
+	if err := db.Shrink(); err != nil {
+		t.Fatal(err)
+	}
+	db = testReOpen(t, db)
+	if res := testDumpSpaces(t, db); res != exp {
+		t.Fatalf("expected '%v', got '%v'", exp, res)
+	}
+	// a keyspace without items is not listed.
+	if err := db.Keyspace("none").View(func(tx *Tx) error {
+		n, err := tx.Len()
+		if n != 0 {
+			t.Fatalf("expected '%v', got '%v'", 0, n)
+		}
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	names, err := db.Keyspaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := strings.Join(names, ","); res != "users" {
+		t.Fatalf("expected '%v', got '%v'", "users", res)
+	}
+}
+
+func TestKeyspaceTx(t *testing.T) {
+	db := testOpen(t)
+	defer testClose(db)
+	tx, err := db.Keyspace("users").Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := tx.Set("key", "val", nil); err != nil {
+		t.Fatal(err)
+	}
+	// the keyspace was created by the transaction, so it's removed by the
+	// rollback.
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Rollback(); err != ErrTxClosed {
+		t.Fatalf("expected '%v', got '%v'", ErrTxClosed, err)
+	}
+	if _, err := tx.Keyspace("users"); err != ErrTxClosed {
+		t.Fatalf("expected '%v', got '%v'", ErrTxClosed, err)
+	}
+	if names, _ := db.Keyspaces(); len(names) != 0 {
+		t.Fatalf("expected '%v', got '%v'", 0, len(names))
+	}
+	if tx, err = db.Keyspace("users").Begin(true); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := tx.Set("key", "val", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if exp, res := "users/key=val", testDumpSpaces(t, db); res != exp {
+		t.Fatalf("expected '%v', got '%v'", exp, res)
+	}
+	// managed transactions cannot be committed from a keyspace.
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("expected a panic")
+			}
+		}()
+		db.Keyspace("users").Update(func(tx *Tx) error {
+			return tx.Commit()
+		})
+	}()
+	otx, err := db.BeginOptimistic()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer otx.Rollback()
+	if _, err := otx.Keyspace("users"); err != ErrInvalidOperation {
+		t.Fatalf("expected '%v', got '%v'", ErrInvalidOperation, err)
+	}
+}
+
+func TestKeyspaceExpires(t *testing.T) {
+	db := testOpen(t)
+	defer testClose(db)
+	// The OnExpired and OnEvicted callbacks can't be used with keyspaces.
+	var config Config
+	if err := db.ReadConfig(&config); err != nil {
+		t.Fatal(err)
+	}
+	config.OnExpired = func(keys []string) {}
+	if err := db.SetConfig(config); err != nil {
+		t.Fatal(err)
+	}
+	err := db.Keyspace("users").Update(func(tx *Tx) error { return nil })
+	if err != ErrInvalidOperation {
+		t.Fatalf("expected '%v', got '%v'", ErrInvalidOperation, err)
+	}
+	config.OnExpired = nil
+	if err := db.SetConfig(config); err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	var events []string
+	if _, err := db.Keyspace("users").Watch("*", func(ev ChangeEvent) {
+		mu.Lock()
+		events = append(events, ev.Type.String()+":"+ev.Key)
+		mu.Unlock()
+	}); err != nil {
+		t.Fatal(err)
+	}
+	opts := &SetOptions{Expires: true, TTL: time.Second / 4}
+	if err := db.Update(func(tx *Tx) error {
+		tx.Set("a", "1", opts)
+		ktx, err := tx.Keyspace("users")
+		if err != nil {
+			return err
+		}
+		ktx.Set("a", "2", opts)
+		_, _, err = ktx.Set("b", "3", nil)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	config.OnExpired = func(keys []string) {}
+	if err := db.SetConfig(config); err != ErrInvalidOperation {
+		t.Fatalf("expected '%v', got '%v'", ErrInvalidOperation, err)
+	}
+	config.OnExpired = nil
+	config.OnEvicted = func(keys []string) {}
+	if err := db.SetConfig(config); err != ErrInvalidOperation {
+		t.Fatalf("expected '%v', got '%v'", ErrInvalidOperation, err)
+	}
+	time.Sleep(time.Second * 2)
+	// The expired items of all of the keyspaces are deleted, and the
+	// watchers of a keyspace only see the changes of the keyspace.
+	if res := testDumpSpaces(t, db); res != "users/b=3" {
+		t.Fatalf("expected '%v', got '%v'", "users/b=3", res)
+	}
+	mu.Lock()
+	res := strings.Join(events, ",")
+	mu.Unlock()
+	if exp := "set:a,set:b,expire:a"; res != exp {
+		t.Fatalf("expected '%v', got '%v'", exp, res)
+	}
+}
+
+func TestKeyspaceMaxMemory(t *testing.T) {
+	db := testOpen(t)
+	defer testClose(db)
+	var config Config
+	if err := db.ReadConfig(&config); err != nil {
+		t.Fatal(err)
+	}
+	// Room for two items.
+	config.MaxMemory = 400
+	if err := db.SetConfig(config); err != nil {
+		t.Fatal(err)
+	}
+	val := strings.Repeat("v", 100)
+	setItem := func(space, key string, ttl time.Duration) error {
+		return db.Keyspace(space).Update(func(tx *Tx) error {
+			var opts *SetOptions
+			if ttl > 0 {
+				opts = &SetOptions{Expires: true, TTL: ttl}
+			}
+			_, _, err := tx.Set(key, val, opts)
+			return err
+		})
+	}
+	if err := setItem("", "a", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := setItem("users", "x", time.Hour*2); err != nil {
+		t.Fatal(err)
+	}
+	if err := setItem("users", "y", 0); err != ErrMaxMemory {
+		t.Fatalf("expected '%v', got '%v'", ErrMaxMemory, err)
+	}
+	// The items of any keyspace may be evicted.
+	config.EvictionPolicy = VolatileTTL
+	if err := db.SetConfig(config); err != nil {
+		t.Fatal(err)
+	}
+	if err := setItem("users", "y", 0); err != nil {
+		t.Fatal(err)
+	}
+	if res, exp := testDumpSpaces(t, db), "users/x="+val+",users/y="+val; res != exp {
+		t.Fatalf("expected '%v', got '%v'", exp, res)
+	}
+	if err := setItem("", "b", 0); err != nil {
+		t.Fatal(err)
+	}
+	if res, exp := testDumpSpaces(t, db), "/b="+val+",users/y="+val; res != exp {
+		t.Fatalf("expected '%v', got '%v'", exp, res)
+	}
+	if err := setItem("orders", "z", 0); err != ErrMaxMemory {
+		t.Fatalf("expected '%v', got '%v'", ErrMaxMemory, err)
+	}
+}
+
+func TestKeyspaceStats(t *testing.T) {
+	db := testOpen(t)
+	defer testClose(db)
+	if err := db.Update(func(tx *Tx) error {
+		tx.Set("a", "1", nil)
+		ktx, err := tx.Keyspace("users")
+		if err != nil {
+			return err
+		}
+		if err := ktx.CreateIndex("name", "*", IndexString); err != nil {
+			return err
+		}
+		ktx.Set("a", "1", &SetOptions{Expires: true, TTL: time.Hour})
+		_, _, err = ktx.Set("b", "2", nil)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := db.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Keys != 1 || stats.Expiring != 0 || len(stats.Indexes) != 0 {
+		t.Fatalf("expected '%v', got '%v'", "1 0 0", fmt.Sprint(stats.Keys,
+			" ", stats.Expiring, " ", len(stats.Indexes)))
+	}
+	stats, err = db.Keyspace("users").Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Keys != 2 || stats.Expiring != 1 || stats.Indexes["name"] != 2 {
+		t.Fatalf("expected '%v', got '%v'", "2 1 2", fmt.Sprint(stats.Keys,
+			" ", stats.Expiring, " ", stats.Indexes["name"]))
+	}
+	if stats.Commits != 1 {
+		t.Fatalf("expected '%v', got '%v'", 1, stats.Commits)
+	}
+	stats, err = db.Keyspace("orders").Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Keys != 0 || len(stats.Indexes) != 0 {
+		t.Fatalf("expected '%v', got '%v'", "0 0", fmt.Sprint(stats.Keys,
+			" ", len(stats.Indexes)))
+	}
+}
+
+func TestKeyspaceBackup(t *testing.T) {
+	s := newMemStorage()
+	db := testOpenSegments(t, s, 256)
+	defer db.Close()
+	for i := 0; i < 20; i++ {
+		if err := db.Keyspace(fmt.Sprintf("ks:%d", i%3)).Update(func(tx *Tx) error {
+			_, _, err := tx.Set(fmt.Sprintf("key:%d", i), fmt.Sprint(i), nil)
+			return err
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Shrink(); err != nil {
+		t.Fatal(err)
+	}
+	exp := testDumpSpaces(t, db)
+	var buf bytes.Buffer
+	if _, err := db.Backup(&buf, 0); err != nil {
+		t.Fatal(err)
+	}
+	// the full backup replaces the items of all of the keyspaces.
+	db2, err := Open(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db2.Close()
+	if err := db2.Keyspace("ks:1").Update(func(tx *Tx) error {
+		_, _, err := tx.Set("other", "val", nil)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db2.Restore(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if res := testDumpSpaces(t, db2); res != exp {
+		t.Fatalf("expected '%v', got '%v'", exp, res)
+	}
+	db.Close()
+	db = testOpenSegments(t, s, 256)
+	if res := testDumpSpaces(t, db); res != exp {
+		t.Fatalf("expected '%v', got '%v'", exp, res)
+	}
+}
@@ -0,0 +1,270 @@
+package buntdb
+
+import (
+	"encoding/json"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+// IncrBy adds n to the integer value of an item, and returns the new value.
+// An item that does not exist, or has expired, is set to n. Returns
+// ErrInvalidValue when the value is not an integer, or the new value
+// overflows. The expiration of the item is kept.
+//
+// Only a writable transaction can be used for this operation.
+// This operation is not allowed during iterations such as Ascend* & Descend*.
+func (tx *Tx) IncrBy(key string, n int64) (int64, error) {
+	var res int64
+	err := tx.mutate(key, func(val string, ok bool) (string, error) {
+		var x int64
+		if ok {
+			var err error
+			if x, err = strconv.ParseInt(val, 10, 64); err != nil {
+				return "", ErrInvalidValue
+			}
+		}
+		if (n > 0 && x > math.MaxInt64-n) || (n < 0 && x < math.MinInt64-n) {
+			return "", ErrInvalidValue
+		}
+		res = x + n
+		return strconv.FormatInt(res, 10), nil
+	})
+	return res, err
+}
+
+// IncrByFloat adds n to the number value of an item, and returns the new
+// value. An item that does not exist, or has expired, is set to n. Returns
+// ErrInvalidValue when the value is not a number, or the new value is not
+// finite. The expiration of the item is kept.
+//
+// Only a writable transaction can be used for this operation.
+// This operation is not allowed during iterations such as Ascend* & Descend*.
+func (tx *Tx) IncrByFloat(key string, n float64) (float64, error) {
+	var res float64
+	err := tx.mutate(key, func(val string, ok bool) (string, error) {
+		var x float64
+		if ok {
+			var err error
+			if x, err = strconv.ParseFloat(val, 64); err != nil {
+				return "", ErrInvalidValue
+			}
+		}
+		res = x + n
+		if math.IsInf(res, 0) || math.IsNaN(res) {
+			return "", ErrInvalidValue
+		}
+		return strconv.FormatFloat(res, 'f', -1, 64), nil
+	})
+	return res, err
+}
+
+// Append appends the value to the value of an item, and returns the length
+// of the new value. An item that does not exist, or has expired, is set to
+// the value. The expiration of the item is kept.
+//
+// Only a writable transaction can be used for this operation.
+// This operation is not allowed during iterations such as Ascend* & Descend*.
+func (tx *Tx) Append(key, value string) (int, error) {
+	var res int
+	err := tx.mutate(key, func(val string, ok bool) (string, error) {
+		res = len(val) + len(value)
+		return val + value, nil
+	})
+	return res, err
+}
+
+// SetJSON sets the value at a path in the JSON document of an item. The path
+// uses the GJSON syntax, without wildcards, queries or modifiers, such as
+// "name.last" or "friends.1". The objects and arrays that are missing from
+// the path are created, and an index of -1 appends to an array. An item that
+// does not exist, or has expired, is set to a new document. The value is
+// encoded with encoding/json, so a json.RawMessage is set as is.
+// Returns ErrInvalidValue when the document is not valid JSON, or the path
+// cannot be set in it. The expiration of the item is kept.
+//
+// Only a writable transaction can be used for this operation.
+// This operation is not allowed during iterations such as Ascend* & Descend*.
+func (tx *Tx) SetJSON(key, path string, value interface{}) error {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	comps, ok := splitJSONPath(path)
+	if !ok {
+		return ErrInvalidValue
+	}
+	return tx.mutate(key, func(val string, ok bool) (string, error) {
+		if !ok {
+			val = "{}"
+		} else if !gjson.Valid(val) {
+			return "", ErrInvalidValue
+		}
+		return setJSONPath(val, comps, string(raw))
+	})
+}
+
+// mutate replaces the value of an item with the value that is returned by
+// fn, which is passed the current value. The ok param is false when the item
+// does not exist, or has expired. The item is written to the database file
+// once, no matter how many times it's changed by the transaction.
+func (tx *Tx) mutate(key string,
+	fn func(val string, ok bool) (string, error)) error {
+	if tx.db == nil {
+		return ErrTxClosed
+	} else if !tx.writable {
+		return ErrTxNotWritable
+	} else if tx.wc.itercount > 0 {
+		return ErrTxIterating
+	}
+	tx.trackRead(key)
+	var val string
+	var opts *dbItemOpts
+	prev := tx.db.get(key)
+	ok := prev != nil && !prev.expired()
+	if ok {
+		val, opts = prev.value(), prev.opts
+	}
+	val, err := fn(val, ok)
+	if err != nil {
+		return err
+	}
+	item := &dbItem{key: key, val: val, opts: opts}
+	if err := tx.db.encodeItem(item); err != nil {
+		return err
+	}
+	_, _, err = tx.set(item)
+	return err
+}
+
+// splitJSONPath splits a path into its components, which are unescaped.
+// Returns false when the path is empty, or has wildcards, queries or
+// modifiers.
+func splitJSONPath(path string) ([]string, bool) {
+	if path == "" {
+		return nil, false
+	}
+	var comps []string
+	var comp []byte
+	for i := 0; i < len(path); i++ {
+		switch c := path[i]; c {
+		case '\\':
+			i++
+			if i == len(path) {
+				return nil, false
+			}
+			comp = append(comp, path[i])
+		case '.':
+			comps = append(comps, string(comp))
+			comp = comp[:0]
+		case '*', '?', '|':
+			return nil, false
+		case '#', '@', '!':
+			if len(comp) == 0 {
+				return nil, false
+			}
+			comp = append(comp, c)
+		default:
+			comp = append(comp, c)
+		}
+	}
+	return append(comps, string(comp)), true
+}
+
+// joinJSONPath joins unescaped components into a path.
+func joinJSONPath(comps []string) string {
+	var path []byte
+	for i, comp := range comps {
+		if i > 0 {
+			path = append(path, '.')
+		}
+		for j := 0; j < len(comp); j++ {
+			switch c := comp[j]; c {
+			case '\\', '.', '*', '?', '|', '#', '@', '!':
+				path = append(path, '\\', c)
+			default:
+				path = append(path, c)
+			}
+		}
+	}
+	return string(path)
+}
+
+// setJSONPath sets the raw value at the path components in the document.
+// The deepest value that exists in the path is replaced, or the rest of the
+// path is added to it.
+func setJSONPath(doc string, comps []string, raw string) (string, error) {
+	for i := len(comps); i > 0; i-- {
+		res := gjson.Get(doc, joinJSONPath(comps[:i]))
+		if !res.Exists() {
+			continue
+		}
+		if res.Index <= 0 {
+			// The position of the value in the document is unknown.
+			return "", ErrInvalidValue
+		}
+		if i == len(comps) {
+			return doc[:res.Index] + raw + doc[res.Index+len(res.Raw):], nil
+		}
+		return addJSONPath(doc, res.Index, res.Raw, comps[i:], raw)
+	}
+	start := len(doc) - len(strings.TrimLeft(doc, " \t\r\n"))
+	return addJSONPath(doc, start, strings.TrimSpace(doc), comps, raw)
+}
+
+// addJSONPath adds the path components, and the raw value at the end of
+// them, to the object or array at the position in the document.
+func addJSONPath(doc string, pos int, container string, comps []string,
+	raw string) (string, error) {
+	res := gjson.Parse(container)
+	var n int
+	res.ForEach(func(_, _ gjson.Result) bool {
+		n++
+		return true
+	})
+	var elem string
+	switch {
+	case res.IsObject():
+		key, _ := json.Marshal(comps[0])
+		elem = string(key) + ":" + buildJSONPath(comps[1:], raw)
+	case res.IsArray():
+		idx, err := strconv.Atoi(comps[0])
+		if err != nil || idx < -1 {
+			return "", ErrInvalidValue
+		}
+		if idx == -1 {
+			idx = n
+		} else if idx < n {
+			return "", ErrInvalidValue
+		}
+		// The elements up to the index are filled with nulls.
+		elem = strings.Repeat("null,", idx-n) + buildJSONPath(comps[1:], raw)
+	default:
+		return "", ErrInvalidValue
+	}
+	if n > 0 {
+		elem = "," + elem
+	}
+	end := pos + len(container) - 1
+	return doc[:end] + elem + doc[end:], nil
+}
+
+// buildJSONPath returns the raw value nested in the path components. An
+// index creates an array, and any other component creates an object.
+func buildJSONPath(comps []string, raw string) string {
+	for i := len(comps) - 1; i >= 0; i-- {
+		idx, err := strconv.Atoi(comps[i])
+		if err != nil || idx < -1 {
+			key, _ := json.Marshal(comps[i])
+			raw = "{" + string(key) + ":" + raw + "}"
+		} else {
+			if idx == -1 {
+				idx = 0
+			}
+			raw = "[" + strings.Repeat("null,", idx) + raw + "]"
+		}
+	}
+	return raw
+}
@@ -0,0 +1,242 @@
+package buntdb
+
+import (
+	"encoding/json"
+	"math"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIncrBy(t *testing.T) {
+	db := testOpen(t)
+	defer testClose(db)
+	if err := db.Update(func(tx *Tx) error {
+		if err := tx.CreateIndex("count", "count:*", IndexInt); err != nil {
+			return err
+		}
+		if _, _, err := tx.Set("count:1", "10", nil); err != nil {
+			return err
+		}
+		_, _, err := tx.Set("count:2", "5", &SetOptions{Expires: true, TTL: time.Hour})
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	size := testFileSize(t, "data.db")
+	if err := db.Update(func(tx *Tx) error {
+		// a missing item starts at zero.
+		for i, exp := range []int64{3, 6, 9} {
+			n, err := tx.IncrBy("count:3", 3)
+			if err != nil {
+				return err
+			}
+			if n != exp {
+				t.Fatalf("%d: expected '%v', got '%v'", i, exp, n)
+			}
+		}
+		if n, err := tx.IncrBy("count:2", 10); err != nil || n != 15 {
+			t.Fatalf("expected '%v', got '%v' (%v)", 15, n, err)
+		}
+		if ttl, err := tx.TTL("count:2"); err != nil || ttl < time.Minute {
+			t.Fatalf("expected the expiration to be kept, got '%v' (%v)", ttl, err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// the three increments of count:3 are a single record.
+	if res := testFileSize(t, "data.db") - size; res > 100 {
+		t.Fatalf("expected two records, got %d bytes", res)
+	}
+	check := func(db *DB) {
+		if err := db.View(func(tx *Tx) error {
+			var keys []string
+			tx.Ascend("count", func(key, value string) bool {
+				keys = append(keys, key+"="+value)
+				return true
+			})
+			exp := "count:3=9,count:1=10,count:2=15"
+			if res := strings.Join(keys, ","); res != exp {
+				t.Fatalf("expected '%v', got '%v'", exp, res)
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check(db)
+	db = testReOpen(t, db)
+	defer testClose(db)
+	if err := db.Update(func(tx *Tx) error {
+		return tx.CreateIndex("count", "count:*", IndexInt)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	check(db)
+	// invalid values are not changed.
+	if err := db.Update(func(tx *Tx) error {
+		if _, _, err := tx.Set("str", "abc", nil); err != nil {
+			return err
+		}
+		if _, _, err := tx.Set("max", "9223372036854775800", nil); err != nil {
+			return err
+		}
+		if _, err := tx.IncrBy("str", 1); err != ErrInvalidValue {
+			t.Fatalf("expected '%v', got '%v'", ErrInvalidValue, err)
+		}
+		if _, err := tx.IncrBy("max", 10); err != ErrInvalidValue {
+			t.Fatalf("expected '%v', got '%v'", ErrInvalidValue, err)
+		}
+		if val, _ := tx.Get("max"); val != "9223372036854775800" {
+			t.Fatalf("expected '%v', got '%v'", "9223372036854775800", val)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.View(func(tx *Tx) error {
+		_, err := tx.IncrBy("count:1", 1)
+		return err
+	}); err != ErrTxNotWritable {
+		t.Fatalf("expected '%v', got '%v'", ErrTxNotWritable, err)
+	}
+}
+
+func TestIncrByFloatAppend(t *testing.T) {
+	db := testOpen(t)
+	defer testClose(db)
+	if err := db.Update(func(tx *Tx) error {
+		if _, _, err := tx.Set("f", "1.5", nil); err != nil {
+			return err
+		}
+		if n, err := tx.IncrByFloat("f", 0.25); err != nil || n != 1.75 {
+			t.Fatalf("expected '%v', got '%v' (%v)", 1.75, n, err)
+		}
+		if _, err := tx.IncrByFloat("max", math.MaxFloat64); err != nil {
+			return err
+		}
+		if n, err := tx.IncrByFloat("g", -2); err != nil || n != -2 {
+			t.Fatalf("expected '%v', got '%v' (%v)", -2, n, err)
+		}
+		if _, err := tx.IncrByFloat("max", math.MaxFloat64); err != ErrInvalidValue {
+			t.Fatalf("expected '%v', got '%v'", ErrInvalidValue, err)
+		}
+		if n, err := tx.Append("s", "hello"); err != nil || n != 5 {
+			t.Fatalf("expected '%v', got '%v' (%v)", 5, n, err)
+		}
+		if n, err := tx.Append("s", " world"); err != nil || n != 11 {
+			t.Fatalf("expected '%v', got '%v' (%v)", 11, n, err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	db = testReOpen(t, db)
+	defer testClose(db)
+	exp := "f=1.75,g=-2,max=" + strconv.FormatFloat(math.MaxFloat64, 'f', -1, 64) +
+		",s=hello world"
+	if res := testDump(t, db); res != exp {
+		t.Fatalf("expected '%v', got '%v'", exp, res)
+	}
+}
+
+func TestSetJSON(t *testing.T) {
+	db := testOpen(t)
+	defer testClose(db)
+	if err := db.Update(func(tx *Tx) error {
+		if err := tx.CreateIndex("age", "user:*", IndexJSON("age")); err != nil {
+			return err
+		}
+		if _, _, err := tx.Set("user:1", `{"name":{"first":"Tom"},"age":38}`, nil); err != nil {
+			return err
+		}
+		_, _, err := tx.Set("user:2", `{"name":{"first":"Jane"}, "age": 47, "tags":[]}`, nil)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		key, path string
+		value     interface{}
+		exp       string
+	}{
+		{"user:1", "age", 50, `{"name":{"first":"Tom"},"age":50}`},
+		{"user:1", "name.last", "Smith", `{"name":{"first":"Tom","last":"Smith"},"age":50}`},
+		{"user:1", "name", json.RawMessage(`{"nick":"T"}`), `{"name":{"nick":"T"},"age":50}`},
+		{"user:1", "a\\.b.1.c", true, `{"name":{"nick":"T"},"age":50,"a.b":[null,{"c":true}]}`},
+		{"user:2", "tags.-1", "x", `{"name":{"first":"Jane"}, "age": 47, "tags":["x"]}`},
+		{"user:2", "tags.-1", "y", `{"name":{"first":"Jane"}, "age": 47, "tags":["x","y"]}`},
+		{"user:2", "tags.3", "z", `{"name":{"first":"Jane"}, "age": 47, "tags":["x","y",null,"z"]}`},
+		{"user:2", "tags.0", nil, `{"name":{"first":"Jane"}, "age": 47, "tags":[null,"y",null,"z"]}`},
+		{"user:3", "age", 21, `{"age":21}`},
+	}
+	if err := db.Update(func(tx *Tx) error {
+		for i, tt := range tests {
+			if err := tx.SetJSON(tt.key, tt.path, tt.value); err != nil {
+				t.Fatalf("%d: %v", i, err)
+			}
+			if val, _ := tx.Get(tt.key); val != tt.exp {
+				t.Fatalf("%d: expected '%v', got '%v'", i, tt.exp, val)
+			}
+		}
+		// the paths that cannot be set.
+		if _, _, err := tx.Set("str", "abc", nil); err != nil {
+			return err
+		}
+		for i, path := range []string{"", "name.*", "a?", "#", "tags.#", "@this", "age.x", "tags.x", "a|b"} {
+			if err := tx.SetJSON("user:2", path, 1); err != ErrInvalidValue {
+				t.Fatalf("%d: expected '%v', got '%v'", i, ErrInvalidValue, err)
+			}
+		}
+		if err := tx.SetJSON("str", "a", 1); err != ErrInvalidValue {
+			t.Fatalf("expected '%v', got '%v'", ErrInvalidValue, err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	check := func(db *DB, exp string) {
+		if err := db.View(func(tx *Tx) error {
+			var keys []string
+			tx.Ascend("age", func(key, value string) bool {
+				keys = append(keys, key)
+				return true
+			})
+			if res := strings.Join(keys, ","); res != exp {
+				t.Fatalf("expected '%v', got '%v'", exp, res)
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check(db, "user:3,user:2,user:1")
+	exp := testDump(t, db)
+	db = testReOpen(t, db)
+	defer testClose(db)
+	if res := testDump(t, db); res != exp {
+		t.Fatalf("expected '%v', got '%v'", exp, res)
+	}
+	if err := db.Update(func(tx *Tx) error {
+		if err := tx.CreateIndex("age", "user:*", IndexJSON("age")); err != nil {
+			return err
+		}
+		return tx.SetJSON("user:3", "age", 99)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// a rollback restores the document and the index.
+	tx, err := db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.SetJSON("user:3", "age", 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	check(db, "user:2,user:1,user:3")
+}
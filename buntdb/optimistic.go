@@ -0,0 +1,161 @@
+package buntdb
+
+// txOptContext is the context of an optimistic transaction.
+type txOptContext struct {
+	db    *DB                // the database that the changes are committed to
+	reads map[string]*dbItem // the items that were read, nil when missing
+}
+
+// BeginOptimistic opens a new optimistic read/write transaction. Unlike a
+// transaction from Begin(true), an optimistic transaction does not hold the
+// database lock while it's in use. Other read/write transactions, including
+// other optimistic transactions, and read-only transactions are not blocked.
+//
+// The transaction works on a private point-in-time copy of the database, like
+// a Snapshot, and its changes are only visible to itself until it's committed.
+// The copy is taken with the read lock, and the spatial and text indexes of
+// the copy are only built when the transaction uses them.
+// Commit returns ErrConflict when an item that the transaction read with Get
+// or TTL, or changed with Set or Delete, which return the previous value, was
+// changed by another transaction after the copy was taken. Items that are
+// only visited by the Ascend*, Descend*, Nearby, Intersects, and Search
+// methods are not checked for changes. Indexes cannot be created or dropped
+// by an optimistic transaction.
+//
+// The transaction must be closed by calling Commit() or Rollback() when done.
+func (db *DB) BeginOptimistic() (*Tx, error) {
+	db.mu.RLock()
+	if db.closed {
+		db.mu.RUnlock()
+		return nil, ErrDatabaseClosed
+	}
+	if db.follower {
+		db.mu.RUnlock()
+		return nil, ErrFollower
+	}
+	sdb := db.detachShared()
+	db.mu.RUnlock()
+	// Items are evicted from the database when the changes are committed.
+	sdb.config.MaxMemory = 0
+	return &Tx{
+		db:       sdb,
+		writable: true,
+		wc: &txWriteContext{
+			rollbackItems:   make(map[string]*dbItem),
+			rollbackIndexes: make(map[string]*index),
+			commitItems:     make(map[string]*dbItem),
+			commitExpires:   make(map[string]bool),
+		},
+		oc: &txOptContext{db: db, reads: make(map[string]*dbItem)},
+	}, nil
+}
+
+// UpdateOptimistic executes a function within a managed optimistic
+// transaction. The transaction is committed when the function returns no
+// error, and the function is called again in a new transaction when the
+// commit returns ErrConflict. The function may be called many times, so it
+// should not have side effects outside of the transaction.
+//
+// Executing a manual commit or rollback from inside the function will result
+// in a panic.
+func (db *DB) UpdateOptimistic(fn func(tx *Tx) error) error {
+	for {
+		err := db.optimistic(fn)
+		if err != ErrConflict {
+			return err
+		}
+	}
+}
+
+// optimistic runs a function in a single optimistic transaction.
+func (db *DB) optimistic(fn func(tx *Tx) error) (err error) {
+	var tx *Tx
+	tx, err = db.BeginOptimistic()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			// The caller returned an error. We must rollback.
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+	tx.funcd = true
+	defer func() {
+		tx.funcd = false
+	}()
+	err = fn(tx)
+	return
+}
+
+// trackRead records the item that an optimistic transaction reads. Items
+// that were changed by the transaction, and all items after a DeleteAll, do
+// not depend on the database.
+func (tx *Tx) trackRead(key string) {
+	if tx.oc == nil || tx.wc.rbkeys != nil {
+		return
+	}
+	if _, ok := tx.oc.reads[key]; ok {
+		return
+	}
+	if _, ok := tx.wc.commitItems[key]; ok {
+		return
+	}
+	tx.oc.reads[key] = tx.db.get(key)
+}
+
+// commitOptimistic checks that the items that were read have not changed,
+// and then applies the changes to the database in a read/write transaction.
+func (tx *Tx) commitOptimistic() error {
+	db, wc, oc := tx.oc.db, tx.wc, tx.oc
+	tx.db = nil
+	ltx, err := db.Begin(true)
+	if err != nil {
+		return err
+	}
+	// The items are never changed in place, so an item that was replaced or
+	// deleted is a different pointer.
+	for key, item := range oc.reads {
+		if db.get(key) != item {
+			_ = ltx.Rollback()
+			return ErrConflict
+		}
+	}
+	if wc.rbkeys != nil {
+		if err := ltx.DeleteAll(); err != nil {
+			_ = ltx.Rollback()
+			return err
+		}
+	}
+	// The deletes go first, which allows for a unique value to be moved from
+	// one key to another.
+	for key := range wc.commitItems {
+		if wc.commitExpires[key] {
+			continue
+		}
+		if _, err := ltx.Delete(key); err != nil && err != ErrNotFound {
+			_ = ltx.Rollback()
+			return err
+		}
+	}
+	for key, item := range wc.commitItems {
+		if item == nil {
+			continue
+		}
+		var err error
+		if wc.commitExpires[key] {
+			// The item that was read is the same, so only the expiration
+			// is changed.
+			err = ltx.expire(key, item.opts)
+		} else {
+			_, _, err = ltx.set(item)
+		}
+		if err != nil {
+			_ = ltx.Rollback()
+			return err
+		}
+	}
+	return ltx.Commit()
+}
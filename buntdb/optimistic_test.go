@@ -0,0 +1,267 @@
+package buntdb
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestOptimistic(t *testing.T) {
+	db := testOpen(t)
+	defer testClose(db)
+	testFillAOF(t, db, 3)
+	tx, err := db.BeginOptimistic()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := tx.Set("key:3", "val:3", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Delete("key:0"); err != nil {
+		t.Fatal(err)
+	}
+	// the transaction sees its own changes, and does not block others.
+	if val, err := tx.Get("key:3"); err != nil || val != "val:3" {
+		t.Fatalf("expected '%v', got '%v'", "val:3", val)
+	}
+	if err := db.Update(func(tx *Tx) error {
+		_, _, err := tx.Set("other", "val", nil)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if res := testDump(t, db); res != "key:0=val:0,key:1=val:1,key:2=val:2,other=val" {
+		t.Fatalf("expected no changes, got '%v'", res)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	exp := "key:1=val:1,key:2=val:2,key:3=val:3,other=val"
+	if res := testDump(t, db); res != exp {
+		t.Fatalf("expected '%v', got '%v'", exp, res)
+	}
+	db = testReOpen(t, db)
+	defer testClose(db)
+	if res := testDump(t, db); res != exp {
+		t.Fatalf("expected '%v', got '%v'", exp, res)
+	}
+	if err := tx.Commit(); err != ErrTxClosed {
+		t.Fatalf("expected '%v', got '%v'", ErrTxClosed, err)
+	}
+	// a rolled back transaction does not change the database.
+	tx, err = db.BeginOptimistic()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.DeleteAll(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.CreateIndex("vals", "*", IndexString); err != ErrInvalidOperation {
+		t.Fatalf("expected '%v', got '%v'", ErrInvalidOperation, err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if res := testDump(t, db); res != exp {
+		t.Fatalf("expected '%v', got '%v'", exp, res)
+	}
+}
+
+func TestOptimisticConflict(t *testing.T) {
+	db := testOpen(t)
+	defer testClose(db)
+	testFillAOF(t, db, 3)
+	begin := func() *Tx {
+		tx, err := db.BeginOptimistic()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tx
+	}
+	tx1, tx2, tx3, tx4, tx5 := begin(), begin(), begin(), begin(), begin()
+	if _, err := tx1.Get("key:1"); err != nil {
+		t.Fatal(err)
+	}
+	// a missing item that is read must still be missing.
+	if _, err := tx2.TTL("key:3"); err != ErrNotFound {
+		t.Fatalf("expected '%v', got '%v'", ErrNotFound, err)
+	}
+	// set and delete return the previous value, so the item is read.
+	if prev, _, err := tx3.Set("key:1", "tx3", nil); err != nil ||
+		prev != "val:1" {
+		t.Fatalf("expected '%v', got '%v'", "val:1", prev)
+	}
+	if prev, err := tx4.Delete("key:2"); err != nil || prev != "val:2" {
+		t.Fatalf("expected '%v', got '%v'", "val:2", prev)
+	}
+	// an item that is not changed by others does not conflict.
+	tx5.Set("key:4", "tx5", nil)
+	for _, tx := range []*Tx{tx1, tx2} {
+		tx.Set("key:0", "conflict", nil)
+	}
+	if err := db.Update(func(tx *Tx) error {
+		tx.Set("key:1", "changed", nil)
+		tx.Set("key:2", "changed", nil)
+		tx.Set("key:3", "val:3", nil)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for _, tx := range []*Tx{tx1, tx2, tx3, tx4} {
+		if err := tx.Commit(); err != ErrConflict {
+			t.Fatalf("expected '%v', got '%v'", ErrConflict, err)
+		}
+	}
+	if err := tx5.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	exp := "key:0=val:0,key:1=changed,key:2=changed,key:3=val:3,key:4=tx5"
+	if res := testDump(t, db); res != exp {
+		t.Fatalf("expected '%v', got '%v'", exp, res)
+	}
+}
+
+func TestOptimisticRetry(t *testing.T) {
+	db := testOpen(t)
+	defer testClose(db)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if err := db.UpdateOptimistic(func(tx *Tx) error {
+					val, err := tx.Get("counter")
+					if err != nil && err != ErrNotFound {
+						return err
+					}
+					n, _ := strconv.Atoi(val)
+					_, _, err = tx.Set("counter", strconv.Itoa(n+1), nil)
+					return err
+				}); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if res := testDump(t, db); res != "counter=400" {
+		t.Fatalf("expected '%v', got '%v'", "counter=400", res)
+	}
+}
+
+func TestOptimisticIndexes(t *testing.T) {
+	db := testOpen(t)
+	defer testClose(db)
+	if err := db.Update(func(tx *Tx) error {
+		tx.Set("user:1", "a", nil)
+		tx.Set("user:2", "b", nil)
+		return tx.CreateIndexOptions("name", "user:*",
+			&IndexOptions{Unique: true}, IndexString)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// swapping the unique values of two items.
+	if err := db.UpdateOptimistic(func(tx *Tx) error {
+		if _, err := tx.Delete("user:1"); err != nil {
+			return err
+		}
+		if _, _, err := tx.Set("user:2", "a", nil); err != nil {
+			return err
+		}
+		if _, _, err := tx.Set("user:1", "b", nil); err != nil {
+			return err
+		}
+		var keys []string
+		tx.Ascend("name", func(key, val string) bool {
+			keys = append(keys, key)
+			return true
+		})
+		if res := strings.Join(keys, ","); res != "user:2,user:1" {
+			t.Fatalf("expected '%v', got '%v'", "user:2,user:1", res)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.View(func(tx *Tx) error {
+		var keys []string
+		tx.Ascend("name", func(key, val string) bool {
+			keys = append(keys, key)
+			return true
+		})
+		if res := strings.Join(keys, ","); res != "user:2,user:1" {
+			t.Fatalf("expected '%v', got '%v'", "user:2,user:1", res)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	err := db.UpdateOptimistic(func(tx *Tx) error {
+		_, _, err := tx.Set("user:3", "a", nil)
+		return err
+	})
+	if err != ErrUniqueViolation {
+		t.Fatalf("expected '%v', got '%v'", ErrUniqueViolation, err)
+	}
+}
+
+func TestOptimisticLazyIndexes(t *testing.T) {
+	db := testOpen(t)
+	defer testClose(db)
+	if err := db.Update(func(tx *Tx) error {
+		if err := tx.CreateSpatialIndex("pos", "pos:*", IndexRect); err != nil {
+			return err
+		}
+		if err := tx.CreateTextIndex("body", "post:*", nil, nil); err != nil {
+			return err
+		}
+		tx.Set("pos:1", "[10 10]", nil)
+		_, _, err := tx.Set("post:1", "hello world", nil)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// an open read-only transaction does not block the optimistic
+	// transaction.
+	rtx, err := db.Begin(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rtx.Rollback()
+	tx, err := db.BeginOptimistic()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	// the spatial and text indexes are filled when they're used, and have
+	// the changes of the transaction.
+	if !tx.db.idxs["pos"].lazy || !tx.db.idxs["body"].lazy {
+		t.Fatal("expected the indexes to be empty")
+	}
+	tx.Set("pos:2", "[20 20]", nil)
+	tx.Set("post:2", "hello planet", nil)
+	var keys []string
+	if err := tx.Intersects("pos", "[0 0],[30 30]", func(key, _ string) bool {
+		keys = append(keys, key)
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Search("body", "hello", func(key, _ string, _ float64) bool {
+		keys = append(keys, key)
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if tx.db.idxs["pos"].lazy || tx.db.idxs["body"].lazy {
+		t.Fatal("expected the indexes to be filled")
+	}
+	sort.Strings(keys)
+	if res := strings.Join(keys, ","); res != "pos:1,pos:2,post:1,post:2" {
+		t.Fatalf("expected '%v', got '%v'", "pos:1,pos:2,post:1,post:2", res)
+	}
+}
@@ -0,0 +1,671 @@
+package buntdb
+
+import (
+	"encoding/json"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/match"
+)
+
+// query is a parsed query.
+type query struct {
+	pattern string     // the key pattern, empty for all keys
+	where   *queryExpr // the filter, nil for all items
+	order   string     // the JSON path of the sort order
+	desc    bool       // sort in descending order
+	limit   int        // the maximum number of items, -1 for no limit
+	offset  int        // the number of items to skip
+}
+
+// queryExpr is a node of a filter expression. The op is "and", "or", "not",
+// or one of the comparison operators.
+type queryExpr struct {
+	op          string
+	left, right *queryExpr
+	path        string       // the JSON path of a comparison
+	lit         gjson.Result // the literal of a comparison
+}
+
+// queryPlan is the way that a query finds its items.
+type queryPlan struct {
+	idx     *index       // the index that is scanned, nil for the keys
+	fields  []IndexField // the fields of the index
+	eqs     []*queryExpr // the equality conditions of the first fields
+	lo, hi  *queryExpr   // the range conditions of the next field
+	ordered bool         // the scan is in the sort order
+}
+
+// Query calls the iterator for every item that matches a query, until the
+// iterator returns false. A query looks like:
+//
+//	FROM user:* WHERE age >= 30 AND city = 'Oslo' ORDER BY name LIMIT 50
+//
+// All of the parts are optional, and the FROM and WHERE keywords may be left
+// out. FROM limits the items to the keys that match a pattern. WHERE filters
+// the items by comparing JSON paths of the values with literals, using the =,
+// !=, <, <=, >, and >= operators, which may be joined with AND, OR, NOT, and
+// parentheses. A literal is a number, a quoted string, true, false, or null.
+// The values are compared like IndexJSON, where strings are case-insensitive,
+// and a comparison is false when the path is missing or when the value has
+// a different type than the literal, except for !=. ORDER BY sorts the items
+// by a JSON path, with ties ordered by key. LIMIT and OFFSET page through the
+// items. The items are in an unspecified order when ORDER BY is missing.
+//
+// The query uses a compound index, or a persistent index with IndexJSON
+// functions, such as "IndexJSON:age", when there's one for the conditions, to
+// scan fewer items. A field of the index is used for equality conditions, or
+// for a range of the first field that is not equal, when the field has no
+// Less function. The index must have no Filter, and its pattern must be "*"
+// or the same as the FROM pattern. Use Explain to see which index is used.
+func (tx *Tx) Query(query string, iterator func(key, value string) bool) error {
+	if tx.db == nil {
+		return ErrTxClosed
+	}
+	q, err := parseQuery(query)
+	if err != nil {
+		return err
+	}
+	p := tx.planQuery(q)
+	if q.limit == 0 {
+		return nil
+	}
+	type item struct{ key, value string }
+	var items []item
+	sorting := q.order != "" && !p.ordered
+	offset, count := q.offset, 0
+	emit := func(key, value string) bool {
+		if q.pattern != "" && !match.Match(key, q.pattern) {
+			return true
+		}
+		if q.where != nil && !q.where.eval(value) {
+			return true
+		}
+		if sorting {
+			items = append(items, item{key, value})
+			return true
+		}
+		if offset > 0 {
+			offset--
+			return true
+		}
+		count++
+		return iterator(key, value) && (q.limit < 0 || count < q.limit)
+	}
+	if p.idx != nil {
+		err = tx.scanPlan(p, emit)
+	} else if q.pattern != "" {
+		err = tx.AscendKeys(q.pattern, emit)
+	} else {
+		err = tx.Ascend("", emit)
+	}
+	if err != nil || !sorting {
+		return err
+	}
+	less := fieldsLess([]IndexField{{Path: q.order, Desc: q.desc}})
+	sort.SliceStable(items, func(i, j int) bool {
+		if less(items[i].value, items[j].value) {
+			return true
+		}
+		if less(items[j].value, items[i].value) {
+			return false
+		}
+		return items[i].key < items[j].key
+	})
+	if offset >= len(items) {
+		return nil
+	}
+	items = items[offset:]
+	if q.limit >= 0 && q.limit < len(items) {
+		items = items[:q.limit]
+	}
+	for _, item := range items {
+		if !iterator(item.key, item.value) {
+			break
+		}
+	}
+	return nil
+}
+
+// Explain returns how a query finds its items, one step per line. The first
+// line is the index that is scanned, or the keys when there's no index for
+// the query, and it's followed by the filter, sort, offset, and limit steps.
+func (tx *Tx) Explain(query string) (string, error) {
+	if tx.db == nil {
+		return "", ErrTxClosed
+	}
+	q, err := parseQuery(query)
+	if err != nil {
+		return "", err
+	}
+	p := tx.planQuery(q)
+	var lines []string
+	if p.idx != nil {
+		line := "scan index " + strconv.Quote(p.idx.name)
+		conds := append([]*queryExpr(nil), p.eqs...)
+		for _, e := range []*queryExpr{p.lo, p.hi} {
+			if e != nil {
+				conds = append(conds, e)
+			}
+		}
+		for i, e := range conds {
+			if i == 0 {
+				line += " where "
+			} else {
+				line += " AND "
+			}
+			line += e.String()
+		}
+		lines = append(lines, line)
+	} else if q.pattern != "" {
+		lines = append(lines, "scan keys matching "+strconv.Quote(q.pattern))
+	} else {
+		lines = append(lines, "scan keys")
+	}
+	if q.where != nil {
+		lines = append(lines, "filter "+q.where.String())
+	}
+	if q.order != "" && !p.ordered {
+		line := "sort by " + q.order
+		if q.desc {
+			line += " desc"
+		}
+		lines = append(lines, line)
+	}
+	if q.offset > 0 {
+		lines = append(lines, "offset "+strconv.Itoa(q.offset))
+	}
+	if q.limit >= 0 {
+		lines = append(lines, "limit "+strconv.Itoa(q.limit))
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// planQuery chooses the index that is scanned by a query. The index with the
+// most equality conditions, and then the most range conditions, is chosen.
+// An index that's only in the sort order is used when there are no
+// conditions for any index.
+func (tx *Tx) planQuery(q *query) *queryPlan {
+	// Only the conditions that every item must match are used.
+	var conds []*queryExpr
+	var walk func(e *queryExpr)
+	walk = func(e *queryExpr) {
+		switch e.op {
+		case "and":
+			walk(e.left)
+			walk(e.right)
+		case "=", "<", "<=", ">", ">=":
+			conds = append(conds, e)
+		}
+	}
+	if q.where != nil {
+		walk(q.where)
+	}
+	names := make([]string, 0, len(tx.db.idxs))
+	for name := range tx.db.idxs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	best, bestScore := &queryPlan{}, 0
+	for _, name := range names {
+		idx := tx.db.idxs[name]
+		fields := idx.jsonFields()
+		if fields == nil || idx.btr == nil || idx.opts.Filter != nil {
+			continue
+		}
+		if idx.pattern != "*" {
+			pattern := q.pattern
+			if idx.opts.CaseInsensitiveKeyMatching {
+				pattern = strings.ToLower(pattern)
+			}
+			if q.pattern == "" || idx.pattern != pattern {
+				continue
+			}
+		}
+		p := &queryPlan{idx: idx, fields: fields}
+		k := 0
+		for ; k < len(fields) && fields[k].Less == nil; k++ {
+			eq := findCond(conds, fields[k].Path, "=")
+			if eq == nil {
+				break
+			}
+			p.eqs = append(p.eqs, eq)
+		}
+		if k < len(fields) && fields[k].Less == nil {
+			for _, e := range conds {
+				if e.path != fields[k].Path ||
+					(e.lit.Type != gjson.Number && e.lit.Type != gjson.String) {
+					continue
+				}
+				switch e.op {
+				case ">", ">=":
+					if p.lo == nil {
+						p.lo = e
+					}
+				case "<", "<=":
+					if p.hi == nil {
+						p.hi = e
+					}
+				}
+			}
+		}
+		if q.order != "" {
+			if k == len(fields) {
+				// All of the items are equal, and in key order.
+				p.ordered = findCond(p.eqs, q.order, "=") != nil
+			} else if k == len(fields)-1 {
+				f := fields[k]
+				p.ordered = f.Path == q.order && f.Less == nil && f.Desc == q.desc
+			}
+		}
+		score := len(p.eqs) * 4
+		if p.lo != nil {
+			score += 2
+		}
+		if p.hi != nil {
+			score += 2
+		}
+		if p.ordered {
+			score++
+		}
+		if score > bestScore {
+			best, bestScore = p, score
+		}
+	}
+	return best
+}
+
+// findCond returns the first condition with the path and operator.
+func findCond(conds []*queryExpr, path, op string) *queryExpr {
+	for _, e := range conds {
+		if e.path == path && e.op == op {
+			return e
+		}
+	}
+	return nil
+}
+
+// scanPlan calls the iterator for the items of the index that are in the
+// range of the plan. The items must still be filtered.
+func (tx *Tx) scanPlan(p *queryPlan, iterator func(key, value string) bool) error {
+	fields := p.fields
+	k := len(p.eqs)
+	var desc bool
+	start, stop := p.lo, p.hi
+	if k < len(fields) && fields[k].Desc {
+		desc = true
+		start, stop = stop, start
+	}
+	values := make([]string, 0, k+1)
+	for _, e := range p.eqs {
+		values = append(values, e.lit.Raw)
+	}
+	if start != nil {
+		values = append(values, start.lit.Raw)
+	}
+	iter := func(key, value string) bool {
+		for i, e := range p.eqs {
+			res := gjson.Get(value, fields[i].Path)
+			if c, ok := queryCompare(res, e.lit); !ok || c != 0 {
+				// Past the items that are equal.
+				return false
+			}
+		}
+		if k == len(fields) || (start == nil && stop == nil) {
+			return iterator(key, value)
+		}
+		res := gjson.Get(value, fields[k].Path)
+		if !res.Exists() {
+			// Missing fields are ordered first.
+			return true
+		}
+		if start != nil {
+			c, ok := queryCompare(res, start.lit)
+			if !ok {
+				return false
+			}
+			if c == 0 && (start.op == ">" || start.op == "<") {
+				return true
+			}
+		}
+		if stop != nil {
+			c, ok := queryCompare(res, stop.lit)
+			if !ok {
+				// Values of another type are grouped by type.
+				return (res.Type < stop.lit.Type) != desc
+			}
+			if desc {
+				c = -c
+			}
+			if c > 0 || (c == 0 && (stop.op == ">" || stop.op == "<")) {
+				return false
+			}
+		}
+		return iterator(key, value)
+	}
+	if len(values) == 0 {
+		return tx.Ascend(p.idx.name, iter)
+	}
+	pivot := fieldsPivot(fields[:len(values)], values)
+	return tx.AscendGreaterOrEqual(p.idx.name, pivot, iter)
+}
+
+// queryCompare compares a value with a literal, like IndexJSON. It returns
+// false when the value is missing or has a different type.
+func queryCompare(a, b gjson.Result) (int, bool) {
+	if !a.Exists() {
+		return 0, false
+	}
+	if a.Type != b.Type && !(isBool(a) && isBool(b)) {
+		return 0, false
+	}
+	if a.Less(b, false) {
+		return -1, true
+	}
+	if b.Less(a, false) {
+		return 1, true
+	}
+	return 0, true
+}
+
+func isBool(r gjson.Result) bool {
+	return r.Type == gjson.True || r.Type == gjson.False
+}
+
+// eval returns true when the value matches the expression.
+func (e *queryExpr) eval(value string) bool {
+	switch e.op {
+	case "and":
+		return e.left.eval(value) && e.right.eval(value)
+	case "or":
+		return e.left.eval(value) || e.right.eval(value)
+	case "not":
+		return !e.left.eval(value)
+	}
+	res := gjson.Get(value, e.path)
+	c, ok := queryCompare(res, e.lit)
+	if !ok {
+		return e.op == "!=" && res.Exists()
+	}
+	switch e.op {
+	case "=":
+		return c == 0
+	case "!=":
+		return c != 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	default: // ">="
+		return c >= 0
+	}
+}
+
+func (e *queryExpr) String() string {
+	switch e.op {
+	case "and":
+		return e.left.group("or") + " AND " + e.right.group("or")
+	case "or":
+		return e.left.String() + " OR " + e.right.String()
+	case "not":
+		return "NOT " + e.left.group("and", "or")
+	}
+	return e.path + " " + e.op + " " + e.lit.Raw
+}
+
+// group returns the expression in parentheses when it's one of the ops.
+func (e *queryExpr) group(ops ...string) string {
+	for _, op := range ops {
+		if e.op == op {
+			return "(" + e.String() + ")"
+		}
+	}
+	return e.String()
+}
+
+// queryParser parses the tokens of a query.
+type queryParser struct {
+	toks []string
+	pos  int
+}
+
+// parseQuery parses a query, which is described by Query.
+func parseQuery(s string) (*query, error) {
+	toks, ok := lexQuery(s)
+	if !ok {
+		return nil, ErrInvalidQuery
+	}
+	p := &queryParser{toks: toks}
+	q := &query{limit: -1}
+	if p.keyword("FROM") {
+		tok := p.next()
+		if tok == "" || isQueryOp(tok) {
+			return nil, ErrInvalidQuery
+		}
+		if tok[0] == '\'' || tok[0] == '"' {
+			tok = unquoteQuery(tok)
+		}
+		q.pattern = tok
+	}
+	where := p.keyword("WHERE")
+	if where || (p.peek() != "" && !p.peekKeyword("ORDER") &&
+		!p.peekKeyword("LIMIT")) {
+		var err error
+		if q.where, err = p.parseOr(); err != nil {
+			return nil, err
+		}
+	}
+	if p.keyword("ORDER") {
+		if !p.keyword("BY") {
+			return nil, ErrInvalidQuery
+		}
+		q.order = p.next()
+		if q.order == "" || !isQueryPath(q.order) {
+			return nil, ErrInvalidQuery
+		}
+		if p.keyword("DESC") {
+			q.desc = true
+		} else {
+			p.keyword("ASC")
+		}
+	}
+	if p.keyword("LIMIT") {
+		n, err := strconv.Atoi(p.next())
+		if err != nil || n < 0 {
+			return nil, ErrInvalidQuery
+		}
+		q.limit = n
+	}
+	if p.keyword("OFFSET") {
+		n, err := strconv.Atoi(p.next())
+		if err != nil || n < 0 {
+			return nil, ErrInvalidQuery
+		}
+		q.offset = n
+	}
+	if p.peek() != "" {
+		return nil, ErrInvalidQuery
+	}
+	return q, nil
+}
+
+func (p *queryParser) peek() string {
+	if p.pos == len(p.toks) {
+		return ""
+	}
+	return p.toks[p.pos]
+}
+
+func (p *queryParser) next() string {
+	tok := p.peek()
+	if tok != "" {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *queryParser) peekKeyword(kw string) bool {
+	return strings.EqualFold(p.peek(), kw)
+}
+
+// keyword skips the next token when it's the keyword.
+func (p *queryParser) keyword(kw string) bool {
+	if p.peekKeyword(kw) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *queryParser) parseOr() (*queryExpr, error) {
+	left, err := p.parseAnd()
+	for err == nil && p.keyword("OR") {
+		var right *queryExpr
+		right, err = p.parseAnd()
+		left = &queryExpr{op: "or", left: left, right: right}
+	}
+	return left, err
+}
+
+func (p *queryParser) parseAnd() (*queryExpr, error) {
+	left, err := p.parseNot()
+	for err == nil && p.keyword("AND") {
+		var right *queryExpr
+		right, err = p.parseNot()
+		left = &queryExpr{op: "and", left: left, right: right}
+	}
+	return left, err
+}
+
+func (p *queryParser) parseNot() (*queryExpr, error) {
+	if p.keyword("NOT") {
+		e, err := p.parseNot()
+		return &queryExpr{op: "not", left: e}, err
+	}
+	if p.peek() == "(" {
+		p.pos++
+		e, err := p.parseOr()
+		if err == nil && p.next() != ")" {
+			err = ErrInvalidQuery
+		}
+		return e, err
+	}
+	path, op := p.next(), p.next()
+	if !isQueryPath(path) || !isQueryOp(op) {
+		return nil, ErrInvalidQuery
+	}
+	switch op {
+	case "==":
+		op = "="
+	case "<>":
+		op = "!="
+	}
+	lit, ok := parseQueryLiteral(p.next())
+	if !ok {
+		return nil, ErrInvalidQuery
+	}
+	return &queryExpr{op: op, path: path, lit: lit}, nil
+}
+
+// parseQueryLiteral returns the JSON value of a literal.
+func parseQueryLiteral(tok string) (gjson.Result, bool) {
+	if tok == "" {
+		return gjson.Result{}, false
+	}
+	if tok[0] == '\'' || tok[0] == '"' {
+		b, _ := json.Marshal(unquoteQuery(tok))
+		return gjson.ParseBytes(b), true
+	}
+	switch strings.ToLower(tok) {
+	case "true", "false", "null":
+		return gjson.Parse(strings.ToLower(tok)), true
+	}
+	n, err := strconv.ParseFloat(tok, 64)
+	if err != nil || math.IsNaN(n) || math.IsInf(n, 0) {
+		return gjson.Result{}, false
+	}
+	// Use the JSON form of the number, such as 1 for +1.0.
+	return gjson.Parse(strconv.FormatFloat(n, 'f', -1, 64)), true
+}
+
+// lexQuery splits a query into tokens, which are words, quoted strings,
+// parentheses, and operators.
+func lexQuery(s string) ([]string, bool) {
+	var toks []string
+	for i := 0; i < len(s); {
+		switch c := s[i]; {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(' || c == ')':
+			toks = append(toks, s[i:i+1])
+			i++
+		case c == '\'' || c == '"':
+			j := i + 1
+			for ; j < len(s) && s[j] != c; j++ {
+				if s[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(s) {
+				return nil, false
+			}
+			toks = append(toks, s[i:j+1])
+			i = j + 1
+		case strings.IndexByte("=!<>", c) != -1:
+			j := i + 1
+			if j < len(s) && (s[j] == '=' || (c == '<' && s[j] == '>')) {
+				j++
+			}
+			if !isQueryOp(s[i:j]) {
+				return nil, false
+			}
+			toks = append(toks, s[i:j])
+			i = j
+		default:
+			j := i
+			for ; j < len(s) && strings.IndexByte(" \t\n\r()'\"=!<>", s[j]) == -1; j++ {
+			}
+			toks = append(toks, s[i:j])
+			i = j
+		}
+	}
+	return toks, true
+}
+
+// unquoteQuery returns the contents of a quoted string, where a backslash
+// escapes the next character.
+func unquoteQuery(tok string) string {
+	var b []byte
+	for i := 1; i < len(tok)-1; i++ {
+		if tok[i] == '\\' {
+			i++
+		}
+		b = append(b, tok[i])
+	}
+	return string(b)
+}
+
+func isQueryOp(tok string) bool {
+	switch tok {
+	case "=", "==", "!=", "<>", "<", "<=", ">", ">=":
+		return true
+	}
+	return false
+}
+
+func isQueryPath(tok string) bool {
+	if tok == "" || tok == "(" || tok == ")" || isQueryOp(tok) ||
+		tok[0] == '\'' || tok[0] == '"' {
+		return false
+	}
+	switch strings.ToUpper(tok) {
+	case "AND", "OR", "NOT", "ORDER", "LIMIT", "OFFSET":
+		return false
+	}
+	return true
+}
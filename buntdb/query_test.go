@@ -0,0 +1,234 @@
+package buntdb
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func testQuery(t *testing.T, tx *Tx, query string) string {
+	var keys []string
+	if err := tx.Query(query, func(key, value string) bool {
+		keys = append(keys, key)
+		return true
+	}); err != nil {
+		t.Fatalf("%v: %v", query, err)
+	}
+	return strings.Join(keys, ",")
+}
+
+func testQueryDB(t *testing.T) *DB {
+	db := testOpen(t)
+	users := []string{
+		`{"name":"Tom","age":38,"city":"Oslo"}`,
+		`{"name":"Anna","age":30,"city":"oslo"}`,
+		`{"name":"Jane","age":25,"city":"Oslo"}`,
+		`{"name":"Carl","age":52,"city":"Bergen"}`,
+		`{"name":"Beth","age":41,"city":"Oslo","admin":true}`,
+		`{"name":"Dave","age":"unknown","city":"Oslo"}`,
+		`{"name":"Eve","city":"Oslo"}`,
+	}
+	if err := db.Update(func(tx *Tx) error {
+		for i, user := range users {
+			if _, _, err := tx.Set(fmt.Sprintf("user:%d", i), user, nil); err != nil {
+				return err
+			}
+		}
+		_, _, err := tx.Set("city:oslo", `{"name":"Oslo","age":1000,"city":"Oslo"}`, nil)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestQuery(t *testing.T) {
+	db := testQueryDB(t)
+	defer testClose(db)
+	tests := []struct{ query, exp string }{
+		{"FROM user:* WHERE age >= 30 AND city = 'Oslo' ORDER BY name",
+			"user:1,user:4,user:0"},
+		{"age >= 30 AND city = 'Oslo' ORDER BY name LIMIT 3", "user:1,user:4,city:oslo"},
+		{"from 'user:*' where age > 30 order by age desc", "user:3,user:4,user:0"},
+		{"FROM user:* ORDER BY age LIMIT 2 OFFSET 1", "user:2,user:1"},
+		{"FROM user:* WHERE age < 30 OR admin = true", "user:2,user:4"},
+		{"FROM user:* WHERE NOT (city = 'oslo' OR age > 50)", ""},
+		{"FROM user:* WHERE city != 'Oslo'", "user:3"},
+		{"FROM user:* WHERE age = 'unknown'", "user:5"},
+		{"FROM user:* WHERE age != 38", "user:1,user:2,user:3,user:4,user:5"},
+		{"FROM user:* WHERE name = \"O'Brien\"", ""},
+		{"ORDER BY name DESC LIMIT 1", "user:0"},
+		{"LIMIT 0", ""},
+	}
+	check := func() {
+		if err := db.View(func(tx *Tx) error {
+			for _, test := range tests {
+				if res := testQuery(t, tx, test.query); res != test.exp {
+					t.Fatalf("%v: expected '%v', got '%v'",
+						test.query, test.exp, res)
+				}
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the results are the same with and without indexes.
+	check()
+	if err := db.Update(func(tx *Tx) error {
+		if err := tx.CreateCompoundIndex("city_age", "*",
+			IndexField{Path: "city"}, IndexField{Path: "age"}); err != nil {
+			return err
+		}
+		if err := tx.CreateCompoundIndex("age", "user:*",
+			IndexField{Path: "age", Desc: true}); err != nil {
+			return err
+		}
+		return tx.CreateCompoundIndex("name", "user:*", IndexField{Path: "name"})
+	}); err != nil {
+		t.Fatal(err)
+	}
+	check()
+	for _, query := range []string{
+		"age >=", "FROM", "age = Oslo", "age => 1", "(age = 1", "ORDER name",
+		"LIMIT -1", "age = 1 LIMIT 1 foo", "'age' = 1", "name = 'Tom",
+		"age = NaN", "WHERE",
+	} {
+		err := db.View(func(tx *Tx) error {
+			return tx.Query(query, func(key, value string) bool { return true })
+		})
+		if err != ErrInvalidQuery {
+			t.Fatalf("%v: expected '%v', got '%v'", query, ErrInvalidQuery, err)
+		}
+	}
+}
+
+func TestQueryExplain(t *testing.T) {
+	db := testQueryDB(t)
+	defer testClose(db)
+	if err := db.Update(func(tx *Tx) error {
+		if err := tx.CreateCompoundIndex("city_age", "*",
+			IndexField{Path: "city"}, IndexField{Path: "age"}); err != nil {
+			return err
+		}
+		if err := tx.CreateCompoundIndex("age", "user:*",
+			IndexField{Path: "age", Desc: true}); err != nil {
+			return err
+		}
+		if err := tx.CreateCompoundIndex("name", "user:*",
+			IndexField{Path: "name"}); err != nil {
+			return err
+		}
+		return tx.CreateCompoundIndexOptions("filtered", "*", &IndexOptions{
+			Filter: func(key, value string) bool { return true },
+		}, IndexField{Path: "admin"})
+	}); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct{ query, exp string }{
+		{"age >= 30 AND city = 'Oslo' ORDER BY name LIMIT 50",
+			"scan index \"city_age\" where city = \"Oslo\" AND age >= 30\n" +
+				"filter age >= 30 AND city = \"Oslo\"\nsort by name\nlimit 50"},
+		{"FROM user:* WHERE age > 30 AND age <= 50 ORDER BY age DESC",
+			"scan index \"age\" where age > 30 AND age <= 50\n" +
+				"filter age > 30 AND age <= 50"},
+		{"FROM user:* ORDER BY name",
+			"scan index \"name\""},
+		{"ORDER BY name",
+			"scan keys\nsort by name"},
+		{"FROM user:* WHERE age > 30 OR (city = 'Oslo' AND NOT admin = true)",
+			"scan keys matching \"user:*\"\n" +
+				"filter age > 30 OR city = \"Oslo\" AND NOT admin = true"},
+		{"admin = true", "scan keys\nfilter admin = true"},
+	}
+	if err := db.View(func(tx *Tx) error {
+		for _, test := range tests {
+			res, err := tx.Explain(test.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res != test.exp {
+				t.Fatalf("%v: expected '%v', got '%v'", test.query, test.exp, res)
+			}
+		}
+		// the range of a descending index.
+		exp := "user:4,user:0,user:1"
+		res := testQuery(t, tx, "FROM user:* WHERE age > 25 AND age < 50 "+
+			"AND city = 'oslo' ORDER BY age DESC")
+		if res != exp {
+			t.Fatalf("expected '%v', got '%v'", exp, res)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestQueryIndexJSON(t *testing.T) {
+	db := testQueryDB(t)
+	defer testClose(db)
+	queries := []string{
+		"FROM user:* WHERE age >= 30 AND age < 50 ORDER BY age",
+		"FROM user:* ORDER BY age DESC",
+		"FROM user:* WHERE age = 38",
+		"FROM user:* WHERE city = 'oslo' AND age > 30 ORDER BY age",
+	}
+	var exps []string
+	if err := db.View(func(tx *Tx) error {
+		for _, query := range queries {
+			exps = append(exps, testQuery(t, tx, query))
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// a persistent index with an IndexJSON function is used like a compound
+	// index with one field, but not the indexes with other less functions,
+	// or with less functions that don't record their path.
+	if err := db.Update(func(tx *Tx) error {
+		if err := tx.CreatePersistentIndex("age", "user:*", nil,
+			"IndexJSON:age"); err != nil {
+			return err
+		}
+		if err := tx.CreatePersistentIndex("int", "*", nil,
+			"IndexInt"); err != nil {
+			return err
+		}
+		if err := tx.CreatePersistentIndex("desc", "*", nil,
+			"Desc:IndexJSON:age"); err != nil {
+			return err
+		}
+		return tx.CreateIndex("city", "*", IndexJSON("city"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.View(func(tx *Tx) error {
+		for i, query := range queries {
+			if res := testQuery(t, tx, query); res != exps[i] {
+				t.Fatalf("%v: expected '%v', got '%v'", query, exps[i], res)
+			}
+		}
+		tests := []struct{ query, exp string }{
+			{"FROM user:* WHERE age >= 30 AND age < 50 ORDER BY age",
+				"scan index \"age\" where age >= 30 AND age < 50\n" +
+					"filter age >= 30 AND age < 50"},
+			{"FROM user:* ORDER BY age", "scan index \"age\""},
+			{"FROM user:* ORDER BY age DESC",
+				"scan keys matching \"user:*\"\nsort by age desc"},
+			{"WHERE age >= 30", "scan keys\nfilter age >= 30"},
+			{"WHERE city = 'oslo'", "scan keys\nfilter city = \"oslo\""},
+		}
+		for _, test := range tests {
+			res, err := tx.Explain(test.query)
+			if err != nil {
+				return err
+			}
+			if res != test.exp {
+				t.Fatalf("%v: expected '%v', got '%v'", test.query, test.exp, res)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
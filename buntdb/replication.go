@@ -0,0 +1,312 @@
+package buntdb
+
+import (
+	"io"
+	"time"
+
+	"github.com/tidwall/btree"
+)
+
+// The log offset is the position of a record in the history of the database.
+// It starts at zero and increases by the size of each record that is appended
+// to the append-only file. Unlike the file position, the log offset is not
+// changed by a shrink. The shrunk file contains a mark record, which holds the
+// log offset of the records that follow it.
+
+// logOffset returns the log offset of the end of the append-only file.
+// Must be called while holding a lock.
+func (db *DB) logOffset() int64 {
+	if db.aofsize < db.logpos {
+		// The file header has not been written yet.
+		return db.logstart
+	}
+	return db.logstart + db.aofsize - db.logpos
+}
+
+// LogOffset returns the log offset of the next record that will be appended
+// to the database file. A follower has the same log offset as the leader
+// after applying the same records, and it's used to resume a Stream.
+func (db *DB) LogOffset() (int64, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return 0, ErrDatabaseClosed
+	}
+	return db.logOffset(), nil
+}
+
+// Stream writes the committed records of the database file to a writer,
+// starting at the log offset. The writer is usually a network connection to
+// a follower, which passes the data to Follow. New records are written as
+// they're committed. This operation does not block the database, and it only
+// returns when the writer fails or the database is closed.
+//
+// When the offset is not available in the database file, such as when it was
+// removed by a shrink, a full copy of the database is written first.
+//
+// The database must persist to disk using the binary format, otherwise
+// ErrInvalidOperation is returned. A file in the legacy text format can be
+// converted by calling Shrink(). The records of an encrypted database file
+// are written as is, so the follower must use the same EncryptionKey. The
+// stream ends with ErrInvalidOperation when a Shrink encrypts the file.
+func (db *DB) Stream(w io.Writer, offset int64) error {
+	var f io.ReadCloser // the database file that is being read
+	var fgen int        // the generation of the database file, -1 when sealed
+	var fskip int64     // the bytes of f that are skipped prior to reading
+	defer func() {
+		if f != nil {
+			_ = f.Close()
+		}
+	}()
+	var buf []byte
+	var crypt *aofCipher // the cipher of the stream
+	for started := false; ; started = true {
+		var sdb *DB
+		var mark bool
+		db.mu.Lock()
+		for {
+			if db.closed {
+				db.mu.Unlock()
+				return ErrDatabaseClosed
+			}
+			if !db.persist || db.textaof ||
+				(started && db.aofcrypt != crypt) {
+				db.mu.Unlock()
+				return ErrInvalidOperation
+			}
+			if f == nil || fgen != db.aofgen || offset != db.logOffset() {
+				break
+			}
+			// wait for new records
+			db.logcond.Wait()
+		}
+		if !started {
+			crypt = db.aofcrypt
+			buf = crypt.appendHeader(buf)
+		}
+		if f == nil {
+			name, pos, _, active, ok := db.findLog(offset, crypt)
+			if !ok {
+				// The offset is not in the file. Send a full copy.
+				sdb = db.detach()
+				offset = db.logOffset()
+				name, pos, _, active, _ = db.findLog(offset, crypt)
+			}
+			var err error
+			f, err = db.fs.ReadAll(name)
+			if err != nil {
+				db.mu.Unlock()
+				return err
+			}
+			fgen, fskip = -1, pos
+			if active {
+				fgen = db.aofgen
+			}
+			mark = true
+		}
+		// The end is -1 when the file has been replaced by a shrink, or when
+		// it's a sealed segment, in which case the file is read to the end.
+		end := int64(-1)
+		if fgen == db.aofgen {
+			end = db.logOffset()
+		}
+		db.mu.Unlock()
+		if fskip > 0 && (end < 0 || end > offset) {
+			// The file is read from the position of the offset onward.
+			err := skipRead(f, fskip)
+			if err == io.ErrUnexpectedEOF && end < 0 {
+				// The file ended before the header was written.
+				err = nil
+			}
+			if err != nil {
+				return err
+			}
+			fskip = 0
+		}
+		if sdb != nil {
+			var err error
+			if buf, err = sdb.writeCopyTo(w, buf, crypt); err != nil {
+				return err
+			}
+		}
+		if mark {
+			// Let the follower know the log offset of the records.
+			mark := len(buf)
+			buf = writeMarkRecordTo(buf, offset)
+			buf = crypt.seal(buf, mark)
+			if _, err := w.Write(buf); err != nil {
+				return err
+			}
+			buf = buf[:0]
+		}
+		var n int64
+		var err error
+		if end < 0 {
+			n, err = io.Copy(w, f)
+		} else {
+			n, err = io.CopyN(w, f, end-offset)
+		}
+		offset += n
+		if err != nil {
+			return err
+		}
+		if end < 0 {
+			// The offset is now the end of the old file, which is also
+			// in the new file, unless another shrink happened.
+			_ = f.Close()
+			f = nil
+		}
+	}
+}
+
+// writeCopyTo writes a flush of all of the keyspaces followed by all of the
+// items to the writer. The records are encrypted with the cipher, unless it's
+// nil.
+func (db *DB) writeCopyTo(w io.Writer, buf []byte,
+	crypt *aofCipher) ([]byte, error) {
+	var err error
+	mark := len(buf)
+	buf = crypt.seal(writeFlushRecordTo(buf, true), mark)
+	for _, kdb := range db.spaceDBs() {
+		mark := len(buf)
+		buf = crypt.seal(kdb.writeIndexesTo(buf), mark)
+		kdb.keys.Ascend(func(item btree.Item) bool {
+			mark := len(buf)
+			buf = item.(*dbItem).writeSetRecordTo(buf, db.opts.Compression)
+			buf = wrapKeyspace(buf, mark, kdb.space)
+			buf = crypt.seal(buf, mark)
+			if len(buf) > 1024*1024*4 {
+				// flush when buffer is over 4MB
+				if _, err = w.Write(buf); err != nil {
+					return false
+				}
+				buf = buf[:0]
+			}
+			return true
+		})
+		if err != nil {
+			break
+		}
+	}
+	return buf, err
+}
+
+// Follow reads the records that are written by a leader's Stream and applies
+// them to the database, in the same way that the database file is loaded.
+// The records are also appended to the database file, which makes it
+// possible to resume following from the LogOffset after a restart.
+//
+// Calling Follow turns the database into a follower, and read/write
+// transactions return ErrFollower from then on. Expired items are only
+// removed when the leader sends the deletes.
+//
+// Returns nil when the reader ends, or an error when the reader fails, the
+// records are invalid, or the database is closed. The records of an
+// encrypted leader are decrypted with the EncryptionKey option, and
+// ErrInvalidOperation is returned when the leader's database file and the
+// database file are not both encrypted, or both not encrypted.
+func (db *DB) Follow(rd io.Reader) error {
+	db.mu.Lock()
+	if db.closed {
+		db.mu.Unlock()
+		return ErrDatabaseClosed
+	}
+	if db.persist && db.textaof {
+		db.mu.Unlock()
+		return ErrInvalidOperation
+	}
+	db.follower = true
+	crypt := db.aofcrypt
+	db.mu.Unlock()
+	ar, err := db.newLogReader(rd, crypt)
+	if err != nil {
+		if err == io.EOF {
+			return nil
+		}
+		return err
+	}
+	var cmd aofCommand
+	for {
+		if err := ar.next(&cmd); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if err := db.follow(&cmd); err != nil {
+			return err
+		}
+	}
+}
+
+// follow appends a single command from a leader to the database file and
+// applies it to the database.
+func (db *DB) follow(cmd *aofCommand) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return ErrDatabaseClosed
+	}
+	return db.appendCommand(cmd)
+}
+
+// appendCommand appends a command from another database to the database file
+// and applies it to the database. Must be called while holding the write
+// lock.
+func (db *DB) appendCommand(cmd *aofCommand) error {
+	if cmd.typ == recMark && cmd.off == db.logOffset() {
+		// The database is already at the offset.
+		return nil
+	}
+	db.buf = db.buf[:0]
+	if db.persist && !db.aofhdr {
+		// The first write to an empty file includes the header.
+		db.buf = db.aofcrypt.appendHeader(db.buf)
+	}
+	mark := len(db.buf)
+	db.buf = db.aofcrypt.seal(cmd.writeRecordTo(db.buf), mark)
+	if db.persist {
+		n, err := db.file.Write(db.buf)
+		if err != nil {
+			if n > 0 {
+				_ = db.file.Truncate(db.aofsize)
+			}
+			return err
+		}
+		if db.config.SyncPolicy == Always {
+			_ = db.file.Sync()
+		}
+		db.aofhdr = true
+		db.flushes++
+	}
+	// An in-memory database only keeps track of the size.
+	db.aofsize += int64(len(db.buf))
+	if cmd.typ == recMark {
+		db.logstart, db.logpos = cmd.off, db.aofsize
+	}
+	if db.persist {
+		db.rotateSegment()
+	}
+	err := db.applyCommand(cmd)
+	db.logcond.Broadcast()
+	return err
+}
+
+// newLogReader returns a reader for the records that were written by Stream
+// or Backup, after reading the header. The records must be encrypted with
+// the cipher, or not encrypted when the cipher is nil, which keeps the log
+// offsets the same as those of the database that wrote them.
+func (db *DB) newLogReader(rd io.Reader, crypt *aofCipher) (*aofReader, error) {
+	ar := newAOFReader(rd, time.Now())
+	if ar.text {
+		return nil, ErrInvalid
+	}
+	ar.cipher = db.crypt
+	if err := ar.readHeader(); err != nil {
+		return nil, err
+	}
+	if ar.enc != (crypt != nil) {
+		return nil, ErrInvalidOperation
+	}
+	return ar, nil
+}
@@ -0,0 +1,246 @@
+package buntdb
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testDump(t *testing.T, db *DB) string {
+	var items []string
+	if err := db.View(func(tx *Tx) error {
+		return tx.Ascend("", func(key, value string) bool {
+			items = append(items, key+"="+value)
+			return true
+		})
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return strings.Join(items, ",")
+}
+
+func testWaitFollower(t *testing.T, leader, follower *DB) {
+	off, err := leader.LogOffset()
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	for {
+		foff, err := follower.LogOffset()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if foff == off {
+			break
+		}
+		if time.Since(start) > time.Second*5 {
+			t.Fatalf("expected '%v', got '%v'", off, foff)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if exp, res := testDump(t, leader), testDump(t, follower); exp != res {
+		t.Fatalf("expected '%v', got '%v'", exp, res)
+	}
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	atomic.AddInt64(&w.n, int64(n))
+	return n, err
+}
+
+func TestReplication(t *testing.T) {
+	leader := testOpen(t)
+	defer testClose(leader)
+	follower, _ := Open(":memory:")
+	defer follower.Close()
+	testFillAOF(t, leader, 10)
+
+	pr, pw := io.Pipe()
+	serrc := make(chan error, 1)
+	ferrc := make(chan error, 1)
+	go func() { serrc <- leader.Stream(pw, 0) }()
+	go func() { ferrc <- follower.Follow(pr) }()
+	testWaitFollower(t, leader, follower)
+
+	if err := follower.Update(func(tx *Tx) error {
+		return nil
+	}); err != ErrFollower {
+		t.Fatalf("expected '%v', got '%v'", ErrFollower, err)
+	}
+	// deletes, expirations, and a delete all.
+	if err := leader.Update(func(tx *Tx) error {
+		tx.Delete("key:1")
+		_, _, err := tx.Set("exp", "val", &SetOptions{Expires: true, TTL: time.Hour})
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	testWaitFollower(t, leader, follower)
+	if err := follower.View(func(tx *Tx) error {
+		ttl, err := tx.TTL("exp")
+		if err != nil {
+			return err
+		}
+		if ttl < time.Hour-time.Minute || ttl > time.Hour {
+			t.Fatalf("invalid ttl: %v", ttl)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := leader.Update(func(tx *Tx) error {
+		if err := tx.DeleteAll(); err != nil {
+			return err
+		}
+		_, _, err := tx.Set("hello", "world", nil)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	testWaitFollower(t, leader, follower)
+
+	// the stream continues beyond a shrink.
+	testFillAOF(t, leader, 20)
+	if err := leader.Shrink(); err != nil {
+		t.Fatal(err)
+	}
+	testFillAOF(t, leader, 5)
+	testWaitFollower(t, leader, follower)
+
+	// disconnect the follower and resume from its offset.
+	pr.Close()
+	if err := <-ferrc; err != io.ErrClosedPipe {
+		t.Fatalf("expected '%v', got '%v'", io.ErrClosedPipe, err)
+	}
+	testFillAOF(t, leader, 3)
+	if err := <-serrc; err != io.ErrClosedPipe {
+		t.Fatalf("expected '%v', got '%v'", io.ErrClosedPipe, err)
+	}
+	off, err := follower.LogOffset()
+	if err != nil {
+		t.Fatal(err)
+	}
+	loff, err := leader.LogOffset()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pr, pw = io.Pipe()
+	cw := &countWriter{w: pw}
+	go func() { serrc <- leader.Stream(cw, off) }()
+	go func() { ferrc <- follower.Follow(pr) }()
+	testWaitFollower(t, leader, follower)
+	// only the missing records are sent.
+	exp := int64(len(aofMagic)+len(writeMarkRecordTo(nil, off))) + loff - off
+	if n := atomic.LoadInt64(&cw.n); n != exp {
+		t.Fatalf("expected '%v', got '%v'", exp, n)
+	}
+
+	// closing the leader ends the stream.
+	leader.Close()
+	if err := <-serrc; err != ErrDatabaseClosed {
+		t.Fatalf("expected '%v', got '%v'", ErrDatabaseClosed, err)
+	}
+	pw.Close()
+	if err := <-ferrc; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReplicationFullCopy(t *testing.T) {
+	leader := testOpen(t)
+	defer testClose(leader)
+	if err := os.RemoveAll("follower.db"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll("follower.db")
+	follower, err := Open("follower.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { follower.Close() }()
+	if err := follower.Update(func(tx *Tx) error {
+		if err := tx.CreateIndex("val", "*", IndexString); err != nil {
+			return err
+		}
+		_, _, err := tx.Set("stale", "val", nil)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	testFillAOF(t, leader, 10)
+	if err := leader.Shrink(); err != nil {
+		t.Fatal(err)
+	}
+	// the start of the log is no longer in the leader's file.
+	pr, pw := io.Pipe()
+	serrc := make(chan error, 1)
+	ferrc := make(chan error, 1)
+	go func() { serrc <- leader.Stream(pw, 0) }()
+	go func() { ferrc <- follower.Follow(pr) }()
+	testWaitFollower(t, leader, follower)
+	testFillAOF(t, leader, 15)
+	testWaitFollower(t, leader, follower)
+	// the index of the follower is kept.
+	var n int
+	if err := follower.View(func(tx *Tx) error {
+		return tx.Ascend("val", func(key, value string) bool {
+			n++
+			return true
+		})
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if n != 15 {
+		t.Fatalf("expected '%v', got '%v'", 15, n)
+	}
+	pr.Close()
+	<-ferrc
+
+	// the follower keeps its offset after a restart.
+	off, err := follower.LogOffset()
+	if err != nil {
+		t.Fatal(err)
+	}
+	follower.Close()
+	follower, err = Open("follower.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	off2, err := follower.LogOffset()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if off != off2 {
+		t.Fatalf("expected '%v', got '%v'", off, off2)
+	}
+	if exp, res := testDump(t, leader), testDump(t, follower); exp != res {
+		t.Fatalf("expected '%v', got '%v'", exp, res)
+	}
+	testFillAOF(t, leader, 20)
+	<-serrc
+}
+
+func TestReplicationInvalid(t *testing.T) {
+	db, _ := Open(":memory:")
+	defer db.Close()
+	if err := db.Stream(ioutil.Discard, 0); err != ErrInvalidOperation {
+		t.Fatalf("expected '%v', got '%v'", ErrInvalidOperation, err)
+	}
+	err := db.Follow(strings.NewReader("*1\r\n$7\r\nflushdb\r\n"))
+	if err != ErrInvalid {
+		t.Fatalf("expected '%v', got '%v'", ErrInvalid, err)
+	}
+	if err := db.Follow(strings.NewReader(aofMagic)); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,563 @@
+package buntdb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// A segmented database file splits the append-only file into segments. The
+// segments are listed in order by a manifest, which is a file that is named
+// after the database file with a ".manifest" suffix. Each segment is a file
+// in the binary format, with its own header, and it's named after the
+// database file with its sequence number as the suffix. The first segment of
+// a database file that was converted to segments is the database file itself,
+// with sequence number zero.
+//
+// New records are appended to the last segment, which is the active segment.
+// When it reaches the SegmentSize it's sealed, and a new active segment is
+// started. A sealed segment is not changed again. Shrink compacts the sealed
+// segments by writing all of the items to new segments, and then replacing
+// the sealed segments in the manifest, which leaves the active segment as is.
+//
+// The manifest is the magic header followed by a single record, which has the
+// sequence number of the next segment and the sequence number and log offset
+// of each segment. The manifest is replaced atomically by writing a new file
+// and renaming it.
+const manifestMagic = "buntdb\x00m"
+
+// recManifest is the record type of the manifest.
+const recManifest = 'm'
+
+// defaultSegmentSize is the segment size of a segmented database file that is
+// opened without the SegmentSize option.
+const defaultSegmentSize = 64 * 1024 * 1024
+
+// segment is a file of a segmented database file. The active segment uses the
+// logstart, logpos, aofsize, and aofcrypt fields of the database instead.
+type segment struct {
+	seq   int        // the sequence number, which names the file
+	start int64      // the log offset at pos, -1 for a compacted segment
+	pos   int64      // the file position of start
+	size  int64      // the size of the file
+	crypt *aofCipher // the cipher of the file, nil when not encrypted
+}
+
+// segName returns the file name of the segment.
+func (db *DB) segName(seq int) string {
+	if seq == 0 {
+		return db.path
+	}
+	return fmt.Sprintf("%s.%08d", db.path, seq)
+}
+
+// manifestName returns the file name of the manifest.
+func (db *DB) manifestName() string {
+	return db.path + ".manifest"
+}
+
+// readManifest reads the segments from the manifest. Returns nil segments
+// when there is no manifest.
+func (db *DB) readManifest() ([]segment, int, error) {
+	rd, err := db.fs.ReadAll(db.manifestName())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, 0, nil
+		}
+		return nil, 0, err
+	}
+	defer rd.Close()
+	data, err := ioutil.ReadAll(rd)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(data) < len(manifestMagic)+recordHeaderSize ||
+		string(data[:len(manifestMagic)]) != manifestMagic {
+		return nil, 0, ErrInvalid
+	}
+	data = data[len(manifestMagic):]
+	payload := data[recordHeaderSize:]
+	if int(binary.LittleEndian.Uint32(data)) != len(payload) ||
+		crc32.Checksum(payload, crcTable) != binary.LittleEndian.Uint32(data[4:]) {
+		return nil, 0, ErrCorrupted
+	}
+	if len(payload) == 0 || payload[0] != recManifest {
+		return nil, 0, ErrInvalid
+	}
+	p := payload[1:]
+	var next, n uint64
+	if next, p, err = readUvarint(p); err != nil {
+		return nil, 0, err
+	}
+	if n, p, err = readUvarint(p); err != nil {
+		return nil, 0, err
+	}
+	if n == 0 || n > uint64(len(p)) {
+		return nil, 0, ErrInvalid
+	}
+	segs := make([]segment, n)
+	for i := range segs {
+		var seq uint64
+		if seq, p, err = readUvarint(p); err != nil {
+			return nil, 0, err
+		}
+		if segs[i].start, p, err = readVarint(p); err != nil {
+			return nil, 0, err
+		}
+		segs[i].seq = int(seq)
+	}
+	if len(p) != 0 {
+		return nil, 0, ErrInvalid
+	}
+	return segs, int(next), nil
+}
+
+// writeManifest atomically replaces the manifest.
+func (db *DB) writeManifest(segs []segment, next int) error {
+	buf := append([]byte(nil), manifestMagic...)
+	buf, mark := beginRecord(buf, recManifest)
+	buf = appendUvarint(buf, uint64(next))
+	buf = appendUvarint(buf, uint64(len(segs)))
+	for _, seg := range segs {
+		buf = appendUvarint(buf, uint64(seg.seq))
+		buf = appendVarint(buf, seg.start)
+	}
+	buf = endRecord(buf, mark)
+	tmpname := db.manifestName() + ".tmp"
+	if err := db.fs.Remove(tmpname); err != nil {
+		return err
+	}
+	f, err := db.fs.OpenFile(tmpname)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(buf)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = db.fs.Rename(tmpname, db.manifestName())
+	}
+	if err != nil {
+		_ = db.fs.Remove(tmpname)
+	}
+	return err
+}
+
+// openSegments opens a segmented database file and loads it. A database file
+// that is not segmented is converted, which makes it the first segment.
+func (db *DB) openSegments(segs []segment, next int) error {
+	if db.opts.SegmentSize <= 0 {
+		db.opts.SegmentSize = defaultSegmentSize
+	}
+	if segs == nil {
+		rd, err := db.fs.ReadAll(db.path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err == nil {
+			ar := newAOFReader(rd, time.Now())
+			_ = rd.Close()
+			if ar.text {
+				// Shrink converts the file to the binary format first.
+				return ErrInvalidOperation
+			}
+		}
+		segs, next = []segment{{seq: 0, start: 0}}, 1
+		if err := db.writeManifest(segs, next); err != nil {
+			return err
+		}
+	}
+	db.segs, db.segseq = segs, next
+	for i := range db.segs {
+		seg := &db.segs[i]
+		last := i == len(db.segs)-1
+		rd, err := db.fs.ReadAll(db.segName(seg.seq))
+		if err != nil {
+			if last && os.IsNotExist(err) {
+				// A new segment that was never written to.
+				continue
+			}
+			return err
+		}
+		ar := newAOFReader(rd, time.Now())
+		ar.cipher = db.crypt
+		if ar.text {
+			_ = rd.Close()
+			return ErrInvalid
+		}
+		db.logstart, db.logpos = seg.start, 0
+		err = db.readAOF(ar)
+		_ = rd.Close()
+		if err != nil {
+			// Only the end of the active segment can be cut off.
+			if !last || db.opts.StrictLoad ||
+				(err != io.ErrUnexpectedEOF && err != ErrCorrupted) {
+				return err
+			}
+			tail, err := db.damagedTail(db.segName(seg.seq), ar.n)
+			if err != nil {
+				return err
+			}
+			if !tail {
+				return ErrCorrupted
+			}
+		}
+		if ar.enc {
+			seg.crypt = db.crypt
+		}
+		if db.logpos == 0 && ar.n > 0 {
+			// There was no mark. The records start after the header.
+			db.logpos = int64(seg.crypt.headerSize())
+		}
+		seg.start, seg.pos, seg.size = db.logstart, db.logpos, ar.n
+	}
+	// The active segment is the last one.
+	act := db.segs[len(db.segs)-1]
+	var err error
+	if db.file, err = db.fs.OpenFile(db.segName(act.seq)); err != nil {
+		return err
+	}
+	size, err := db.file.Size()
+	if err != nil {
+		return err
+	}
+	if size > act.size {
+		// Cut off the damaged records at the end.
+		if err := db.file.Truncate(act.size); err != nil {
+			return err
+		}
+	}
+	db.aofsize = act.size
+	db.aofhdr = act.size > 0
+	db.aofcrypt = db.crypt
+	if db.aofhdr {
+		// A segment that is not encrypted stays that way until it's sealed.
+		db.aofcrypt = act.crypt
+	}
+	db.logstart, db.logpos = act.start, act.pos
+	if !db.aofhdr {
+		db.logpos = int64(db.aofcrypt.headerSize())
+	}
+	db.lastaofsz = int(db.fileSize())
+	return nil
+}
+
+// fileSize returns the size of the database file, which is the size of all
+// of the segments of a segmented database file. Must be called while holding
+// a lock.
+func (db *DB) fileSize() int64 {
+	size := db.aofsize
+	if len(db.segs) > 0 {
+		for _, seg := range db.segs[:len(db.segs)-1] {
+			size += seg.size
+		}
+	}
+	return size
+}
+
+// rotateSegment seals the active segment when it has reached the segment
+// size. A segment that failed to be sealed is sealed after the next write.
+// Must be called while holding the write lock, after writing to the file,
+// and before a group commit syncs the file.
+func (db *DB) rotateSegment() {
+	if db.segs != nil && db.aofsize >= int64(db.opts.SegmentSize) {
+		_ = db.sealSegment()
+	}
+}
+
+// sealSegment seals the active segment and starts a new active segment.
+// Must be called while holding the write lock, and not while a group commit
+// syncs the file.
+func (db *DB) sealSegment() error {
+	// The records of a sealed segment must be on disk before the records of
+	// the new segment.
+	if err := db.file.Sync(); err != nil {
+		return err
+	}
+	seq := db.segseq
+	name := db.segName(seq)
+	// A failed seal may have left the file.
+	if err := db.fs.Remove(name); err != nil {
+		return err
+	}
+	f, err := db.fs.OpenFile(name)
+	if err != nil {
+		return err
+	}
+	hdr := db.crypt.appendHeader(nil)
+	if _, err = f.Write(hdr); err == nil {
+		err = f.Sync()
+	}
+	start := db.logOffset()
+	segs := append(db.segs[:len(db.segs):len(db.segs)], segment{
+		seq: seq, start: start,
+	})
+	segs[len(segs)-2] = segment{
+		seq:   segs[len(segs)-2].seq,
+		start: db.logstart,
+		pos:   db.logpos,
+		size:  db.aofsize,
+		crypt: db.aofcrypt,
+	}
+	if err == nil {
+		err = db.writeManifest(segs, seq+1)
+	}
+	if err != nil {
+		_ = f.Close()
+		_ = db.fs.Remove(name)
+		return err
+	}
+	_ = db.file.Close()
+	db.file, db.segs, db.segseq = f, segs, seq+1
+	db.aofsize, db.aofhdr, db.aofcrypt = int64(len(hdr)), true, db.crypt
+	db.logstart, db.logpos = start, int64(len(hdr))
+	// The streams read the sealed segment to the end.
+	db.aofgen++
+	db.logcond.Broadcast()
+	return nil
+}
+
+// compactSegments is the Shrink of a segmented database file. The active
+// segment is sealed, and all of the items are written to new segments, which
+// replace the sealed segments. The records that are appended in the meantime
+// go to the new active segment, which is kept, so writes are not blocked.
+// Must be called while holding the write lock, which is released.
+func (db *DB) compactSegments() error {
+	// The group commit that is being synced uses the file.
+	db.waitSync()
+	if db.closed {
+		db.mu.Unlock()
+		return ErrDatabaseClosed
+	}
+	if db.aofsize > db.logpos {
+		// The active segment has records.
+		if err := db.sealSegment(); err != nil {
+			db.mu.Unlock()
+			return err
+		}
+	}
+	n := len(db.segs) - 1
+	if n == 0 {
+		db.mu.Unlock()
+		return nil
+	}
+	old := append([]segment(nil), db.segs[:n]...)
+	crypt := db.crypt
+	segsize := int64(db.opts.SegmentSize)
+	compress := db.opts.Compression
+	cur := db.newItemCursor()
+	db.mu.Unlock()
+	var segs []segment
+	var f StorageFile
+	var w *aofWriter
+	done := false
+	defer func() {
+		if f != nil {
+			_ = f.Close()
+		}
+		if !done {
+			for _, seg := range segs {
+				_ = db.fs.Remove(db.segName(seg.seq))
+			}
+		}
+	}()
+	// closeSegment syncs and closes the segment that is being written.
+	closeSegment := func() error {
+		if f == nil {
+			return nil
+		}
+		err := f.Sync()
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		f = nil
+		return err
+	}
+	var buf []byte
+	for more := true; more; {
+		if f == nil || w.n >= segsize {
+			if err := closeSegment(); err != nil {
+				return err
+			}
+			db.mu.Lock()
+			seq := db.segseq
+			db.segseq++
+			db.mu.Unlock()
+			name := db.segName(seq)
+			if err := db.fs.Remove(name); err != nil {
+				return err
+			}
+			var err error
+			if f, err = db.fs.OpenFile(name); err != nil {
+				return err
+			}
+			w = &aofWriter{w: f, crypt: crypt}
+			segs = append(segs, segment{seq: seq, start: -1, crypt: crypt})
+		}
+		// The items are read in chunks, which does not hold up the database
+		// for too long.
+		err := func() error {
+			db.mu.RLock()
+			defer db.mu.RUnlock()
+			if db.closed {
+				return ErrDatabaseClosed
+			}
+			buf, more = cur.next(db, buf, compress)
+			return nil
+		}()
+		if err != nil {
+			return err
+		}
+		buf = crypt.seal(buf, 0)
+		if len(buf) > 0 {
+			if _, err := w.Write(buf); err != nil {
+				return err
+			}
+			buf = buf[:0]
+		}
+		segs[len(segs)-1].size = w.n
+	}
+	if err := closeSegment(); err != nil {
+		return err
+	}
+	if last := segs[len(segs)-1]; last.size == 0 {
+		// There were no more items.
+		_ = db.fs.Remove(db.segName(last.seq))
+		segs = segs[:len(segs)-1]
+	}
+	if err := func() error {
+		db.mu.Lock()
+		defer db.mu.Unlock()
+		if db.closed {
+			return ErrDatabaseClosed
+		}
+		// The segments that were started in the meantime are kept.
+		segs = append(segs, db.segs[n:]...)
+		if err := db.writeManifest(segs, db.segseq); err != nil {
+			return err
+		}
+		done = true
+		db.segs = segs
+		db.lastaofsz = int(db.fileSize())
+		db.shrinkat = time.Now()
+		return nil
+	}(); err != nil {
+		return err
+	}
+	// The streams and backups that read the old segments keep reading them.
+	for _, seg := range old {
+		_ = db.fs.Remove(db.segName(seg.seq))
+	}
+	return nil
+}
+
+// findLog returns the name of the file that has the log offset, the file
+// position of the offset, and the log offset of the end of the file. The
+// active file is the one that's appended to. Returns false when the offset
+// is not in the database file, or when the file is not encrypted with the
+// cipher. Must be called while holding a lock.
+func (db *DB) findLog(offset int64, crypt *aofCipher) (name string,
+	pos, end int64, active, ok bool) {
+	name, start, pos, end, fcrypt := db.path, db.logstart, db.logpos,
+		db.logOffset(), db.aofcrypt
+	if len(db.segs) > 0 {
+		name = db.segName(db.segs[len(db.segs)-1].seq)
+	}
+	active = true
+	// The files are searched from the newest to the oldest.
+	for i := len(db.segs) - 2; ; i-- {
+		if start >= 0 && offset >= start && offset <= end {
+			if fcrypt != crypt {
+				return "", 0, 0, false, false
+			}
+			return name, pos + offset - start, end, active, true
+		}
+		if i < 0 {
+			return "", 0, 0, false, false
+		}
+		seg := db.segs[i]
+		name, start, pos, fcrypt = db.segName(seg.seq), seg.start, seg.pos,
+			seg.crypt
+		end = start + seg.size - pos
+		active = false
+	}
+}
+
+// readLog returns a reader of the records from the log offset to the end log
+// offset, which may be in more than one file. The files are opened right
+// away, which keeps the records when a shrink removes the files. Returns nil
+// when the records are not all in the database file with the same cipher.
+// Must be called while holding a lock.
+func (db *DB) readLog(offset, end int64, crypt *aofCipher) (io.ReadCloser,
+	error) {
+	var rds []io.Reader
+	var files multiCloser
+	for first := true; first || offset < end; first = false {
+		name, pos, fend, _, ok := db.findLog(offset, crypt)
+		if !ok || (fend == offset && offset < end) {
+			files.Close()
+			return nil, nil
+		}
+		f, err := db.fs.ReadAll(name)
+		if err != nil {
+			files.Close()
+			return nil, err
+		}
+		files = append(files, f)
+		if fend > end {
+			fend = end
+		}
+		rds = append(rds, &skipReader{r: f, skip: pos, n: fend - offset})
+		offset = fend
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(rds...), files}, nil
+}
+
+// multiCloser closes all of the files.
+type multiCloser []io.ReadCloser
+
+func (files multiCloser) Close() error {
+	for _, f := range files {
+		_ = f.Close()
+	}
+	return nil
+}
+
+// skipReader reads n bytes, after skipping the first bytes of the reader.
+type skipReader struct {
+	r    io.Reader
+	skip int64
+	n    int64
+}
+
+func (r *skipReader) Read(p []byte) (int, error) {
+	if r.n <= 0 {
+		return 0, io.EOF
+	}
+	if r.skip > 0 {
+		if err := skipRead(r.r, r.skip); err != nil {
+			return 0, err
+		}
+		r.skip = 0
+	}
+	if int64(len(p)) > r.n {
+		p = p[:r.n]
+	}
+	n, err := r.r.Read(p)
+	r.n -= int64(n)
+	if err == io.EOF && r.n > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
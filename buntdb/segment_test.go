@@ -0,0 +1,287 @@
+package buntdb
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func (s *memStorage) names() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var names []string
+	for name := range s.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+func (s *memStorage) size(name string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.files[name].data)
+}
+
+func testOpenSegments(t *testing.T, s Storage, size int) *DB {
+	db, err := OpenWithOptions("data.db", &Options{Storage: s, SegmentSize: size})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestSegments(t *testing.T) {
+	s := newMemStorage()
+	db := testOpenSegments(t, s, 256)
+	defer db.Close()
+	testFillAOF(t, db, 50)
+	// the transactions are small, so the sealed segments are about the same
+	// size.
+	if len(db.segs) < 4 {
+		t.Fatalf("expected more segments, got %d", len(db.segs))
+	}
+	for _, seg := range db.segs[:len(db.segs)-1] {
+		if size := s.size(db.segName(seg.seq)); size < 256 || size > 256+64 {
+			t.Fatalf("expected a segment of about 256 bytes, got %d", size)
+		}
+	}
+	if err := db.Update(func(tx *Tx) error {
+		for i := 0; i < 40; i++ {
+			if _, err := tx.Delete(fmt.Sprintf("key:%d", i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	exp := testDump(t, db)
+	expoff, _ := db.LogOffset()
+	db.Close()
+	// the segments are kept without the option.
+	db = testOpenStorage(t, s)
+	defer db.Close()
+	if res := testDump(t, db); res != exp {
+		t.Fatalf("expected '%v', got '%v'", exp, res)
+	}
+	if res, _ := db.LogOffset(); res != expoff {
+		t.Fatalf("expected '%v', got '%v'", expoff, res)
+	}
+	if db.opts.SegmentSize != defaultSegmentSize {
+		t.Fatalf("expected '%v', got '%v'", defaultSegmentSize, db.opts.SegmentSize)
+	}
+}
+
+func TestSegmentsCompact(t *testing.T) {
+	s := newMemStorage()
+	db := testOpenSegments(t, s, 512)
+	defer db.Close()
+	for i := 0; i < 20; i++ {
+		testFillAOF(t, db, 20)
+	}
+	size := db.fileSize()
+	// the writes that happen during the compaction are kept.
+	done := make(chan error)
+	go func() {
+		for i := 0; i < 20; i++ {
+			if err := db.Update(func(tx *Tx) error {
+				_, _, err := tx.Set(fmt.Sprintf("new:%d", i), "val", nil)
+				return err
+			}); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	if err := db.Shrink(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if res := db.fileSize(); res >= size/4 {
+		t.Fatalf("expected a smaller file, got %d of %d bytes", res, size)
+	}
+	// the old segments were removed, which includes the database file.
+	var exp []string
+	for _, seg := range db.segs {
+		if seg.seq == 0 {
+			t.Fatal("expected the first segment to be compacted")
+		}
+		exp = append(exp, db.segName(seg.seq))
+	}
+	exp = append(exp, "data.db.manifest")
+	sort.Strings(exp)
+	if res := s.names(); res != strings.Join(exp, ",") {
+		t.Fatalf("expected '%v', got '%v'", strings.Join(exp, ","), res)
+	}
+	expdump := testDump(t, db)
+	expoff, _ := db.LogOffset()
+	db.Close()
+	db = testOpenSegments(t, s, 512)
+	defer db.Close()
+	if res := testDump(t, db); res != expdump {
+		t.Fatalf("expected '%v', got '%v'", expdump, res)
+	}
+	if res, _ := db.LogOffset(); res != expoff {
+		t.Fatalf("expected '%v', got '%v'", expoff, res)
+	}
+	if n := testCountItems(t, db); n != 40 {
+		t.Fatalf("expected '%v', got '%v'", 40, n)
+	}
+}
+
+func TestSegmentsConvert(t *testing.T) {
+	s := newMemStorage()
+	db := testOpenStorage(t, s)
+	defer db.Close()
+	testFillAOF(t, db, 10)
+	if err := db.Shrink(); err != nil {
+		t.Fatal(err)
+	}
+	testFillAOF(t, db, 20)
+	exp := testDump(t, db)
+	expoff, _ := db.LogOffset()
+	db.Close()
+	// the database file becomes the first segment.
+	db = testOpenSegments(t, s, 256)
+	defer db.Close()
+	if res := s.names(); res != "data.db,data.db.manifest" {
+		t.Fatalf("expected '%v', got '%v'", "data.db,data.db.manifest", res)
+	}
+	if res := testDump(t, db); res != exp {
+		t.Fatalf("expected '%v', got '%v'", exp, res)
+	}
+	if res, _ := db.LogOffset(); res != expoff {
+		t.Fatalf("expected '%v', got '%v'", expoff, res)
+	}
+	testFillAOF(t, db, 30)
+	if len(db.segs) < 2 {
+		t.Fatal("expected a new segment")
+	}
+	exp = testDump(t, db)
+	db.Close()
+	db = testOpenStorage(t, s)
+	defer db.Close()
+	if res := testDump(t, db); res != exp {
+		t.Fatalf("expected '%v', got '%v'", exp, res)
+	}
+}
+
+func TestSegmentsTornTail(t *testing.T) {
+	s := newMemStorage()
+	db := testOpenSegments(t, s, 256)
+	defer db.Close()
+	testFillAOF(t, db, 20)
+	act := db.segName(db.segs[len(db.segs)-1].seq)
+	sealed := db.segName(db.segs[len(db.segs)-2].seq)
+	db.Close()
+	// the end of the active segment is cut off.
+	s.files[act].data = s.files[act].data[:len(s.files[act].data)-3]
+	db = testOpenSegments(t, s, 256)
+	if n := testCountItems(t, db); n != 19 {
+		t.Fatalf("expected '%v', got '%v'", 19, n)
+	}
+	db.Close()
+	// a damaged record that is followed by valid records is not.
+	data := append([]byte(nil), s.files[act].data...)
+	s.files[act].data[len(aofMagic)+recordHeaderSize+2]++
+	if _, err := OpenWithOptions("data.db", &Options{Storage: s}); err != ErrCorrupted {
+		t.Fatalf("expected '%v', got '%v'", ErrCorrupted, err)
+	}
+	s.files[act].data = data
+	// a sealed segment is not.
+	s.files[sealed].data = s.files[sealed].data[:len(s.files[sealed].data)-3]
+	if _, err := OpenWithOptions("data.db", &Options{Storage: s}); err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected '%v', got '%v'", io.ErrUnexpectedEOF, err)
+	}
+}
+
+func TestSegmentsReplication(t *testing.T) {
+	s := newMemStorage()
+	leader := testOpenSegments(t, s, 256)
+	defer leader.Close()
+	testFillAOF(t, leader, 20)
+	// an incremental backup and a stream read from more than one segment.
+	var full, inc bytes.Buffer
+	off, err := leader.Backup(&full, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	follower, _ := Open(":memory:")
+	defer follower.Close()
+	pr, pw := io.Pipe()
+	go func() { leader.Stream(pw, 0) }()
+	go func() { follower.Follow(pr) }()
+	testWaitFollower(t, leader, follower)
+	testFillAOF(t, leader, 40)
+	if _, err := leader.Backup(&inc, off); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(inc.String(), "key:1\x03") {
+		t.Fatal("expected an incremental backup")
+	}
+	testWaitFollower(t, leader, follower)
+	// the stream continues after the sealed segments are compacted.
+	if err := leader.Shrink(); err != nil {
+		t.Fatal(err)
+	}
+	testFillAOF(t, leader, 50)
+	testWaitFollower(t, leader, follower)
+	mdb, _ := Open(":memory:")
+	defer mdb.Close()
+	if err := mdb.Restore(&full, &inc); err != nil {
+		t.Fatal(err)
+	}
+	if n := testCountItems(t, mdb); n != 40 {
+		t.Fatalf("expected '%v', got '%v'", 40, n)
+	}
+	// an offset that was compacted gets a full copy.
+	follower2, _ := Open(":memory:")
+	defer follower2.Close()
+	pr2, pw2 := io.Pipe()
+	go func() { leader.Stream(pw2, off) }()
+	go func() { follower2.Follow(pr2) }()
+	testWaitFollower(t, leader, follower2)
+	leader.Close()
+	pr.Close()
+	pr2.Close()
+}
+
+func TestSegmentsFiles(t *testing.T) {
+	clean := func() {
+		names, _ := filepath.Glob("data.db*")
+		for _, name := range names {
+			os.RemoveAll(name)
+		}
+	}
+	clean()
+	defer clean()
+	db, err := OpenWithOptions("data.db", &Options{SegmentSize: 256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	testFillAOF(t, db, 20)
+	if err := db.Shrink(); err != nil {
+		t.Fatal(err)
+	}
+	testFillAOF(t, db, 30)
+	exp := testDump(t, db)
+	db.Close()
+	db, err = Open("data.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if res := testDump(t, db); res != exp {
+		t.Fatalf("expected '%v', got '%v'", exp, res)
+	}
+}
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// The limits of a command that is read from a client. The memory for a
+// command is allocated as its data arrives, up to the limits, and not by the
+// sizes in its headers.
+const (
+	maxArgs     = 1024 * 1024
+	maxBulkSize = 512 * 1024 * 1024
+	minArgs     = 16 // the initial capacity of the arguments
+)
+
+// errProtocol is returned when a client sends data that is not a valid
+// command. The connection is closed after the error is sent.
+var errProtocol = errors.New("Protocol error")
+
+// readCommand reads the next command from a client. A command is either a
+// RESP array of bulk strings, which is what Redis clients send, or an inline
+// command, which is a line of arguments that are separated by spaces. An
+// empty command is returned for an empty inline command.
+func readCommand(rd *bufio.Reader) ([]string, error) {
+	line, err := readLine(rd)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		return strings.Fields(string(line)), nil
+	}
+	n, err := strconv.Atoi(string(line[1:]))
+	if err != nil || n > maxArgs {
+		return nil, errProtocol
+	}
+	if n <= 0 {
+		return nil, nil
+	}
+	args := make([]string, 0, minInt(n, minArgs))
+	for i := 0; i < n; i++ {
+		line, err := readLine(rd)
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, errProtocol
+		}
+		size, err := strconv.Atoi(string(line[1:]))
+		if err != nil || size < 0 || size > maxBulkSize {
+			return nil, errProtocol
+		}
+		arg, err := readBulk(rd, size)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	return args, nil
+}
+
+// readBulk reads the data of a bulk string with the size, followed by the
+// line ending. The data is read in chunks, which keeps a client from
+// allocating more memory than it sends.
+func readBulk(rd *bufio.Reader, size int) (string, error) {
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, rd, int64(size)); err != nil {
+		return "", unexpectedEOF(err)
+	}
+	var crlf [2]byte
+	if _, err := io.ReadFull(rd, crlf[:]); err != nil {
+		return "", unexpectedEOF(err)
+	}
+	if crlf[0] != '\r' || crlf[1] != '\n' {
+		return "", errProtocol
+	}
+	return buf.String(), nil
+}
+
+// minInt returns the smaller of a and b.
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// readLine reads a line and removes the line ending.
+func readLine(rd *bufio.Reader) ([]byte, error) {
+	line, err := rd.ReadSlice('\n')
+	if err != nil {
+		if err == bufio.ErrBufferFull {
+			return nil, errProtocol
+		}
+		if err == io.EOF && len(line) > 0 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	line = line[:len(line)-1]
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	}
+	return line, nil
+}
+
+// unexpectedEOF returns io.ErrUnexpectedEOF for an EOF in the middle of a
+// command.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// appendString appends a simple string reply, such as OK.
+func appendString(buf []byte, s string) []byte {
+	buf = append(buf, '+')
+	buf = append(buf, s...)
+	return append(buf, '\r', '\n')
+}
+
+// appendError appends an error reply. The message starts with an error
+// code, such as ERR.
+func appendError(buf []byte, msg string) []byte {
+	buf = append(buf, '-')
+	for i := 0; i < len(msg); i++ {
+		// the message must be on a single line
+		if msg[i] == '\r' || msg[i] == '\n' {
+			buf = append(buf, ' ')
+		} else {
+			buf = append(buf, msg[i])
+		}
+	}
+	return append(buf, '\r', '\n')
+}
+
+// appendErr appends an error reply with the ERR code.
+func appendErr(buf []byte, err error) []byte {
+	return appendError(buf, "ERR "+err.Error())
+}
+
+// appendInt appends an integer reply.
+func appendInt(buf []byte, n int64) []byte {
+	buf = append(buf, ':')
+	buf = strconv.AppendInt(buf, n, 10)
+	return append(buf, '\r', '\n')
+}
+
+// appendBulk appends a bulk string reply.
+func appendBulk(buf []byte, s string) []byte {
+	buf = append(buf, '$')
+	buf = strconv.AppendInt(buf, int64(len(s)), 10)
+	buf = append(buf, '\r', '\n')
+	buf = append(buf, s...)
+	return append(buf, '\r', '\n')
+}
+
+// appendNull appends a null bulk string reply.
+func appendNull(buf []byte) []byte {
+	return append(buf, "$-1\r\n"...)
+}
+
+// appendArray appends the header of an array reply with n elements.
+func appendArray(buf []byte, n int) []byte {
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(n), 10)
+	return append(buf, '\r', '\n')
+}
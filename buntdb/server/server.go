@@ -0,0 +1,599 @@
+// Package server exposes a buntdb database over the Redis protocol (RESP),
+// which allows for any Redis client to be used with the database.
+//
+// The supported commands are:
+//
+//	PING [message]
+//	ECHO message
+//	QUIT
+//	GET key
+//	SET key value [EX seconds|PX milliseconds] [NX|XX]
+//	DEL key [key ...]
+//	TTL key
+//	PTTL key
+//	SCAN cursor [MATCH pattern] [COUNT count]
+//	MULTI
+//	EXEC
+//	DISCARD
+//	ASCENDRANGE index greaterOrEqual lessThan [LIMIT count]
+//	NEARBY index bounds [LIMIT count]
+//	INTERSECTS index bounds [LIMIT count]
+//
+// The index commands reply with an array of keys and values, and NEARBY
+// also includes the distance of each item. The indexes are created with the
+// buntdb API.
+package server
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tidwall/buntdb"
+	"github.com/tidwall/match"
+)
+
+// ErrServerClosed is returned by Serve after the server has been closed.
+var ErrServerClosed = errors.New("server closed")
+
+// errSyntax is returned for a command with invalid arguments.
+var errSyntax = errors.New("syntax error")
+
+// errNotInteger is returned for an argument that should be an integer.
+var errNotInteger = errors.New("value is not an integer or out of range")
+
+// Server serves a database to Redis clients.
+type Server struct {
+	db     *buntdb.DB
+	mu     sync.Mutex
+	closed bool
+	lns    map[net.Listener]bool
+	conns  map[net.Conn]bool
+	wg     sync.WaitGroup
+}
+
+// New returns a server for the database. The database is not closed when the
+// server is closed.
+func New(db *buntdb.DB) *Server {
+	return &Server{
+		db:    db,
+		lns:   make(map[net.Listener]bool),
+		conns: make(map[net.Conn]bool),
+	}
+}
+
+// ListenAndServe listens on the network address and then calls Serve. The
+// network is "tcp" or "unix". An existing unix socket file is removed.
+func (s *Server) ListenAndServe(network, address string) error {
+	if network == "unix" {
+		os.Remove(address)
+	}
+	ln, err := net.Listen(network, address)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ln)
+}
+
+// Serve accepts connections on the listener and serves each connection in a
+// new goroutine. Serve always returns an error, and returns ErrServerClosed
+// after Close is called.
+func (s *Server) Serve(ln net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		ln.Close()
+		return ErrServerClosed
+	}
+	s.lns[ln] = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.lns, ln)
+		s.mu.Unlock()
+		ln.Close()
+	}()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return ErrServerClosed
+		}
+		s.conns[conn] = true
+		s.wg.Add(1)
+		s.mu.Unlock()
+		go func() {
+			defer s.wg.Done()
+			s.serveConn(conn)
+			s.mu.Lock()
+			delete(s.conns, conn)
+			s.mu.Unlock()
+			conn.Close()
+		}()
+	}
+}
+
+// Close closes the listeners and the client connections, and waits for the
+// connections to finish the commands that are running.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrServerClosed
+	}
+	s.closed = true
+	for ln := range s.lns {
+		ln.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return nil
+}
+
+// client is the state of a connection.
+type client struct {
+	multi bool       // a MULTI is in progress
+	dirty bool       // a queued command failed, EXEC must abort
+	queue [][]string // the queued commands of the MULTI
+}
+
+// serveConn reads commands from the connection until it's closed. The
+// replies are written when there are no more buffered commands, so a
+// pipeline of commands is replied to with a single write.
+func (s *Server) serveConn(conn net.Conn) {
+	rd := bufio.NewReader(conn)
+	var c client
+	var out []byte
+	for {
+		args, err := readCommand(rd)
+		if err != nil {
+			if err == errProtocol {
+				out = appendErr(out, err)
+				conn.Write(out)
+			}
+			return
+		}
+		var quit bool
+		if len(args) > 0 {
+			out, quit = s.execCommand(&c, args, out)
+		}
+		if rd.Buffered() == 0 || quit || len(out) > 64*1024 {
+			if _, err := conn.Write(out); err != nil || quit {
+				return
+			}
+			out = out[:0]
+		}
+	}
+}
+
+// execCommand runs a command for the client and appends the reply.
+func (s *Server) execCommand(c *client, args []string, out []byte) (
+	[]byte, bool) {
+	name := strings.ToLower(args[0])
+	switch name {
+	case "quit":
+		return appendString(out, "OK"), true
+	case "multi":
+		if len(args) != 1 {
+			return appendErr(out, arityError(name)), false
+		}
+		if c.multi {
+			return appendError(out, "ERR MULTI calls can not be nested"), false
+		}
+		c.multi, c.dirty, c.queue = true, false, nil
+		return appendString(out, "OK"), false
+	case "discard", "exec":
+		if len(args) != 1 {
+			return appendErr(out, arityError(name)), false
+		}
+		if !c.multi {
+			return appendError(out,
+				"ERR "+strings.ToUpper(name)+" without MULTI"), false
+		}
+		queue, dirty := c.queue, c.dirty
+		c.multi, c.dirty, c.queue = false, false, nil
+		if name == "discard" {
+			return appendString(out, "OK"), false
+		}
+		if dirty {
+			return appendError(out, "EXECABORT Transaction discarded "+
+				"because of previous errors."), false
+		}
+		return s.exec(queue, out), false
+	}
+	cmd, err := lookup(name, args)
+	if err != nil {
+		if c.multi {
+			c.dirty = true
+		}
+		return appendErr(out, err), false
+	}
+	if c.multi {
+		c.queue = append(c.queue, args)
+		return appendString(out, "QUEUED"), false
+	}
+	if cmd.tx == nil {
+		return cmd.fn(out, args), false
+	}
+	var reply []byte
+	fn := func(tx *buntdb.Tx) error {
+		var err error
+		reply, err = cmd.tx(reply, tx, args)
+		return err
+	}
+	if cmd.write {
+		err = s.db.Update(fn)
+	} else {
+		err = s.db.View(fn)
+	}
+	if err != nil {
+		return appendErr(out, err), false
+	}
+	return append(out, reply...), false
+}
+
+// exec runs the commands of a MULTI in a single transaction. Like Redis, a
+// command that fails does not stop the other commands, and its error is
+// included in the reply. The transaction is only rolled back when it cannot
+// be committed.
+func (s *Server) exec(queue [][]string, out []byte) []byte {
+	var write bool
+	for _, args := range queue {
+		cmd, _ := lookup(strings.ToLower(args[0]), args)
+		write = write || cmd.write
+	}
+	var reply []byte
+	fn := func(tx *buntdb.Tx) error {
+		reply = appendArray(reply[:0], len(queue))
+		for _, args := range queue {
+			cmd, _ := lookup(strings.ToLower(args[0]), args)
+			if cmd.tx == nil {
+				reply = cmd.fn(reply, args)
+				continue
+			}
+			mark := len(reply)
+			var err error
+			reply, err = cmd.tx(reply, tx, args)
+			if err != nil {
+				reply = appendErr(reply[:mark], err)
+			}
+		}
+		return nil
+	}
+	var err error
+	if write {
+		err = s.db.Update(fn)
+	} else {
+		err = s.db.View(fn)
+	}
+	if err != nil {
+		return appendErr(out, err)
+	}
+	return append(out, reply...)
+}
+
+// command is a command that can be sent by a client.
+type command struct {
+	// arity is the number of arguments, including the command name. A
+	// negative arity is the minimum number of arguments.
+	arity int
+	// write is true for commands that modify the database.
+	write bool
+	// tx runs a command in a transaction.
+	tx func(out []byte, tx *buntdb.Tx, args []string) ([]byte, error)
+	// fn runs a command that does not use the database.
+	fn func(out []byte, args []string) []byte
+}
+
+var commands = map[string]command{
+	"ping":        {arity: -1, fn: cmdPING},
+	"echo":        {arity: 2, fn: cmdECHO},
+	"get":         {arity: 2, tx: cmdGET},
+	"set":         {arity: -3, write: true, tx: cmdSET},
+	"del":         {arity: -2, write: true, tx: cmdDEL},
+	"ttl":         {arity: 2, tx: cmdTTL},
+	"pttl":        {arity: 2, tx: cmdTTL},
+	"scan":        {arity: -2, tx: cmdSCAN},
+	"ascendrange": {arity: -4, tx: cmdASCENDRANGE},
+	"nearby":      {arity: -3, tx: cmdNEARBY},
+	"intersects":  {arity: -3, tx: cmdINTERSECTS},
+}
+
+// lookup returns the command with the name, and checks the number of
+// arguments.
+func lookup(name string, args []string) (command, error) {
+	cmd, ok := commands[name]
+	if !ok {
+		return cmd, errors.New("unknown command '" + args[0] + "'")
+	}
+	if (cmd.arity > 0 && len(args) != cmd.arity) ||
+		(cmd.arity < 0 && len(args) < -cmd.arity) {
+		return cmd, arityError(name)
+	}
+	return cmd, nil
+}
+
+func arityError(name string) error {
+	return errors.New("wrong number of arguments for '" + name + "' command")
+}
+
+func cmdPING(out []byte, args []string) []byte {
+	switch len(args) {
+	case 1:
+		return appendString(out, "PONG")
+	case 2:
+		return appendBulk(out, args[1])
+	}
+	return appendErr(out, arityError("ping"))
+}
+
+func cmdECHO(out []byte, args []string) []byte {
+	return appendBulk(out, args[1])
+}
+
+func cmdGET(out []byte, tx *buntdb.Tx, args []string) ([]byte, error) {
+	val, err := tx.Get(args[1])
+	if err != nil {
+		if err == buntdb.ErrNotFound {
+			return appendNull(out), nil
+		}
+		return out, err
+	}
+	return appendBulk(out, val), nil
+}
+
+func cmdSET(out []byte, tx *buntdb.Tx, args []string) ([]byte, error) {
+	var opts *buntdb.SetOptions
+	var nx, xx bool
+	for i := 3; i < len(args); i++ {
+		switch strings.ToLower(args[i]) {
+		case "ex", "px":
+			if opts != nil || i+1 == len(args) {
+				return out, errSyntax
+			}
+			n, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil || n <= 0 {
+				return out, errors.New("invalid expire time in 'set' command")
+			}
+			unit := time.Second
+			if strings.ToLower(args[i]) == "px" {
+				unit = time.Millisecond
+			}
+			opts = &buntdb.SetOptions{Expires: true, TTL: time.Duration(n) * unit}
+			i++
+		case "nx":
+			nx = true
+		case "xx":
+			xx = true
+		default:
+			return out, errSyntax
+		}
+	}
+	if nx && xx {
+		return out, errSyntax
+	}
+	if nx || xx {
+		_, err := tx.Get(args[1])
+		if err != nil && err != buntdb.ErrNotFound {
+			return out, err
+		}
+		if exists := err == nil; (nx && exists) || (xx && !exists) {
+			return appendNull(out), nil
+		}
+	}
+	if _, _, err := tx.Set(args[1], args[2], opts); err != nil {
+		return out, err
+	}
+	return appendString(out, "OK"), nil
+}
+
+func cmdDEL(out []byte, tx *buntdb.Tx, args []string) ([]byte, error) {
+	var n int64
+	for _, key := range args[1:] {
+		if _, err := tx.Delete(key); err != nil {
+			if err == buntdb.ErrNotFound {
+				continue
+			}
+			return out, err
+		}
+		n++
+	}
+	return appendInt(out, n), nil
+}
+
+// cmdTTL replies with -2 when the key does not exist, and with -1 when the
+// key does not expire.
+func cmdTTL(out []byte, tx *buntdb.Tx, args []string) ([]byte, error) {
+	dur, err := tx.TTL(args[1])
+	if err != nil {
+		if err == buntdb.ErrNotFound {
+			return appendInt(out, -2), nil
+		}
+		return out, err
+	}
+	if dur < 0 {
+		return appendInt(out, -1), nil
+	}
+	if strings.ToLower(args[0]) == "pttl" {
+		return appendInt(out, int64((dur+time.Millisecond/2)/time.Millisecond)), nil
+	}
+	return appendInt(out, int64((dur+time.Second/2)/time.Second)), nil
+}
+
+// cmdSCAN iterates over the keys in order. The cursor is the last key that
+// was returned by the previous call, in base64, and the next call resumes
+// right after it. This returns every key that exists for the whole
+// iteration, even when other keys are deleted, and the iteration is
+// complete when the returned cursor is 0.
+func cmdSCAN(out []byte, tx *buntdb.Tx, args []string) ([]byte, error) {
+	var after string
+	if args[1] != "0" {
+		key, err := base64.RawURLEncoding.DecodeString(args[1])
+		if err != nil || len(key) == 0 {
+			return out, errors.New("invalid cursor")
+		}
+		after = string(key)
+	}
+	pattern := "*"
+	count := 10
+	for i := 2; i < len(args); i++ {
+		if i+1 == len(args) {
+			return out, errSyntax
+		}
+		switch strings.ToLower(args[i]) {
+		case "match":
+			pattern = args[i+1]
+		case "count":
+			var err error
+			count, err = strconv.Atoi(args[i+1])
+			if err != nil {
+				return out, errNotInteger
+			}
+			if count < 1 {
+				return out, errSyntax
+			}
+		default:
+			return out, errSyntax
+		}
+		i++
+	}
+	// The keys that match the pattern are within the allowable range.
+	var min, max string
+	if pattern != "" && pattern[0] != '*' {
+		min, max = match.Allowable(pattern)
+	}
+	pivot := after
+	if min > pivot {
+		pivot = min
+	}
+	var keys []string
+	next := "0"
+	err := tx.AscendGreaterOrEqual("", pivot, func(key, _ string) bool {
+		if max != "" && key > max {
+			return false
+		}
+		if key == after || !match.Match(key, pattern) {
+			return true
+		}
+		if _, err := tx.TTL(key); err == buntdb.ErrNotFound {
+			// The item has expired, which GET treats as not found.
+			return true
+		}
+		if len(keys) == count {
+			next = base64.RawURLEncoding.EncodeToString(
+				[]byte(keys[len(keys)-1]))
+			return false
+		}
+		keys = append(keys, key)
+		return true
+	})
+	if err != nil {
+		return out, err
+	}
+	out = appendArray(out, 2)
+	out = appendBulk(out, next)
+	out = appendArray(out, len(keys))
+	for _, key := range keys {
+		out = appendBulk(out, key)
+	}
+	return out, nil
+}
+
+// parseLimit parses the optional LIMIT argument of the index commands. Zero
+// means no limit.
+func parseLimit(args []string) (int, error) {
+	if len(args) == 0 {
+		return 0, nil
+	}
+	if len(args) != 2 || strings.ToLower(args[0]) != "limit" {
+		return 0, errSyntax
+	}
+	limit, err := strconv.Atoi(args[1])
+	if err != nil || limit < 0 {
+		return 0, errNotInteger
+	}
+	return limit, nil
+}
+
+// items collects the results of an index command.
+type items struct {
+	limit int
+	vals  []string
+}
+
+func (it *items) add(key, value string) bool {
+	it.vals = append(it.vals, key, value)
+	return it.limit == 0 || len(it.vals) < it.limit*2
+}
+
+func (it *items) addDist(key, value string, dist float64) bool {
+	it.vals = append(it.vals, key, value,
+		strconv.FormatFloat(dist, 'f', -1, 64))
+	return it.limit == 0 || len(it.vals) < it.limit*3
+}
+
+func (it *items) appendReply(out []byte) []byte {
+	out = appendArray(out, len(it.vals))
+	for _, val := range it.vals {
+		out = appendBulk(out, val)
+	}
+	return out
+}
+
+func cmdASCENDRANGE(out []byte, tx *buntdb.Tx, args []string) ([]byte,
+	error) {
+	limit, err := parseLimit(args[4:])
+	if err != nil {
+		return out, err
+	}
+	it := &items{limit: limit}
+	if err := tx.AscendRange(args[1], args[2], args[3], it.add); err != nil {
+		return out, err
+	}
+	return it.appendReply(out), nil
+}
+
+func cmdNEARBY(out []byte, tx *buntdb.Tx, args []string) ([]byte, error) {
+	limit, err := parseLimit(args[3:])
+	if err != nil {
+		return out, err
+	}
+	it := &items{limit: limit}
+	if err := tx.Nearby(args[1], args[2], it.addDist); err != nil {
+		return out, err
+	}
+	return it.appendReply(out), nil
+}
+
+func cmdINTERSECTS(out []byte, tx *buntdb.Tx, args []string) ([]byte,
+	error) {
+	limit, err := parseLimit(args[3:])
+	if err != nil {
+		return out, err
+	}
+	it := &items{limit: limit}
+	if err := tx.Intersects(args[1], args[2], it.add); err != nil {
+		return out, err
+	}
+	return it.appendReply(out), nil
+}
@@ -0,0 +1,341 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tidwall/buntdb"
+)
+
+// testClient is a minimal Redis client.
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	rd   *bufio.Reader
+}
+
+// testServe starts a server for an in-memory database on a unix socket.
+func testServe(t *testing.T) (*buntdb.DB, *testClient, func()) {
+	db, err := buntdb.Open(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "buntdb.sock")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(db)
+	done := make(chan error)
+	go func() { done <- s.Serve(ln) }()
+	c := testDial(t, path)
+	return db, c, func() {
+		c.conn.Close()
+		s.Close()
+		if err := <-done; err != ErrServerClosed {
+			t.Fatalf("expected '%v', got '%v'", ErrServerClosed, err)
+		}
+		db.Close()
+	}
+}
+
+func testDial(t *testing.T, path string) *testClient {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testClient{t: t, conn: conn, rd: bufio.NewReader(conn)}
+}
+
+// do sends a command and returns the reply in a simple text form. Arrays
+// are in brackets, null is "nil", and errors start with "ERR".
+func (c *testClient) do(args ...string) string {
+	c.send(args...)
+	return c.reply()
+}
+
+func (c *testClient) send(args ...string) {
+	buf := fmt.Sprintf("*%d\r\n", len(args))
+	for _, arg := range args {
+		buf += fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := c.conn.Write([]byte(buf)); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *testClient) reply() string {
+	line, err := c.rd.ReadString('\n')
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	switch line[0] {
+	case '+', '-', ':':
+		return line[1:]
+	case '$':
+		n, _ := strconv.Atoi(line[1:])
+		if n < 0 {
+			return "nil"
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.rd, buf); err != nil {
+			c.t.Fatal(err)
+		}
+		return string(buf[:n])
+	case '*':
+		n, _ := strconv.Atoi(line[1:])
+		var vals []string
+		for i := 0; i < n; i++ {
+			vals = append(vals, c.reply())
+		}
+		return "[" + strings.Join(vals, " ") + "]"
+	}
+	c.t.Fatalf("invalid reply '%v'", line)
+	return ""
+}
+
+func (c *testClient) expect(exp string, args ...string) {
+	c.t.Helper()
+	if res := c.do(args...); res != exp {
+		c.t.Fatalf("expected '%v', got '%v'", exp, res)
+	}
+}
+
+func TestServer(t *testing.T) {
+	_, c, close := testServe(t)
+	defer close()
+	c.expect("PONG", "PING")
+	c.expect("hello", "ECHO", "hello")
+	c.expect("nil", "GET", "key:1")
+	c.expect("OK", "SET", "key:1", "val:1")
+	c.expect("val:1", "get", "key:1")
+	c.expect("OK", "SET", "key:2", "val:2", "EX", "100")
+	c.expect("OK", "SET", "key:3", "val:3", "PX", "100000")
+	c.expect("nil", "SET", "key:3", "val:3", "NX")
+	c.expect("nil", "SET", "key:4", "val:4", "XX")
+	c.expect("-2", "TTL", "key:4")
+	c.expect("-1", "TTL", "key:1")
+	c.expect("100", "TTL", "key:2")
+	c.expect("100", "TTL", "key:3")
+	if res, _ := strconv.Atoi(c.do("PTTL", "key:3")); res <= 99000 || res > 100000 {
+		t.Fatalf("expected a ttl near 100000, got '%v'", res)
+	}
+	c.expect("2", "DEL", "key:1", "key:2", "key:4")
+	c.expect("nil", "GET", "key:1")
+	c.expect("ERR wrong number of arguments for 'get' command", "GET")
+	c.expect("ERR syntax error", "SET", "key:1", "val:1", "EX")
+	c.expect("ERR invalid expire time in 'set' command",
+		"SET", "key:1", "val:1", "EX", "0")
+	c.expect("ERR unknown command 'FOO'", "FOO")
+
+	// a pipeline of commands, including an inline command.
+	if _, err := c.conn.Write([]byte("PING\r\n*1\r\n$4\r\nPING\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if res := c.reply(); res != "PONG" {
+			t.Fatalf("expected '%v', got '%v'", "PONG", res)
+		}
+	}
+}
+
+func TestServerScan(t *testing.T) {
+	_, c, close := testServe(t)
+	defer close()
+	for i := 0; i < 25; i++ {
+		c.expect("OK", "SET", fmt.Sprintf("key:%02d", i), "val")
+		c.expect("OK", "SET", fmt.Sprintf("other:%02d", i), "val")
+	}
+	var keys []string
+	cursor := "0"
+	for {
+		res := c.do("SCAN", cursor, "MATCH", "key:*", "COUNT", "10")
+		res = strings.NewReplacer("[", " ", "]", " ").Replace(res)
+		parts := strings.Fields(res)
+		cursor = parts[0]
+		keys = append(keys, parts[1:]...)
+		if cursor == "0" {
+			break
+		}
+		// deleting the returned keys does not skip the other keys.
+		c.expect("10", append([]string{"DEL"}, parts[1:]...)...)
+	}
+	if len(keys) != 25 || keys[0] != "key:00" || keys[24] != "key:24" {
+		t.Fatalf("expected 25 keys, got '%v'", keys)
+	}
+	for i, key := range keys {
+		if key != fmt.Sprintf("key:%02d", i) {
+			t.Fatalf("expected '%v', got '%v'", fmt.Sprintf("key:%02d", i), key)
+		}
+	}
+	c.expect("[0 []]", "SCAN", "0", "MATCH", "none:*")
+	// expired keys are skipped like by GET.
+	c.expect("OK", "SET", "tmp:1", "val", "PX", "10")
+	c.expect("OK", "SET", "tmp:2", "val")
+	time.Sleep(time.Millisecond * 20)
+	c.expect("nil", "GET", "tmp:1")
+	c.expect("[0 [tmp:2]]", "SCAN", "0", "MATCH", "tmp:*")
+	c.expect("ERR invalid cursor", "SCAN", "x")
+	c.expect("ERR syntax error", "SCAN", "0", "MATCH")
+}
+
+func TestServerMulti(t *testing.T) {
+	db, c, close := testServe(t)
+	defer close()
+	c.expect("OK", "MULTI")
+	c.expect("QUEUED", "SET", "key:1", "val:1")
+	c.expect("QUEUED", "SET", "key:2", "val:2", "EX", "x")
+	c.expect("QUEUED", "GET", "key:1")
+	c.expect("QUEUED", "DEL", "key:1")
+	c.expect("[OK ERR invalid expire time in 'set' command val:1 1]", "EXEC")
+	c.expect("nil", "GET", "key:1")
+	c.expect("ERR EXEC without MULTI", "EXEC")
+
+	// an invalid command aborts the transaction.
+	c.expect("OK", "MULTI")
+	c.expect("ERR MULTI calls can not be nested", "MULTI")
+	c.expect("QUEUED", "SET", "key:1", "val:1")
+	c.expect("ERR wrong number of arguments for 'get' command", "GET")
+	c.expect("EXECABORT Transaction discarded because of previous errors.",
+		"EXEC")
+	c.expect("nil", "GET", "key:1")
+	c.expect("OK", "MULTI")
+	c.expect("QUEUED", "SET", "key:1", "val:1")
+	c.expect("OK", "DISCARD")
+	c.expect("nil", "GET", "key:1")
+
+	// the commands of a transaction are atomic. Another transaction cannot
+	// run in between the commands.
+	c.expect("OK", "MULTI")
+	c.expect("QUEUED", "SET", "key:1", "val:1")
+	c.expect("QUEUED", "SET", "key:2", "val:2")
+	c.send("EXEC")
+	time.Sleep(time.Millisecond * 10)
+	if err := db.View(func(tx *buntdb.Tx) error {
+		v1, _ := tx.Get("key:1")
+		v2, _ := tx.Get("key:2")
+		if v1 != "val:1" || v2 != "val:2" {
+			t.Fatalf("expected both values, got '%v' and '%v'", v1, v2)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if res := c.reply(); res != "[OK OK]" {
+		t.Fatalf("expected '%v', got '%v'", "[OK OK]", res)
+	}
+}
+
+func TestServerIndexes(t *testing.T) {
+	db, c, close := testServe(t)
+	defer close()
+	if err := db.Update(func(tx *buntdb.Tx) error {
+		if err := tx.CreateIndex("ages", "user:*", buntdb.IndexInt); err != nil {
+			return err
+		}
+		return tx.CreateSpatialIndex("fleet", "fleet:*", buntdb.IndexRect)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	c.expect("OK", "SET", "user:1", "35")
+	c.expect("OK", "SET", "user:2", "50")
+	c.expect("OK", "SET", "user:3", "20")
+	c.expect("OK", "SET", "user:4", "38")
+	c.expect("OK", "SET", "fleet:0", "[-115.567 33.532]")
+	c.expect("OK", "SET", "fleet:1", "[-116.671 35.735]")
+	c.expect("OK", "SET", "fleet:2", "[-113.902 31.234]")
+
+	c.expect("[user:1 35 user:4 38]", "ASCENDRANGE", "ages", "30", "40")
+	c.expect("[user:1 35]", "ASCENDRANGE", "ages", "30", "40", "LIMIT", "1")
+	c.expect("[user:1 35 user:2 50]", "ASCENDRANGE", "", "user:1", "user:3")
+	c.expect("ERR not found", "ASCENDRANGE", "none", "30", "40")
+	c.expect("ERR syntax error", "ASCENDRANGE", "ages", "30", "40", "LIMIT")
+
+	c.expect("[fleet:1 [-116.671 35.735]]",
+		"INTERSECTS", "fleet", "[-117 35],[-116 36]")
+	res := c.do("NEARBY", "fleet", "[-113 33]", "LIMIT", "2")
+	if !strings.HasPrefix(res, "[fleet:2 [-113.902 31.234] ") ||
+		!strings.Contains(res, " fleet:0 [-115.567 33.532] ") ||
+		strings.Contains(res, "fleet:1") {
+		t.Fatalf("expected fleet:0 and fleet:2, got '%v'", res)
+	}
+}
+
+func TestServerFollower(t *testing.T) {
+	db, c, close := testServe(t)
+	defer close()
+	c.expect("OK", "SET", "key:1", "val:1")
+	// a database that follows a leader is read-only.
+	rd, wr := net.Pipe()
+	go db.Follow(rd)
+	defer wr.Close()
+	start := time.Now()
+	for {
+		res := c.do("SET", "key:2", "val:2")
+		if res == "ERR "+buntdb.ErrFollower.Error() {
+			break
+		}
+		if time.Since(start) > time.Second*5 {
+			t.Fatalf("expected '%v', got '%v'", buntdb.ErrFollower, res)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	c.expect("val:1", "GET", "key:1")
+}
+
+func TestServerProtocolError(t *testing.T) {
+	_, c, close := testServe(t)
+	defer close()
+	if _, err := c.conn.Write([]byte("*1\r\n+PING\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if res := c.reply(); res != "ERR Protocol error" {
+		t.Fatalf("expected '%v', got '%v'", "ERR Protocol error", res)
+	}
+	if _, err := c.rd.ReadByte(); err == nil {
+		t.Fatal("expected the connection to be closed")
+	}
+	c2 := testDial(t, c.conn.RemoteAddr().String())
+	defer c2.conn.Close()
+	c2.expect("OK", "QUIT")
+	if _, err := c2.rd.ReadByte(); err == nil {
+		t.Fatal("expected the connection to be closed")
+	}
+}
+
+func TestReadCommandLimits(t *testing.T) {
+	// the headers of a command do not allocate the memory that they declare.
+	for _, data := range []string{
+		"*1000000\r\n$3\r\nGET\r\n",
+		"*1\r\n$536870000\r\nabc",
+	} {
+		var ms runtime.MemStats
+		runtime.ReadMemStats(&ms)
+		alloc := ms.TotalAlloc
+		_, err := readCommand(bufio.NewReader(strings.NewReader(data)))
+		if err != io.ErrUnexpectedEOF {
+			t.Fatalf("expected '%v', got '%v'", io.ErrUnexpectedEOF, err)
+		}
+		runtime.ReadMemStats(&ms)
+		if n := ms.TotalAlloc - alloc; n > 1024*1024 {
+			t.Fatalf("expected less than 1MB, got '%v'", n)
+		}
+	}
+	args, err := readCommand(bufio.NewReader(strings.NewReader(
+		"*2\r\n$3\r\nGET\r\n$0\r\n\r\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := fmt.Sprintf("%q", args); res != `["GET" ""]` {
+		t.Fatalf("expected '%v', got '%v'", `["GET" ""]`, res)
+	}
+}
@@ -0,0 +1,110 @@
+package buntdb
+
+import (
+	"github.com/tidwall/btree"
+	"github.com/tidwall/rtree"
+)
+
+// Snapshot returns a read-only transaction for a point-in-time copy of the
+// database. Unlike View, the snapshot does not hold the database lock while
+// it's in use, which allows for long running reads to happen at the same time
+// as Update calls. Changes that are committed after the snapshot was taken
+// are not visible to the snapshot.
+//
+// The keys, expirations, and b-tree indexes are copied using copy-on-write
+// clones and are nearly free to create. The copy is taken with the read lock,
+// so other reads are not blocked. The spatial and text indexes are rebuilt
+// for the snapshot when they're first used, outside of the lock.
+//
+// The returned transaction must be closed by calling Rollback() when done.
+func (db *DB) Snapshot() (*Tx, error) {
+	db.mu.RLock()
+	if db.closed {
+		db.mu.RUnlock()
+		return nil, ErrDatabaseClosed
+	}
+	sdb := db.detachShared()
+	db.mu.RUnlock()
+	return &Tx{db: sdb}, nil
+}
+
+// fill fills a spatial or text index of a detached database, which is left
+// empty by detach until it's used. The items that were changed since the
+// copy was taken are in the keys of the database.
+func (idx *index) fill() {
+	if !idx.lazy {
+		return
+	}
+	idx.lazy = false
+	if idx.rect != nil {
+		idx.rtr = rtree.New(idx)
+	}
+	if idx.extract != nil {
+		idx.txt = newTextIndex()
+	}
+	idx.db.keys.Ascend(func(item btree.Item) bool {
+		dbi := item.(*dbItem)
+		if !idx.include(dbi) {
+			return true
+		}
+		if idx.rtr != nil {
+			idx.rtr.Insert(dbi)
+		}
+		if idx.txt != nil {
+			idx.txt.insert(dbi.key, idx.extract(dbi.value()))
+		}
+		return true
+	})
+}
+
+// detachShared creates a detached copy of the database while holding the
+// read lock. Cloning a b-tree changes the original, so the clones of the
+// readers are serialized, and the writers are excluded by the read lock.
+func (db *DB) detachShared() *DB {
+	db.clonemu.Lock()
+	defer db.clonemu.Unlock()
+	return db.detach()
+}
+
+// detach creates a detached copy of the database, and of its keyspaces. The
+// b-trees are cloned, but the spatial and text indexes are left empty until
+// they're used. Must be called while holding the write lock, or by
+// detachShared, because cloning a b-tree changes the original.
+func (db *DB) detach() *DB {
+	sdb := &DB{
+		space:    db.space,
+		keys:     db.keys.Clone(),
+		exps:     db.exps.Clone(),
+		idxs:     make(map[string]*index, len(db.idxs)),
+		config:   db.config,
+		opts:     db.opts,
+		memsize:  db.memsize,
+		snapshot: true,
+	}
+	for name, idx := range db.idxs {
+		nidx := &index{
+			name:    idx.name,
+			pattern: idx.pattern,
+			less:    idx.less,
+			rect:    idx.rect,
+			db:      sdb,
+			opts:    idx.opts,
+			fields:  idx.fields,
+			extract: idx.extract,
+			def:     idx.def,
+			lazy:    idx.rect != nil || idx.extract != nil,
+		}
+		if idx.btr != nil {
+			nidx.btr = idx.btr.Clone()
+		}
+		sdb.idxs[name] = nidx
+	}
+	for name, kdb := range db.spaces {
+		if sdb.spaces == nil {
+			sdb.spaces = make(map[string]*DB, len(db.spaces))
+		}
+		sdb.spaces[name] = kdb.detach()
+		sdb.spaces[name].root = sdb
+	}
+	return sdb
+}
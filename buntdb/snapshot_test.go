@@ -0,0 +1,94 @@
+package buntdb
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+	db := testOpen(t)
+	defer testClose(db)
+	if err := db.Update(func(tx *Tx) error {
+		if err := tx.CreateIndex("age", "user:*", IndexJSON("age")); err != nil {
+			return err
+		}
+		if err := tx.CreateSpatialIndex("pos", "pos:*", IndexRect); err != nil {
+			return err
+		}
+		for i := 0; i < 10; i++ {
+			tx.Set(fmt.Sprintf("user:%d", i), fmt.Sprintf(`{"age":%d}`, 50-i), nil)
+			tx.Set(fmt.Sprintf("pos:%d", i), Point(float64(i), float64(i)), nil)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	snap, err := db.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the snapshot must not block writers.
+	if err := db.Update(func(tx *Tx) error {
+		for i := 0; i < 10; i++ {
+			tx.Delete(fmt.Sprintf("pos:%d", i))
+		}
+		tx.Set("user:0", `{"age":10}`, nil)
+		tx.Set("user:100", `{"age":1}`, nil)
+		return tx.DropIndex("pos")
+	}); err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	if err := snap.Ascend("age", func(key, value string) bool {
+		keys = append(keys, key)
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	res := strings.Join(keys, ",")
+	exp := "user:9,user:8,user:7,user:6,user:5,user:4,user:3,user:2,user:1,user:0"
+	if res != exp {
+		t.Fatalf("expected '%v', got '%v'", exp, res)
+	}
+	var n int
+	if err := snap.Intersects("pos", "[2 2],[5 5]", func(key, value string) bool {
+		n++
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if n != 4 {
+		t.Fatalf("expected '%v', got '%v'", 4, n)
+	}
+	if _, _, err := snap.Set("hello", "world", nil); err != ErrTxNotWritable {
+		t.Fatalf("expected '%v', got '%v'", ErrTxNotWritable, err)
+	}
+	if err := snap.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if err := snap.Rollback(); err != ErrTxClosed {
+		t.Fatalf("expected '%v', got '%v'", ErrTxClosed, err)
+	}
+	// the database should have its own view.
+	if err := db.View(func(tx *Tx) error {
+		val, err := tx.Get("user:0")
+		if err != nil {
+			return err
+		}
+		if val != `{"age":10}` {
+			t.Fatalf("expected '%v', got '%v'", `{"age":10}`, val)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSnapshotClosed(t *testing.T) {
+	db, _ := Open(":memory:")
+	db.Close()
+	if _, err := db.Snapshot(); err != ErrDatabaseClosed {
+		t.Fatalf("expected '%v', got '%v'", ErrDatabaseClosed, err)
+	}
+}
@@ -0,0 +1,130 @@
+package buntdb
+
+import (
+	"sync"
+	"time"
+)
+
+// Stats are the statistics of a database.
+type Stats struct {
+	// Keys is the number of items, which includes the items that have
+	// expired and are not deleted yet.
+	Keys int
+	// Indexes is the number of items in each index.
+	Indexes map[string]int
+	// Expiring is the number of items that have an expiration.
+	Expiring int
+	// AOFSize is the size of the append-only file, or the total size of the
+	// segments when the file is segmented.
+	AOFSize int64
+	// LastShrinkSize is the size of the append-only file after it was last
+	// shrunk, or when the database was opened.
+	LastShrinkSize int64
+	// LastShrinkTime is when the append-only file was last shrunk. It's zero
+	// when the file has not been shrunk since the database was opened.
+	LastShrinkTime time.Time
+	// Flushes is the number of writes to the append-only file.
+	Flushes int
+	// Shrinking is true while the append-only file is being shrunk.
+	Shrinking bool
+	// Commits is the number of read/write transactions that were committed,
+	// and CommitTime is the total time that the commits took.
+	Commits    int64
+	CommitTime time.Duration
+	// Rollbacks is the number of read/write transactions that were rolled
+	// back, and RollbackTime is the total time that the rollbacks took. A
+	// commit that fails is counted as a rollback.
+	Rollbacks    int64
+	RollbackTime time.Duration
+}
+
+// dbStats are the counts of the transactions. It has its own lock because
+// transactions can finish after the database lock is released.
+type dbStats struct {
+	mu           sync.Mutex
+	commits      int64
+	committime   time.Duration
+	rollbacks    int64
+	rollbacktime time.Duration
+}
+
+// commit counts a commit that was started at the time.
+func (s *dbStats) commit(start time.Time, err error) {
+	if err != nil {
+		s.rollback(start)
+		return
+	}
+	s.mu.Lock()
+	s.commits++
+	s.committime += time.Since(start)
+	s.mu.Unlock()
+}
+
+// rollback counts a rollback that was started at the time.
+func (s *dbStats) rollback(start time.Time) {
+	s.mu.Lock()
+	s.rollbacks++
+	s.rollbacktime += time.Since(start)
+	s.mu.Unlock()
+}
+
+// Stats returns the statistics of the database. The Keys, Indexes, and
+// Expiring counts are of the default keyspace, and Keyspace.Stats has the
+// counts of other keyspaces.
+func (db *DB) Stats() (Stats, error) {
+	return db.spaceStats("")
+}
+
+// spaceStats returns the statistics of the database with the counts of the
+// keyspace with the name.
+func (db *DB) spaceStats(space string) (Stats, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return Stats{}, ErrDatabaseClosed
+	}
+	kdb := db
+	if space != "" {
+		if kdb = db.spaces[space]; kdb == nil {
+			// The keyspace has not been created.
+			kdb = db.newKeyspace(space)
+		}
+	}
+	stats := Stats{
+		Keys:           kdb.keys.Len(),
+		Indexes:        make(map[string]int, len(kdb.idxs)),
+		Expiring:       kdb.exps.Len(),
+		AOFSize:        db.fileSize(),
+		LastShrinkSize: int64(db.lastaofsz),
+		LastShrinkTime: db.shrinkat,
+		Flushes:        db.flushes,
+		Shrinking:      db.shrinking,
+	}
+	db.stats.mu.Lock()
+	stats.Commits, stats.CommitTime = db.stats.commits, db.stats.committime
+	stats.Rollbacks, stats.RollbackTime = db.stats.rollbacks, db.stats.rollbacktime
+	db.stats.mu.Unlock()
+	for name, idx := range kdb.idxs {
+		switch {
+		case idx.btr != nil:
+			stats.Indexes[name] = idx.btr.Len()
+		case idx.rtr != nil:
+			stats.Indexes[name] = idx.rtr.Count()
+		case idx.txt != nil:
+			stats.Indexes[name] = len(idx.txt.docs)
+		}
+	}
+	return stats, nil
+}
+
+// StatsVar returns the statistics of the database, or nil when the database
+// is closed. It's a hook for exporting the statistics as an expvar variable.
+//
+//	expvar.Publish("buntdb", expvar.Func(db.StatsVar))
+func (db *DB) StatsVar() interface{} {
+	stats, err := db.Stats()
+	if err != nil {
+		return nil
+	}
+	return stats
+}
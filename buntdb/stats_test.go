@@ -0,0 +1,113 @@
+package buntdb
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"testing"
+	"time"
+)
+
+func TestStats(t *testing.T) {
+	db := testOpen(t)
+	defer testClose(db)
+	if err := db.Update(func(tx *Tx) error {
+		if err := tx.CreateIndex("age", "user:*", IndexJSON("age")); err != nil {
+			return err
+		}
+		return tx.CreateSpatialIndex("pos", "pos:*", IndexRect)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	testFillJSON(t, db, 10)
+	if err := db.Update(func(tx *Tx) error {
+		opts := &SetOptions{Expires: true, TTL: time.Hour}
+		if _, _, err := tx.Set("pos:1", "[1 2]", opts); err != nil {
+			return err
+		}
+		_, _, err := tx.Set("pos:2", "[3 4]", opts)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	errRollback := errors.New("rollback")
+	if err := db.Update(func(tx *Tx) error {
+		return errRollback
+	}); err != errRollback {
+		t.Fatalf("expected '%v', got '%v'", errRollback, err)
+	}
+	// read-only transactions are not counted.
+	if err := db.View(func(tx *Tx) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := db.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Keys != 13 || stats.Expiring != 2 {
+		t.Fatalf("expected '%v', got '%v'", "13 2", []int{stats.Keys, stats.Expiring})
+	}
+	if stats.Indexes["age"] != 10 || stats.Indexes["pos"] != 2 || len(stats.Indexes) != 2 {
+		t.Fatalf("expected '%v', got '%v'", "map[age:10 pos:2]", stats.Indexes)
+	}
+	if stats.Commits != 3 || stats.Rollbacks != 1 {
+		t.Fatalf("expected '%v', got '%v'", "3 1", []int64{stats.Commits, stats.Rollbacks})
+	}
+	if stats.CommitTime <= 0 || stats.RollbackTime <= 0 {
+		t.Fatal("expected the time of the transactions")
+	}
+	if stats.AOFSize != testFileSize(t, "data.db") {
+		t.Fatalf("expected '%v', got '%v'", testFileSize(t, "data.db"), stats.AOFSize)
+	}
+	if stats.Flushes != 2 {
+		t.Fatalf("expected '%v', got '%v'", 2, stats.Flushes)
+	}
+	if !stats.LastShrinkTime.IsZero() || stats.Shrinking {
+		t.Fatal("expected no shrink")
+	}
+	if err := db.Shrink(); err != nil {
+		t.Fatal(err)
+	}
+	stats, _ = db.Stats()
+	if stats.LastShrinkTime.IsZero() || stats.LastShrinkSize != stats.AOFSize {
+		t.Fatalf("expected '%v', got '%v'", stats.AOFSize, stats.LastShrinkSize)
+	}
+	// the stats are exported as an expvar variable.
+	var res Stats
+	if err := json.Unmarshal([]byte(expvar.Func(db.StatsVar).String()), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Keys != 13 || res.Indexes["age"] != 10 || res.Commits != 3 {
+		t.Fatalf("expected '%v', got '%v'", stats, res)
+	}
+	db.Close()
+	if _, err := db.Stats(); err != ErrDatabaseClosed {
+		t.Fatalf("expected '%v', got '%v'", ErrDatabaseClosed, err)
+	}
+	if res := db.StatsVar(); res != nil {
+		t.Fatalf("expected '%v', got '%v'", nil, res)
+	}
+}
+
+func TestStatsOptimistic(t *testing.T) {
+	db := testOpen(t)
+	defer testClose(db)
+	tx1, _ := db.BeginOptimistic()
+	tx2, _ := db.BeginOptimistic()
+	tx3, _ := db.BeginOptimistic()
+	for _, tx := range []*Tx{tx1, tx2, tx3} {
+		tx.Get("key")
+		tx.Set("key", "val", nil)
+	}
+	if err := tx1.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx2.Commit(); err != ErrConflict {
+		t.Fatalf("expected '%v', got '%v'", ErrConflict, err)
+	}
+	tx3.Rollback()
+	stats, _ := db.Stats()
+	if stats.Commits != 1 || stats.Rollbacks != 2 {
+		t.Fatalf("expected '%v', got '%v'", "1 2", []int64{stats.Commits, stats.Rollbacks})
+	}
+}
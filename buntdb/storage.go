@@ -0,0 +1,99 @@
+package buntdb
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// Storage is where the database file is kept. The default storage uses the
+// files of the operating system. Another storage can keep the database file
+// somewhere else, such as in memory for tests, or inject faults.
+type Storage interface {
+	// OpenFile opens the named file for appending. The file is created when
+	// it does not exist.
+	OpenFile(name string) (StorageFile, error)
+	// ReadAll opens the named file for reading all of it, from the start.
+	// Data that is appended to the file while it's being read is also read.
+	// The reader keeps the contents of the file when the file is replaced
+	// by Rename, or removed. A reader that is also an io.Seeker is used to
+	// skip ahead. The error satisfies os.IsNotExist when the file does not
+	// exist.
+	ReadAll(name string) (io.ReadCloser, error)
+	// Rename atomically replaces the file at newname with the file at
+	// oldname.
+	Rename(oldname, newname string) error
+	// Remove removes the named file. It's not an error when the file does
+	// not exist.
+	Remove(name string) error
+}
+
+// StorageFile is a file that was opened by a Storage for appending.
+type StorageFile interface {
+	// Write appends the data to the end of the file.
+	Write(p []byte) (int, error)
+	// Sync commits the data of the file to stable storage.
+	Sync() error
+	// Truncate changes the size of the file. The data that is written
+	// after is appended at the new size.
+	Truncate(size int64) error
+	// Size returns the size of the file.
+	Size() (int64, error)
+	// Close closes the file.
+	Close() error
+}
+
+// osStorage is the default storage, which uses the files of the operating
+// system.
+type osStorage struct{}
+
+func (osStorage) OpenFile(name string) (StorageFile, error) {
+	// hardcoding 0666 as the default mode.
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, err
+	}
+	return osFile{f}, nil
+}
+
+func (osStorage) ReadAll(name string) (io.ReadCloser, error) {
+	// An opened file keeps its contents when it's replaced by a rename.
+	return os.Open(name)
+}
+
+func (osStorage) Rename(oldname, newname string) error {
+	return os.Rename(oldname, newname)
+}
+
+func (osStorage) Remove(name string) error {
+	return os.RemoveAll(name)
+}
+
+// osFile is a file of the operating system.
+type osFile struct {
+	*os.File
+}
+
+func (f osFile) Size() (int64, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// skipRead skips the first n bytes of the reader.
+func skipRead(rd io.Reader, n int64) error {
+	if s, ok := rd.(io.Seeker); ok {
+		_, err := s.Seek(n, io.SeekCurrent)
+		return err
+	}
+	m, err := io.CopyN(ioutil.Discard, rd, n)
+	if m == n {
+		return nil
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,233 @@
+package buntdb
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"testing"
+)
+
+// memStorage keeps the files in memory. The writes fail once the limit of
+// bytes has been written, when the limit is not negative.
+type memStorage struct {
+	mu    sync.Mutex
+	files map[string]*memData
+	limit int
+}
+
+type memData struct {
+	data []byte
+}
+
+var errMemFault = errors.New("fault")
+
+func newMemStorage() *memStorage {
+	return &memStorage{files: make(map[string]*memData), limit: -1}
+}
+
+func (s *memStorage) OpenFile(name string) (StorageFile, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d := s.files[name]
+	if d == nil {
+		d = &memData{}
+		s.files[name] = d
+	}
+	return &memFile{s: s, d: d}, nil
+}
+
+func (s *memStorage) ReadAll(name string) (io.ReadCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d := s.files[name]
+	if d == nil {
+		return nil, os.ErrNotExist
+	}
+	return &memReader{s: s, d: d}, nil
+}
+
+func (s *memStorage) Rename(oldname, newname string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d := s.files[oldname]
+	if d == nil {
+		return os.ErrNotExist
+	}
+	s.files[newname] = d
+	delete(s.files, oldname)
+	return nil
+}
+
+func (s *memStorage) Remove(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.files, name)
+	return nil
+}
+
+func (s *memStorage) setLimit(limit int) {
+	s.mu.Lock()
+	s.limit = limit
+	s.mu.Unlock()
+}
+
+type memFile struct {
+	s *memStorage
+	d *memData
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.s.mu.Lock()
+	defer f.s.mu.Unlock()
+	if f.s.limit >= 0 && len(p) > f.s.limit {
+		f.d.data = append(f.d.data, p[:f.s.limit]...)
+		n := f.s.limit
+		f.s.limit = 0
+		return n, errMemFault
+	}
+	if f.s.limit >= 0 {
+		f.s.limit -= len(p)
+	}
+	f.d.data = append(f.d.data, p...)
+	return len(p), nil
+}
+
+func (f *memFile) Sync() error { return nil }
+
+func (f *memFile) Truncate(size int64) error {
+	f.s.mu.Lock()
+	defer f.s.mu.Unlock()
+	f.d.data = f.d.data[:size]
+	return nil
+}
+
+func (f *memFile) Size() (int64, error) {
+	f.s.mu.Lock()
+	defer f.s.mu.Unlock()
+	return int64(len(f.d.data)), nil
+}
+
+func (f *memFile) Close() error { return nil }
+
+type memReader struct {
+	s   *memStorage
+	d   *memData
+	pos int
+}
+
+func (r *memReader) Read(p []byte) (int, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	if r.pos >= len(r.d.data) {
+		return 0, io.EOF
+	}
+	n := copy(p, r.d.data[r.pos:])
+	r.pos += n
+	return n, nil
+}
+
+func (r *memReader) Close() error { return nil }
+
+func testOpenStorage(t *testing.T, s Storage) *DB {
+	db, err := OpenWithOptions("data.db", &Options{Storage: s})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestStorage(t *testing.T) {
+	if err := os.RemoveAll("data.db"); err != nil {
+		t.Fatal(err)
+	}
+	s := newMemStorage()
+	db := testOpenStorage(t, s)
+	defer db.Close()
+	testFillAOF(t, db, 20)
+	if err := db.Update(func(tx *Tx) error {
+		_, err := tx.Delete("key:3")
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	size := len(s.files["data.db"].data)
+	if err := db.Shrink(); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.files) != 1 || len(s.files["data.db"].data) >= size {
+		t.Fatal("expected a smaller file")
+	}
+	testFillAOF(t, db, 25)
+	exp := testDump(t, db)
+	// the files of the operating system are not used.
+	if _, err := os.Stat("data.db"); !os.IsNotExist(err) {
+		t.Fatalf("expected '%v', got '%v'", os.ErrNotExist, err)
+	}
+	// a follower and a backup read the file through the storage.
+	follower, _ := Open(":memory:")
+	defer follower.Close()
+	pr, pw := io.Pipe()
+	go func() { db.Stream(pw, 0) }()
+	go func() { follower.Follow(pr) }()
+	testWaitFollower(t, db, follower)
+	var backup bytes.Buffer
+	if _, err := db.Backup(&backup, 0); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	pr.Close()
+	mdb, _ := Open(":memory:")
+	defer mdb.Close()
+	if err := mdb.Restore(&backup); err != nil {
+		t.Fatal(err)
+	}
+	db = testOpenStorage(t, s)
+	defer db.Close()
+	for _, db := range []*DB{db, follower, mdb} {
+		if res := testDump(t, db); res != exp {
+			t.Fatalf("expected '%v', got '%v'", exp, res)
+		}
+	}
+}
+
+func TestStorageFaults(t *testing.T) {
+	s := newMemStorage()
+	db := testOpenStorage(t, s)
+	defer db.Close()
+	testFillAOF(t, db, 10)
+	exp := testDump(t, db)
+	size := len(s.files["data.db"].data)
+	// a partial write is cut off, and the transaction is rolled back.
+	s.setLimit(5)
+	if err := db.Update(func(tx *Tx) error {
+		_, _, err := tx.Set("key:99", "val:99", nil)
+		return err
+	}); err != errMemFault {
+		t.Fatalf("expected '%v', got '%v'", errMemFault, err)
+	}
+	if res := testDump(t, db); res != exp {
+		t.Fatalf("expected '%v', got '%v'", exp, res)
+	}
+	if res := len(s.files["data.db"].data); res != size {
+		t.Fatalf("expected '%v', got '%v'", size, res)
+	}
+	// a failed shrink keeps the file.
+	s.setLimit(5)
+	if err := db.Shrink(); err != errMemFault {
+		t.Fatalf("expected '%v', got '%v'", errMemFault, err)
+	}
+	if len(s.files) != 1 || len(s.files["data.db"].data) != size {
+		t.Fatal("expected the file to be kept")
+	}
+	s.setLimit(-1)
+	testFillAOF(t, db, 12)
+	exp = testDump(t, db)
+	db.Close()
+	db = testOpenStorage(t, s)
+	defer db.Close()
+	if res := testDump(t, db); res != exp {
+		t.Fatalf("expected '%v', got '%v'", exp, res)
+	}
+}
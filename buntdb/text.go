@@ -0,0 +1,246 @@
+package buntdb
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/tidwall/btree"
+)
+
+// The BM25 ranking parameters.
+const (
+	bm25K1 = 1.2  // term frequency saturation
+	bm25B  = 0.75 // document length normalization
+)
+
+// textIndex is an inverted index of the terms of the items.
+type textIndex struct {
+	terms *btree.BTree   // the terms, in order
+	docs  map[string]int // the number of terms of each item
+	total int            // the number of terms of all items
+}
+
+// textTerm is a term and the items that have the term.
+type textTerm struct {
+	term  string
+	freqs map[string]int // the frequency of the term in each item
+}
+
+func (t *textTerm) Less(item btree.Item, ctx interface{}) bool {
+	return t.term < item.(*textTerm).term
+}
+
+func newTextIndex() *textIndex {
+	return &textIndex{
+		terms: btree.New(btreeDegrees, nil),
+		docs:  make(map[string]int),
+	}
+}
+
+// tokenize splits the text into lowercase terms. A term is a run of letters
+// and digits.
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// insert adds the terms of the text for the key.
+func (t *textIndex) insert(key, text string) {
+	tokens := tokenize(text)
+	t.docs[key] = len(tokens)
+	t.total += len(tokens)
+	for _, token := range tokens {
+		var tt *textTerm
+		if item := t.terms.Get(&textTerm{term: token}); item != nil {
+			tt = item.(*textTerm)
+		} else {
+			tt = &textTerm{term: token, freqs: make(map[string]int)}
+			t.terms.ReplaceOrInsert(tt)
+		}
+		tt.freqs[key]++
+	}
+}
+
+// remove removes the terms of the text for the key. The text must be the
+// same as when the key was inserted.
+func (t *textIndex) remove(key, text string) {
+	n, ok := t.docs[key]
+	if !ok {
+		return
+	}
+	delete(t.docs, key)
+	t.total -= n
+	for _, token := range tokenize(text) {
+		item := t.terms.Get(&textTerm{term: token})
+		if item == nil {
+			continue
+		}
+		tt := item.(*textTerm)
+		delete(tt.freqs, key)
+		if len(tt.freqs) == 0 {
+			t.terms.Delete(tt)
+		}
+	}
+}
+
+// score adds the BM25 scores of a term to the scores of the items that have
+// the term.
+func (t *textIndex) score(tt *textTerm, scores map[string]float64) {
+	n := float64(len(t.docs))
+	avgdl := float64(t.total) / n
+	df := float64(len(tt.freqs))
+	idf := math.Log(1 + (n-df+0.5)/(df+0.5))
+	for key, freq := range tt.freqs {
+		tf := float64(freq)
+		dl := float64(t.docs[key])
+		scores[key] += idf * tf * (bm25K1 + 1) /
+			(tf + bm25K1*(1-bm25B+bm25B*dl/avgdl))
+	}
+}
+
+// match returns the scores of the items that have any of the terms. A term
+// that ends with a '*' matches all of the terms with that prefix.
+func (t *textIndex) match(terms []string) map[string]float64 {
+	scores := make(map[string]float64)
+	for _, term := range terms {
+		if !strings.HasSuffix(term, "*") {
+			for _, token := range tokenize(term) {
+				if item := t.terms.Get(&textTerm{term: token}); item != nil {
+					t.score(item.(*textTerm), scores)
+				}
+			}
+			continue
+		}
+		prefix := strings.ToLower(strings.TrimSuffix(term, "*"))
+		t.terms.AscendGreaterOrEqual(&textTerm{term: prefix},
+			func(item btree.Item) bool {
+				tt := item.(*textTerm)
+				if !strings.HasPrefix(tt.term, prefix) {
+					return false
+				}
+				t.score(tt, scores)
+				return true
+			},
+		)
+	}
+	return scores
+}
+
+// CreateTextIndex builds a new full-text index. The text of each item is
+// returned by the extract function, such as the value of a JSON field, and
+// it's split into lowercase terms, which are runs of letters and digits. A
+// nil extract function uses the whole value.
+//
+// Use Search to find the items that have some terms. The index cannot be used
+// by the Ascend*, Descend*, Nearby, or Intersects methods, and the Unique
+// option is not allowed.
+func (tx *Tx) CreateTextIndex(name, pattern string,
+	extract func(value string) string, opts *IndexOptions) error {
+	if opts != nil && opts.Unique {
+		return ErrInvalidOperation
+	}
+	if extract == nil {
+		extract = func(value string) string { return value }
+	}
+	return tx.addIndex(&index{
+		name:    name,
+		pattern: pattern,
+		extract: extract,
+	}, opts)
+}
+
+// Search calls the iterator for every item in a text index that matches the
+// query, until iterator returns false. The items are ordered by their BM25
+// score, with the best match first, and then by key.
+//
+// The query has one or more terms. All of the terms that are separated by
+// spaces must match, and terms that are joined by OR match when either term
+// matches. A term that ends with '*' matches the terms that start with it.
+// For example, the query
+//
+//	quick brown OR red fox*
+//
+// matches the items that have "quick", either "brown" or "red", and a term
+// that starts with "fox". An AND between terms is optional.
+func (tx *Tx) Search(index, query string,
+	iterator func(key, value string, score float64) bool) error {
+	if tx.db == nil {
+		return ErrTxClosed
+	}
+	idx := tx.db.idxs[index]
+	if idx == nil {
+		return ErrNotFound
+	}
+	idx.fill()
+	if idx.txt == nil {
+		return ErrInvalidOperation
+	}
+	var scores map[string]float64
+	for i, clause := range parseTextQuery(query) {
+		cscores := idx.txt.match(clause)
+		if i == 0 {
+			scores = cscores
+			continue
+		}
+		// all of the clauses must match.
+		for key, score := range scores {
+			if cscore, ok := cscores[key]; ok {
+				scores[key] = score + cscore
+			} else {
+				delete(scores, key)
+			}
+		}
+	}
+	type result struct {
+		item  *dbItem
+		score float64
+	}
+	results := make([]result, 0, len(scores))
+	for key, score := range scores {
+		item := tx.db.get(key)
+		if item == nil || item.expired() {
+			// The item has expired, which Get treats as not found.
+			continue
+		}
+		results = append(results, result{item, score})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].score != results[j].score {
+			return results[i].score > results[j].score
+		}
+		return results[i].item.key < results[j].item.key
+	})
+	for _, r := range results {
+		if !iterator(r.item.key, r.item.value(), r.score) {
+			break
+		}
+	}
+	return nil
+}
+
+// parseTextQuery returns the clauses of a query. Each clause is the terms
+// that are joined by OR.
+func parseTextQuery(query string) [][]string {
+	var clauses [][]string
+	var or bool
+	for _, word := range strings.Fields(query) {
+		switch word {
+		case "AND":
+			or = false
+			continue
+		case "OR":
+			or = len(clauses) > 0
+			continue
+		}
+		if or {
+			clauses[len(clauses)-1] = append(clauses[len(clauses)-1], word)
+			or = false
+		} else {
+			clauses = append(clauses, []string{word})
+		}
+	}
+	return clauses
+}
@@ -0,0 +1,155 @@
+package buntdb
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+func testSearch(t *testing.T, tx *Tx, index, query string) string {
+	var keys []string
+	if err := tx.Search(index, query, func(key, value string, score float64) bool {
+		keys = append(keys, key)
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return strings.Join(keys, ",")
+}
+
+func TestTextIndex(t *testing.T) {
+	db := testOpen(t)
+	defer testClose(db)
+	body := func(value string) string {
+		return gjson.Get(value, "body").String()
+	}
+	if err := db.Update(func(tx *Tx) error {
+		tx.Set("doc:1", `{"body":"The quick brown fox"}`, nil)
+		tx.Set("doc:2", `{"body":"The lazy brown dog, the dog sleeps"}`, nil)
+		tx.Set("doc:3", `{"body":"A red fox jumps over foxes"}`, nil)
+		tx.Set("other", `{"body":"quick fox"}`, nil)
+		return tx.CreateTextIndex("body", "doc:*", body, nil)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct{ query, exp string }{
+		{"fox", "doc:1,doc:3"},
+		{"FOX brown", "doc:1"},
+		{"fox AND brown", "doc:1"},
+		{"brown OR red", "doc:3,doc:1,doc:2"},
+		{"quick OR lazy brown", "doc:1,doc:2"},
+		{"fox*", "doc:3,doc:1"},
+		{"cat", ""},
+		{"", ""},
+	}
+	if err := db.View(func(tx *Tx) error {
+		for _, test := range tests {
+			if res := testSearch(t, tx, "body", test.query); res != test.exp {
+				t.Fatalf("%v: expected '%v', got '%v'", test.query, test.exp, res)
+			}
+		}
+		// the item with more of the term is the better match.
+		if res := testSearch(t, tx, "body", "dog OR quick"); res != "doc:2,doc:1" {
+			t.Fatalf("expected '%v', got '%v'", "doc:2,doc:1", res)
+		}
+		if err := tx.Search("missing", "fox", nil); err != ErrNotFound {
+			t.Fatalf("expected '%v', got '%v'", ErrNotFound, err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// the index follows the changes, and a rollback.
+	if err := db.Update(func(tx *Tx) error {
+		tx.Set("doc:1", `{"body":"A slow green turtle"}`, nil)
+		tx.Delete("doc:3")
+		if res := testSearch(t, tx, "body", "fox OR turtle"); res != "doc:1" {
+			t.Fatalf("expected '%v', got '%v'", "doc:1", res)
+		}
+		return ErrNotFound
+	}); err != ErrNotFound {
+		t.Fatalf("expected '%v', got '%v'", ErrNotFound, err)
+	}
+	if err := db.Update(func(tx *Tx) error {
+		if res := testSearch(t, tx, "body", "fox OR turtle"); res != "doc:1,doc:3" {
+			t.Fatalf("expected '%v', got '%v'", "doc:1,doc:3", res)
+		}
+		tx.Delete("doc:1")
+		tx.Set("doc:4", `{"body":"fox"}`, nil)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	snap, err := db.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snap.Rollback()
+	if err := db.Update(func(tx *Tx) error {
+		return tx.DeleteAll()
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if res := testSearch(t, snap, "body", "fox"); res != "doc:4,doc:3" {
+		t.Fatalf("expected '%v', got '%v'", "doc:4,doc:3", res)
+	}
+	if err := db.View(func(tx *Tx) error {
+		if res := testSearch(t, tx, "body", "fox"); res != "" {
+			t.Fatalf("expected '%v', got '%v'", "", res)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTextIndexExpired(t *testing.T) {
+	db := testOpen(t)
+	defer testClose(db)
+	if err := db.Update(func(tx *Tx) error {
+		if err := tx.CreateTextIndex("text", "*", nil, nil); err != nil {
+			return err
+		}
+		tx.Set("doc:1", "quick fox", nil)
+		tx.Set("doc:2", "quick fox", &SetOptions{ExpiresAt: time.Now().Add(-time.Second)})
+		// an expired item is not found, like by Get.
+		if _, err := tx.Get("doc:2"); err != ErrNotFound {
+			t.Fatalf("expected '%v', got '%v'", ErrNotFound, err)
+		}
+		if res := testSearch(t, tx, "text", "fox"); res != "doc:1" {
+			t.Fatalf("expected '%v', got '%v'", "doc:1", res)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTextIndexInvalid(t *testing.T) {
+	db := testOpen(t)
+	defer testClose(db)
+	if err := db.Update(func(tx *Tx) error {
+		err := tx.CreateTextIndex("text", "*", nil, &IndexOptions{Unique: true})
+		if err != ErrInvalidOperation {
+			t.Fatalf("expected '%v', got '%v'", ErrInvalidOperation, err)
+		}
+		if err := tx.CreateIndex("name", "*", IndexString); err != nil {
+			return err
+		}
+		if err := tx.Search("name", "fox", nil); err != ErrInvalidOperation {
+			t.Fatalf("expected '%v', got '%v'", ErrInvalidOperation, err)
+		}
+		if err := tx.CreateTextIndex("text", "*", nil, nil); err != nil {
+			return err
+		}
+		tx.Set("1", "hello world", nil)
+		if res := testSearch(t, tx, "text", "hello"); res != "1" {
+			t.Fatalf("expected '%v', got '%v'", "1", res)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,263 @@
+package buntdb
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/tidwall/btree"
+	"github.com/tidwall/match"
+)
+
+// EventType is the kind of change that is described by a ChangeEvent.
+type EventType int
+
+const (
+	// EventSet is sent when a key has been inserted or replaced.
+	EventSet EventType = iota + 1
+	// EventDelete is sent when a key has been deleted.
+	EventDelete
+	// EventExpire is sent when an expired key has been removed from the
+	// database.
+	EventExpire
+)
+
+// String returns a string representation of the event type.
+func (t EventType) String() string {
+	switch t {
+	case EventSet:
+		return "set"
+	case EventDelete:
+		return "delete"
+	case EventExpire:
+		return "expire"
+	}
+	return "unknown"
+}
+
+// ChangeEvent describes a committed change to a single key.
+type ChangeEvent struct {
+	// Type is the kind of change.
+	Type EventType
+	// Key is the key that changed.
+	Key string
+	// OldValue is the value prior to the change. For EventSet it's only
+	// valid when Replaced is true.
+	OldValue string
+	// NewValue is the value after the change. Only valid for EventSet.
+	NewValue string
+	// Replaced is true when an EventSet replaced an existing item.
+	Replaced bool
+}
+
+// watcher is a single subscription that was created by Watch.
+type watcher struct {
+	space   string // the name of the keyspace, "" for the default
+	pattern string
+	fn      func(ev ChangeEvent)
+	removed bool // protected by watchQueue.mu
+}
+
+// watchEvent pairs an event with the watcher that it must be delivered to.
+type watchEvent struct {
+	w  *watcher
+	ev ChangeEvent
+}
+
+// watchQueue holds events that are waiting to be delivered. Events are
+// appended by committing transactions and delivered in order by a single
+// goroutine, which allows for the watcher functions to open transactions.
+type watchQueue struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	events  []watchEvent
+	running bool
+	closed  bool
+}
+
+// Watch registers a function that is called for every committed change to a
+// key matching the specified pattern. This is a very simple pattern match
+// where '*' matches on any number characters and '?' matches on any one
+// character.
+//
+// Events are sent for items that have been set, deleted, and expired. Changes
+// that are rolled back never produce events. The events are delivered in
+// commit order from a background goroutine, so it's safe for the function to
+// open new transactions.
+//
+// The returned unwatch function removes the subscription. Only the changes of
+// the default keyspace are sent, and Keyspace.Watch is for the changes of
+// other keyspaces.
+func (db *DB) Watch(pattern string, fn func(ev ChangeEvent)) (
+	unwatch func(), err error) {
+	return db.watch("", pattern, fn)
+}
+
+// watch registers a function for the changes of the keyspace with the name.
+func (db *DB) watch(space, pattern string, fn func(ev ChangeEvent)) (
+	unwatch func(), err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return nil, ErrDatabaseClosed
+	}
+	if db.watchq == nil {
+		db.watchq = &watchQueue{}
+		db.watchq.cond = sync.NewCond(&db.watchq.mu)
+	}
+	w := &watcher{space: space, pattern: pattern, fn: fn}
+	db.watchers = append(db.watchers, w)
+	q := db.watchq
+	q.mu.Lock()
+	if !q.running {
+		q.running = true
+		go q.run()
+	}
+	q.mu.Unlock()
+	return func() {
+		db.mu.Lock()
+		for i, w2 := range db.watchers {
+			if w2 == w {
+				db.watchers = append(db.watchers[:i], db.watchers[i+1:]...)
+				break
+			}
+		}
+		db.mu.Unlock()
+		q.mu.Lock()
+		w.removed = true
+		q.mu.Unlock()
+	}, nil
+}
+
+// push adds events to the end of the queue.
+func (q *watchQueue) push(events []watchEvent) {
+	q.mu.Lock()
+	q.events = append(q.events, events...)
+	q.mu.Unlock()
+	q.cond.Signal()
+}
+
+// close stops the delivery goroutine once all pending events are sent.
+func (q *watchQueue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	q.cond.Signal()
+}
+
+// run delivers events until the queue has been closed and drained.
+func (q *watchQueue) run() {
+	q.mu.Lock()
+	for {
+		for len(q.events) == 0 {
+			if q.closed {
+				q.running = false
+				q.mu.Unlock()
+				return
+			}
+			q.cond.Wait()
+		}
+		events := q.events
+		q.events = nil
+		for _, we := range events {
+			if we.w.removed {
+				continue
+			}
+			q.mu.Unlock()
+			we.w.fn(we.ev)
+			q.mu.Lock()
+		}
+	}
+}
+
+// changeEvent compares the state of an item before and after a transaction
+// and produces an event. Returns false when there was no visible change.
+func changeEvent(key string, prev, item *dbItem) (ChangeEvent, bool) {
+	if prev == item {
+		return ChangeEvent{}, false
+	}
+	if item == nil {
+		switch {
+		case prev == nil:
+			return ChangeEvent{}, false
+		case prev.expired():
+			return ChangeEvent{Type: EventExpire, Key: key, OldValue: prev.value()},
+				true
+		default:
+			return ChangeEvent{Type: EventDelete, Key: key, OldValue: prev.value()},
+				true
+		}
+	}
+	ev := ChangeEvent{Type: EventSet, Key: key, NewValue: item.value()}
+	if prev != nil && !prev.expired() {
+		ev.OldValue, ev.Replaced = prev.value(), true
+	}
+	return ev, true
+}
+
+// changeEvents returns the events for all watchers that are interested in
+// the changes of the current writable transaction, followed by the events of
+// its keyspaces. Must be called prior to unlocking the database.
+func (tx *Tx) changeEvents() []watchEvent {
+	events := tx.spaceChangeEvents()
+	names := make([]string, 0, len(tx.spaces))
+	for name := range tx.spaces {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		events = append(events, tx.spaces[name].spaceChangeEvents()...)
+	}
+	return events
+}
+
+// spaceChangeEvents returns the events for the changes of the keyspace of
+// the transaction.
+func (tx *Tx) spaceChangeEvents() []watchEvent {
+	watchers := tx.db.watchers
+	if tx.db.root != nil {
+		watchers = tx.db.root.watchers
+	}
+	// The rollback items hold the original state of every key that was
+	// changed prior to a DeleteAll, and the rollback keys tree holds the
+	// state that was removed by the DeleteAll.
+	prevItem := func(key string) *dbItem {
+		if prev, ok := tx.wc.rollbackItems[key]; ok {
+			return prev
+		}
+		if tx.wc.rbkeys != nil {
+			if item := tx.wc.rbkeys.Get(&dbItem{key: key}); item != nil {
+				return item.(*dbItem)
+			}
+		}
+		return nil
+	}
+	keys := make(map[string]bool, len(tx.wc.rollbackItems))
+	for key := range tx.wc.rollbackItems {
+		keys[key] = true
+	}
+	if tx.wc.rbkeys != nil {
+		// A DeleteAll occurred. Compare the full trees.
+		addKey := func(item btree.Item) bool {
+			keys[item.(*dbItem).key] = true
+			return true
+		}
+		tx.wc.rbkeys.Ascend(addKey)
+		tx.db.keys.Ascend(addKey)
+	}
+	evs := make([]ChangeEvent, 0, len(keys))
+	for key := range keys {
+		if ev, ok := changeEvent(key, prevItem(key), tx.db.get(key)); ok {
+			evs = append(evs, ev)
+		}
+	}
+	sort.Slice(evs, func(i, j int) bool { return evs[i].Key < evs[j].Key })
+	var events []watchEvent
+	for _, ev := range evs {
+		for _, w := range watchers {
+			if w.space == tx.db.space && match.Match(ev.Key, w.pattern) {
+				events = append(events, watchEvent{w, ev})
+			}
+		}
+	}
+	return events
+}
@@ -0,0 +1,210 @@
+package buntdb
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// eventRecorder collects events sent to a watcher.
+type eventRecorder struct {
+	mu     sync.Mutex
+	events []ChangeEvent
+}
+
+func (r *eventRecorder) record(ev ChangeEvent) {
+	r.mu.Lock()
+	r.events = append(r.events, ev)
+	r.mu.Unlock()
+}
+
+// wait waits for n events to arrive and returns them.
+func (r *eventRecorder) wait(t *testing.T, n int) []ChangeEvent {
+	start := time.Now()
+	for {
+		r.mu.Lock()
+		if len(r.events) >= n {
+			events := append([]ChangeEvent(nil), r.events...)
+			r.events = nil
+			r.mu.Unlock()
+			return events
+		}
+		r.mu.Unlock()
+		if time.Since(start) > time.Second*5 {
+			t.Fatalf("timeout waiting for %d events", n)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	db := testOpen(t)
+	defer testClose(db)
+	var r eventRecorder
+	unwatch, err := db.Watch("user:*", r.record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Update(func(tx *Tx) error {
+		tx.Set("user:1", "Tom", nil)
+		tx.Set("user:2", "Jane", nil)
+		tx.Set("other", "ignored", nil)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	events := r.wait(t, 2)
+	expect := []ChangeEvent{
+		{Type: EventSet, Key: "user:1", NewValue: "Tom"},
+		{Type: EventSet, Key: "user:2", NewValue: "Jane"},
+	}
+	if !reflect.DeepEqual(events, expect) {
+		t.Fatalf("expected %v, got %v", expect, events)
+	}
+
+	// rolled back changes should never produce events.
+	errRollback := errors.New("rollback")
+	if err := db.Update(func(tx *Tx) error {
+		tx.Set("user:1", "Tim", nil)
+		tx.Delete("user:2")
+		return errRollback
+	}); err != errRollback {
+		t.Fatalf("expected '%v', got '%v'", errRollback, err)
+	}
+
+	// a key that is deleted and set again reports the original value.
+	if err := db.Update(func(tx *Tx) error {
+		tx.Set("user:1", "Tim", nil)
+		tx.Delete("user:1")
+		tx.Set("user:1", "Tam", nil)
+		tx.Delete("user:2")
+		tx.Set("user:3", "tmp", nil)
+		tx.Delete("user:3")
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	events = r.wait(t, 2)
+	expect = []ChangeEvent{
+		{Type: EventSet, Key: "user:1", OldValue: "Tom", NewValue: "Tam",
+			Replaced: true},
+		{Type: EventDelete, Key: "user:2", OldValue: "Jane"},
+	}
+	if !reflect.DeepEqual(events, expect) {
+		t.Fatalf("expected %v, got %v", expect, events)
+	}
+
+	// delete everything
+	if err := db.Update(func(tx *Tx) error {
+		tx.Set("user:4", "Ann", nil)
+		if err := tx.DeleteAll(); err != nil {
+			return err
+		}
+		tx.Set("user:5", "Bob", nil)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	events = r.wait(t, 2)
+	expect = []ChangeEvent{
+		{Type: EventDelete, Key: "user:1", OldValue: "Tam"},
+		{Type: EventSet, Key: "user:5", NewValue: "Bob"},
+	}
+	if !reflect.DeepEqual(events, expect) {
+		t.Fatalf("expected %v, got %v", expect, events)
+	}
+
+	// expiring items
+	if err := db.Update(func(tx *Tx) error {
+		_, _, err := tx.Set("user:5", "Bob", &SetOptions{
+			Expires: true, TTL: time.Millisecond * 100,
+		})
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	events = r.wait(t, 2)
+	expect = []ChangeEvent{
+		{Type: EventSet, Key: "user:5", OldValue: "Bob", NewValue: "Bob",
+			Replaced: true},
+		{Type: EventExpire, Key: "user:5", OldValue: "Bob"},
+	}
+	if !reflect.DeepEqual(events, expect) {
+		t.Fatalf("expected %v, got %v", expect, events)
+	}
+
+	unwatch()
+	if err := db.Update(func(tx *Tx) error {
+		_, _, err := tx.Set("user:6", "Sue", nil)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 100)
+	r.mu.Lock()
+	n := len(r.events)
+	r.mu.Unlock()
+	if n != 0 {
+		t.Fatalf("expected 0 events, got %d", n)
+	}
+}
+
+func TestWatchOrder(t *testing.T) {
+	db, _ := Open(":memory:")
+	defer db.Close()
+	var r eventRecorder
+	if _, err := db.Watch("*", func(ev ChangeEvent) {
+		// writing from inside a watcher must not deadlock.
+		if ev.Key == "counter" {
+			db.Update(func(tx *Tx) error {
+				_, _, err := tx.Set("last", ev.NewValue, nil)
+				return err
+			})
+		}
+		r.record(ev)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				db.Update(func(tx *Tx) error {
+					val, _ := tx.Get("counter")
+					var n int
+					fmt.Sscan(val, &n)
+					_, _, err := tx.Set("counter", fmt.Sprint(n+1), nil)
+					return err
+				})
+			}
+		}()
+	}
+	wg.Wait()
+	events := r.wait(t, 200)
+	var n int
+	for _, ev := range events {
+		if ev.Key != "counter" {
+			continue
+		}
+		n++
+		if ev.NewValue != fmt.Sprint(n) {
+			t.Fatalf("expected '%v', got '%v'", n, ev.NewValue)
+		}
+	}
+	if n != 100 {
+		t.Fatalf("expected '%v', got '%v'", 100, n)
+	}
+}
+
+func TestWatchClosed(t *testing.T) {
+	db, _ := Open(":memory:")
+	db.Close()
+	if _, err := db.Watch("*", func(ev ChangeEvent) {}); err != ErrDatabaseClosed {
+		t.Fatalf("expected '%v', got '%v'", ErrDatabaseClosed, err)
+	}
+}